@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/sdoque/mbaigo/components"
@@ -80,14 +81,23 @@ func main() {
 	// Register the (system) and its services
 	usecases.RegisterServices(&sys)
 
-	// start the http handler and server
-	go usecases.SetoutServers(&sys)
+	// start the http handler and server, with the server policy of the environment if any (see server.go)
+	go setoutServers(&sys)
 
 	// wait for shutdown signal, and gracefully close properly goroutines with context
 	<-sys.Sigs // wait for a SIGINT (Ctrl+C) signal
 	fmt.Println("\nshuting down system", sys.Name)
-	cancel()                    // cancel the context, signaling the goroutines to stop
-	time.Sleep(2 * time.Second) // allow the go routines to be executed, which might take more time than the main routine to end
+	cancel()                                   // cancel the context, signaling the goroutines to stop
+	time.Sleep(shutdownGrace(2 * time.Second)) // allow the go routines to be executed, which might take more time than the main routine to end
+}
+
+// shutdownGrace returns how long the goroutines are given to end once the context is cancelled.
+// The SHUTDOWN_GRACE environment variable (e.g., "5s") overrides the default; an invalid value is ignored.
+func shutdownGrace(defaultGrace time.Duration) time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE")); err == nil && grace >= 0 {
+		return grace
+	}
+	return defaultGrace
 }
 
 // Serving handles the resources services. NOTE: it expects those names from the request URL path
@@ -0,0 +1,41 @@
+/*******************************************************************************
+ * Copyright (c) 2025 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import "time"
+
+// clock is the source of time of the registry's time-dependent logic (scheduling and expiration), which tests replace with a fake one
+type clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once the duration has elapsed, as time.AfterFunc does
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a pending call of a clock's AfterFunc
+type timer interface {
+	// Stop prevents the call, returning false if it already happened or was stopped
+	Stop() bool
+	// Reset makes the call happen once the duration has elapsed from now, as time.Timer's Reset does
+	Reset(d time.Duration) bool
+}
+
+// realClock is the clock of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ------------------------------------------------------------ //
+// Fake clock making the time-dependent tests deterministic
+// ------------------------------------------------------------ //
+
+// fakeClock is a clock whose time only moves when the test advances it
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a call pending on a fake clock
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	pending bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f, pending: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the time forward and makes the calls that became due, in chronological order,
+// before returning (instead of in their own goroutine)
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.pending && !t.at.After(c.now) {
+			t.pending = false
+			due = append(due, t)
+		}
+	}
+	c.timers = slices.DeleteFunc(c.timers, func(t *fakeTimer) bool { return !t.pending })
+	c.mu.Unlock()
+	slices.SortStableFunc(due, func(a, b *fakeTimer) int { return a.at.Compare(b.at) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := t.pending
+	t.pending = false
+	return stopped
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.pending
+	t.at = t.clock.now.Add(d)
+	t.pending = true
+	if !slices.Contains(t.clock.timers, t) {
+		t.clock.timers = append(t.clock.timers, t)
+	}
+	return active
+}
+
+// useFakeClock makes the unit asset and its scheduler run on a fake clock starting at the given time
+func useFakeClock(ua *UnitAsset, now time.Time) *fakeClock {
+	c := newFakeClock(now)
+	ua.mu.Lock()
+	ua.clock = c
+	ua.mu.Unlock()
+	ua.sched.mu.Lock()
+	ua.sched.clock = c
+	ua.sched.mu.Unlock()
+	return c
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC)
+	c := newFakeClock(start)
+	var fired []int
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	c.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	stopped := c.AfterFunc(time.Second, func() { fired = append(fired, 0) })
+	if !stopped.Stop() {
+		t.Errorf("Expected a pending call to be stopped")
+	}
+
+	c.Advance(500 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Errorf("Expected no call before its time, got %v", fired)
+	}
+	c.Advance(2 * time.Second)
+	if !slices.Equal(fired, []int{1, 2}) {
+		t.Errorf("Expected the due calls in chronological order, got %v", fired)
+	}
+	if got, want := c.Now(), start.Add(2500*time.Millisecond); !got.Equal(want) {
+		t.Errorf("Expected the time %v, got %v", want, got)
+	}
+	if stopped.Stop() {
+		t.Errorf("Expected a stopped call not to be stopped again")
+	}
+}
@@ -17,15 +17,24 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -42,6 +51,7 @@ func main() {
 
 	// instantiate the System
 	sys := components.NewSystem("serviceregistrar", ctx)
+	setLogFormat(sys.Name) // emit JSON lines instead of text when LOG_FORMAT=json
 
 	// Instantiate the Capsule
 	sys.Husk = &components.Husk{
@@ -75,7 +85,10 @@ func main() {
 		if err := json.Unmarshal(raw, &uac); err != nil {
 			log.Fatalf("Resource configuration error: %+v\n", err)
 		}
-		ua, cleanup := newResource(uac, &sys)
+		ua, cleanup, err := newResource(uac, &sys)
+		if err != nil {
+			log.Fatalf("Resource configuration error: %v\n", err)
+		}
 		defer cleanup()
 		sys.UAssets[ua.GetName()] = &ua
 	}
@@ -86,17 +99,34 @@ func main() {
 	// Register the (system) and its services
 	usecases.RegisterServices(&sys)
 
-	// start the http handler and server
-	go usecases.SetoutServers(&sys)
+	// start the http handler and server, with the server policy of the environment if any (see server.go)
+	go setoutServers(&sys)
 
 	// wait for shutdown signal, and gracefully close properly goroutines with context
 	<-sys.Sigs // wait for a SIGINT (Ctrl+C) signal
 	fmt.Println("\nShutting down system", sys.Name)
 	cancel() // cancel the context, signaling the goroutines to stop
 	// allow the go routines to be executed, which might take more time than the main routine to end
-	time.Sleep(3 * time.Second)
+	time.Sleep(shutdownGrace(3 * time.Second))
+	for _, ua := range sys.UAssets {
+		if registrar, ok := (*ua).(*UnitAsset); ok {
+			log.Println(registrar.shutdownSummary(time.Now()))
+		}
+	}
+}
+
+// shutdownGrace returns how long the goroutines are given to end once the context is cancelled.
+// The SHUTDOWN_GRACE environment variable (e.g., "5s") overrides the default; an invalid value is ignored.
+func shutdownGrace(defaultGrace time.Duration) time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE")); err == nil && grace >= 0 {
+		return grace
+	}
+	return defaultGrace
 }
 
+// version is the build of the registrar, set at build time with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
 // ---------------------------------------------------------------------------- end of main()
 
 // Serving handles the resources services. NOTE: it expects those names from the request URL path
@@ -108,17 +138,78 @@ func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath
 		ua.queryDB(w, r)
 	case "unregister":
 		ua.cleanDB(w, r)
+	case "heartbeat":
+		ua.heartbeat(w, r)
 	case "status":
 		ua.roleStatus(w, r)
 	case "syslist":
 		ua.systemList(w, r)
+	case "deflist":
+		ua.definitionList(w, r)
+	case "nodelist":
+		ua.nodeList(w, r)
+	case "alias":
+		ua.aliasLookup(w, r)
+	case "lookup":
+		ua.lookupDB(w, r)
+	case "info":
+		ua.registrarInfo(w, r)
+	case "epoch":
+		ua.registrarEpoch(w, r)
+	case "stepdown":
+		ua.stepDown(w, r)
+	case "records":
+		ua.records(w, r)
+	case "requesters":
+		ua.requesterList(w, r)
 	default:
 		http.Error(w, "Invalid service request [Do not modify the services subpath in the configuration file]", http.StatusBadRequest)
 	}
 }
 
+// requestIDHeader carries the correlation ID that ties a request to its processing across systems
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the correlation ID of the request (generating one if the caller did not provide it) and echoes it in the response
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// allowCORS adds the CORS headers to the response of a read endpoint when the request comes from an allowed origin.
+// It answers a preflight request itself and then returns true, so that the endpoint stops there
+func (ua *UnitAsset) allowCORS(w http.ResponseWriter, r *http.Request, methods string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !(slices.Contains(ua.AllowedOrigins, origin) || slices.Contains(ua.AllowedOrigins, "*")) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, "+requestIDHeader)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// newRequestID generates a random correlation ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
 // updateDB is used to add a new service record or to extend its registration life
 func (ua *UnitAsset) updateDB(w http.ResponseWriter, r *http.Request) {
+	reqID := requestID(w, r)
 	if !ua.leading {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		if _, err := w.Write([]byte("Service Unavailable")); err != nil {
@@ -128,49 +219,131 @@ func (ua *UnitAsset) updateDB(w http.ResponseWriter, r *http.Request) {
 	}
 	switch r.Method {
 	case "POST", "PUT":
-		contentType := r.Header.Get("Content-Type")
-		mediaType, _, err := mime.ParseMediaType(contentType)
+		if allowed, retryIn := ua.limiter.allow(remoteHost(r), time.Now()); !allowed {
+			log.Printf("[%s] Registration rate exceeded by %s", reqID, remoteHost(r))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryIn.Seconds()))))
+			http.Error(w, "Too many registration requests", http.StatusTooManyRequests)
+			return
+		}
+		mediaType, err := negotiateMediaType(r.Header.Get("Content-Type"), acceptedMediaTypes(ua.MediaTypes))
 		if err != nil {
-			log.Println("Error parsing media type:", err)
-			http.Error(w, "Error parsing media type", http.StatusBadRequest)
+			log.Printf("[%s] Error negotiating the media type: %v", reqID, err)
+			http.Error(w, err.Error(), mediaTypeStatus(err))
 			return
 		}
 
 		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
 		bodyBytes, err := io.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			log.Printf("[%s] Registration request body exceeds %d bytes", reqID, ua.maxBodySize())
+			http.Error(w, "Registration request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil {
-			log.Printf("Error reading registration request body: %v", err)
+			log.Printf("[%s] Error reading registration request body: %v", reqID, err)
 			http.Error(w, "Error reading registration request body", http.StatusBadRequest)
 			return
 		}
+		namespace, err := ua.requestNamespace(r)
+		if err != nil {
+			log.Printf("[%s] Refusing the registration: %v", reqID, err)
+			http.Error(w, "The registration must come with a valid namespace", http.StatusForbidden)
+			return
+		}
+		idemKey := idempotencyKey{namespace: namespace, registrant: verifiedClient(r), key: r.Header.Get(idempotencyKeyHeader)}
+		if idemKey.key != "" {
+			reply, found, err := ua.replay(idemKey, bodyBytes)
+			if err != nil {
+				log.Printf("[%s] Refusing the registration: %v", reqID, err)
+				http.Error(w, "The idempotency key was already used for another registration", http.StatusUnprocessableEntity)
+				return
+			}
+			if found {
+				log.Printf("[%s] Replaying the registration sent with the idempotency key %q", reqID, idemKey.key)
+				w.Header().Set("Content-Type", reply.contentType)
+				w.Header().Set(idempotentReplayHeader, "true")
+				w.WriteHeader(http.StatusOK)
+				if _, err := w.Write(reply.body); err != nil {
+					log.Printf("Error occurred while writing to response: %v", err)
+				}
+				return
+			}
+		}
 		record, err := usecases.Unpack(bodyBytes, mediaType)
 		if err != nil {
-			log.Printf("Error extracting the registration request %v\n", err)
+			log.Printf("[%s] Error extracting the registration request %v\n", reqID, err)
 			http.Error(w, "Error extracting the registration request", http.StatusBadRequest)
 			return
 		}
+		if rec, ok := record.(*forms.ServiceRecord_v1); ok {
+			rec.ServiceDefinition = qualify(namespace, rec.ServiceDefinition)
+		}
 
 		// Create a struct to send on a channel to handle the request
 		addRecord := ServiceRegistryRequest{
-			Action: "add",
-			Record: record,
-			Error:  make(chan error),
+			Action:     "add",
+			Record:     record,
+			Key:        r.Header.Get(registrationKeyHeader),
+			RequestID:  reqID,
+			Registrant: verifiedClient(r),
+			Error:      make(chan error),
 		}
 
 		// Send request to add a record to the unit asset
 		ua.requests <- addRecord
 		// Check the error back from the unit asset
 		err = <-addRecord.Error
+		if errors.Is(err, errDefinitionRefused) {
+			log.Printf("[%s] Refusing the registration: %v", reqID, err)
+			http.Error(w, "The registrar does not accept services of this definition", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errBadSubPath) {
+			log.Printf("[%s] Refusing the registration: %v", reqID, err)
+			http.Error(w, "The sub-path of the registration is not a valid URL path", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errNoUsablePort) {
+			log.Printf("[%s] Refusing the registration: %v", reqID, err)
+			http.Error(w, "The registration must offer at least one valid protocol port", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errNotRegistrant) {
+			log.Printf("[%s] Refusing the registration: %v", reqID, err)
+			http.Error(w, "Only the registrant may update the service record", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errAliasTaken) {
+			log.Printf("[%s] Refusing the registration: %v", reqID, err)
+			http.Error(w, "The alias is already used by another service record", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errRegistryFull) {
+			log.Printf("[%s] Refusing the new service: %v", reqID, err)
+			http.Error(w, "The service registry is full", http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
-			log.Printf("Error adding the new service: %v", err)
+			log.Printf("[%s] Error adding the new service: %v", reqID, err)
 			http.Error(w, "Error registering service", http.StatusInternalServerError)
 			return
 		}
+		if rec, ok := record.(*forms.ServiceRecord_v1); ok && ua.AnnounceTimeout > 0 {
+			w.Header().Set(providerVerifiedHeader, strconv.FormatBool(ua.verify(r.Context(), reqID, rec)))
+		}
+		if rec, ok := record.(*forms.ServiceRecord_v1); ok {
+			rec.ServiceDefinition = unqualify(namespace, []forms.ServiceRecord_v1{*rec})[0].ServiceDefinition
+		}
 		// fmt.Println(record)
 		updatedRecordBytes, err := usecases.Pack(record, mediaType)
 		if err != nil {
-			log.Printf("Error confirming new service: %s", err)
+			log.Printf("[%s] Error confirming new service: %s", reqID, err)
 			http.Error(w, "Error registering service", http.StatusInternalServerError)
+			return
+		}
+		if idemKey.key != "" {
+			ua.remember(idemKey, bodyBytes, mediaType, updatedRecordBytes)
 		}
 		w.Header().Set("Content-Type", mediaType)
 		w.WriteHeader(http.StatusOK)
@@ -187,27 +360,61 @@ func (ua *UnitAsset) updateDB(w http.ResponseWriter, r *http.Request) {
 
 // queryDB looks for service records in the service registry
 func (ua *UnitAsset) queryDB(w http.ResponseWriter, r *http.Request) {
+	reqID := requestID(w, r)
+	ctx, span := ua.tracer.startServerSpan(r, "query")
+	span.setAttribute("request.id", reqID)
+	defer span.end(nil)
+	if ua.allowCORS(w, r, "GET, HEAD, POST, OPTIONS") {
+		return
+	}
 	switch r.Method {
+	case "HEAD": // from a monitoring probe, which only needs the status and the entity tag
+		if ua.notModified(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", listingContentType)
+		w.WriteHeader(http.StatusOK)
+
 	case "GET": // from a web browser
-		// Create a struct to send on a channel to handle the request
+		if ua.notModified(w, r) {
+			return
+		}
+		namespace, err := ua.requestNamespace(r)
+		if err != nil {
+			log.Printf("[%s] Refusing the service listing request: %v", reqID, err)
+			http.Error(w, "The service listing request must come with a valid namespace", http.StatusForbidden)
+			return
+		}
+		// Create a struct to send on a channel to handle the request, whose replies are buffered
+		// so that the handler does not block on a request that timed out
 		recordsRequest := ServiceRegistryRequest{
-			Action: "read",
-			Result: make(chan []forms.ServiceRecord_v1),
-			Error:  make(chan error),
+			Action:    "read",
+			RequestID: reqID,
+			Result:    make(chan []forms.ServiceRecord_v1, 1),
+			Error:     make(chan error, 1),
 		}
 
 		// Send request to the `ua.requests` channel
-		ua.requests <- recordsRequest
+		timeout := time.After(ua.queryTimeout())
+		select {
+		case ua.requests <- recordsRequest:
+		case <-timeout:
+			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+			log.Printf("[%s] Failure to process service listing request", reqID)
+			return
+		}
 
 		// Use a select statement to wait for responses on either the Result or Error channel
 		select {
 		case err := <-recordsRequest.Error:
 			if err != nil {
-				log.Printf("Error retrieving service records: %v", err)
+				log.Printf("[%s] Error retrieving service records: %v", reqID, err)
 				http.Error(w, "Error retrieving service records", http.StatusInternalServerError)
 			}
 		case servicesList := <-recordsRequest.Result:
+			servicesList = ofNamespace(namespace, servicesList)
 			// Build the HTML response
+			w.Header().Set("Content-Type", listingContentType)
 			text := "<!DOCTYPE html><html><body>"
 			if _, err := w.Write([]byte(text)); err != nil {
 				log.Printf("Error occurred while writing to responsewriter: %v", err)
@@ -233,71 +440,151 @@ func (ua *UnitAsset) queryDB(w http.ResponseWriter, r *http.Request) {
 			if _, err := w.Write([]byte(text)); err != nil {
 				log.Printf("Error occurred while writing to responsewriter: %v", err)
 			}
-		case <-time.After(5 * time.Second): // Optional timeout
+		case <-timeout:
 			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
-			log.Println("Failure to process service listing request")
+			log.Printf("[%s] Failure to process service listing request", reqID)
 		}
 
 	case "POST": // from the orchestrator
-		contentType := r.Header.Get("Content-Type")
-		mediaType, _, err := mime.ParseMediaType(contentType)
+		mediaType, err := negotiateMediaType(r.Header.Get("Content-Type"), acceptedMediaTypes(ua.MediaTypes))
+		if err != nil {
+			log.Printf("[%s] Error negotiating the media type: %v", reqID, err)
+			http.Error(w, err.Error(), mediaTypeStatus(err))
+			return
+		}
+		wait, err := pollingWait(r)
+		if err != nil {
+			log.Printf("[%s] Error parsing the wait duration: %v", reqID, err)
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		fresh, err := freshnessWindow(r)
+		if err != nil {
+			log.Printf("[%s] Error parsing the freshness window: %v", reqID, err)
+			http.Error(w, "Invalid freshness window", http.StatusBadRequest)
+			return
+		}
+		window, err := queryWindow(r)
+		if err != nil {
+			log.Printf("[%s] Error parsing the registration window: %v", reqID, err)
+			http.Error(w, "Invalid registration window", http.StatusBadRequest)
+			return
+		}
+		match, err := parseMatchMode(r.URL.Query().Get("match"))
+		if err != nil {
+			log.Printf("[%s] Error parsing the matching mode: %v", reqID, err)
+			http.Error(w, "Invalid details matching mode", http.StatusBadRequest)
+			return
+		}
+		subnet, err := querySubnet(r)
+		if err != nil {
+			log.Printf("[%s] Error parsing the consumer's subnet: %v", reqID, err)
+			http.Error(w, "Invalid subnet, expected a CIDR such as 10.0.1.0/24", http.StatusBadRequest)
+			return
+		}
+		single, err := singleProvider(r)
 		if err != nil {
-			log.Println("Error parsing media type:", err)
-			http.Error(w, "Error parsing media type", http.StatusBadRequest)
+			log.Printf("[%s] Error parsing the single provider flag: %v", reqID, err)
+			http.Error(w, "Invalid single provider flag, expected true or false", http.StatusBadRequest)
 			return
 		}
 
 		defer r.Body.Close()
-		bodyBytes, err := io.ReadAll(r.Body)
+		r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
+		bodyBytes, err := readBody(r, ua.maxBodySize())
+		if bodyTooLarge(err) {
+			log.Printf("[%s] Service discovery request body exceeds %d bytes", reqID, ua.maxBodySize())
+			http.Error(w, "Service discovery request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil {
-			log.Printf("Error reading service discovery request body: %v", err)
+			log.Printf("[%s] Error reading service discovery request body: %v", reqID, err)
 			http.Error(w, "Error reading service discovery request body", http.StatusBadRequest)
 			return
 		}
 		record, err := usecases.Unpack(bodyBytes, mediaType)
 		if err != nil {
-			log.Printf("Error extracting the service discovery request %v\n", err)
+			log.Printf("[%s] Error extracting the service discovery request %v\n", reqID, err)
 			http.Error(w, "Error extracting the service discovery request", http.StatusBadRequest)
 			return
 		}
+		namespace, err := ua.requestNamespace(r)
+		if err != nil {
+			log.Printf("[%s] Refusing the service discovery request: %v", reqID, err)
+			http.Error(w, "The service discovery request must come with a valid namespace", http.StatusForbidden)
+			return
+		}
+		if quest, ok := record.(*forms.ServiceQuest_v1); ok {
+			span.setAttribute("service.definition", quest.ServiceDefinition)
+			quest.ServiceDefinition = qualify(namespace, quest.ServiceDefinition)
+			ua.noteRequester(quest.ServiceDefinition, quest.RequesterName)
+		}
 
-		// Create a struct to send on a channel to handle the request
+		// Create a struct to send on a channel to handle the request, whose replies are buffered
+		// so that the handler does not block on a request that timed out
 		readRecord := ServiceRegistryRequest{
-			Action: "read",
-			Record: record,
-			Result: make(chan []forms.ServiceRecord_v1),
-			Error:  make(chan error),
+			Action:    "read",
+			Record:    record,
+			Fresh:     fresh,
+			Window:    window,
+			Node:      r.URL.Query().Get("node"),
+			Subnet:    subnet,
+			Match:     match,
+			RequestID: reqID,
+			Result:    make(chan []forms.ServiceRecord_v1, 1),
+			Error:     make(chan error, 1),
 		}
 
 		// Send request to add a record to the unit asset
-		ua.requests <- readRecord
+		timeout := time.After(ua.queryTimeout())
+		select {
+		case ua.requests <- readRecord:
+		case <-timeout:
+			log.Printf("[%s] Failure to process service discovery request", reqID)
+			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+			return
+		}
 
 		// Use a select statement to wait for responses on either the Result or Error channel
 		select {
 		case err := <-readRecord.Error:
 			if err != nil {
-				log.Printf("Error retrieving service records: %v", err)
+				log.Printf("[%s] Error retrieving service records: %v", reqID, err)
 				http.Error(w, "Error retrieving service records", http.StatusInternalServerError)
 				return
 			}
 		case servicesList := <-readRecord.Result:
+			if len(servicesList) == 0 && wait > 0 {
+				servicesList = ua.awaitRecords(ctx, readRecord, wait)
+			}
+			span.setAttribute("records", strconv.Itoa(len(servicesList)))
 			var slForm forms.ServiceRecordList_v1
 			slForm.NewForm()
-			slForm.List = servicesList
+			slForm.List = unqualify(namespace, servicesList)
+			if quest, ok := record.(*forms.ServiceQuest_v1); ok && single {
+				ua.writeServicePoint(w, r, reqID, mediaType, quest.ServiceDefinition, slForm.List)
+				return
+			}
+			if ua.StreamListings && mediaType == "application/json" {
+				w.Header().Set("Content-Type", mediaType)
+				if err := streamRecordList(w, r, slForm); err != nil {
+					log.Printf("[%s] Error streaming the service records: %v", reqID, err)
+				}
+				return
+			}
 			updatedRecordBytes, err := usecases.Pack(&slForm, mediaType)
 			if err != nil {
-				log.Printf("error confirming new service: %s", err)
+				log.Printf("[%s] error confirming new service: %s", reqID, err)
 				http.Error(w, "Error registering service", http.StatusInternalServerError)
 			}
 			w.Header().Set("Content-Type", mediaType)
-			w.WriteHeader(http.StatusOK)
-			_, err = w.Write([]byte(updatedRecordBytes))
+			err = writeBody(w, r, updatedRecordBytes)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-		case <-time.After(5 * time.Second): // Optional timeout
-			log.Println("Failure to process service discovery request")
+		case <-timeout:
+			log.Printf("[%s] Failure to process service discovery request", reqID)
 			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
 			return
 		}
@@ -306,10 +593,348 @@ func (ua *UnitAsset) queryDB(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// listingContentType is the media type of the HTML listing, also announced by its HEAD replies
+const listingContentType = "text/html; charset=utf-8"
+
+// maxPollingWait bounds how long a long-polling query is held open
+const maxPollingWait = 60 * time.Second
+
+// pollingWait returns how long a query may wait for a matching record to be registered (e.g., ?wait=10s), zero if it should not wait
+func pollingWait(r *http.Request) (time.Duration, error) {
+	waitStr := r.URL.Query().Get("wait")
+	if waitStr == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(waitStr)
+	if err != nil {
+		return 0, err
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("negative wait duration %s", waitStr)
+	}
+	return min(wait, maxPollingWait), nil
+}
+
+// freshnessWindow returns how recently the providers of the queried records must have been heard from (e.g., ?fresh=30s),
+// zero if any registered record will do
+func freshnessWindow(r *http.Request) (time.Duration, error) {
+	freshStr := r.URL.Query().Get("fresh")
+	if freshStr == "" {
+		return 0, nil
+	}
+	fresh, err := time.ParseDuration(freshStr)
+	if err != nil {
+		return 0, err
+	}
+	if fresh <= 0 {
+		return 0, fmt.Errorf("non positive freshness window %s", freshStr)
+	}
+	return fresh, nil
+}
+
+// queryWindow returns the registration window of a query (e.g., ?createdAfter=2025-03-04T05:06:07Z or ?updatedAfter=...)
+func queryWindow(r *http.Request) (win registrationWindow, err error) {
+	if s := r.URL.Query().Get("createdAfter"); s != "" {
+		if win.createdAfter, err = time.Parse(time.RFC3339, s); err != nil {
+			return win, err
+		}
+	}
+	if s := r.URL.Query().Get("updatedAfter"); s != "" {
+		if win.updatedAfter, err = time.Parse(time.RFC3339, s); err != nil {
+			return win, err
+		}
+	}
+	return win, nil
+}
+
+// querySubnet returns the subnet from which the consumer reaches the providers (e.g., ?subnet=10.0.1.0/24),
+// nil if any address will do
+func querySubnet(r *http.Request) (*net.IPNet, error) {
+	s := r.URL.Query().Get("subnet")
+	if s == "" {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(s)
+	return subnet, err
+}
+
+// singleProvider reports whether the query asks for the single provider selected by the registrar (e.g., ?single=true)
+// instead of the list of the matching records
+func singleProvider(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("single")
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// writeServicePoint answers a single-provider quest with the service point of the selected provider,
+// or with 404 Not Found when none of the records has a usable service URL
+func (ua *UnitAsset) writeServicePoint(w http.ResponseWriter, r *http.Request, reqID, mediaType, definition string, records []forms.ServiceRecord_v1) {
+	sp, err := ua.selectProvider(definition, records)
+	if err != nil {
+		log.Printf("[%s] Error selecting the provider: %v", reqID, err)
+		http.Error(w, "No usable provider of the service", http.StatusNotFound)
+		return
+	}
+	payload, err := usecases.Pack(&sp, mediaType)
+	if err != nil {
+		log.Printf("[%s] Error packing the service point: %v", reqID, err)
+		http.Error(w, "Error packing the service point", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	if err := writeBody(w, r, payload); err != nil {
+		log.Printf("[%s] Error writing the service point: %v", reqID, err)
+	}
+}
+
+// awaitRecords holds the read query until a record passing its filters is registered, the wait elapses or the requester goes away
+func (ua *UnitAsset) awaitRecords(ctx context.Context, read ServiceRegistryRequest, wait time.Duration) []forms.ServiceRecord_v1 {
+	watch := read // keeps the quest and the filters of the query
+	watch.Action = "watch"
+	watch.Result = make(chan []forms.ServiceRecord_v1, 1) // buffered so the registry handler never blocks on a waiter
+	watch.Error = make(chan error)
+	ua.requests <- watch
+	if err := <-watch.Error; err != nil {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var servicesList []forms.ServiceRecord_v1
+	select {
+	case servicesList = <-watch.Result:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	ua.requests <- ServiceRegistryRequest{Action: "unwatch", Result: watch.Result}
+	return servicesList
+}
+
+// remoteHost returns the IP address of the requesting system, used as the source of a registration
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// readBody reads the request body, transparently decompressing it when it is gzip encoded,
+// and fails with an *http.MaxBytesError when the decompressed body exceeds the limit
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return io.ReadAll(r.Body)
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(http.MaxBytesReader(nil, zr, limit))
+}
+
+// bodyTooLarge reports whether reading a request body failed because it exceeds the size limit
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// acceptsGzip reports whether the Accept-Encoding headers of the request allow a gzip encoded reply: gzip, or else the
+// "*" wildcard, is listed with a non-zero quality, so that "gzip;q=0" refuses it
+func acceptsGzip(r *http.Request) bool {
+	wildcard := false
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			switch strings.ToLower(strings.TrimSpace(coding)) {
+			case "gzip":
+				return codingQuality(params) > 0
+			case "*":
+				wildcard = codingQuality(params) > 0
+			}
+		}
+	}
+	return wildcard
+}
+
+// codingQuality returns the q parameter of a content coding of the Accept-Encoding header, 1 if it has none
+func codingQuality(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if !strings.EqualFold(name, "q") {
+			continue
+		}
+		if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			return q
+		}
+	}
+	return 1
+}
+
+// writeBody writes the payload with a status OK, gzip compressing it when the client accepts it
+func writeBody(w http.ResponseWriter, r *http.Request, payload []byte) error {
+	if !acceptsGzip(r) {
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(payload)
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(payload); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// streamFlushEvery is the number of records written between two flushes of a streamed listing
+const streamFlushEvery = 64
+
+// streamRecordList writes the list in JSON one record at a time, compressed if the client accepts gzip,
+// flushing the reply every streamFlushEvery records so that it is never packed in memory as a whole.
+// The reply is already under way when an error occurs, which then only ends it early.
+func streamRecordList(w http.ResponseWriter, r *http.Request, list forms.ServiceRecordList_v1) error {
+	// the envelope of the form around an empty list, split where the records go
+	records := list.List
+	list.List = []forms.ServiceRecord_v1{}
+	envelope, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	split := bytes.Index(envelope, []byte("[]")) + 1
+
+	var out io.Writer = w
+	flush := func() error { return nil }
+	if acceptsGzip(r) {
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		out, flush = zw, zw.Flush
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	flusher, _ := w.(http.Flusher)
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := out.Write(envelope[:split]); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	for i, rec := range records {
+		if i > 0 {
+			if _, err := io.WriteString(out, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+		if (i+1)%streamFlushEvery == 0 && flusher != nil {
+			if err := flush(); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+	}
+	_, err = out.Write(envelope[split:])
+	return err
+}
+
+// heartbeat notes (PUT) that the provider of the record whose ID ends the URL path is alive, without extending its registration life
+func (ua *UnitAsset) heartbeat(w http.ResponseWriter, r *http.Request) {
+	reqID := requestID(w, r)
+	if !ua.leading {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	id, err := strconv.Atoi(parts[len(parts)-1]) // the ID is the last part of the URL path
+	if err != nil {
+		http.Error(w, "Invalid record ID", http.StatusBadRequest)
+		return
+	}
+	beat := ServiceRegistryRequest{
+		Action:    "heartbeat",
+		Id:        int64(id),
+		RequestID: reqID,
+		Error:     make(chan error),
+	}
+	ua.requests <- beat
+	err = <-beat.Error
+	if errors.Is(err, errUnknownRecord) {
+		// the record expired or was never registered, the provider has to register again
+		http.Error(w, "Unknown service record", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Error noting the heartbeat of the service with id: %d, %s\n", reqID, id, err)
+		http.Error(w, "Error noting the heartbeat", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifiedClient returns the common name of the client's verified certificate when mutual TLS is used, empty otherwise
+func verifiedClient(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// namespaceHeader carries the tenant namespace of a request when the namespaces are taken from a header
+const namespaceHeader = "X-Registry-Namespace"
+
+// requestNamespace returns the tenant namespace of the request, empty when the registry is not namespaced
+func (ua *UnitAsset) requestNamespace(r *http.Request) (string, error) {
+	var namespace string
+	switch ua.Namespaces {
+	case "":
+		return "", nil
+	case namespacesFromClient:
+		namespace = verifiedClient(r)
+	case namespacesFromHeader:
+		namespace = strings.TrimSpace(r.Header.Get(namespaceHeader))
+	}
+	if namespace == "" || strings.Contains(namespace, namespaceSeparator) {
+		return "", fmt.Errorf("%w %q from the %s", errBadNamespace, namespace, ua.Namespaces)
+	}
+	return namespace, nil
+}
+
+// idempotencyKeyHeader carries the key under which a client may retry a registration without it being processed twice,
+// and idempotentReplayHeader marks the replies replayed to such retries
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	idempotentReplayHeader = "Idempotent-Replayed"
+)
+
+// providerVerifiedHeader tells a provider whether the registrar could reach the service it just registered
+const providerVerifiedHeader = "X-Provider-Verified"
+
+// registrationKeyHeader carries the key under which a provider keeps the same record ID across renewals and restarts
+const registrationKeyHeader = "X-Registration-Key"
+
 // cleanDB deletes service records upon request (e.g., when a system shuts down)
 func (ua *UnitAsset) cleanDB(w http.ResponseWriter, r *http.Request) {
+	reqID := requestID(w, r)
 	switch r.Method {
 	case "DELETE":
+		if key := r.URL.Query().Get("key"); key != "" {
+			ua.deleteByKey(w, reqID, key, verifiedClient(r))
+			return
+		}
 		parts := strings.Split(r.URL.Path, "/")
 		idStr := parts[len(parts)-1]   // the ID is the last part of the URL path
 		id, err := strconv.Atoi(idStr) // convert the ID to an integer
@@ -320,17 +945,24 @@ func (ua *UnitAsset) cleanDB(w http.ResponseWriter, r *http.Request) {
 		}
 		// Create a struct to send on a channel to handle the request
 		addRecord := ServiceRegistryRequest{
-			Action: "delete",
-			Id:     int64(id),
-			Error:  make(chan error),
+			Action:     "delete",
+			Id:         int64(id),
+			RequestID:  reqID,
+			Registrant: verifiedClient(r),
+			Error:      make(chan error),
 		}
 
 		// Send request to add a record to the unit asset
 		ua.requests <- addRecord
 		// Check the error back from the unit asset
 		err = <-addRecord.Error
+		if errors.Is(err, errNotRegistrant) {
+			log.Printf("[%s] Refusing to delete the service with id: %d, %s\n", reqID, id, err)
+			http.Error(w, "Only the registrant may delete the service record", http.StatusForbidden)
+			return
+		}
 		if err != nil {
-			log.Printf("Error deleting the service with id: %d, %s\n", id, err)
+			log.Printf("[%s] Error deleting the service with id: %d, %s\n", reqID, id, err)
 			http.Error(w, "Error deleting service", http.StatusInternalServerError)
 			return
 		}
@@ -339,10 +971,52 @@ func (ua *UnitAsset) cleanDB(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// deleteByKey deletes the service record holding the stable ID of a registration key
+func (ua *UnitAsset) deleteByKey(w http.ResponseWriter, reqID string, key string, registrant string) {
+	deleteRecord := ServiceRegistryRequest{
+		Action:     "delete",
+		Key:        key,
+		RequestID:  reqID,
+		Registrant: registrant,
+		Error:      make(chan error),
+	}
+	ua.requests <- deleteRecord
+	err := <-deleteRecord.Error
+	if errors.Is(err, errUnknownKey) {
+		http.Error(w, "Unknown registration key", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotRegistrant) {
+		log.Printf("[%s] Refusing to delete the service with key: %s, %s\n", reqID, key, err)
+		http.Error(w, "Only the registrant may delete the service record", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Error deleting the service with key: %s, %s\n", reqID, key, err)
+		http.Error(w, "Error deleting service", http.StatusInternalServerError)
+	}
+}
+
+// registrarStatus is the JSON representation of the registrar's role, used by monitoring and failover logic
+type registrarStatus struct {
+	Leading      bool   `json:"leading"`
+	LeadingSince string `json:"leadingSince,omitempty"`
+	LeaderURL    string `json:"leaderUrl,omitempty"`
+	RecordCount  int    `json:"recordCount"`
+	Priority     int    `json:"priority"`
+}
+
 // roleStatus returns the current activity of a service registrar (i.e., leading or on stand by)
+// The plain text response is kept as default since the election loop and the other systems rely on it
 func (ua *UnitAsset) roleStatus(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
+		ua.advertisePriority(w)
+		w.Header().Set(bootIDHeader, ua.bootID)
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			ua.roleStatusJSON(w)
+			return
+		}
 		if ua.leading {
 			text := fmt.Sprintf("lead Service Registrar since %s", ua.leadingSince)
 			fmt.Fprint(w, text)
@@ -362,49 +1036,106 @@ func (ua *UnitAsset) roleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Role repeatedly check which service registrar in the local cloud is the leading service registrar
-func (ua *UnitAsset) Role() {
-	peersList, err := peersList(ua.Owner)
+// roleStatusJSON responds with the role, the leader and the number of records held by the registrar
+func (ua *UnitAsset) roleStatusJSON(w http.ResponseWriter) {
+	ua.mu.Lock()
+	status := registrarStatus{
+		Leading:     ua.leading,
+		RecordCount: len(ua.serviceRegistry),
+		Priority:    ua.Priority,
+	}
+	ua.mu.Unlock()
+	statusCode := http.StatusServiceUnavailable
+	if status.Leading {
+		status.LeadingSince = ua.leadingSince.Format(time.RFC3339)
+		statusCode = http.StatusOK
+	} else if ua.leadingRegistrar != nil {
+		status.LeaderURL = ua.leadingRegistrar.Url
+	}
+	payload, err := json.Marshal(status)
 	if err != nil {
-		panic(err)
+		http.Error(w, "Error packing the registrar status", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// Role repeatedly check which service registrar in the local cloud is the leading service registrar
+func (ua *UnitAsset) Role(peersList []*components.CoreSystem) {
+	if ua.promotesOnStartup(len(peersList)) {
+		ua.takeLead(time.Now()) // the election below still yields to a peer that already leads
 	}
 	go func() {
 		ticker := time.NewTicker(5 * time.Second)
 		for {
-			standby := false
-		foundLead:
-			for _, cSys := range peersList {
-				resp, err := http.Get(cSys.Url + "/status")
-				if err != nil {
-					break // that system registrar is not up
-				}
-				defer resp.Body.Close()
-
-				// Handle status codes
-				switch resp.StatusCode {
-				case http.StatusOK:
-					standby = true
-					ua.leading = false
-					ua.leadingSince = time.Time{} // reset lead timer
-					ua.leadingRegistrar = cSys
-					break foundLead
-				case http.StatusServiceUnavailable:
-					// Service unavailable
-				default:
-					log.Printf("Received unexpected status code: %d\n", resp.StatusCode)
-				}
-			}
-			if !standby && !ua.leading {
-				ua.leading = true
-				ua.leadingSince = time.Now()
-				ua.leadingRegistrar = nil
-				log.Printf("Taking the service registry lead at %s\n", ua.leadingSince)
-			}
+			ua.elect(peersList, time.Now())
 			<-ticker.C
 		}
 	}()
 }
 
+// elect runs one election round: the registrar follows the first peer that leads, or takes the lead if none does.
+// It yields to any reachable peer with a higher priority and, after a step-down, waits for its cooldown to elapse
+func (ua *UnitAsset) elect(peersList []*components.CoreSystem, now time.Time) {
+	standby := false
+	higherUp := false
+	for _, cSys := range peersList {
+		resp, err := http.Get(cSys.Url + "/status")
+		if err != nil {
+			continue // that system registrar is not up
+		}
+		resp.Body.Close()
+		if priority, ok := peerPriority(resp); ok && priority > ua.Priority {
+			higherUp = true
+		}
+
+		// Handle status codes
+		switch resp.StatusCode {
+		case http.StatusOK:
+			if !standby {
+				standby = true
+				ua.loseLead(now) // reset lead timer
+				ua.leadingRegistrar = cSys
+			}
+		case http.StatusServiceUnavailable:
+			// Service unavailable
+		default:
+			log.Printf("Received unexpected status code: %d\n", resp.StatusCode)
+		}
+	}
+	if higherUp && ua.leading {
+		ua.loseLead(now)
+		log.Printf("Handing the service registry lead over to a peer with a higher priority than %d\n", ua.Priority)
+	}
+	if !standby && !higherUp && !ua.leading && !now.Before(ua.suppressedUntil) {
+		ua.takeLead(now)
+	}
+}
+
+// priorityHeader carries the election priority of a registrar in its status responses
+const priorityHeader = "X-Registrar-Priority"
+
+// advertisePriority adds the election priority to a status response, unless the registrar stepped down and must not be waited for
+func (ua *UnitAsset) advertisePriority(w http.ResponseWriter) {
+	if time.Now().Before(ua.suppressedUntil) {
+		return
+	}
+	w.Header().Set(priorityHeader, strconv.Itoa(ua.Priority))
+}
+
+// peerPriority reads the election priority a peer advertised in its status response
+func peerPriority(resp *http.Response) (int, bool) {
+	priority, err := strconv.Atoi(resp.Header.Get(priorityHeader))
+	if err != nil {
+		return 0, false
+	}
+	return priority, true
+}
+
 // peerslist provides a list of the other service registrars in the local cloud
 func peersList(sys *components.System) (peers []*components.CoreSystem, err error) {
 	for _, cs := range sys.CoreS {
@@ -429,9 +1160,20 @@ func peersList(sys *components.System) (peers []*components.CoreSystem, err erro
 
 // queryDB looks for service records in the service registry
 func (ua *UnitAsset) systemList(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r, "GET, OPTIONS") {
+		return
+	}
 	switch r.Method {
 	case "GET":
-		systemsList, err := getUniqueSystems(ua)
+		if ua.notModified(w, r) {
+			return
+		}
+		namespace, err := ua.requestNamespace(r)
+		if err != nil {
+			http.Error(w, "The system list request must come with a valid namespace", http.StatusForbidden)
+			return
+		}
+		systemsList, err := getUniqueSystems(ua, namespace)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("System list error: %s", err), http.StatusInternalServerError)
 			return
@@ -441,3 +1183,419 @@ func (ua *UnitAsset) systemList(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
 	}
 }
+
+// definitionList returns (GET) the distinct service definitions currently offered in the local cloud with the number of records of each
+func (ua *UnitAsset) definitionList(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if ua.notModified(w, r) {
+		return
+	}
+	namespace, err := ua.requestNamespace(r)
+	if err != nil {
+		http.Error(w, "The definition list request must come with a valid namespace", http.StatusForbidden)
+		return
+	}
+	payload, err := json.Marshal(getUniqueDefinitions(ua, namespace))
+	if err != nil {
+		http.Error(w, "Error packing the service definitions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// nodeList returns (GET) the service nodes of the local cloud with the number of records and the systems each one hosts
+func (ua *UnitAsset) nodeList(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if ua.notModified(w, r) {
+		return
+	}
+	namespace, err := ua.requestNamespace(r)
+	if err != nil {
+		http.Error(w, "The node list request must come with a valid namespace", http.StatusForbidden)
+		return
+	}
+	payload, err := json.Marshal(getNodeSummaries(ua, namespace))
+	if err != nil {
+		http.Error(w, "Error packing the service nodes", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// lookupDB returns the service records whose IDs are listed in the JSON body (e.g., [3, 7, 12]), omitting the unknown ones,
+// so that a consumer caching record IDs can check them all at once
+func (ua *UnitAsset) lookupDB(w http.ResponseWriter, r *http.Request) {
+	reqID := requestID(w, r)
+	if ua.allowCORS(w, r, "POST, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+		return
+	}
+	mediaType, err := negotiateMediaType(r.Header.Get("Content-Type"), listMediaTypes)
+	if err != nil {
+		log.Printf("[%s] Error negotiating the media type: %v", reqID, err)
+		http.Error(w, err.Error(), mediaTypeStatus(err))
+		return
+	}
+	namespace, err := ua.requestNamespace(r)
+	if err != nil {
+		log.Printf("[%s] Refusing the record lookup request: %v", reqID, err)
+		http.Error(w, "The record lookup request must come with a valid namespace", http.StatusForbidden)
+		return
+	}
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
+	var ids []int
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		if bodyTooLarge(err) {
+			http.Error(w, "Lookup request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("[%s] Error extracting the record IDs: %v", reqID, err)
+		http.Error(w, "The body must be a list of record IDs", http.StatusBadRequest)
+		return
+	}
+
+	// The replies are buffered so that the handler does not block on a request that timed out
+	lookup := ServiceRegistryRequest{
+		Action:    "lookup",
+		IDs:       ids,
+		RequestID: reqID,
+		Result:    make(chan []forms.ServiceRecord_v1, 1),
+		Error:     make(chan error, 1),
+	}
+	timeout := time.After(ua.queryTimeout())
+	select {
+	case ua.requests <- lookup:
+	case <-timeout:
+		log.Printf("[%s] Failure to process record lookup request", reqID)
+		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	select {
+	case servicesList := <-lookup.Result:
+		var slForm forms.ServiceRecordList_v1
+		slForm.NewForm()
+		slForm.List = ofNamespace(namespace, servicesList)
+		payload, err := usecases.Pack(&slForm, mediaType)
+		if err != nil {
+			log.Printf("[%s] Error packing the looked up records: %v", reqID, err)
+			http.Error(w, "Error packing the service records", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mediaType)
+		if err := writeBody(w, r, payload); err != nil {
+			log.Printf("Error occurred while writing to responsewriter: %v", err)
+		}
+	case <-timeout:
+		log.Printf("[%s] Failure to process record lookup request", reqID)
+		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+	}
+}
+
+// aliasLookup returns the service record registered under the alias given by the name query parameter
+func (ua *UnitAsset) aliasLookup(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+		return
+	}
+	alias := r.URL.Query().Get("name")
+	if alias == "" {
+		http.Error(w, "Missing alias name", http.StatusBadRequest)
+		return
+	}
+	namespace, err := ua.requestNamespace(r)
+	if err != nil {
+		http.Error(w, "The alias lookup request must come with a valid namespace", http.StatusForbidden)
+		return
+	}
+	rec, found := ua.recordByAlias(qualify(namespace, alias))
+	if !found {
+		http.Error(w, "Unknown alias", http.StatusNotFound)
+		return
+	}
+	rec = unqualify(namespace, []forms.ServiceRecord_v1{rec})[0]
+	payload, err := usecases.Pack(&rec, "application/json")
+	if err != nil {
+		http.Error(w, "Error packing the service record", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// requesterList returns (GET) the consumers that recently sent a quest for the given service definition, the most recent first
+func (ua *UnitAsset) requesterList(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Unsupported HTTP request method", http.StatusMethodNotAllowed)
+		return
+	}
+	definition := r.URL.Query().Get("definition")
+	if definition == "" {
+		http.Error(w, "Missing service definition", http.StatusBadRequest)
+		return
+	}
+	namespace, err := ua.requestNamespace(r)
+	if err != nil {
+		http.Error(w, "The requesters request must come with a valid namespace", http.StatusForbidden)
+		return
+	}
+	payload, err := json.Marshal(ua.recentRequesters(qualify(namespace, definition)))
+	if err != nil {
+		http.Error(w, "Error packing the requesters", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// registryETag returns a weak entity tag of the current record set, which changes whenever a record is added, updated or removed.
+// The start time of the registrar tells apart the tags of registrars that restarted or took over the lead.
+func (ua *UnitAsset) registryETag() string {
+	ua.mu.Lock()
+	revision := ua.revision
+	ua.mu.Unlock()
+	return fmt.Sprintf(`W/"%x-%d"`, ua.startedAt.UnixNano(), revision)
+}
+
+// notModified sets the entity tag of a listing and answers 304 Not Modified if the client already holds the current one.
+// The tag is taken before the records are read, so that a concurrent change at worst causes one more full reply.
+func (ua *UnitAsset) notModified(w http.ResponseWriter, r *http.Request) bool {
+	etag := ua.registryETag()
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether the If-None-Match header lists the entity tag, using the weak comparison
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// registrarInfo is the build and uptime of the registrar, to help debugging a flapping leader,
+// and the optional features it supports, for the clients to negotiate them
+type registrarInfo struct {
+	Version      string   `json:"version"`
+	StartedAt    string   `json:"startedAt"`
+	Uptime       string   `json:"uptime"`
+	Leading      bool     `json:"leading"`
+	BootID       string   `json:"bootId"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// capabilities are the optional features of the registrar: the query parameters wait (long polling), fresh, window
+// (createdAfter and updatedAfter), node and match, and the lookup, alias, heartbeat and epoch paths
+var capabilities = []string{"wait", "fresh", "window", "node", "match", "lookup", "alias", "heartbeat", "epoch"}
+
+// registrarInfo reports (GET) the version and the uptime of the registrar
+func (ua *UnitAsset) registrarInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	ua.mu.Lock()
+	info := registrarInfo{
+		Version:      version,
+		StartedAt:    ua.startedAt.Format(time.RFC3339),
+		Uptime:       time.Since(ua.startedAt).Round(time.Second).String(),
+		Leading:      ua.leading,
+		BootID:       ua.bootID,
+		Capabilities: capabilities,
+	}
+	ua.mu.Unlock()
+	payload, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, "Error packing the registrar information", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// bootIDHeader carries the boot ID of the registrar in its status responses
+const bootIDHeader = "X-Registrar-Boot-ID"
+
+// newBootID returns a random identifier for a run of the registrar, falling back on its start time
+func newBootID(startedAt time.Time) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(startedAt.UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// registrarEpochReply tells the providers which run of the registrar holds their records
+type registrarEpochReply struct {
+	BootID    string `json:"bootId"`
+	StartedAt string `json:"startedAt"`
+}
+
+// registrarEpoch reports (GET) the boot ID of the registrar. The registry is not persisted, so a provider that
+// sees the boot ID change knows its records were lost with the restart and registers again without waiting for its
+// registration period. The boot ID doubles as an ETag, so that polling it costs a 304 while the registrar runs
+func (ua *UnitAsset) registrarEpoch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	etag := `"` + ua.bootID + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set(bootIDHeader, ua.bootID)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	payload, err := json.Marshal(registrarEpochReply{BootID: ua.bootID, StartedAt: ua.startedAt.Format(time.RFC3339)})
+	if err != nil {
+		http.Error(w, "Error packing the registrar epoch", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// defaultStepDownCooldown applies when the stepDownCooldown trait is not set
+const defaultStepDownCooldown = 30 * time.Second
+
+// stepDown hands over the lead (POST) for maintenance, keeping the registrar on standby for the cooldown so a peer takes over.
+// The request must carry the configured token as "Authorization: Bearer <token>"
+func (ua *UnitAsset) stepDown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	if ua.StepDownToken == "" {
+		http.Error(w, "Step-down is not enabled on this registrar", http.StatusForbidden)
+		return
+	}
+	if !hasBearer(r, ua.StepDownToken) {
+		log.Printf("Unauthorized step-down request from %s\n", remoteHost(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !ua.leading {
+		http.Error(w, "This registrar is not leading", http.StatusConflict)
+		return
+	}
+	cooldown := time.Duration(ua.StepDownCooldown) * time.Second
+	if cooldown <= 0 {
+		cooldown = defaultStepDownCooldown
+	}
+	ua.suppressedUntil = time.Now().Add(cooldown)
+	ua.loseLead(time.Now())
+	log.Printf("Stepping down from the service registry lead until %s\n", ua.suppressedUntil.Format(time.RFC3339))
+	fmt.Fprintf(w, "Stepped down, on standby until %s", ua.suppressedUntil.Format(time.RFC3339))
+}
+
+// hasBearer reports whether the request carries the token as its bearer credentials
+func hasBearer(r *http.Request, token string) bool {
+	credentials, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(credentials), []byte(token)) == 1
+}
+
+// importResult is the outcome of a records import
+type importResult struct {
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+}
+
+// records exports (GET) all the records as a ServiceRecordList_v1 form or imports (POST) such a form,
+// for operators holding the admin token
+func (ua *UnitAsset) records(w http.ResponseWriter, r *http.Request) {
+	reqID := requestID(w, r)
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	if ua.AdminToken == "" {
+		http.Error(w, "Record export and import are not enabled on this registrar", http.StatusForbidden)
+		return
+	}
+	if !hasBearer(r, ua.AdminToken) {
+		log.Printf("[%s] Unauthorized records request from %s\n", reqID, remoteHost(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		list := ua.exportRecords()
+		log.Printf("[%s] Exporting %d service records", reqID, len(list.List))
+		usecases.HTTPProcessGetRequest(w, r, &list)
+		return
+	}
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
+	bodyBytes, err := io.ReadAll(r.Body)
+	if bodyTooLarge(err) {
+		http.Error(w, "Records import body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading records import body", http.StatusBadRequest)
+		return
+	}
+	form, err := usecases.Unpack(bodyBytes, "application/json")
+	if err != nil {
+		log.Printf("[%s] Error extracting the records import: %v", reqID, err)
+		http.Error(w, "Error extracting the records import", http.StatusBadRequest)
+		return
+	}
+	list, ok := form.(*forms.ServiceRecordList_v1)
+	if !ok {
+		http.Error(w, "Expected a ServiceRecordList_v1 form", http.StatusBadRequest)
+		return
+	}
+	imported, failed := ua.importRecords(*list, reqID)
+	log.Printf("[%s] Imported %d service records, %d failed", reqID, imported, failed)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(importResult{Imported: imported, Failed: failed}); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
@@ -2,11 +2,20 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -108,6 +117,58 @@ func TestRoleStatus(t *testing.T) {
 	}
 }
 
+type roleStatusJSONParams struct {
+	expectedStatuscode int
+	expectedLeading    bool
+	expectedLeaderURL  string
+	setup              func() *UnitAsset
+	testCase           string
+}
+
+func TestRoleStatusJSON(t *testing.T) {
+	params := []roleStatusJSONParams{
+		{
+			http.StatusOK,
+			true,
+			"",
+			func() *UnitAsset { return createFilledRegistrar() },
+			"Good case, leading registrar",
+		},
+		{
+			http.StatusServiceUnavailable,
+			false,
+			"otherURL",
+			func() *UnitAsset { return createNonLeadingRegistrar() },
+			"Good case, standby registrar",
+		},
+	}
+
+	for _, c := range params {
+		ua := c.setup()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/status", nil)
+		r.Header.Set("Accept", "application/json")
+
+		ua.roleStatus(w, r)
+		res := w.Result()
+		if res.StatusCode != c.expectedStatuscode {
+			t.Errorf("Failed '%s', expected statuscode %d got: %d", c.testCase, c.expectedStatuscode, res.StatusCode)
+		}
+
+		var status registrarStatus
+		if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+			t.Fatalf("Failed '%s' while decoding status: %v", c.testCase, err)
+		}
+		if status.Leading != c.expectedLeading || status.LeaderURL != c.expectedLeaderURL {
+			t.Errorf("Failed '%s', expected leading %t and leader '%s', got: %t and '%s'",
+				c.testCase, c.expectedLeading, c.expectedLeaderURL, status.Leading, status.LeaderURL)
+		}
+		if status.RecordCount != len(ua.serviceRegistry) {
+			t.Errorf("Failed '%s', expected %d records, got: %d", c.testCase, len(ua.serviceRegistry), status.RecordCount)
+		}
+	}
+}
+
 // ---------------------------------------------- //
 // Help functions and structs to test peersList()
 // ---------------------------------------------- //
@@ -272,8 +333,10 @@ func TestSystemList(t *testing.T) {
 func createSpecialRequest(statusCode int, method string) *http.Request {
 	if statusCode == 200 {
 		rec := &forms.ServiceRecord_v1{
-			Id:      0,
-			Version: "ServiceRecord_v1",
+			Id:        0,
+			RegLife:   30,
+			Version:   "ServiceRecord_v1",
+			ProtoPort: map[string]int{"http": 1234},
 		}
 
 		data, _ := json.Marshal(rec)
@@ -371,7 +434,7 @@ func TestUpdateDB(t *testing.T) {
 		var ua *UnitAsset
 		sys := createTestSystem()
 		confAsset := createConfAssetMultipleTraits()
-		temp, shutdown := newResource(confAsset, &sys)
+		temp, shutdown := newTestResource(t, confAsset, &sys)
 		ua = temp.(*UnitAsset)
 		ua.leading = c.leading
 		w := httptest.NewRecorder()
@@ -396,6 +459,276 @@ func TestUpdateDB(t *testing.T) {
 	}
 }
 
+func TestUpdateDBRateLimit(t *testing.T) {
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(`{"registrationRate": 0.01, "registrationBurst": 2}`)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, code := range expected {
+		w := httptest.NewRecorder()
+		r := createSpecialRequest(http.StatusOK, http.MethodPost)
+		r.Header.Set("Content-Type", "application/json")
+		ua.updateDB(w, r)
+
+		res := w.Result()
+		if res.StatusCode != code {
+			t.Errorf("Expected statuscode %d for registration %d, got: %d", code, i+1, res.StatusCode)
+		}
+		if code == http.StatusTooManyRequests && res.Header.Get("Retry-After") == "" {
+			t.Errorf("Expected a Retry-After header when the rate is exceeded")
+		}
+	}
+}
+
+type bodyTooLargeParams struct {
+	handler  func(ua *UnitAsset) http.HandlerFunc
+	body     []byte
+	gzipped  bool
+	testCase string
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	quest := []byte(`{"serviceDefinition": "test", "version":"ServiceQuest_v1"}`)
+	padded := []byte(`{"serviceDefinition": "test", "version":"ServiceQuest_v1", "pad":"` + strings.Repeat("x", 1000) + `"}`)
+	updateDB := func(ua *UnitAsset) http.HandlerFunc { return ua.updateDB }
+	queryDB := func(ua *UnitAsset) http.HandlerFunc { return ua.queryDB }
+	params := []bodyTooLargeParams{
+		{updateDB, padded, false, "Bad case, oversized registration"},
+		{queryDB, padded, false, "Bad case, oversized service discovery request"},
+		{queryDB, gzipBytes(t, padded), true, "Bad case, compressed request inflating beyond the limit"},
+	}
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(`{"maxBodySize": 100}`)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+
+	for _, c := range params {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/", bytes.NewReader(c.body))
+		r.Header.Set("Content-Type", "application/json")
+		if c.gzipped {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+
+		c.handler(ua)(w, r)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", http.StatusRequestEntityTooLarge, w.Code, c.testCase)
+		}
+	}
+
+	// a request within the limit is still served
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/", bytes.NewReader(quest))
+	r.Header.Set("Content-Type", "application/json")
+	ua.queryDB(w, r)
+	if w.Code == http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a request within the limit to be served, got: %d", w.Code)
+	}
+}
+
+func TestUpdateDBRegistryFull(t *testing.T) {
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(`{"maxRecords": 1}`)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+
+	expected := []int{http.StatusOK, http.StatusServiceUnavailable}
+	for i, code := range expected {
+		w := httptest.NewRecorder()
+		r := createSpecialRequest(http.StatusOK, http.MethodPost)
+		r.Header.Set("Content-Type", "application/json")
+		ua.updateDB(w, r)
+
+		if w.Code != code {
+			t.Errorf("Expected statuscode %d for registration %d, got: %d", code, i+1, w.Code)
+		}
+	}
+}
+
+type updateDBSubPathParams struct {
+	subPath            string
+	expectedStatuscode int
+	expectedSubPath    string
+	testCase           string
+}
+
+func TestUpdateDBSubPath(t *testing.T) {
+	params := []updateDBSubPathParams{
+		{"/Kitchen/temperature/", http.StatusOK, "Kitchen/temperature", "Good case, slashes trimmed"},
+		{"Kitchen/tempé", http.StatusOK, "Kitchen/temp%C3%A9", "Good case, segment escaped"},
+		{"Kitchen/temp erature", http.StatusBadRequest, "", "Bad case, whitespace"},
+		{"Kitchen/temp?unit=C", http.StatusBadRequest, "", "Bad case, query characters"},
+	}
+
+	for _, c := range params {
+		sys := createTestSystem()
+		temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+		ua := temp.(*UnitAsset)
+		ua.leading = true
+
+		rec := forms.ServiceRecord_v1{ServiceDefinition: "temperature", SystemName: "thermostat", SubPath: c.subPath,
+			IPAddresses: []string{"192.168.1.2"}, ProtoPort: map[string]int{"http": 8870}, RegLife: 30, Version: "ServiceRecord_v1"}
+		data, _ := json.Marshal(rec)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/reg", bytes.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		ua.updateDB(w, r)
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+		}
+
+		ua.mu.Lock()
+		stored := make([]forms.ServiceRecord_v1, 0, len(ua.serviceRegistry))
+		for _, sr := range ua.serviceRegistry {
+			stored = append(stored, sr)
+		}
+		ua.mu.Unlock()
+		if c.expectedStatuscode != http.StatusOK {
+			if len(stored) != 0 {
+				t.Errorf("Expected the registration to be refused, got: %v in '%s'", stored, c.testCase)
+			}
+			shutdown()
+			continue
+		}
+		if len(stored) != 1 || stored[0].SubPath != c.expectedSubPath {
+			t.Errorf("Expected the sub-path %q to be stored, got: %v in '%s'", c.expectedSubPath, stored, c.testCase)
+			shutdown()
+			continue
+		}
+		// The service URL, built as the orchestrator does, is well-formed and leads to the service
+		location := "http://" + stored[0].IPAddresses[0] + ":8870/" + stored[0].SystemName + "/" + stored[0].SubPath
+		u, err := url.Parse(location)
+		if err != nil || u.RawQuery != "" || u.Fragment != "" || u.EscapedPath() != "/thermostat/"+c.expectedSubPath {
+			t.Errorf("Expected the well-formed URL %s, got: %v and %v in '%s'", location, u, err, c.testCase)
+		}
+		shutdown()
+	}
+}
+
+func TestUnsupportedMediaType(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+
+	handlers := map[string]http.HandlerFunc{"reg": ua.updateDB, "query": ua.queryDB}
+	for path, handler := range handlers {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/"+path, strings.NewReader("<quest/>"))
+		r.Header.Set("Content-Type", "text/xml")
+		handler(w, r)
+		if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), "application/json") {
+			t.Errorf("Expected statuscode %d naming the accepted media types, got: %d and '%s' for '%s'",
+				http.StatusUnsupportedMediaType, w.Code, w.Body.String(), path)
+		}
+	}
+}
+
+type updateDBDefinitionsParams struct {
+	traits             string
+	definition         string
+	expectedStatuscode int
+	testCase           string
+}
+
+func TestUpdateDBDefinitions(t *testing.T) {
+	params := []updateDBDefinitionsParams{
+		{`{}`, "humidity", http.StatusOK, "Good case, any definition accepted by default"},
+		{`{"acceptDefinitions": ["temperature", "humidity"]}`, "humidity", http.StatusOK, "Good case, accepted definition"},
+		{`{"acceptDefinitions": ["temperature"]}`, "temprature", http.StatusForbidden, "Bad case, definition not accepted"},
+		{`{"rejectDefinitions": ["debug"]}`, "temperature", http.StatusOK, "Good case, definition not rejected"},
+		{`{"rejectDefinitions": ["debug"]}`, "debug", http.StatusForbidden, "Bad case, rejected definition"},
+		{`{"acceptDefinitions": ["debug"], "rejectDefinitions": ["debug"]}`, "debug", http.StatusForbidden, "Bad case, rejection prevails"},
+	}
+	for _, c := range params {
+		sys := createTestSystem()
+		confAsset := createConfAssetMultipleTraits()
+		confAsset.Traits = []json.RawMessage{json.RawMessage(c.traits)}
+		temp, shutdown := newTestResource(t, confAsset, &sys)
+		ua := temp.(*UnitAsset)
+		ua.leading = true
+
+		body := `{"id": 0, "definition": "` + c.definition + `", "systemName": "thermostat", "protoPort": {"http": 8870}, "registrationLife": 30, "version": "ServiceRecord_v1"}`
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/reg", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		ua.updateDB(w, r)
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+		}
+		ua.mu.Lock()
+		count := len(ua.serviceRegistry)
+		ua.mu.Unlock()
+		if registered := c.expectedStatuscode == http.StatusOK; (count == 1) != registered {
+			t.Errorf("Expected the service to be registered %t, got: %d records in '%s'", registered, count, c.testCase)
+		}
+		shutdown()
+	}
+}
+
+type updateDBPortsParams struct {
+	protoPort          map[string]int
+	expectedStatuscode int
+	testCase           string
+}
+
+func TestUpdateDBPorts(t *testing.T) {
+	params := []updateDBPortsParams{
+		{map[string]int{"http": 8870, "https": 8871, "coap": 5683}, http.StatusOK, "Good case, all ports registered together"},
+		{map[string]int{"http": 0, "https": 8871}, http.StatusOK, "Good case, unused protocols kept at zero"},
+		{map[string]int{}, http.StatusBadRequest, "Bad case, no port"},
+		{map[string]int{"http": 0, "coap": 0}, http.StatusBadRequest, "Bad case, only zero ports"},
+		{map[string]int{"http": 8870, "https": 70000}, http.StatusBadRequest, "Bad case, port out of range"},
+		{map[string]int{"http": -1, "https": 8871}, http.StatusBadRequest, "Bad case, negative port"},
+	}
+
+	for _, c := range params {
+		sys := createTestSystem()
+		temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+		ua := temp.(*UnitAsset)
+		ua.leading = true
+
+		rec := forms.ServiceRecord_v1{ServiceDefinition: "temperature", SystemName: "thermostat",
+			ProtoPort: c.protoPort, RegLife: 30, Version: "ServiceRecord_v1"}
+		data, _ := json.Marshal(rec)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/reg", bytes.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		ua.updateDB(w, r)
+
+		ua.mu.Lock()
+		count := len(ua.serviceRegistry)
+		var stored map[string]int
+		for _, sr := range ua.serviceRegistry {
+			stored = sr.ProtoPort
+		}
+		ua.mu.Unlock()
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+		}
+		if c.expectedStatuscode == http.StatusOK && !maps.Equal(stored, c.protoPort) {
+			t.Errorf("Expected the ports %v to be stored, got: %v in '%s'", c.protoPort, stored, c.testCase)
+		}
+		if c.expectedStatuscode != http.StatusOK && count != 0 {
+			t.Errorf("Expected nothing to be stored, got: %d records in '%s'", count, c.testCase)
+		}
+		shutdown()
+	}
+}
+
 // ----------------------------------------------- //
 // Help functions and structs to test queryDB()
 // ----------------------------------------------- //
@@ -474,7 +807,7 @@ func TestQueryDB(t *testing.T) {
 		var ua *UnitAsset
 		sys := createTestSystem()
 		confAsset := createConfAssetMultipleTraits()
-		temp, shutdown := newResource(confAsset, &sys)
+		temp, shutdown := newTestResource(t, confAsset, &sys)
 		ua = temp.(*UnitAsset)
 		ua.leading = c.leading
 		w := httptest.NewRecorder()
@@ -495,6 +828,371 @@ func TestQueryDB(t *testing.T) {
 	}
 }
 
+type queryTimeoutParams struct {
+	method   string
+	slow     bool
+	testCase string
+}
+
+func TestQueryDBTimeout(t *testing.T) {
+	params := []queryTimeoutParams{
+		{http.MethodGet, true, "Bad case GET, the registry answers too late"},
+		{http.MethodPost, true, "Bad case POST, the registry answers too late"},
+		{http.MethodGet, false, "Bad case GET, the registry does not take the request"},
+		{http.MethodPost, false, "Bad case POST, the registry does not take the request"},
+	}
+
+	for _, c := range params {
+		ua := createLeadingRegistrar()
+		ua.QueryTimeout = 50
+		ua.requests = make(chan ServiceRegistryRequest)
+		replied := make(chan struct{})
+		if c.slow {
+			// A slow handler takes the request but replies after the timeout, which must not block it
+			go func() {
+				request := <-ua.requests
+				time.Sleep(200 * time.Millisecond)
+				request.Result <- nil
+				close(replied)
+			}()
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "http://localhost/query", strings.NewReader(`{"serviceDefinition": "test", "version":"ServiceQuest_v1"}`))
+		r.Header.Set("Content-Type", "application/json")
+		start := time.Now()
+		ua.queryDB(w, r)
+		if elapsed := time.Since(start); w.Code != http.StatusGatewayTimeout || elapsed > time.Second {
+			t.Errorf("Expected statuscode %d after the configured timeout, got: %d after %v in '%s'",
+				http.StatusGatewayTimeout, w.Code, elapsed, c.testCase)
+		}
+		if !c.slow {
+			continue
+		}
+		select {
+		case <-replied:
+		case <-time.After(time.Second):
+			t.Errorf("Expected the late reply not to block the handler in '%s'", c.testCase)
+		}
+	}
+}
+
+// ------------------------------------------------------- //
+// Help functions and structs to test long-polling queries
+// ------------------------------------------------------- //
+
+func TestQueryDBLongPolling(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+
+	quest := `{"serviceDefinition": "late", "version":"ServiceQuest_v1"}`
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/query?wait=2s", strings.NewReader(quest))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	// The provider registers while the query is waiting
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sendAddRequest(0, "late", "testPath", "", ua.requests)
+	}()
+
+	start := time.Now()
+	ua.queryDB(w, r)
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Errorf("Expected the query to return when the record was added, it took %v", elapsed)
+	}
+
+	var list forms.ServiceRecordList_v1
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed while unmarshalling response: %v", err)
+	}
+	if len(list.List) != 1 {
+		t.Errorf("Expected 1 service record, got: %d", len(list.List))
+	}
+
+	// An invalid wait duration is rejected
+	r = httptest.NewRequest(http.MethodPost, "http://localhost/query?wait=soon", strings.NewReader(quest))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	ua.queryDB(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected statuscode %d for an invalid wait, got: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// longPoll sends a long-polling quest for the flow service and returns the records of the reply with the time it took
+func longPoll(t *testing.T, ua *UnitAsset, query string) ([]forms.ServiceRecord_v1, time.Duration) {
+	quest := `{"serviceDefinition": "flow", "version":"ServiceQuest_v1"}`
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/query"+query, strings.NewReader(quest))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	ua.queryDB(w, r)
+	elapsed := time.Since(start)
+	var list forms.ServiceRecordList_v1
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed while unmarshalling response: %v", err)
+	}
+	return list.List, elapsed
+}
+
+// registerOnNode registers a flow service of the system on the service node
+func registerOnNode(t *testing.T, ua *UnitAsset, system, node string) {
+	rec := &forms.ServiceRecord_v1{
+		ServiceDefinition: "flow",
+		SystemName:        system,
+		ServiceNode:       node,
+		IPAddresses:       []string{"10.0.1.1"},
+		ProtoPort:         map[string]int{"http": 8870},
+		SubPath:           "flow",
+		RegLife:           25,
+		Version:           "ServiceRecord_v1",
+	}
+	if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+		t.Errorf("Expected no errors registering %s on %s: %v", system, node, err)
+	}
+}
+
+func TestQueryDBLongPollingNode(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	registerOnNode(t, ua, "pump", "edge2")
+
+	// The record of the other node doesn't answer the quest, which waits in vain
+	wait := 200 * time.Millisecond
+	if records, elapsed := longPoll(t, ua, "?wait=200ms&node=edge1"); len(records) != 0 || elapsed < wait {
+		t.Errorf("Expected no record after waiting %v, got: %d after %v", wait, len(records), elapsed)
+	}
+
+	// A registration on the other node doesn't end the wait, one on the queried node does
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		registerOnNode(t, ua, "fan", "edge2")
+		registerOnNode(t, ua, "valve", "edge1")
+	}()
+	records, elapsed := longPoll(t, ua, "?wait=2s&node=edge1")
+	if elapsed >= 2*time.Second {
+		t.Errorf("Expected the query to return when the record of edge1 was added, it took %v", elapsed)
+	}
+	if len(records) != 1 || records[0].SystemName != "valve" {
+		t.Errorf("Expected only the record of edge1, got: %v", records)
+	}
+}
+
+func TestQueryDBLongPollingWindow(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	start := time.Now().UTC().Truncate(time.Second)
+	clock := useFakeClock(ua, start.Add(-time.Hour))
+	registerOnNode(t, ua, "pump", "edge1")
+	clock.Advance(time.Hour)
+	createdAfter := "?createdAfter=" + start.Add(-30*time.Minute).Format(time.RFC3339)
+
+	// The record registered before the window doesn't answer the quest, which waits in vain
+	wait := 200 * time.Millisecond
+	if records, elapsed := longPoll(t, ua, createdAfter+"&wait=200ms"); len(records) != 0 || elapsed < wait {
+		t.Errorf("Expected no record after waiting %v, got: %d after %v", wait, len(records), elapsed)
+	}
+
+	// A registration within the window ends the wait
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		registerOnNode(t, ua, "valve", "edge1")
+	}()
+	records, elapsed := longPoll(t, ua, createdAfter+"&wait=2s")
+	if elapsed >= 2*time.Second {
+		t.Errorf("Expected the query to return when the new record was added, it took %v", elapsed)
+	}
+	if len(records) != 1 || records[0].SystemName != "valve" {
+		t.Errorf("Expected only the record created within the window, got: %v", records)
+	}
+}
+
+func TestQueryDBFreshness(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	sendAddRequest(0, "flow", "testPath", "", ua.requests)
+	ua.mu.Lock()
+	for id := range ua.lastSeen {
+		ua.lastSeen[id] = time.Now().Add(-time.Hour)
+	}
+	ua.mu.Unlock()
+
+	table := []struct {
+		query          string
+		expectedStatus int
+		expectedCount  int
+	}{
+		// The quiet provider is still registered
+		{"", http.StatusOK, 1},
+		// but was not heard from within the window
+		{"?fresh=30s", http.StatusOK, 0},
+		// Invalid windows are rejected
+		{"?fresh=recently", http.StatusBadRequest, 0},
+		{"?fresh=-5s", http.StatusBadRequest, 0},
+	}
+	for _, test := range table {
+		quest := `{"serviceDefinition": "flow", "version":"ServiceQuest_v1"}`
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/query"+test.query, strings.NewReader(quest))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ua.queryDB(w, r)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("Expected statuscode %d for '%s', got: %d", test.expectedStatus, test.query, w.Code)
+			continue
+		}
+		if test.expectedStatus != http.StatusOK {
+			continue
+		}
+		var list forms.ServiceRecordList_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed while unmarshalling response: %v", err)
+		}
+		if len(list.List) != test.expectedCount {
+			t.Errorf("Expected %d service records for '%s', got: %d", test.expectedCount, test.query, len(list.List))
+		}
+	}
+}
+
+func TestQueryDBRegistrationWindow(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	sendAddRequest(0, "flow", "testPath", "", ua.requests)
+
+	table := []struct {
+		query          string
+		expectedStatus int
+		expectedCount  int
+	}{
+		// Registered within the last hour
+		{"?createdAfter=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), http.StatusOK, 1},
+		// Nothing registered after a time in the future
+		{"?createdAfter=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), http.StatusOK, 0},
+		{"?updatedAfter=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), http.StatusOK, 0},
+		// Invalid times are rejected
+		{"?createdAfter=yesterday", http.StatusBadRequest, 0},
+		{"?updatedAfter=2025-13-01", http.StatusBadRequest, 0},
+	}
+	for _, test := range table {
+		quest := `{"serviceDefinition": "flow", "version":"ServiceQuest_v1"}`
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/query"+test.query, strings.NewReader(quest))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ua.queryDB(w, r)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("Expected statuscode %d for '%s', got: %d", test.expectedStatus, test.query, w.Code)
+			continue
+		}
+		if test.expectedStatus != http.StatusOK {
+			continue
+		}
+		var list forms.ServiceRecordList_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed while unmarshalling response: %v", err)
+		}
+		if len(list.List) != test.expectedCount {
+			t.Errorf("Expected %d service records for '%s', got: %d", test.expectedCount, test.query, len(list.List))
+		}
+	}
+}
+
+// ------------------------------------------------------- //
+// Help functions and structs to test gzip in queryDB()
+// ------------------------------------------------------- //
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("Failed while compressing test data: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed while closing gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestQueryDBGzip(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	sendAddRequest(0, "test", "testPath", "", ua.requests)
+
+	quest := []byte(`{"serviceDefinition": "test", "version":"ServiceQuest_v1"}`)
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/query", bytes.NewReader(gzipBytes(t, quest)))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	ua.queryDB(w, r)
+
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected statuscode %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzip encoded response, got: '%s'", res.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("Failed while opening gzip response: %v", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Failed while decompressing response: %v", err)
+	}
+	var list forms.ServiceRecordList_v1
+	if err := json.Unmarshal(data, &list); err != nil {
+		t.Fatalf("Failed while unmarshalling response: %v", err)
+	}
+	if len(list.List) != 1 {
+		t.Errorf("Expected 1 service record, got: %d", len(list.List))
+	}
+}
+
+type acceptsGzipParams struct {
+	acceptEncoding []string
+	expected       bool
+	testCase       string
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	params := []acceptsGzipParams{
+		{[]string{"gzip"}, true, "Good case, gzip"},
+		{[]string{"deflate, GZIP;q=0.5"}, true, "Good case, gzip with a quality"},
+		{[]string{"deflate", "gzip"}, true, "Good case, gzip in a second header"},
+		{[]string{"*"}, true, "Good case, wildcard"},
+		{[]string{"gzip;q=0"}, false, "Bad case, gzip refused"},
+		{[]string{"*, gzip; q=0.0"}, false, "Bad case, gzip refused despite the wildcard"},
+		{[]string{"*;q=0"}, false, "Bad case, wildcard refused"},
+		{[]string{"x-gzipped, br"}, false, "Bad case, other codings"},
+		{nil, false, "Bad case, no header"},
+	}
+	for _, c := range params {
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/query", nil)
+		for _, value := range c.acceptEncoding {
+			r.Header.Add("Accept-Encoding", value)
+		}
+		if got := acceptsGzip(r); got != c.expected {
+			t.Errorf("Expected %t, got: %t in '%s'", c.expected, got, c.testCase)
+		}
+	}
+}
+
 // ----------------------------------------------- //
 // Help functions and structs to test cleanDB()
 // ----------------------------------------------- //
@@ -507,29 +1205,105 @@ type cleanDBParams struct {
 	testCase           string
 }
 
-func TestCleanDB(t *testing.T) {
-	params := []cleanDBParams{
-		{
-			http.StatusBadRequest,
-			true,
-			io.NopCloser(strings.NewReader(`{"id": 0, "version":"ServiceQuest_v1"}`)),
-			http.MethodDelete,
-			"Bad case DELETE, couldn't convert id to int",
-		},
-		{
-			200,
-			true,
-			io.NopCloser(strings.NewReader(`{"id": 0, "version":"ServiceQuest_v1"}`)),
-			http.MethodGet,
-			"Bad case default, unsupported http method",
-		},
+// queryRecordSet sends a quest for the flow and returns the records of the reply by ID, in JSON
+func queryRecordSet(t *testing.T, ua *UnitAsset, acceptGzip bool) map[int]string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/query",
+		strings.NewReader(`{"serviceDefinition": "flow", "version":"ServiceQuest_v1"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if acceptGzip {
+		r.Header.Set("Accept-Encoding", "gzip")
+	}
+	w := httptest.NewRecorder()
+	ua.queryDB(w, r)
+
+	res := w.Result()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected statuscode %d with a JSON reply, got: %d '%s'", http.StatusOK, res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	body := io.Reader(res.Body)
+	if acceptGzip {
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatalf("Failed while opening gzip response: %v", err)
+		}
+		body = zr
+	}
+	var list forms.ServiceRecordList_v1
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		t.Fatalf("Failed while unmarshalling response: %v", err)
+	}
+	if list.Version != "ServiceRecordList_v1" {
+		t.Errorf("Expected a ServiceRecordList_v1 form, got version '%s'", list.Version)
+	}
+	set := make(map[int]string, len(list.List))
+	for _, rec := range list.List {
+		data, _ := json.Marshal(rec)
+		set[rec.Id] = string(data)
+	}
+	return set
+}
+
+type streamListingsParams struct {
+	records    int
+	acceptGzip bool
+	testCase   string
+}
+
+func TestQueryDBStreamListings(t *testing.T) {
+	params := []streamListingsParams{
+		{0, false, "Good case, no records"},
+		{1, false, "Good case, a single record"},
+		{3*streamFlushEvery + 5, false, "Good case, records across several flushes"},
+		{3*streamFlushEvery + 5, true, "Good case, compressed records across several flushes"},
+	}
+	for _, c := range params {
+		sys := createTestSystem()
+		temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+		ua := temp.(*UnitAsset)
+		for i := range c.records {
+			rec := &forms.ServiceRecord_v1{ServiceDefinition: "flow", SystemName: "System", SubPath: "flow" + strconv.Itoa(i),
+				ProtoPort: map[string]int{"http": 1234}, RegLife: 25, Version: "ServiceRecord_v1"}
+			if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+				t.Fatalf("Expected no errors registering the records: %v in '%s'", err, c.testCase)
+			}
+		}
+
+		buffered := queryRecordSet(t, ua, c.acceptGzip)
+		ua.StreamListings = true
+		streamed := queryRecordSet(t, ua, c.acceptGzip)
+		shutdown()
+
+		if len(buffered) != c.records || !maps.Equal(streamed, buffered) {
+			t.Errorf("Expected the %d streamed records to match the buffered ones, got %d streamed and %d buffered in '%s'",
+				c.records, len(streamed), len(buffered), c.testCase)
+		}
+	}
+}
+
+func TestCleanDB(t *testing.T) {
+	params := []cleanDBParams{
+		{
+			http.StatusBadRequest,
+			true,
+			io.NopCloser(strings.NewReader(`{"id": 0, "version":"ServiceQuest_v1"}`)),
+			http.MethodDelete,
+			"Bad case DELETE, couldn't convert id to int",
+		},
+		{
+			200,
+			true,
+			io.NopCloser(strings.NewReader(`{"id": 0, "version":"ServiceQuest_v1"}`)),
+			http.MethodGet,
+			"Bad case default, unsupported http method",
+		},
 	}
 
 	for _, c := range params {
 		var ua *UnitAsset
 		sys := createTestSystem()
 		confAsset := createConfAssetMultipleTraits()
-		temp, shutdown := newResource(confAsset, &sys)
+		temp, shutdown := newTestResource(t, confAsset, &sys)
 		ua = temp.(*UnitAsset)
 		ua.leading = c.leading
 
@@ -549,3 +1323,1829 @@ func TestCleanDB(t *testing.T) {
 		shutdown()
 	}
 }
+
+func TestCleanDBByKey(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+
+	rec, err := sendKeyedAddRequest("pump-flow", "flow", ua.requests)
+	if err != nil {
+		t.Fatalf("Expected no errors registering with a key: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, "http://localhost/reg/unregister?key=pump-flow", nil)
+	ua.cleanDB(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected statuscode %d deleting by key, got: %d", http.StatusOK, w.Code)
+	}
+	ua.mu.Lock()
+	_, exists := ua.serviceRegistry[rec.Id]
+	ua.mu.Unlock()
+	if exists {
+		t.Errorf("Expected the record with ID %d to be deleted", rec.Id)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodDelete, "http://localhost/reg/unregister?key=no-such-key", nil)
+	ua.cleanDB(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected statuscode %d for an unknown key, got: %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// withClientCert makes the request look like it came over mutual TLS from a client with the given common name
+func withClientCert(r *http.Request, commonName string) *http.Request {
+	if commonName != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	return r
+}
+
+type registrantParams struct {
+	deleter            string
+	expectedStatuscode int
+	expectDeleted      bool
+	testCase           string
+}
+
+func TestCleanDBRegistrant(t *testing.T) {
+	params := []registrantParams{
+		{"intruder", http.StatusForbidden, false, "Bad case, another client may not delete the record"},
+		{"", http.StatusForbidden, false, "Bad case, a client without certificate may not delete the record"},
+		{"thermostat", http.StatusOK, true, "Good case, the registrant deletes its record"},
+	}
+
+	for _, c := range params {
+		sys := createTestSystem()
+		temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+		ua := temp.(*UnitAsset)
+		ua.leading = true
+
+		w := httptest.NewRecorder()
+		r := withClientCert(createSpecialRequest(http.StatusOK, http.MethodPost), "thermostat")
+		r.Header.Set("Content-Type", "application/json")
+		ua.updateDB(w, r)
+		var rec forms.ServiceRecord_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected the registration to succeed, got: %d %s in '%s'", w.Code, w.Body.String(), c.testCase)
+		}
+		if got := rec.Details[registrantDetail]; len(got) != 1 || got[0] != "thermostat" {
+			t.Errorf("Expected the record to be stamped with its registrant, got: %v in '%s'", got, c.testCase)
+		}
+
+		w = httptest.NewRecorder()
+		r = withClientCert(httptest.NewRequest(http.MethodDelete, "http://localhost/reg/unregister/"+strconv.Itoa(rec.Id), nil), c.deleter)
+		ua.cleanDB(w, r)
+		ua.mu.Lock()
+		_, exists := ua.serviceRegistry[rec.Id]
+		ua.mu.Unlock()
+		if w.Code != c.expectedStatuscode || exists == c.expectDeleted {
+			t.Errorf("Expected statuscode %d and deleted %t, got: %d and %t in '%s'",
+				c.expectedStatuscode, c.expectDeleted, w.Code, !exists, c.testCase)
+		}
+		shutdown()
+	}
+}
+
+func TestUpdateDBRegistrant(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+
+	// A provider cannot claim a registrant by itself
+	body := `{"id": 0, "protoPort": {"http": 1234}, "details": {"_registrant": ["thermostat"]}, "version": "ServiceRecord_v1"}`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/reg", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	ua.updateDB(w, r)
+	var rec forms.ServiceRecord_v1
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil || len(rec.Details[registrantDetail]) != 0 {
+		t.Errorf("Expected the claimed registrant to be dropped, got: %s", w.Body.String())
+	}
+
+	// Once stamped, only the registrant may renew the record
+	w = httptest.NewRecorder()
+	r = withClientCert(createSpecialRequest(http.StatusOK, http.MethodPost), "thermostat")
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(registrationKeyHeader, "thermostat-temperature")
+	ua.updateDB(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the registration to succeed, got: %d", w.Code)
+	}
+	for _, client := range []string{"intruder", "thermostat"} {
+		w = httptest.NewRecorder()
+		r = withClientCert(createSpecialRequest(http.StatusOK, http.MethodPut), client)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(registrationKeyHeader, "thermostat-temperature")
+		ua.updateDB(w, r)
+		expected := http.StatusOK
+		if client == "intruder" {
+			expected = http.StatusForbidden
+		}
+		if w.Code != expected {
+			t.Errorf("Expected statuscode %d renewing as %s, got: %d", expected, client, w.Code)
+		}
+	}
+}
+
+// keyedRegistration sends a registration of the temperature with the idempotency key, as the client
+func keyedRegistration(ua *UnitAsset, key, client string, port int) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"id": 0, "definition": "temperature", "systemName": "thermostat", "ipAddresses": ["192.168.1.2"], "protoPort": {"http": %d}, "registrationLife": 30, "version": "ServiceRecord_v1"}`, port)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/reg", strings.NewReader(body))
+	if client != "" {
+		r = withClientCert(r, client)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		r.Header.Set(idempotencyKeyHeader, key)
+	}
+	ua.updateDB(w, r)
+	return w
+}
+
+type idempotencyParams struct {
+	key            string
+	client         string
+	port           int
+	expectedCode   int
+	expectedReplay bool
+	expectedCount  int
+	testCase       string
+}
+
+func TestUpdateDBIdempotencyKey(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+	clock := useFakeClock(ua, time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC))
+
+	first := keyedRegistration(ua, "retry-1", "", 8870)
+	if first.Code != http.StatusOK || first.Header().Get(idempotentReplayHeader) != "" {
+		t.Fatalf("Expected the keyed registration to be processed, got: %d and %v", first.Code, first.Header())
+	}
+
+	// Each case runs in order on the same registry, which holds the first record
+	params := []idempotencyParams{
+		{"retry-1", "", 8870, http.StatusOK, true, 1, "Good case, retry replayed"},
+		{"retry-1", "", 8871, http.StatusUnprocessableEntity, false, 1, "Bad case, key reused for another registration"},
+		{"retry-1", "thermostat", 8870, http.StatusOK, false, 2, "Good case, key of another client"},
+		{"", "", 8870, http.StatusOK, false, 3, "Good case, no key"},
+	}
+	for _, c := range params {
+		w := keyedRegistration(ua, c.key, c.client, c.port)
+		if w.Code != c.expectedCode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedCode, w.Code, c.testCase)
+		}
+		if replayed := w.Header().Get(idempotentReplayHeader) == "true"; replayed != c.expectedReplay {
+			t.Errorf("Expected a replayed reply to be %t, got: %t in '%s'", c.expectedReplay, replayed, c.testCase)
+		}
+		if c.expectedReplay && w.Body.String() != first.Body.String() {
+			t.Errorf("Expected the original reply %s, got: %s in '%s'", first.Body.String(), w.Body.String(), c.testCase)
+		}
+		ua.mu.Lock()
+		count := len(ua.serviceRegistry)
+		ua.mu.Unlock()
+		if count != c.expectedCount {
+			t.Errorf("Expected %d records, got: %d in '%s'", c.expectedCount, count, c.testCase)
+		}
+	}
+
+	// Once the window is over, the key is forgotten and the registration processed again
+	clock.Advance(defaultIdempotencyWindow)
+	ua.mu.Lock()
+	remembered := len(ua.idempotent)
+	ua.mu.Unlock()
+	if remembered != 0 {
+		t.Errorf("Expected the idempotency keys to be forgotten, got: %d", remembered)
+	}
+	if w := keyedRegistration(ua, "retry-1", "", 8871); w.Code != http.StatusOK || w.Header().Get(idempotentReplayHeader) != "" {
+		t.Errorf("Expected the expired key to be processed again, got: %d and %v", w.Code, w.Header())
+	}
+}
+
+func TestUpdateDBIdempotencyKeyNamespaces(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+	ua.Namespaces = namespacesFromHeader
+
+	// Both tenants come through the certificate of the gateway and happen to send the same key
+	register := func(tenant string, port int) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"definition": "temperature", "systemName": "thermostat", "ipAddresses": ["192.168.1.2"], "protoPort": {"http": %d}, "registrationLife": 30, "version": "ServiceRecord_v1"}`, port)
+		w := httptest.NewRecorder()
+		r := withClientCert(httptest.NewRequest(http.MethodPost, "http://localhost/reg", strings.NewReader(body)), "gateway")
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(namespaceHeader, tenant)
+		r.Header.Set(idempotencyKeyHeader, "retry-1")
+		ua.updateDB(w, r)
+		return w
+	}
+	if w := register("tenantA", 8870); w.Code != http.StatusOK {
+		t.Fatalf("Expected the registration of tenant A to be processed, got: %d", w.Code)
+	}
+	// The same registration is processed rather than replayed, and another one is not taken for a reused key
+	for tenant, port := range map[string]int{"tenantB": 8870, "tenantC": 8871} {
+		w := register(tenant, port)
+		if w.Code != http.StatusOK || w.Header().Get(idempotentReplayHeader) != "" {
+			t.Errorf("Expected the registration of %s to be processed, got: %d and %v", tenant, w.Code, w.Header())
+		}
+	}
+	ua.mu.Lock()
+	count := len(ua.serviceRegistry)
+	ua.mu.Unlock()
+	if count != 3 {
+		t.Errorf("Expected a record per tenant, got: %d", count)
+	}
+}
+
+// announceTransport answers the registrar's announcements with the status, or fails to connect when it is zero
+type announceTransport struct {
+	status int
+	urls   []string
+}
+
+func (at *announceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	at.urls = append(at.urls, req.URL.String())
+	if at.status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: at.status, Status: http.StatusText(at.status), Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+type announceParams struct {
+	status           int
+	expectedVerified string
+	testCase         string
+}
+
+func TestUpdateDBAnnounce(t *testing.T) {
+	params := []announceParams{
+		{http.StatusOK, "true", "Good case, provider serving"},
+		{http.StatusMethodNotAllowed, "true", "Good case, provider serving other methods"},
+		{http.StatusNotFound, "false", "Bad case, service not found"},
+		{http.StatusBadGateway, "false", "Bad case, server error"},
+		{0, "false", "Bad case, provider unreachable"},
+	}
+	for _, c := range params {
+		sys := createTestSystem()
+		confAsset := createConfAssetMultipleTraits()
+		confAsset.Traits = []json.RawMessage{json.RawMessage(`{"announceTimeout": 500}`)}
+		temp, shutdown := newTestResource(t, confAsset, &sys)
+		ua := temp.(*UnitAsset)
+		ua.leading = true
+		transport := &announceTransport{status: c.status}
+		ua.announcer = &http.Client{Transport: transport}
+
+		w := keyedRegistration(ua, "", "", 8870)
+		if w.Code != http.StatusOK || w.Header().Get(providerVerifiedHeader) != c.expectedVerified {
+			t.Errorf("Expected the provider to be verified %s, got: %d and %q in '%s'",
+				c.expectedVerified, w.Code, w.Header().Get(providerVerifiedHeader), c.testCase)
+		}
+		var rec forms.ServiceRecord_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil {
+			t.Fatalf("Failed while unmarshalling response: %v", err)
+		}
+		ua.mu.Lock()
+		stored := ua.serviceRegistry[rec.Id]
+		ua.mu.Unlock()
+		verified := c.expectedVerified == "true"
+		if (len(rec.Details[verifiedDetail]) > 0) != verified || (len(stored.Details[verifiedDetail]) > 0) != verified {
+			t.Errorf("Expected the record to be marked verified %t, got: %v and %v in '%s'", verified, rec.Details, stored.Details, c.testCase)
+		}
+
+		// Once known to serve, the provider is not announced again when it renews its registration
+		if verified {
+			rec.Details = nil
+			body, _ := json.Marshal(rec)
+			r := httptest.NewRequest(http.MethodPut, "http://localhost/reg", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+			ua.updateDB(w, r)
+			if w.Code != http.StatusOK || w.Header().Get(providerVerifiedHeader) != "true" || !strings.Contains(w.Body.String(), verifiedDetail) {
+				t.Errorf("Expected the renewal to stay verified, got: %d and %s in '%s'", w.Code, w.Body.String(), c.testCase)
+			}
+		}
+		if len(transport.urls) != 1 || transport.urls[0] != "http://192.168.1.2:8870/thermostat/" {
+			t.Errorf("Expected a single announcement to the service, got: %v in '%s'", transport.urls, c.testCase)
+		}
+		shutdown()
+	}
+}
+
+// namespacedRequest sends a registration or a quest for the temperature as the client, in the namespaced registry
+func namespacedRequest(ua *UnitAsset, handler func(http.ResponseWriter, *http.Request), body, client string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := withClientCert(httptest.NewRequest(http.MethodPost, "http://localhost/reg", strings.NewReader(body)), client)
+	r.Header.Set("Content-Type", "application/json")
+	handler(w, r)
+	return w
+}
+
+type namespaceParams struct {
+	client       string
+	expectedCode int
+	expectedPort int
+	testCase     string
+}
+
+func TestNamespaces(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+	ua.Namespaces = namespacesFromClient
+
+	for client, port := range map[string]int{"tenantA": 1234, "tenantB": 5678} {
+		body := `{"definition": "temperature", "systemName": "` + client + `", "subpath": "temperature", "registrationLife": 25,
+			"protoPort": {"http": ` + strconv.Itoa(port) + `}, "version": "ServiceRecord_v1"}`
+		w := namespacedRequest(ua, ua.updateDB, body, client)
+		var rec forms.ServiceRecord_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &rec); w.Code != http.StatusOK || err != nil || rec.ServiceDefinition != "temperature" {
+			t.Fatalf("Expected %s to register its temperature, got: %d %s", client, w.Code, w.Body.String())
+		}
+	}
+	ua.mu.Lock()
+	for _, rec := range ua.serviceRegistry {
+		if !strings.HasSuffix(rec.ServiceDefinition, namespaceSeparator+"temperature") || !strings.HasPrefix(rec.ServiceDefinition, rec.SystemName) {
+			t.Errorf("Expected the definition to be stored in the namespace of %s, got: %s", rec.SystemName, rec.ServiceDefinition)
+		}
+	}
+	ua.mu.Unlock()
+	w := namespacedRequest(ua, ua.updateDB, `{"definition": "temperature", "protoPort": {"http": 4321}, "version": "ServiceRecord_v1"}`, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected statuscode %d registering without a namespace, got: %d", http.StatusForbidden, w.Code)
+	}
+
+	params := []namespaceParams{
+		{"tenantA", http.StatusOK, 1234, "Good case, tenant A only sees its own service"},
+		{"tenantB", http.StatusOK, 5678, "Good case, tenant B only sees its own service"},
+		{"tenantC", http.StatusOK, 0, "Good case, a tenant without services sees none"},
+		{"", http.StatusForbidden, 0, "Bad case, no namespace"},
+	}
+	for _, c := range params {
+		w := namespacedRequest(ua, ua.queryDB, `{"serviceDefinition": "temperature", "version": "ServiceQuest_v1"}`, c.client)
+		if w.Code != c.expectedCode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedCode, w.Code, c.testCase)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var list forms.ServiceRecordList_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed while unmarshalling response: %v", err)
+		}
+		if c.expectedPort == 0 {
+			if len(list.List) != 0 {
+				t.Errorf("Expected no service records, got: %d in '%s'", len(list.List), c.testCase)
+			}
+			continue
+		}
+		if len(list.List) != 1 || list.List[0].ProtoPort["http"] != c.expectedPort || list.List[0].ServiceDefinition != "temperature" {
+			t.Errorf("Expected the temperature record on port %d, got: %+v in '%s'", c.expectedPort, list.List, c.testCase)
+		}
+	}
+
+	// A tenant cannot reach into the namespace of another by naming it in the definition
+	w = namespacedRequest(ua, ua.queryDB, `{"serviceDefinition": "tenantB/temperature", "version": "ServiceQuest_v1"}`, "tenantA")
+	var list forms.ServiceRecordList_v1
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.List) != 0 {
+		t.Errorf("Expected no service records of another namespace, got: %s", w.Body.String())
+	}
+}
+
+// tenantRequest sends a request to a service of the registrar on behalf of the tenant named by the client certificate
+func tenantRequest(ua *UnitAsset, method, target, body, client string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := withClientCert(httptest.NewRequest(method, "http://localhost/"+target, strings.NewReader(body)), client)
+	r.Header.Set("Content-Type", "application/json")
+	servicePath, _, _ := strings.Cut(target, "?")
+	ua.Serving(w, r, servicePath)
+	return w
+}
+
+type namespaceIsolationParams struct {
+	method       string
+	target       string
+	body         string
+	expectedCode int
+	expectedText string
+	testCase     string
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+	ua.Namespaces = namespacesFromClient
+
+	// Both tenants register a temperature under the same alias
+	ids := make(map[string]int)
+	for client, port := range map[string]int{"tenantA": 1234, "tenantB": 5678} {
+		body := `{"definition": "temperature", "systemName": "` + client + `", "serviceNode": "` + client + `-node",
+			"ipAddresses": ["127.0.0.1"], "subpath": "temperature", "registrationLife": 25, "protoPort": {"http": ` + strconv.Itoa(port) + `},
+			"details": {"alias": ["probe"]}, "version": "ServiceRecord_v1"}`
+		w := tenantRequest(ua, http.MethodPost, "register", body, client)
+		var rec forms.ServiceRecord_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &rec); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("Expected %s to register its temperature, got: %d %s", client, w.Code, w.Body.String())
+		}
+		ids[client] = rec.Id
+	}
+	lookupBody := fmt.Sprintf("[%d, %d]", ids["tenantA"], ids["tenantB"])
+
+	params := []namespaceIsolationParams{
+		{http.MethodGet, "query", "", http.StatusOK, `:1234/tenantA/temperature">temperature<`, "Good case, listing"},
+		{http.MethodGet, "syslist", "", http.StatusOK, ":1234/tenantA", "Good case, system list"},
+		{http.MethodGet, "deflist", "", http.StatusOK, `"definition":"temperature","count":1`, "Good case, definition list"},
+		{http.MethodGet, "nodelist", "", http.StatusOK, `"node":"tenantA-node","count":1`, "Good case, node list"},
+		{http.MethodPost, "lookup", lookupBody, http.StatusOK, `"systemName": "tenantA"`, "Good case, lookup"},
+		{http.MethodGet, "alias?name=probe", "", http.StatusOK, `"systemName": "tenantA"`, "Good case, alias"},
+	}
+	for _, c := range params {
+		w := tenantRequest(ua, c.method, c.target, c.body, "tenantA")
+		if w.Code != c.expectedCode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedCode, w.Code, c.testCase)
+			continue
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, c.expectedText) {
+			t.Errorf("Expected the reply to contain %s, got: %s in '%s'", c.expectedText, body, c.testCase)
+		}
+		if strings.Contains(body, "tenantB") {
+			t.Errorf("Expected no record of another tenant, got: %s in '%s'", body, c.testCase)
+		}
+		if strings.Contains(body, `"tenantA/temperature"`) {
+			t.Errorf("Expected the definitions stripped of the namespace, got: %s in '%s'", body, c.testCase)
+		}
+
+		// A request without a namespace is refused
+		if w := tenantRequest(ua, c.method, c.target, c.body, ""); w.Code != http.StatusForbidden {
+			t.Errorf("Expected statuscode %d without a namespace, got: %d in '%s'", http.StatusForbidden, w.Code, c.testCase)
+		}
+	}
+}
+
+type requestNamespaceParams struct {
+	namespaces        string
+	client            string
+	header            string
+	expectedNamespace string
+	expectError       bool
+	testCase          string
+}
+
+func TestRequestNamespace(t *testing.T) {
+	params := []requestNamespaceParams{
+		{"", "tenantA", "tenantB", "", false, "Good case, unnamespaced"},
+		{namespacesFromClient, "tenantA", "tenantB", "tenantA", false, "Good case, from the certificate"},
+		{namespacesFromHeader, "tenantA", " tenantB ", "tenantB", false, "Good case, from the header"},
+		{namespacesFromClient, "", "tenantB", "", true, "Bad case, no certificate"},
+		{namespacesFromHeader, "tenantA", "", "", true, "Bad case, no header"},
+		{namespacesFromHeader, "", "tenantA/tenantB", "", true, "Bad case, separator in the namespace"},
+	}
+	for _, c := range params {
+		ua := &UnitAsset{Traits: Traits{Namespaces: c.namespaces}}
+		r := withClientCert(httptest.NewRequest(http.MethodPost, "http://localhost/query", nil), c.client)
+		r.Header.Set(namespaceHeader, c.header)
+		namespace, err := ua.requestNamespace(r)
+		if (err != nil) != c.expectError || (err != nil && !errors.Is(err, errBadNamespace)) {
+			t.Errorf("Expected error %t, got: %v in '%s'", c.expectError, err, c.testCase)
+		}
+		if namespace != c.expectedNamespace {
+			t.Errorf("Expected namespace '%s', got: '%s' in '%s'", c.expectedNamespace, namespace, c.testCase)
+		}
+	}
+}
+
+// ----------------------------------------------- //
+// Help functions and structs to test requestID()
+// ----------------------------------------------- //
+
+type requestIDParams struct {
+	providedID string
+	testCase   string
+}
+
+func TestRequestID(t *testing.T) {
+	params := []requestIDParams{
+		{"abc123", "Good case, caller provided ID is kept and echoed"},
+		{"", "Good case, ID generated and echoed"},
+	}
+
+	for _, c := range params {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/query", nil)
+		if c.providedID != "" {
+			r.Header.Set(requestIDHeader, c.providedID)
+		}
+
+		id := requestID(w, r)
+		if id == "" {
+			t.Errorf("Expected a request ID in '%s'", c.testCase)
+		}
+		if c.providedID != "" && id != c.providedID {
+			t.Errorf("Expected request ID '%s' in '%s', got: '%s'", c.providedID, c.testCase, id)
+		}
+		if echoed := w.Header().Get(requestIDHeader); echoed != id {
+			t.Errorf("Expected echoed request ID '%s' in '%s', got: '%s'", id, c.testCase, echoed)
+		}
+	}
+}
+
+func TestRegistrarInfo(t *testing.T) {
+	ua := createLeadingRegistrar()
+	ua.startedAt = time.Now().Add(-90 * time.Second)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/info", nil)
+	ua.Serving(w, r, "info")
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected statuscode %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	var info registrarInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed while decoding info: %v", err)
+	}
+	if info.Version != version || info.Version == "" {
+		t.Errorf("Expected version '%s', got: '%s'", version, info.Version)
+	}
+	if info.Uptime != "1m30s" {
+		t.Errorf("Expected uptime '1m30s', got: '%s'", info.Uptime)
+	}
+	if !info.Leading || info.StartedAt == "" {
+		t.Errorf("Expected a leading registrar with its start time, got: %+v", info)
+	}
+	if info.BootID != ua.bootID {
+		t.Errorf("Expected the boot ID '%s', got: '%s'", ua.bootID, info.BootID)
+	}
+	if !slices.Contains(info.Capabilities, "wait") || !slices.Contains(info.Capabilities, "lookup") {
+		t.Errorf("Expected the optional features among the capabilities, got: %v", info.Capabilities)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "http://localhost/info", nil)
+	ua.Serving(w, r, "info")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected statuscode %d for a POST, got: %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestRegistrarEpoch(t *testing.T) {
+	// Each run of the registrar, e.g. after a restart, has a boot ID of its own
+	var bootIDs []string
+	for range 2 {
+		sys := createTestSystem()
+		temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+		bootIDs = append(bootIDs, temp.(*UnitAsset).bootID)
+		shutdown()
+	}
+	if bootIDs[0] == "" || bootIDs[0] == bootIDs[1] {
+		t.Fatalf("Expected a new boot ID with every start, got: %v", bootIDs)
+	}
+
+	ua := &UnitAsset{Traits: Traits{bootID: bootIDs[1], startedAt: time.Now()}}
+	w := httptest.NewRecorder()
+	ua.Serving(w, httptest.NewRequest(http.MethodGet, "http://localhost/epoch", nil), "epoch")
+	var epoch registrarEpochReply
+	if err := json.NewDecoder(w.Body).Decode(&epoch); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected statuscode %d with the epoch, got: %d (%v)", http.StatusOK, w.Code, err)
+	}
+	if epoch.BootID != ua.bootID || epoch.StartedAt == "" || w.Header().Get(bootIDHeader) != ua.bootID {
+		t.Errorf("Expected the boot ID '%s', got: %+v and header '%s'", ua.bootID, epoch, w.Header().Get(bootIDHeader))
+	}
+
+	// A provider polling with the boot ID it knows is told nothing changed
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/epoch", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	ua.Serving(w, r, "epoch")
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected statuscode %d for the current boot ID, got: %d", http.StatusNotModified, w.Code)
+	}
+	r.Header.Set("If-None-Match", `"`+bootIDs[0]+`"`)
+	w = httptest.NewRecorder()
+	ua.Serving(w, r, "epoch")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected statuscode %d for the boot ID of a former run, got: %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ua.Serving(w, httptest.NewRequest(http.MethodPost, "http://localhost/epoch", nil), "epoch")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected statuscode %d for a POST, got: %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// ----------------------------------------------- //
+// Help functions and structs to test stepDown()
+// ----------------------------------------------- //
+
+type stepDownParams struct {
+	method             string
+	token              string
+	authorization      string
+	leading            bool
+	expectedStatuscode int
+	expectedLeading    bool
+	testCase           string
+}
+
+func TestStepDown(t *testing.T) {
+	params := []stepDownParams{
+		{http.MethodPost, "secret", "Bearer secret", true, http.StatusOK, false, "Good case, leader steps down"},
+		{http.MethodPost, "secret", "Bearer wrong", true, http.StatusUnauthorized, true, "Bad case, wrong token"},
+		{http.MethodPost, "secret", "", true, http.StatusUnauthorized, true, "Bad case, no token"},
+		{http.MethodPost, "", "Bearer ", true, http.StatusForbidden, true, "Bad case, step-down not enabled"},
+		{http.MethodPost, "secret", "Bearer secret", false, http.StatusConflict, false, "Bad case, not leading"},
+		{http.MethodGet, "secret", "Bearer secret", true, http.StatusNotFound, true, "Bad case, unsupported method"},
+	}
+
+	for _, c := range params {
+		ua := createLeadingRegistrar()
+		ua.leading = c.leading
+		ua.StepDownToken = c.token
+		ua.StepDownCooldown = 60
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "http://localhost/stepdown", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		ua.Serving(w, r, "stepdown")
+
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+		}
+		if ua.leading != c.expectedLeading {
+			t.Errorf("Expected leading %v, got: %v in '%s'", c.expectedLeading, ua.leading, c.testCase)
+		}
+		suppressed := !ua.suppressedUntil.IsZero()
+		if suppressed != (c.expectedStatuscode == http.StatusOK) {
+			t.Errorf("Unexpected suppression until %s in '%s'", ua.suppressedUntil, c.testCase)
+		}
+	}
+}
+
+func TestElectAfterStepDown(t *testing.T) {
+	ua := createLeadingRegistrar()
+	ua.StepDownToken = "secret"
+	ua.StepDownCooldown = 60
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/stepdown", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	ua.stepDown(w, r)
+	steppedDown := time.Now()
+
+	// Without any leading peer, the registrar stays on standby during the cooldown window
+	for _, after := range []time.Duration{0, 5 * time.Second, 59 * time.Second} {
+		ua.elect(nil, steppedDown.Add(after))
+		if ua.leading {
+			t.Fatalf("Expected the registrar to stay on standby %s after stepping down", after)
+		}
+	}
+
+	// Once the cooldown elapsed, the normal election resumes
+	ua.elect(nil, steppedDown.Add(61*time.Second))
+	if !ua.leading {
+		t.Errorf("Expected the registrar to take the lead again after the cooldown")
+	}
+}
+
+func TestElectWithoutSuppression(t *testing.T) {
+	ua := createNonLeadingRegistrar()
+	ua.elect(nil, time.Now())
+	if !ua.leading || ua.leadingRegistrar != nil {
+		t.Errorf("Expected a registrar without peers to take the lead")
+	}
+}
+
+// --------------------------------------------------- //
+// Help functions and structs to test elect() priorities
+// --------------------------------------------------- //
+
+// newPeerRegistrar starts a fake registrar answering /status with the given role and advertised priority
+func newPeerRegistrar(leading bool, priority string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if priority != "" {
+			w.Header().Set(priorityHeader, priority)
+		}
+		if leading {
+			fmt.Fprint(w, "lead Service Registrar since now")
+			return
+		}
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}))
+}
+
+type electPriorityParams struct {
+	priority        int
+	leading         bool
+	peerLeading     bool
+	peerPriority    string
+	expectedLeading bool
+	testCase        string
+}
+
+func TestElectPriority(t *testing.T) {
+	params := []electPriorityParams{
+		{1, true, false, "5", false, "Good case, leader yields to a higher priority peer on standby"},
+		{5, true, false, "1", true, "Good case, leader keeps the lead over a lower priority peer"},
+		{1, false, false, "5", false, "Good case, standby waits for the higher priority peer to lead"},
+		{5, false, false, "1", true, "Good case, highest priority takes the lead"},
+		{5, false, true, "1", false, "Good case, higher priority waits for the lower priority leader to step down"},
+		{0, false, false, "", true, "Good case, peer without priority does not block the election"},
+		{0, false, false, "0", true, "Good case, equal priority keeps the first come behavior"},
+	}
+
+	for _, c := range params {
+		peer := newPeerRegistrar(c.peerLeading, c.peerPriority)
+		ua := createNonLeadingRegistrar()
+		ua.leading = c.leading
+		ua.leadingRegistrar = nil
+		ua.Priority = c.priority
+
+		ua.elect([]*components.CoreSystem{{Name: "serviceregistrar", Url: peer.URL}}, time.Now())
+
+		if ua.leading != c.expectedLeading {
+			t.Errorf("Expected leading %v, got: %v in '%s'", c.expectedLeading, ua.leading, c.testCase)
+		}
+		peer.Close()
+	}
+}
+
+func TestElectUnreachableHigherPeer(t *testing.T) {
+	// A higher priority peer that is down does not prevent the election
+	peer := newPeerRegistrar(false, "9")
+	down := peer.URL
+	peer.Close()
+	lower := newPeerRegistrar(false, "1")
+	defer lower.Close()
+
+	ua := createNonLeadingRegistrar()
+	ua.leadingRegistrar = nil
+	ua.Priority = 5
+	ua.elect([]*components.CoreSystem{{Url: down}, {Url: lower.URL}}, time.Now())
+	if !ua.leading {
+		t.Errorf("Expected the registrar to lead when the only higher priority peer is down")
+	}
+}
+
+func TestRoleStatusPriority(t *testing.T) {
+	ua := createLeadingRegistrar()
+	ua.Priority = 7
+	w := httptest.NewRecorder()
+	ua.roleStatus(w, httptest.NewRequest(http.MethodGet, "http://localhost/status", nil))
+	if got := w.Header().Get(priorityHeader); got != "7" {
+		t.Errorf("Expected advertised priority '7', got: '%s'", got)
+	}
+
+	// A registrar that stepped down is not waited for by its peers
+	ua.suppressedUntil = time.Now().Add(time.Minute)
+	w = httptest.NewRecorder()
+	ua.roleStatus(w, httptest.NewRequest(http.MethodGet, "http://localhost/status", nil))
+	if got := w.Header().Get(priorityHeader); got != "" {
+		t.Errorf("Expected no advertised priority during the cooldown, got: '%s'", got)
+	}
+}
+
+// ----------------------------------------------- //
+// Help functions and structs to test heartbeat()
+// ----------------------------------------------- //
+
+func TestHeartbeat(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	rec, err := sendKeyedAddRequest("", "flow", ua.requests)
+	if err != nil {
+		t.Fatalf("Expected no errors registering: %v", err)
+	}
+	id := strconv.Itoa(rec.Id)
+
+	table := []struct {
+		leading        bool
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		// Heartbeat of a registered record
+		{true, http.MethodPut, "/heartbeat/" + id, http.StatusNoContent},
+		// Heartbeat of an unknown record, the provider must register again
+		{true, http.MethodPut, "/heartbeat/999", http.StatusNotFound},
+		// Record ID that is not a number
+		{true, http.MethodPut, "/heartbeat/abc", http.StatusBadRequest},
+		// Unsupported method
+		{true, http.MethodGet, "/heartbeat/" + id, http.StatusNotFound},
+		// Registrar on standby
+		{false, http.MethodPut, "/heartbeat/" + id, http.StatusServiceUnavailable},
+	}
+	for _, test := range table {
+		ua.leading = test.leading
+		w := httptest.NewRecorder()
+		ua.Serving(w, httptest.NewRequest(test.method, "http://localhost"+test.path, nil), "heartbeat")
+		if w.Code != test.expectedStatus {
+			t.Errorf("Expected statuscode %d for %s %s, got: %d", test.expectedStatus, test.method, test.path, w.Code)
+		}
+	}
+}
+
+// ----------------------------------------------- //
+// Help functions and structs to test allowCORS()
+// ----------------------------------------------- //
+
+type allowCORSParams struct {
+	allowed            []string
+	method             string
+	origin             string
+	preflight          bool
+	expectedStatuscode int
+	expectedOrigin     string
+	testCase           string
+}
+
+func TestAllowCORS(t *testing.T) {
+	params := []allowCORSParams{
+		{nil, http.MethodGet, "https://admin.local", false, http.StatusOK, "", "Good case, CORS off by default"},
+		{[]string{"https://admin.local"}, http.MethodGet, "https://admin.local", false, http.StatusOK, "https://admin.local", "Good case, GET from an allowed origin"},
+		{[]string{"https://admin.local"}, http.MethodGet, "https://evil.example", false, http.StatusOK, "", "Bad case, GET from another origin"},
+		{[]string{"*"}, http.MethodGet, "https://admin.local", false, http.StatusOK, "https://admin.local", "Good case, any origin allowed"},
+		{[]string{"https://admin.local"}, http.MethodOptions, "https://admin.local", true, http.StatusNoContent, "https://admin.local", "Good case, preflight from an allowed origin"},
+		{[]string{"https://admin.local"}, http.MethodOptions, "https://evil.example", true, http.StatusMethodNotAllowed, "", "Bad case, preflight from another origin"},
+	}
+
+	for _, c := range params {
+		ua := createLeadingRegistrar()
+		ua.AllowedOrigins = c.allowed
+		ua.serviceRegistry = map[int]forms.ServiceRecord_v1{}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "http://localhost/syslist", nil)
+		r.Header.Set("Origin", c.origin)
+		if c.preflight {
+			r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		ua.systemList(w, r)
+
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != c.expectedOrigin {
+			t.Errorf("Expected allowed origin '%s', got: '%s' in '%s'", c.expectedOrigin, got, c.testCase)
+		}
+		if c.expectedStatuscode == http.StatusNoContent && w.Header().Get("Access-Control-Allow-Methods") != "GET, OPTIONS" {
+			t.Errorf("Expected the allowed methods in the preflight response in '%s'", c.testCase)
+		}
+	}
+}
+
+// -------------------------------------------------- //
+// Help functions and structs to test definitionList()
+// -------------------------------------------------- //
+
+func TestDefinitionList(t *testing.T) {
+	ua := createLeadingRegistrar()
+	ua.serviceRegistry = make(map[int]forms.ServiceRecord_v1)
+	for id, definition := range []string{"temperature", "pressure", "temperature", "flow", "temperature", "pressure"} {
+		ua.serviceRegistry[id+1] = forms.ServiceRecord_v1{Id: id + 1, ServiceDefinition: definition}
+	}
+
+	w := httptest.NewRecorder()
+	ua.Serving(w, httptest.NewRequest(http.MethodGet, "http://localhost/deflist", nil), "deflist")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected statuscode %d, got: %d", http.StatusOK, w.Code)
+	}
+	var definitions []definitionCount
+	if err := json.Unmarshal(w.Body.Bytes(), &definitions); err != nil {
+		t.Fatalf("Failed while unmarshalling definitions: %v", err)
+	}
+	expected := []definitionCount{{"flow", 1}, {"pressure", 2}, {"temperature", 3}}
+	if fmt.Sprint(definitions) != fmt.Sprint(expected) {
+		t.Errorf("Expected definitions %v, got: %v", expected, definitions)
+	}
+
+	// An empty registry gives an empty list
+	ua.serviceRegistry = make(map[int]forms.ServiceRecord_v1)
+	w = httptest.NewRecorder()
+	ua.Serving(w, httptest.NewRequest(http.MethodGet, "http://localhost/deflist", nil), "deflist")
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Errorf("Expected an empty list, got: %s", got)
+	}
+
+	w = httptest.NewRecorder()
+	ua.Serving(w, httptest.NewRequest(http.MethodPost, "http://localhost/deflist", nil), "deflist")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected statuscode %d for a POST, got: %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+// ------------------------------------------------ //
+// Help functions and structs to test nodeList()
+// ------------------------------------------------ //
+
+func TestNodeList(t *testing.T) {
+	ua := createLeadingRegistrar()
+	ua.serviceRegistry = make(map[int]forms.ServiceRecord_v1)
+	nodes := []string{"edge1", "edge2", "edge1", "", "edge1"}
+	systemNames := []string{"pump", "fan", "valve", "boiler", "pump"}
+	for id, node := range nodes {
+		ua.serviceRegistry[id+1] = forms.ServiceRecord_v1{Id: id + 1, SystemName: systemNames[id], ServiceNode: node}
+	}
+
+	w := httptest.NewRecorder()
+	ua.Serving(w, httptest.NewRequest(http.MethodGet, "http://localhost/nodelist", nil), "nodelist")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected statuscode %d, got: %d", http.StatusOK, w.Code)
+	}
+	var summaries []nodeSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+		t.Fatalf("Failed while unmarshalling nodes: %v", err)
+	}
+	expected := []nodeSummary{{"", 1, []string{"boiler"}}, {"edge1", 3, []string{"pump", "valve"}}, {"edge2", 1, []string{"fan"}}}
+	if fmt.Sprint(summaries) != fmt.Sprint(expected) {
+		t.Errorf("Expected nodes %v, got: %v", expected, summaries)
+	}
+
+	w = httptest.NewRecorder()
+	ua.Serving(w, httptest.NewRequest(http.MethodPost, "http://localhost/nodelist", nil), "nodelist")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected statuscode %d for a POST, got: %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+type lookupParams struct {
+	method             string
+	contentType        string
+	body               string
+	expectedStatuscode int
+	expectedIDs        []int
+	testCase           string
+}
+
+func TestLookupDB(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	var ids []int
+	for _, def := range []string{"flow", "level", "pressure"} {
+		rec := &forms.ServiceRecord_v1{ServiceDefinition: def, SystemName: "System", SubPath: def, RegLife: 30,
+			ProtoPort: map[string]int{"http": 1234}}
+		if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+			t.Fatalf("Unexpected error registering %s: %v", def, err)
+		}
+		ids = append(ids, rec.Id)
+	}
+	mixed := fmt.Sprintf("[%d, 999, %d, %d]", ids[2], ids[0], ids[2])
+
+	params := []lookupParams{
+		{http.MethodPost, "application/json", mixed, http.StatusOK, []int{ids[2], ids[0]}, "Good case, unknown and repeated IDs omitted"},
+		{http.MethodPost, "application/json", "[998, 999]", http.StatusOK, nil, "Good case, no known ID"},
+		{http.MethodPost, "application/json", `{"ids": [1]}`, http.StatusBadRequest, nil, "Bad case, body is not a list"},
+		{http.MethodPost, "text/plain", "[1]", http.StatusUnsupportedMediaType, nil, "Bad case, unsupported media type"},
+		{http.MethodGet, "", "", http.StatusMethodNotAllowed, nil, "Bad case, wrong method"},
+	}
+	for _, c := range params {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "http://localhost/lookup", strings.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		ua.Serving(w, r, "lookup")
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+			continue
+		}
+		if c.expectedStatuscode == http.StatusUnsupportedMediaType && !strings.Contains(w.Body.String(), "the accepted media types are application/json") {
+			t.Errorf("Expected the reply to name the accepted media types, got: %s in '%s'", w.Body.String(), c.testCase)
+		}
+		if c.expectedStatuscode != http.StatusOK {
+			continue
+		}
+		var list forms.ServiceRecordList_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed while unmarshalling the records: %v in '%s'", err, c.testCase)
+		}
+		var got []int
+		for _, rec := range list.List {
+			got = append(got, rec.Id)
+		}
+		if !slices.Equal(got, c.expectedIDs) {
+			t.Errorf("Expected records %v, got: %v in '%s'", c.expectedIDs, got, c.testCase)
+		}
+	}
+}
+
+type aliasParams struct {
+	method             string
+	query              string
+	expectedStatuscode int
+	testCase           string
+}
+
+func TestAliasLookup(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.leading = true
+
+	expected := []int{http.StatusOK, http.StatusConflict}
+	for i, def := range []string{"temperature", "humidity"} {
+		body := `{"definition": "` + def + `", "systemName": "System", "protoPort": {"http": 1234}, "registrationLife": 30, ` +
+			`"details": {"alias": ["kitchen-temp"]}, "version": "ServiceRecord_v1"}`
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/reg", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		ua.updateDB(w, r)
+		if w.Code != expected[i] {
+			t.Errorf("Expected statuscode %d registering %s, got: %d", expected[i], def, w.Code)
+		}
+	}
+
+	params := []aliasParams{
+		{http.MethodGet, "?name=kitchen-temp", http.StatusOK, "Good case, alias resolved"},
+		{http.MethodGet, "?name=garage-temp", http.StatusNotFound, "Bad case, unknown alias"},
+		{http.MethodGet, "", http.StatusBadRequest, "Bad case, missing alias"},
+		{http.MethodPost, "?name=kitchen-temp", http.StatusMethodNotAllowed, "Bad case, wrong method"},
+	}
+	for _, c := range params {
+		w := httptest.NewRecorder()
+		ua.Serving(w, httptest.NewRequest(c.method, "http://localhost/alias"+c.query, nil), "alias")
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+			continue
+		}
+		if c.expectedStatuscode != http.StatusOK {
+			continue
+		}
+		var rec forms.ServiceRecord_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil || rec.ServiceDefinition != "temperature" {
+			t.Errorf("Expected the temperature record, got: %s in '%s'", w.Body.String(), c.testCase)
+		}
+	}
+}
+
+func TestQueryDBNode(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	for i, node := range []string{"edge1", "edge2", "edge1"} {
+		rec := &forms.ServiceRecord_v1{
+			ServiceDefinition: "flow",
+			SystemName:        "System",
+			ServiceNode:       node,
+			ProtoPort:         map[string]int{"http": 8870},
+			SubPath:           "testPath" + strconv.Itoa(i),
+			RegLife:           25,
+			Version:           "ServiceRecord_v1",
+		}
+		if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+			t.Fatalf("Expected no errors registering the records: %v", err)
+		}
+	}
+
+	table := []struct {
+		node          string
+		expectedCount int
+	}{
+		// Without a node filter, every matching record is returned
+		{"", 3},
+		{"edge1", 2},
+		{"edge2", 1},
+		// An unknown node has no records
+		{"edge3", 0},
+	}
+	for _, test := range table {
+		quest := `{"serviceDefinition": "flow", "version":"ServiceQuest_v1"}`
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/query?node="+test.node, strings.NewReader(quest))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ua.queryDB(w, r)
+
+		var list forms.ServiceRecordList_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed while unmarshalling response: %v", err)
+		}
+		if len(list.List) != test.expectedCount {
+			t.Errorf("Expected %d service records for node '%s', got: %d", test.expectedCount, test.node, len(list.List))
+		}
+		for _, rec := range list.List {
+			if test.node != "" && rec.ServiceNode != test.node {
+				t.Errorf("Expected only records of node %s, got one of %s", test.node, rec.ServiceNode)
+			}
+		}
+	}
+}
+
+func TestQueryDBSubnet(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	for i, addresses := range [][]string{{"10.0.1.7"}, {"10.0.2.7"}, {"192.168.1.2", "10.0.1.8"}} {
+		rec := &forms.ServiceRecord_v1{
+			ServiceDefinition: "flow",
+			SystemName:        "System",
+			IPAddresses:       addresses,
+			ProtoPort:         map[string]int{"http": 8870},
+			SubPath:           "testPath" + strconv.Itoa(i),
+			RegLife:           25,
+			Version:           "ServiceRecord_v1",
+		}
+		if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+			t.Fatalf("Expected no errors registering the records: %v", err)
+		}
+	}
+
+	table := []struct {
+		subnet             string
+		expectedStatuscode int
+		expectedAddresses  []string
+	}{
+		// Without a subnet, every matching record is returned with all its addresses
+		{"", http.StatusOK, []string{"10.0.1.7", "10.0.2.7", "192.168.1.2", "10.0.1.8"}},
+		// Records out of the subnet are dropped and the others keep their reachable addresses
+		{"10.0.1.0/24", http.StatusOK, []string{"10.0.1.7", "10.0.1.8"}},
+		{"172.16.0.0/12", http.StatusOK, nil},
+		{"10.0.1.0", http.StatusBadRequest, nil},
+	}
+	for _, test := range table {
+		quest := `{"serviceDefinition": "flow", "version":"ServiceQuest_v1"}`
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/query?subnet="+url.QueryEscape(test.subnet), strings.NewReader(quest))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ua.queryDB(w, r)
+		if w.Code != test.expectedStatuscode {
+			t.Errorf("Expected statuscode %d for subnet '%s', got: %d", test.expectedStatuscode, test.subnet, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var list forms.ServiceRecordList_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed while unmarshalling response: %v", err)
+		}
+		var addresses []string
+		for _, rec := range list.List {
+			addresses = append(addresses, rec.IPAddresses...)
+		}
+		slices.Sort(addresses)
+		slices.Sort(test.expectedAddresses)
+		if !slices.Equal(addresses, test.expectedAddresses) {
+			t.Errorf("Expected the addresses %v for subnet '%s', got: %v", test.expectedAddresses, test.subnet, addresses)
+		}
+	}
+}
+
+// querySingle sends a single-provider quest for the flow and returns the reply
+func querySingle(ua *UnitAsset, flag string) *httptest.ResponseRecorder {
+	quest := `{"serviceDefinition": "flow", "version":"ServiceQuest_v1"}`
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/query?single="+flag, strings.NewReader(quest))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ua.queryDB(w, r)
+	return w
+}
+
+type queryDBSingleParams struct {
+	selection         string
+	expectedLocations []string // service URLs of the replies to successive quests
+	testCase          string
+}
+
+func TestQueryDBSingle(t *testing.T) {
+	params := []queryDBSingleParams{
+		{"", []string{"http://10.0.1.1:8870/System/flow1", "http://10.0.1.1:8870/System/flow1"}, "Good case, first provider"},
+		{"roundrobin", []string{"http://10.0.1.1:8870/System/flow1", "http://10.0.1.3:8870/System/flow3",
+			"http://10.0.1.1:8870/System/flow1"}, "Good case, round robin"},
+	}
+	for _, c := range params {
+		sys := createTestSystem()
+		confAsset := createConfAssetMultipleTraits()
+		confAsset.Traits = []json.RawMessage{json.RawMessage(`{"selection": "` + c.selection + `"}`)}
+		temp, shutdown := newTestResource(t, confAsset, &sys)
+		ua := temp.(*UnitAsset)
+		// the second record has no address and cannot be selected
+		for i, address := range []string{"10.0.1.1", "", "10.0.1.3"} {
+			rec := &forms.ServiceRecord_v1{
+				ServiceDefinition: "flow",
+				SystemName:        "System",
+				SubPath:           "flow" + strconv.Itoa(i+1),
+				ProtoPort:         map[string]int{"http": 8870},
+				RegLife:           25,
+				Version:           "ServiceRecord_v1",
+			}
+			if address != "" {
+				rec.IPAddresses = []string{address}
+			}
+			if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+				t.Fatalf("Expected no errors registering the records: %v", err)
+			}
+		}
+
+		for i, expected := range c.expectedLocations {
+			w := querySingle(ua, "true")
+			var sp forms.ServicePoint_v1
+			if err := json.Unmarshal(w.Body.Bytes(), &sp); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("Expected a service point, got: %d and %s in '%s'", w.Code, w.Body.String(), c.testCase)
+			}
+			if sp.Version != "ServicePoint_v1" || sp.ServiceDefinition != "flow" || sp.ProviderName != "System" || sp.ServLocation != expected {
+				t.Errorf("Expected the service point of %s for quest %d, got: %+v in '%s'", expected, i+1, sp, c.testCase)
+			}
+			if u, err := url.Parse(sp.ServLocation); err != nil || u.Host == "" {
+				t.Errorf("Expected a well-formed service URL, got: %s in '%s'", sp.ServLocation, c.testCase)
+			}
+		}
+		shutdown()
+	}
+
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	if w := querySingle(ua, "true"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected statuscode %d without any provider, got: %d", http.StatusNotFound, w.Code)
+	}
+	if w := querySingle(ua, "perhaps"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected statuscode %d for an invalid flag, got: %d", http.StatusBadRequest, w.Code)
+	}
+	var list forms.ServiceRecordList_v1
+	if w := querySingle(ua, "false"); json.Unmarshal(w.Body.Bytes(), &list) != nil || list.Version != "ServiceRecordList_v1" {
+		t.Errorf("Expected a list of records without the flag, got: %s", w.Body.String())
+	}
+}
+
+// questFrom sends the quest of the requester for the service definition
+func questFrom(ua *UnitAsset, requester, definition string) *httptest.ResponseRecorder {
+	quest := `{"requesterName": "` + requester + `", "serviceDefinition": "` + definition + `", "version":"ServiceQuest_v1"}`
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/query", strings.NewReader(quest))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ua.queryDB(w, r)
+	return w
+}
+
+type requesterListParams struct {
+	method             string
+	query              string
+	expectedStatuscode int
+	expectedNames      []string
+	testCase           string
+}
+
+func TestRequesterList(t *testing.T) {
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(`{"trackRequesters": 60}`)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	clock := useFakeClock(ua, time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC))
+
+	// The dashboard asks twice, the second time after the thermostat, and an anonymous quest is not recorded
+	for _, quest := range [][2]string{{"dashboard", "temperature"}, {"thermostat", "temperature"}, {"logger", "pressure"},
+		{"dashboard", "temperature"}, {"", "temperature"}} {
+		clock.Advance(time.Second)
+		if w := questFrom(ua, quest[0], quest[1]); w.Code != http.StatusOK {
+			t.Fatalf("Expected statuscode %d for the quest of %q, got: %d", http.StatusOK, quest[0], w.Code)
+		}
+	}
+
+	params := []requesterListParams{
+		{http.MethodGet, "?definition=temperature", http.StatusOK, []string{"dashboard", "thermostat"}, "Good case, most recent first"},
+		{http.MethodGet, "?definition=pressure", http.StatusOK, []string{"logger"}, "Good case, requesters kept per definition"},
+		{http.MethodGet, "?definition=flow", http.StatusOK, []string{}, "Good case, no requester"},
+		{http.MethodGet, "", http.StatusBadRequest, nil, "Bad case, missing definition"},
+		{http.MethodPost, "?definition=temperature", http.StatusMethodNotAllowed, nil, "Bad case, wrong method"},
+	}
+	for _, c := range params {
+		w := httptest.NewRecorder()
+		ua.Serving(w, httptest.NewRequest(c.method, "http://localhost/requesters"+c.query, nil), "requesters")
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+			continue
+		}
+		if c.expectedNames == nil {
+			continue
+		}
+		var requesters []requesterSeen
+		if err := json.Unmarshal(w.Body.Bytes(), &requesters); err != nil {
+			t.Fatalf("Failed while unmarshalling the requesters: %v in '%s'", err, c.testCase)
+		}
+		names := []string{}
+		for _, req := range requesters {
+			names = append(names, req.RequesterName)
+		}
+		if !slices.Equal(names, c.expectedNames) {
+			t.Errorf("Expected the requesters %v, got: %v in '%s'", c.expectedNames, names, c.testCase)
+		}
+	}
+	if got := ua.recentRequesters("temperature"); len(got) > 0 && !got[0].LastQuery.Equal(clock.Now().Add(-time.Second)) {
+		t.Errorf("Expected the last quest of the dashboard to be timestamped, got: %v", got[0].LastQuery)
+	}
+
+	// The thermostat goes quiet and is forgotten once the tracking window is over, while the dashboard keeps asking
+	clock.Advance(30 * time.Second)
+	questFrom(ua, "dashboard", "temperature")
+	clock.Advance(40 * time.Second)
+	if got := ua.recentRequesters("temperature"); len(got) != 1 || got[0].RequesterName != "dashboard" {
+		t.Errorf("Expected only the dashboard to be remembered, got: %v", got)
+	}
+	clock.Advance(time.Minute)
+	ua.mu.Lock()
+	remaining := len(ua.requesters)
+	ua.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected every requester to be forgotten, got: %d definitions", remaining)
+	}
+}
+
+func TestRequesterListNamespaces(t *testing.T) {
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(`{"trackRequesters": 60}`)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.Namespaces = namespacesFromClient
+
+	for client, requester := range map[string]string{"tenantA": "dashboard", "tenantB": "thermostat"} {
+		quest := `{"requesterName": "` + requester + `", "serviceDefinition": "temperature", "version":"ServiceQuest_v1"}`
+		if w := tenantRequest(ua, http.MethodPost, "query", quest, client); w.Code != http.StatusOK {
+			t.Fatalf("Expected statuscode %d for the quest of %s, got: %d", http.StatusOK, client, w.Code)
+		}
+	}
+
+	params := []requesterListParams{
+		{http.MethodGet, "?definition=temperature", http.StatusOK, []string{"dashboard"}, "Good case, the requesters of the own definition"},
+		{http.MethodGet, "?definition=tenantB/temperature", http.StatusOK, []string{}, "Bad case, the definition of another tenant"},
+	}
+	for _, c := range params {
+		w := tenantRequest(ua, c.method, "requesters"+c.query, "", "tenantA")
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+			continue
+		}
+		var requesters []requesterSeen
+		if err := json.Unmarshal(w.Body.Bytes(), &requesters); err != nil {
+			t.Fatalf("Failed while unmarshalling the requesters: %v in '%s'", err, c.testCase)
+		}
+		names := []string{}
+		for _, req := range requesters {
+			names = append(names, req.RequesterName)
+		}
+		if !slices.Equal(names, c.expectedNames) {
+			t.Errorf("Expected the requesters %v, got: %v in '%s'", c.expectedNames, names, c.testCase)
+		}
+	}
+	if w := tenantRequest(ua, http.MethodGet, "requesters?definition=temperature", "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected statuscode %d without a namespace, got: %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestNoteRequesterBounded(t *testing.T) {
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(`{"trackRequesters": 60}`)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	clock := useFakeClock(ua, time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC))
+
+	for i := 0; i <= maxRequesters; i++ {
+		clock.Advance(time.Millisecond)
+		ua.noteRequester("temperature", "consumer"+strconv.Itoa(i))
+	}
+	requesters := ua.recentRequesters("temperature")
+	if len(requesters) != maxRequesters {
+		t.Fatalf("Expected %d requesters, got: %d", maxRequesters, len(requesters))
+	}
+	if requesters[len(requesters)-1].RequesterName != "consumer1" {
+		t.Errorf("Expected the least recent requester to be dropped, got: %s last", requesters[len(requesters)-1].RequesterName)
+	}
+
+	// Without the trait nothing is recorded
+	ua.TrackRequesters = 0
+	ua.noteRequester("pressure", "logger")
+	if got := ua.recentRequesters("pressure"); len(got) != 0 {
+		t.Errorf("Expected no requester without the trait, got: %v", got)
+	}
+}
+
+func TestQueryDBMatch(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	registered := []map[string][]string{
+		{"Location": {"Kitchen"}},
+		{"Location": {"Kitchen", "Bathroom"}},
+		{"Location": {"Kitchen"}, "Unit": {"Celsius"}},
+		{},
+		{"Location": {"Bathroom"}},
+	}
+	for i, details := range registered {
+		rec := &forms.ServiceRecord_v1{
+			ServiceDefinition: "temperature",
+			SystemName:        "System",
+			ProtoPort:         map[string]int{"http": 8870},
+			SubPath:           "testPath" + strconv.Itoa(i),
+			Details:           details,
+			RegLife:           25,
+			Version:           "ServiceRecord_v1",
+		}
+		if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+			t.Fatalf("Expected no errors registering the records: %v", err)
+		}
+	}
+
+	table := []struct {
+		match         string
+		expectedPaths []string
+		expectedCode  int
+	}{
+		// Without a mode, the records having the queried values are returned
+		{"", []string{"testPath0", "testPath1", "testPath2"}, http.StatusOK},
+		{"subset", []string{"testPath0", "testPath1", "testPath2"}, http.StatusOK},
+		// Only the record with the very same details
+		{"exact", []string{"testPath0"}, http.StatusOK},
+		// The records whose details are all among the queried ones, including the record without details
+		{"superset", []string{"testPath0", "testPath3"}, http.StatusOK},
+		{"partial", nil, http.StatusBadRequest},
+	}
+	for _, test := range table {
+		quest := `{"serviceDefinition": "temperature", "details": {"Location": ["Kitchen"]}, "version":"ServiceQuest_v1"}`
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/query?match="+test.match, strings.NewReader(quest))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ua.queryDB(w, r)
+
+		if w.Code != test.expectedCode {
+			t.Errorf("Expected status %d for mode '%s', got: %d", test.expectedCode, test.match, w.Code)
+			continue
+		}
+		if test.expectedCode != http.StatusOK {
+			continue
+		}
+		var list forms.ServiceRecordList_v1
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed while unmarshalling response: %v", err)
+		}
+		var paths []string
+		for _, rec := range list.List {
+			paths = append(paths, rec.SubPath)
+		}
+		slices.Sort(paths)
+		if !slices.Equal(paths, test.expectedPaths) {
+			t.Errorf("Expected the records %v for mode '%s', got: %v", test.expectedPaths, test.match, paths)
+		}
+	}
+}
+
+type conditionalGetParams struct {
+	handler  func(ua *UnitAsset) http.HandlerFunc
+	path     string
+	testCase string
+}
+
+func TestConditionalGet(t *testing.T) {
+	params := []conditionalGetParams{
+		{func(ua *UnitAsset) http.HandlerFunc { return ua.queryDB }, "query", "Good case, HTML listing"},
+		{func(ua *UnitAsset) http.HandlerFunc { return ua.systemList }, "syslist", "Good case, system list"},
+		{func(ua *UnitAsset) http.HandlerFunc { return ua.definitionList }, "deflist", "Good case, definition list"},
+		{func(ua *UnitAsset) http.HandlerFunc { return ua.nodeList }, "nodelist", "Good case, node list"},
+	}
+	for _, c := range params {
+		sys := createTestSystem()
+		temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+		ua := temp.(*UnitAsset)
+		sendAddRequest(0, "test", "testPath", "", ua.requests)
+		get := func(etag string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/"+c.path, nil)
+			if etag != "" {
+				r.Header.Set("If-None-Match", etag)
+			}
+			c.handler(ua)(w, r)
+			return w
+		}
+
+		first := get("")
+		etag := first.Header().Get("ETag")
+		if first.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+			t.Errorf("Expected statuscode %d with a weak ETag, got: %d and '%s' in '%s'", http.StatusOK, first.Code, etag, c.testCase)
+		}
+		unchanged := get(etag)
+		if unchanged.Code != http.StatusNotModified || unchanged.Body.Len() != 0 {
+			t.Errorf("Expected statuscode %d without body on an unchanged registry, got: %d in '%s'",
+				http.StatusNotModified, unchanged.Code, c.testCase)
+		}
+
+		sendAddRequest(0, "other", "otherPath", "", ua.requests)
+		changed := get(etag)
+		if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+			t.Errorf("Expected statuscode %d with a new ETag after a registration, got: %d and '%s' in '%s'",
+				http.StatusOK, changed.Code, changed.Header().Get("ETag"), c.testCase)
+		}
+		sendKeyedDeleteRequest(1, "", ua.requests)
+		if deleted := get(changed.Header().Get("ETag")); deleted.Code != http.StatusOK {
+			t.Errorf("Expected statuscode %d after a deletion, got: %d in '%s'", http.StatusOK, deleted.Code, c.testCase)
+		}
+		shutdown()
+	}
+}
+
+func TestQueryDBHead(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	sendAddRequest(0, "test", "testPath", "", ua.requests)
+	request := func(method, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "http://localhost/query", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		ua.queryDB(w, r)
+		return w
+	}
+
+	get := request(http.MethodGet, "")
+	head := request(http.MethodHead, "")
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Errorf("Expected statuscode %d without body, got: %d and '%s'", http.StatusOK, head.Code, head.Body.String())
+	}
+	for _, header := range []string{"ETag", "Content-Type"} {
+		if head.Header().Get(header) == "" || head.Header().Get(header) != get.Header().Get(header) {
+			t.Errorf("Expected the %s header '%s' of the listing, got: '%s'", header, get.Header().Get(header), head.Header().Get(header))
+		}
+	}
+	if unchanged := request(http.MethodHead, head.Header().Get("ETag")); unchanged.Code != http.StatusNotModified {
+		t.Errorf("Expected statuscode %d on an unchanged registry, got: %d", http.StatusNotModified, unchanged.Code)
+	}
+}
+
+func TestQueryDBTracing(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	var out bytes.Buffer
+	ua.tracer = &tracer{out: &out}
+	sendAddRequest(0, "test", "testPath", "", ua.requests)
+
+	quest := `{"serviceDefinition": "test", "version":"ServiceQuest_v1"}`
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/query", strings.NewReader(quest))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	ua.queryDB(w, r)
+
+	spans := exportedSpans(t, &out)
+	if w.Code != http.StatusOK || len(spans) != 1 {
+		t.Fatalf("Expected statuscode %d and 1 exported span, got: %d and %v", http.StatusOK, w.Code, spans)
+	}
+	s := spans[0]
+	if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentID != "00f067aa0ba902b7" || s.Name != "query" {
+		t.Errorf("Expected the query span to continue the orchestrator's trace, got: %+v", s)
+	}
+	if s.Attributes["service.definition"] != "test" || s.Attributes["records"] != "1" || s.Attributes["request.id"] == "" {
+		t.Errorf("Expected the quest and its result on the span, got: %v", s.Attributes)
+	}
+}
+
+type etagMatchesParams struct {
+	ifNoneMatch string
+	expected    bool
+	testCase    string
+}
+
+func TestETagMatches(t *testing.T) {
+	params := []etagMatchesParams{
+		{`W/"1f-3"`, true, "Good case, same weak tag"},
+		{`"1f-3"`, true, "Good case, strong form of the tag"},
+		{`W/"1f-2", W/"1f-3"`, true, "Good case, tag among others"},
+		{`*`, true, "Good case, any tag"},
+		{`W/"1f-2"`, false, "Bad case, outdated tag"},
+		{``, false, "Bad case, no tag"},
+	}
+	for _, c := range params {
+		if got := etagMatches(c.ifNoneMatch, `W/"1f-3"`); got != c.expected {
+			t.Errorf("Expected %v, got: %v in '%s'", c.expected, got, c.testCase)
+		}
+	}
+}
+
+type recordsParams struct {
+	method             string
+	token              string
+	expectedStatuscode int
+	testCase           string
+}
+
+func TestRecordsAuthorization(t *testing.T) {
+	params := []recordsParams{
+		{http.MethodGet, "", http.StatusUnauthorized, "Bad case, no credentials"},
+		{http.MethodGet, "Bearer wrong", http.StatusUnauthorized, "Bad case, wrong token"},
+		{http.MethodPut, "Bearer secret", http.StatusNotFound, "Bad case, unsupported method"},
+		{http.MethodGet, "Bearer secret", http.StatusOK, "Good case, export with the admin token"},
+	}
+	ua := createFilledRegistrar()
+	ua.AdminToken = "secret"
+	for _, c := range params {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "http://localhost/records", nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", c.token)
+		}
+		ua.records(w, r)
+		if w.Code != c.expectedStatuscode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedStatuscode, w.Code, c.testCase)
+		}
+	}
+
+	// Without an admin token, the export and import are disabled
+	ua.AdminToken = ""
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/records", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	ua.records(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected statuscode %d without an admin token, got: %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestRecordsExportImport(t *testing.T) {
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(`{"adminToken": "secret"}`)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	source := temp.(*UnitAsset)
+	sendAddRequest(0, "temperature", "kitchen/temperature", "", source.requests)
+	sendAddRequest(0, "rotation", "kitchen/rotation", "", source.requests)
+
+	// Export the live registry
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/records", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	source.records(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected statuscode %d for the export, got: %d", http.StatusOK, w.Code)
+	}
+	dump := w.Body.Bytes()
+
+	// Import it into a fresh registrar
+	temp, shutdownTarget := newTestResource(t, confAsset, &sys)
+	defer shutdownTarget()
+	target := temp.(*UnitAsset)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "http://localhost/records", bytes.NewReader(dump))
+	r.Header.Set("Authorization", "Bearer secret")
+	target.records(w, r)
+	var result importResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected statuscode %d with an import result, got: %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if result.Imported != 2 || result.Failed != 0 {
+		t.Errorf("Expected 2 imported records and no failure, got: %+v", result)
+	}
+
+	// Both registrars offer the same services, with a validity recomputed by the import
+	exported, imported := source.exportRecords().List, target.exportRecords().List
+	if len(exported) != len(imported) {
+		t.Fatalf("Expected %d records after the import, got: %d", len(exported), len(imported))
+	}
+	for i := range exported {
+		want, got := exported[i], imported[i]
+		if got.ServiceDefinition != want.ServiceDefinition || got.SubPath != want.SubPath ||
+			got.SystemName != want.SystemName || !slices.Equal(got.IPAddresses, want.IPAddresses) {
+			t.Errorf("Expected the imported record %+v, got: %+v", want, got)
+		}
+		if _, err := time.Parse(time.RFC3339, got.EndOfValidity); err != nil {
+			t.Errorf("Expected a recomputed end of validity, got: '%s'", got.EndOfValidity)
+		}
+	}
+
+	// A body that is not a record list is refused
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "http://localhost/records", strings.NewReader(`{"version":"ServiceQuest_v1"}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	target.records(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected statuscode %d for another form, got: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// dumpRecord is a record of an exported registry with the definition and sub-path
+func dumpRecord(definition, subPath string) forms.ServiceRecord_v1 {
+	return forms.ServiceRecord_v1{
+		ServiceDefinition: definition,
+		SystemName:        "System",
+		SubPath:           subPath,
+		IPAddresses:       []string{"10.0.1.1"},
+		ProtoPort:         map[string]int{"http": 8870},
+		RegLife:           25,
+		Version:           "ServiceRecord_v1",
+	}
+}
+
+// importDump imports the records into a fresh registrar with the traits, returning the result and the records it holds
+func importDump(t *testing.T, traits string, records ...forms.ServiceRecord_v1) (importResult, []forms.ServiceRecord_v1) {
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(traits)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	dump, err := json.Marshal(forms.ServiceRecordList_v1{List: records, Version: "ServiceRecordList_v1"})
+	if err != nil {
+		t.Fatalf("Failed while marshalling the dump: %v", err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/records", bytes.NewReader(dump))
+	r.Header.Set("Authorization", "Bearer secret")
+	ua.records(w, r)
+	var result importResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected statuscode %d with an import result, got: %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	return result, ua.exportRecords().List
+}
+
+func TestRecordsImportPorts(t *testing.T) {
+	usable, unserved, outOfRange := dumpRecord("temperature", "temp"), dumpRecord("rotation", "rot"), dumpRecord("flow", "flow")
+	unserved.ProtoPort = map[string]int{"http": 0}
+	outOfRange.ProtoPort = map[string]int{"http": 8870, "coap": 70000}
+	result, records := importDump(t, `{"adminToken": "secret"}`, usable, unserved, outOfRange)
+	if result.Imported != 1 || result.Failed != 2 {
+		t.Errorf("Expected 1 imported record and 2 failures, got: %+v", result)
+	}
+	if len(records) != 1 || records[0].ServiceDefinition != "temperature" {
+		t.Errorf("Expected only the record with a usable port, got: %v", records)
+	}
+}
+
+func TestRecordsImportSubPaths(t *testing.T) {
+	result, records := importDump(t, `{"adminToken": "secret"}`,
+		dumpRecord("temperature", "/Kitchen//temp/"), dumpRecord("rotation", "/a b?x"), dumpRecord("flow", "../flow"))
+	if result.Imported != 1 || result.Failed != 2 {
+		t.Errorf("Expected 1 imported record and 2 failures, got: %+v", result)
+	}
+	if len(records) != 1 || records[0].SubPath != "Kitchen/temp" {
+		t.Errorf("Expected only the record with a valid sub-path, normalized, got: %v", records)
+	}
+}
+
+type importDefinitionsParams struct {
+	traits              string
+	dump                []forms.ServiceRecord_v1
+	expectedDefinitions []string
+	testCase            string
+}
+
+func TestRecordsImportDefinitions(t *testing.T) {
+	dump := []forms.ServiceRecord_v1{dumpRecord("temperature", "temp"), dumpRecord("rotation", "rot")}
+	params := []importDefinitionsParams{
+		{`{"adminToken": "secret"}`, dump, []string{"temperature", "rotation"}, "Good case, no restriction"},
+		{`{"adminToken": "secret", "rejectDefinitions": ["rotation"]}`, dump, []string{"temperature"}, "Bad case, rejected definition"},
+		{`{"adminToken": "secret", "acceptDefinitions": ["rotation"]}`, dump, []string{"rotation"}, "Bad case, definition not accepted"},
+		{`{"adminToken": "secret", "namespaces": "header", "acceptDefinitions": ["temperature"]}`,
+			[]forms.ServiceRecord_v1{dumpRecord("tenantA/temperature", "temp"), dumpRecord("tenantA/rotation", "rot")},
+			[]string{"tenantA/temperature"}, "Good case, namespaced definitions checked without their namespace"},
+	}
+	for _, c := range params {
+		result, records := importDump(t, c.traits, c.dump...)
+		if result.Imported != len(c.expectedDefinitions) || result.Failed != len(c.dump)-len(c.expectedDefinitions) {
+			t.Errorf("Expected %d imported records, got: %+v in '%s'", len(c.expectedDefinitions), result, c.testCase)
+		}
+		var definitions []string
+		for _, rec := range records {
+			definitions = append(definitions, rec.ServiceDefinition)
+		}
+		if !slices.Equal(definitions, c.expectedDefinitions) {
+			t.Errorf("Expected the definitions %v, got: %v in '%s'", c.expectedDefinitions, definitions, c.testCase)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+/*******************************************************************************
+ * Copyright (c) 2025 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of sources tracked before the full (idle) buckets are pruned
+const maxBuckets = 1024
+
+// rateLimiter holds a token bucket per source to protect the registry from providers stuck in a registration loop
+type rateLimiter struct {
+	rate    float64 // tokens refilled per second
+	burst   float64 // capacity of a bucket
+	buckets map[string]*bucket
+	mu      sync.Mutex
+}
+
+// bucket is the token count of a source at its last update
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter, or nil (i.e., no limit) if the rate is not positive
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow consumes a token from the source's bucket. If the bucket is empty, it returns false with the time until the next token
+func (rl *rateLimiter) allow(source string, now time.Time) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, exists := rl.buckets[source]
+	if !exists {
+		if len(rl.buckets) >= maxBuckets {
+			rl.prune(now)
+		}
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[source] = b
+	}
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune removes the buckets that have refilled, since those sources are back to their full allowance
+func (rl *rateLimiter) prune(now time.Time) {
+	for source, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, source)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*******************************************************************************
+ * Copyright (c) 2025 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// logLine is one structured log entry, as expected by log aggregators such as ELK or Loki
+type logLine struct {
+	Ts    string `json:"ts"`
+	Level string `json:"level"`
+	Sys   string `json:"sys"`
+	Msg   string `json:"msg"`
+}
+
+// jsonLogWriter turns every entry of the standard logger into a JSON line
+type jsonLogWriter struct {
+	out    io.Writer
+	system string
+	now    func() time.Time
+}
+
+// setLogFormat switches the standard logger to JSON lines when the LOG_FORMAT environment variable is "json",
+// keeping the usual text format otherwise
+func setLogFormat(system string) {
+	if !strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		return
+	}
+	log.SetFlags(0) // the timestamp is a field of the JSON line
+	log.SetOutput(&jsonLogWriter{out: os.Stderr, system: system, now: time.Now})
+}
+
+// Write formats one entry of the standard logger, which calls it once per entry
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	line, err := json.Marshal(logLine{
+		Ts:    w.now().UTC().Format(time.RFC3339Nano),
+		Level: logLevel(msg),
+		Sys:   w.system,
+		Msg:   msg,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logLevel infers the level of a free-form entry from its wording since the call sites do not state it
+func logLevel(msg string) string {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "error"), strings.Contains(lower, "fail"), strings.Contains(lower, "problem"):
+		return "error"
+	case strings.Contains(lower, "warning"):
+		return "warn"
+	default:
+		return "info"
+	}
+}
@@ -17,37 +17,131 @@
 package main
 
 import (
+	"math/rand/v2"
 	"sync"
 	"time"
 )
 
-// Scheduler struct type with the list and three channels
+// Scheduler struct type with the task map and, optionally, a bounded pool of workers for the fired jobs
 type Scheduler struct {
-	taskMap map[int]*time.Timer // list elements has id, timer
+	taskMap map[int]timer // list elements has id, timer
 	mu      sync.Mutex
+	clock   clock       // source of time of the timers
+	pooled  bool        // fired jobs wait in the queue for a worker instead of running in their own goroutine
+	queue   []firedTask // fired jobs not yet picked up by a worker
+	ready   *sync.Cond  // wakes up the workers when a job is queued or the scheduler stops
+	stopped bool
+}
+
+// firedTask is a job whose timer went off, kept with its timer to skip it if the task was removed or replaced in the meantime
+type firedTask struct {
+	id    int
+	timer timer
+	job   func()
 }
 
 // Returns a scheduler with an empty task map
 func NewScheduler() *Scheduler {
 	return &Scheduler{
-		taskMap: make(map[int]*time.Timer),
+		taskMap: make(map[int]timer),
 		mu:      sync.Mutex{},
+		clock:   realClock{},
 	}
 }
 
+// NewPooledScheduler returns a scheduler running at most workers jobs at a time, the other fired jobs being queued.
+// With no workers, it is the same as NewScheduler
+func NewPooledScheduler(workers int) *Scheduler {
+	s := NewScheduler()
+	if workers <= 0 {
+		return s
+	}
+	s.pooled = true
+	s.ready = sync.NewCond(&s.mu)
+	for range workers {
+		go s.work()
+	}
+	return s
+}
+
 // AddTask adds a task to the task map and starts a timer for its job, when timer is done it runs the job in a goroutine
-// It's up to the caller to ensure that the deadline is not before time.Now()
+// (or queues it for the worker pool)
+// It's up to the caller to ensure that the deadline is not before the scheduler clock's Now()
 func (s *Scheduler) AddTask(deadline time.Time, job func(), id int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	timer, exists := s.taskMap[id]
-	if exists {
-		timer.Stop()
+	if old, exists := s.taskMap[id]; exists {
+		old.Stop()
+	}
+	var t timer
+	fire := job
+	if s.pooled {
+		fire = func() {
+			s.mu.Lock() // also ensures that t is set
+			defer s.mu.Unlock()
+			if s.stopped {
+				return
+			}
+			s.queue = append(s.queue, firedTask{id: id, timer: t, job: job})
+			s.ready.Signal()
+		}
 	}
-	t := time.AfterFunc(time.Until(deadline), job)
+	t = s.clock.AfterFunc(deadline.Sub(s.clock.Now()), fire)
 	s.taskMap[id] = t
 }
 
+// AddTaskWithJitter is AddTask with the deadline pushed back by a random delay below jitter, which spreads out
+// the jobs of tasks added at the same instant. The job never runs before the deadline
+func (s *Scheduler) AddTaskWithJitter(deadline time.Time, jitter time.Duration, job func(), id int) {
+	s.AddTask(jittered(deadline, jitter), job, id)
+}
+
+// jittered returns the deadline delayed by a random duration in [0, jitter)
+func jittered(deadline time.Time, jitter time.Duration) time.Time {
+	if jitter <= 0 {
+		return deadline
+	}
+	return deadline.Add(rand.N(jitter))
+}
+
+// work runs the queued jobs one after the other until the scheduler stops
+func (s *Scheduler) work() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.queue) == 0 && !s.stopped {
+			s.ready.Wait()
+		}
+		if s.stopped {
+			return
+		}
+		task := s.queue[0]
+		s.queue[0] = firedTask{} // release the job
+		s.queue = s.queue[1:]
+		if s.taskMap[task.id] != task.timer {
+			continue // removed or replaced after its timer went off
+		}
+		s.mu.Unlock()
+		task.job()
+		s.mu.Lock()
+	}
+}
+
+// Reschedule moves the deadline of a pending task, keeping its job. It returns false if there is no such task
+// or if its job already ran (or was queued for the worker pool), in which case the task has to be added again.
+// The registration renewals do not use it: the task of a draining record runs its removal instead of the
+// expiration check, so a renewal replaces the job with AddTask rather than only moving its deadline
+func (s *Scheduler) Reschedule(id int, deadline time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, exists := s.taskMap[id]
+	if !exists || !t.Stop() {
+		return false
+	}
+	t.Reset(deadline.Sub(s.clock.Now()))
+	return true
+}
+
 // RemoveTask removes a scheduled job and deletes the task from the task map
 func (s *Scheduler) RemoveTask(id int) bool {
 	s.mu.Lock()
@@ -62,6 +156,7 @@ func (s *Scheduler) RemoveTask(id int) bool {
 }
 
 // Stop() loops through the task map and turns off the timer for each tasks job
+// The workers of a pooled scheduler end, dropping the queued jobs
 func (s *Scheduler) Stop() (counter int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -69,6 +164,11 @@ func (s *Scheduler) Stop() (counter int) {
 		timer.Stop()
 		counter++
 	}
-	s.taskMap = make(map[int]*time.Timer)
+	s.taskMap = make(map[int]timer)
+	if s.pooled {
+		s.stopped = true
+		s.queue = nil
+		s.ready.Broadcast()
+	}
 	return
 }
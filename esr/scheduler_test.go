@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -11,32 +13,32 @@ import (
 
 func TestAddTask(t *testing.T) {
 	sched := NewScheduler()
-	now := time.Now()
-	ch := make(chan int)
+	clock := newFakeClock(time.Now())
+	sched.clock = clock
+	now := clock.Now()
+	var ran []int
 
 	// case: ensure chrono order
-	sched.AddTask(now.Add(2*time.Second), func() { ch <- 0 }, 0)
-	sched.AddTask(now.Add(5*time.Millisecond), func() { ch <- 1 }, 1)
-	select {
-	case id := <-ch:
-		if id != 1 {
-			t.Errorf("Expected 1 from channel, got %d", id)
-		}
-	case <-time.After(50 * time.Millisecond):
-		t.Errorf("Chronological order test timed out")
+	sched.AddTask(now.Add(2*time.Second), func() { ran = append(ran, 0) }, 0)
+	sched.AddTask(now.Add(5*time.Millisecond), func() { ran = append(ran, 1) }, 1)
+	clock.Advance(5 * time.Millisecond)
+	if len(ran) != 1 || ran[0] != 1 {
+		t.Errorf("Expected only task 1 to run, got %v", ran)
+	}
+	clock.Advance(2 * time.Second)
+	if len(ran) != 2 || ran[1] != 0 {
+		t.Errorf("Expected task 0 to run in turn, got %v", ran)
 	}
 	sched.Stop()
 
 	// Case: ID is reused between tasks
-	sched.AddTask(now.Add(2*time.Second), func() { ch <- 0 }, 0)
-	sched.AddTask(now.Add(25*time.Millisecond), func() { ch <- 1 }, 0)
-	select {
-	case id := <-ch:
-		if id != 1 {
-			t.Errorf("Expected 1 from channel, got %d", id)
-		}
-	case <-time.After(50 * time.Millisecond):
-		t.Errorf("Duplicate ID test timed out")
+	ran = nil
+	now = clock.Now()
+	sched.AddTask(now.Add(2*time.Second), func() { ran = append(ran, 0) }, 0)
+	sched.AddTask(now.Add(25*time.Millisecond), func() { ran = append(ran, 1) }, 0)
+	clock.Advance(time.Minute)
+	if len(ran) != 1 || ran[0] != 1 {
+		t.Errorf("Expected only the replacing task to run, got %v", ran)
 	}
 	sched.Stop()
 }
@@ -65,6 +67,80 @@ func TestRemoveTask(t *testing.T) {
 	}
 }
 
+func TestReschedule(t *testing.T) {
+	sched := NewScheduler()
+	clock := newFakeClock(time.Now())
+	sched.clock = clock
+	now := clock.Now()
+	var ran []int
+
+	// Case: the deadline is pushed back, then brought forward
+	sched.AddTask(now.Add(2*time.Second), func() { ran = append(ran, 0) }, 0)
+	if !sched.Reschedule(0, now.Add(5*time.Second)) {
+		t.Errorf("Expected the pending task to be rescheduled")
+	}
+	clock.Advance(3 * time.Second)
+	if len(ran) != 0 {
+		t.Errorf("Expected the task not to run at its former deadline, got %v", ran)
+	}
+	clock.Advance(2 * time.Second)
+	if len(ran) != 1 {
+		t.Errorf("Expected the task to run once at its new deadline, got %v", ran)
+	}
+
+	now = clock.Now()
+	sched.AddTask(now.Add(time.Minute), func() { ran = append(ran, 1) }, 1)
+	sched.Reschedule(1, now.Add(time.Second))
+	clock.Advance(time.Second)
+	if len(ran) != 2 || ran[1] != 1 {
+		t.Errorf("Expected the task to run at its earlier deadline, got %v", ran)
+	}
+
+	// Case: the task already ran or doesn't exist
+	if sched.Reschedule(1, clock.Now().Add(time.Second)) {
+		t.Errorf("Expected a task that already ran not to be rescheduled")
+	}
+	if sched.Reschedule(7, clock.Now().Add(time.Second)) {
+		t.Errorf("Expected an unknown task not to be rescheduled")
+	}
+	clock.Advance(time.Minute)
+	if len(ran) != 2 {
+		t.Errorf("Expected no job to run again, got %v", ran)
+	}
+	sched.Stop()
+}
+
+func TestRescheduleConcurrently(t *testing.T) {
+	sched := NewScheduler()
+	clock := newFakeClock(time.Now())
+	sched.clock = clock
+	defer sched.Stop()
+	now := clock.Now()
+	var runs atomic.Int32
+	sched.AddTask(now.Add(time.Hour), func() { runs.Add(1) }, 0)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !sched.Reschedule(0, now.Add(time.Duration(i+1)*time.Second)) {
+				t.Errorf("Expected the pending task to be rescheduled")
+			}
+		}()
+	}
+	wg.Wait()
+	// The fake clock runs the due jobs before Advance returns
+	clock.Advance(8 * time.Second)
+	if got := runs.Load(); got != 1 {
+		t.Errorf("Expected the job to run once, got %d", got)
+	}
+	clock.Advance(time.Hour)
+	if got := runs.Load(); got != 1 {
+		t.Errorf("Expected the job not to run at its former deadline, got %d runs", got)
+	}
+}
+
 func TestStop(t *testing.T) {
 	sched := NewScheduler()
 	now := time.Now()
@@ -80,3 +156,142 @@ func TestStop(t *testing.T) {
 		t.Errorf("Expected scheduler to turn off 4 tasks, got %d", count)
 	}
 }
+
+func TestPooledSchedulerConcurrency(t *testing.T) {
+	const workers = 3
+	const jobs = 200
+	sched := NewPooledScheduler(workers)
+	defer sched.Stop()
+	clock := newFakeClock(time.Now())
+	sched.clock = clock
+
+	var running, maxRunning, done atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(jobs)
+	deadline := clock.Now().Add(10 * time.Millisecond) // all the timers fire at once
+	for i := range jobs {
+		sched.AddTask(deadline, func() {
+			defer wg.Done()
+			n := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+			done.Add(1)
+		}, i)
+	}
+	clock.Advance(10 * time.Millisecond)
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected all jobs to run, %d did", done.Load())
+	}
+	if peak := maxRunning.Load(); peak > workers {
+		t.Errorf("Expected at most %d jobs running at once, got %d", workers, peak)
+	}
+}
+
+func TestPooledSchedulerRemoveQueued(t *testing.T) {
+	sched := NewPooledScheduler(1)
+	defer sched.Stop()
+	clock := newFakeClock(time.Now())
+	sched.clock = clock
+	now := clock.Now()
+
+	// The only worker is kept busy so that the next jobs are queued
+	release := make(chan struct{})
+	ch := make(chan int, 3)
+	sched.AddTask(now.Add(5*time.Millisecond), func() { <-release; ch <- 0 }, 0)
+	sched.AddTask(now.Add(10*time.Millisecond), func() { ch <- 1 }, 1)
+	sched.AddTask(now.Add(10*time.Millisecond), func() { ch <- 2 }, 2)
+	clock.Advance(10 * time.Millisecond)
+
+	// Case: a queued job whose task is removed is skipped
+	sched.RemoveTask(1)
+	close(release)
+
+	var ran []int
+	timeout := time.After(time.Second)
+	for len(ran) < 2 {
+		select {
+		case id := <-ch:
+			ran = append(ran, id)
+		case <-timeout:
+			t.Fatalf("Expected jobs 0 and 2 to run, got %v", ran)
+		}
+	}
+	if ran[0] != 0 || ran[1] != 2 {
+		t.Errorf("Expected jobs 0 and 2 to run in order, got %v", ran)
+	}
+}
+
+func TestPooledSchedulerStop(t *testing.T) {
+	sched := NewPooledScheduler(2)
+	clock := newFakeClock(time.Now())
+	sched.clock = clock
+	ch := make(chan int, 1)
+	sched.AddTask(clock.Now().Add(10*time.Millisecond), func() { ch <- 0 }, 0)
+
+	if count := sched.Stop(); count != 1 {
+		t.Errorf("Expected scheduler to turn off 1 task, got %d", count)
+	}
+	clock.Advance(time.Second)
+	sched.mu.Lock()
+	queued := len(sched.queue)
+	sched.mu.Unlock()
+	if queued != 0 || len(ch) != 0 {
+		t.Errorf("Expected no job to run after Stop()")
+	}
+}
+
+func TestJittered(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	jitter := 500 * time.Millisecond
+
+	// Case: jittered deadlines fall within [deadline, deadline+jitter) and are spread out
+	seen := make(map[time.Time]bool)
+	for range 1000 {
+		d := jittered(deadline, jitter)
+		if d.Before(deadline) || !d.Before(deadline.Add(jitter)) {
+			t.Fatalf("Expected a deadline within [%s, %s), got %s", deadline, deadline.Add(jitter), d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected the jittered deadlines to differ")
+	}
+
+	// Case: no jitter keeps the deadline
+	if d := jittered(deadline, 0); !d.Equal(deadline) {
+		t.Errorf("Expected the deadline %s without jitter, got %s", deadline, d)
+	}
+}
+
+func TestAddTaskWithJitter(t *testing.T) {
+	sched := NewScheduler()
+	defer sched.Stop()
+	clock := newFakeClock(time.Now())
+	sched.clock = clock
+	deadline := clock.Now().Add(20 * time.Millisecond)
+	var fired []time.Time
+	sched.AddTaskWithJitter(deadline, 30*time.Millisecond, func() { fired = append(fired, clock.Now()) }, 0)
+
+	clock.Advance(20*time.Millisecond - time.Nanosecond)
+	if len(fired) != 0 {
+		t.Errorf("Expected the job not to run before its deadline, it ran %v early", deadline.Sub(fired[0]))
+	}
+	clock.Advance(30 * time.Millisecond)
+	if len(fired) != 1 {
+		t.Errorf("Expected the jittered job to run once within the jitter, it ran %d times", len(fired))
+	}
+}
@@ -17,15 +17,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/sdoque/mbaigo/components"
 	"github.com/sdoque/mbaigo/forms"
@@ -34,25 +44,88 @@ import (
 
 // Define the types of requests the serviceRegistry manager can handle
 type ServiceRegistryRequest struct {
-	Action string
-	Record forms.Form
-	Id     int64
-	Result chan []forms.ServiceRecord_v1 // For returning records
-	Error  chan error
+	Action     string
+	Record     forms.Form
+	Id         int64
+	Key        string                        // Registration key mapping the record to a stable ID
+	Fresh      time.Duration                 // if positive, only records heard from within this window are read
+	Window     registrationWindow            // only records created or updated after these times are read
+	Node       string                        // if not empty, only records of this service node are read
+	Subnet     *net.IPNet                    // if not nil, only records with an address within this subnet are read
+	Match      matchMode                     // how the details of the quest are matched against those of the records
+	IDs        []int                         // IDs of the records looked up
+	RequestID  string                        // Correlation ID of the originating HTTP request
+	Registrant string                        // verified identity of the client that sent the request, empty without a client certificate
+	Result     chan []forms.ServiceRecord_v1 // For returning records
+	Error      chan error
 }
 
 // -------------------------------------Define the unit asset
 // Traits are Asset-specific configurable parameters and variables
 type Traits struct {
+	RegistrationRate  float64  `json:"registrationRate"`  // registrations per second allowed per source (0 disables the limit)
+	RegistrationBurst int      `json:"registrationBurst"` // registrations a source may send in a burst
+	IndexedDetails    []string `json:"indexedDetails"`    // detail keys indexed for fast filtering (e.g., "Location")
+	StableIDs         bool     `json:"stableIDs"`         // derive a registration key for providers that do not send one
+	StepDownToken     string   `json:"stepDownToken"`     // bearer token authorizing a leadership step-down (empty disables it)
+	AdminToken        string   `json:"adminToken"`        // bearer token authorizing the export and import of the records (empty disables them)
+	StepDownCooldown  int      `json:"stepDownCooldown"`  // seconds a registrar that stepped down stays on standby
+	Priority          int      `json:"priority"`          // election priority, the highest reachable registrar leads
+	AllowedOrigins    []string `json:"allowedOrigins"`    // browser origins allowed to call the read endpoints (e.g., "https://admin.local" or "*")
+	ExpiryWorkers     int      `json:"expiryWorkers"`     // expiration checks run at once, the others are queued (0 runs each in its own goroutine)
+	ExpiryJitter      int      `json:"expiryJitter"`      // milliseconds by which expiration checks are at most randomly delayed (0 disables it)
+	MaxBodySize       int      `json:"maxBodySize"`       // largest request body accepted in bytes (0 accepts up to 1 MiB)
+	MaxRecords        int      `json:"maxRecords"`        // records the registry holds at most (0 disables the limit)
+	CapacityPolicy    string   `json:"capacityPolicy"`    // at capacity, "reject" new registrations or "evict" the record nearest to expiry
+	QueryTimeout      int      `json:"queryTimeout"`      // milliseconds a query waits for the registry before answering 504 (0 waits 5 s)
+	DrainWindow       int      `json:"drainWindow"`       // milliseconds an unregistered record is kept as draining before its removal (0 removes it at once)
+	MediaTypes        []string `json:"mediaTypes"`        // media types accepted for the forms, application/json and/or application/xml (empty accepts application/json)
+	TraceExporter     string   `json:"traceExporter"`     // exporter of the query spans, "console" or "none" (empty follows OTEL_TRACES_EXPORTER)
+	PromoteOnStartup  string   `json:"promoteOnStartup"`  // at startup, "solo" takes the lead at once when no peer registrar is configured and "force" always does (empty waits for the election)
+	FoldDetails       bool     `json:"foldDetails"`       // compare the detail values regardless of case and surrounding whitespace (false compares them exactly)
+	Identity          []string `json:"identity"`          // record fields from which stableIDs derives the key, e.g. "systemName", "definition" or "details.Location" (empty uses systemName, definition and subpath)
+	Namespaces        string   `json:"namespaces"`        // tenant namespace prefixed to the definitions, named by the "client" certificate or a "header" (empty leaves them unscoped)
+	StreamListings    bool     `json:"streamListings"`    // write the JSON replies to the quests one record at a time instead of packing them at once
+	AcceptDefinitions []string `json:"acceptDefinitions"` // service definitions the registrar accepts registrations for (empty accepts any)
+	RejectDefinitions []string `json:"rejectDefinitions"` // service definitions whose registrations are refused, even if accepted otherwise
+	Selection         string   `json:"selection"`         // provider answering the single-provider quests, the "first" registered or in "roundrobin" (empty selects the first)
+	AnnounceTimeout   int      `json:"announceTimeout"`   // milliseconds the registrar waits for a newly registered service to answer its announcement (0 disables the announcements)
+	IdempotencyWindow int      `json:"idempotencyWindow"` // seconds the reply to a registration sent with an Idempotency-Key is replayed to its retries (0 replays it for 60 s)
+	TrackRequesters   int      `json:"trackRequesters"`   // seconds the requesters of each service definition are remembered for the requesters lookup (0 does not record them)
+
 	serviceRegistry map[int]forms.ServiceRecord_v1
 
 	recCount int64
 	requests chan ServiceRegistryRequest
 	// Error            chan error // For error handling
 	sched            *Scheduler
+	clock            clock   // source of time of the registry and its scheduler
+	tracer           *tracer // exporter of the query spans, nil when tracing is off
 	leading          bool
 	leadingSince     time.Time
 	leadingRegistrar *components.CoreSystem // if not leading this points to the current leader
+	startedAt        time.Time              // time at which the registrar was started, for its uptime
+	bootID           string                 // random identifier of this run of the registrar, changing with every restart
+	ledFor           time.Duration          // time spent leading in the terms that ended, for the shutdown summary
+	registrations    uint64                 // successful registrations and renewals since the start
+	suppressedUntil  time.Time              // after a step-down, the registrar does not take the lead before this time
+	limiter          *rateLimiter           // registration rate limiter per source
+	detailIndex      detailIndex            // record IDs per value of the indexed detail keys
+	keyIDs           map[string]int         // stable record ID per registration key
+	idKeys           map[int]string         // registration key per reserved record ID
+	lastSeen         map[int]time.Time      // last registration or heartbeat per record ID
+	aliasIDs         map[string]int         // record ID per alias of the registered services
+	announcer        *http.Client           // client of the announcements, http.DefaultClient when nil
+	rotation         map[string]int         // turn of the round robin selection per service definition
+	revision         uint64                 // incremented whenever a record is added, updated or removed
+	// long-polling queries waiting for a matching record (only accessed by the registry handler)
+	waiters map[chan []forms.ServiceRecord_v1]waiter
+	// replies to the recent keyed registrations, forgotten by cleanup tasks
+	idempotent map[idempotencyKey]idempotentReply
+	// recent requesters per service definition, forgotten by cleanup tasks
+	requesters map[string]map[string]requester
+	// count of the cleanup tasks, which are numbered below the record IDs
+	cleanupTasks int
 }
 
 // UnitAsset type models the unit asset (interface) of the system
@@ -111,14 +184,21 @@ func initTemplate() components.UnitAsset {
 		Definition:  "query",
 		SubPath:     "query",
 		Details:     map[string][]string{"Forms": usecases.ServQuestForms()},
-		Description: "retrieves all currently available services using a GET request [accessed via a browser by a deployment technician] or retrieves a specific set of services using a POST request with a payload [initiated by the Orchestrator]",
+		Description: "retrieves all currently available services using a GET request [accessed via a browser by a deployment technician] or retrieves a specific set of services using a POST request with a payload [initiated by the Orchestrator], optionally waiting for a provider to appear (e.g., ?wait=10s)",
 	}
 
 	unregisterService := components.Service{
 		Definition:  "unregister",
 		SubPath:     "unregister",
 		Details:     map[string][]string{"Forms": {"ID_only"}},
-		Description: "removes a record (DELETE) based on record ID",
+		Description: "removes a record (DELETE) based on record ID or on its registration key (e.g., ?key=...)",
+	}
+
+	heartbeatService := components.Service{
+		Definition:  "heartbeat",
+		SubPath:     "heartbeat",
+		Details:     map[string][]string{"Forms": {"ID_only"}},
+		Description: "notes (PUT) that the provider of a record is alive without extending its registration life",
 	}
 
 	statusService := components.Service{
@@ -128,14 +208,30 @@ func initTemplate() components.UnitAsset {
 		Description: "reports (GET) the role of the Service Registrar as leading or on stand by",
 	}
 
+	assetTraits := Traits{
+		RegistrationRate:  10,
+		RegistrationBurst: 100,
+		IndexedDetails:    []string{},
+		StepDownCooldown:  30,
+		AllowedOrigins:    []string{},
+		ExpiryWorkers:     8,
+		ExpiryJitter:      1000,
+		MaxBodySize:       defaultMaxBodySize,
+		MaxRecords:        10000,
+		CapacityPolicy:    capacityReject,
+		QueryTimeout:      int(defaultQueryTimeout / time.Millisecond),
+	}
+
 	// Create the UnitAsset with the defined services
 	uat := &UnitAsset{
 		Name:    "registry",
 		Details: map[string][]string{"Type": {"ephemeral"}},
+		Traits:  assetTraits,
 		ServicesMap: components.Services{
 			registerService.SubPath:   &registerService,
 			queryService.SubPath:      &queryService,
 			unregisterService.SubPath: &unregisterService,
+			heartbeatService.SubPath:  &heartbeatService,
 			statusService.SubPath:     &statusService,
 		},
 	}
@@ -145,10 +241,7 @@ func initTemplate() components.UnitAsset {
 //-------------------------------------Instantiate unit asset(s) based on configuration
 
 // newResource creates the unit asset with its pointers and channels based on the configuration using the uaConfig structs
-func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.System) (components.UnitAsset, func()) {
-	// Start the registration expiration check scheduler
-	cleaningScheduler := NewScheduler()
-
+func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.System) (components.UnitAsset, func(), error) {
 	// Initialize the UnitAsset
 	ua := &UnitAsset{
 		Name:        configuredAsset.Name,
@@ -159,23 +252,44 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 
 	traits, err := UnmarshalTraits(configuredAsset.Traits)
 	if err != nil {
-		log.Println("Warning: could not unmarshal traits:", err)
-	} else if len(traits) > 0 {
+		return nil, nil, err
+	}
+	if len(traits) > 0 {
 		ua.Traits = traits[0] // or handle multiple traits if needed
 	}
-
-	assetTraits := Traits{
-		serviceRegistry: make(map[int]forms.ServiceRecord_v1),
-		recCount:        1, // 0 is used for non registered services
-		sched:           cleaningScheduler,
-		requests:        make(chan ServiceRegistryRequest), // Initialize the requests channel
-		// Error:           make(chan error),                  // Initialize the error channel
+	if err := ua.Traits.validate(); err != nil {
+		return nil, nil, err
 	}
+	peers, err := peersList(sys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("peer registrar: %w", err)
+	}
+
+	// Start the registration expiration check scheduler
+	ua.clock = realClock{}
+	cleaningScheduler := NewPooledScheduler(ua.ExpiryWorkers)
+	cleaningScheduler.clock = ua.clock
 
-	ua.Traits = assetTraits // Assign the traits to the UnitAsset
+	// Initialize the runtime traits, keeping the configured ones
+	ua.serviceRegistry = make(map[int]forms.ServiceRecord_v1)
+	ua.recCount = 1 // 0 is used for non registered services
+	ua.sched = cleaningScheduler
+	ua.requests = make(chan ServiceRegistryRequest) // Initialize the requests channel
+	ua.waiters = make(map[chan []forms.ServiceRecord_v1]waiter)
+	ua.limiter = newRateLimiter(ua.RegistrationRate, ua.RegistrationBurst)
+	checkMediaTypes(ua.MediaTypes)
+	ua.tracer = newTracer(ua.TraceExporter)
+	ua.detailIndex = newDetailIndex(ua.IndexedDetails)
+	ua.keyIDs = make(map[string]int)
+	ua.idKeys = make(map[int]string)
+	ua.lastSeen = make(map[int]time.Time)
+	ua.aliasIDs = make(map[string]int)
+	ua.idempotent = make(map[idempotencyKey]idempotentReply)
+	ua.startedAt = ua.now()
+	ua.bootID = newBootID(ua.startedAt)
 
 	// Start to repeatedly check which is the leading registrar
-	ua.Role()
+	ua.Role(peers)
 
 	// Start the service registry manager goroutine
 	go ua.serviceRegistryHandler()
@@ -186,22 +300,72 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 		cleaningScheduler.Stop() // Gracefully stop the scheduler
 		ua.mu.Unlock()
 		log.Println("Closing the service registry database connection")
-	}
+	}, nil
 }
 
 // UnmarshalTraits unmarshals a slice of json.RawMessage into a slice of Traits.
+// An unknown trait is refused, so that a misspelled one does not silently keep its default.
 func UnmarshalTraits(rawTraits []json.RawMessage) ([]Traits, error) {
 	var traitsList []Traits
 	for _, raw := range rawTraits {
 		var t Traits
-		if err := json.Unmarshal(raw, &t); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal trait: %w", err)
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&t); err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadTraits, err)
 		}
 		traitsList = append(traitsList, t)
 	}
 	return traitsList, nil
 }
 
+// errBadTraits is returned when the configured traits would leave the registrar in a confusing state
+var errBadTraits = errors.New("invalid registrar traits")
+
+// validate checks the configured traits before the registrar starts with them
+func (t Traits) validate() error {
+	switch t.CapacityPolicy {
+	case "", capacityReject, capacityEvict:
+	default:
+		return fmt.Errorf("%w: unknown capacity policy %q, expected %q or %q", errBadTraits, t.CapacityPolicy, capacityReject, capacityEvict)
+	}
+	switch t.PromoteOnStartup {
+	case "", promoteSolo, promoteForce:
+	default:
+		return fmt.Errorf("%w: unknown startup promotion %q, expected %q or %q", errBadTraits, t.PromoteOnStartup, promoteSolo, promoteForce)
+	}
+	switch t.Selection {
+	case "", selectFirst, selectRoundRobin:
+	default:
+		return fmt.Errorf("%w: unknown selection %q, expected %q or %q", errBadTraits, t.Selection, selectFirst, selectRoundRobin)
+	}
+	switch t.Namespaces {
+	case "", namespacesFromClient, namespacesFromHeader:
+	default:
+		return fmt.Errorf("%w: unknown namespace source %q, expected %q or %q", errBadTraits, t.Namespaces, namespacesFromClient, namespacesFromHeader)
+	}
+	if err := checkIdentity(t.Identity); err != nil {
+		return fmt.Errorf("%w: %w", errBadTraits, err)
+	}
+	counts := []struct {
+		name  string
+		value float64
+	}{
+		{"registrationRate", t.RegistrationRate}, {"registrationBurst", float64(t.RegistrationBurst)},
+		{"stepDownCooldown", float64(t.StepDownCooldown)}, {"expiryWorkers", float64(t.ExpiryWorkers)},
+		{"expiryJitter", float64(t.ExpiryJitter)}, {"maxBodySize", float64(t.MaxBodySize)},
+		{"maxRecords", float64(t.MaxRecords)}, {"queryTimeout", float64(t.QueryTimeout)},
+		{"drainWindow", float64(t.DrainWindow)}, {"idempotencyWindow", float64(t.IdempotencyWindow)},
+		{"announceTimeout", float64(t.AnnounceTimeout)}, {"trackRequesters", float64(t.TrackRequesters)},
+	}
+	for _, count := range counts {
+		if count.value < 0 {
+			return fmt.Errorf("%w: %s cannot be negative, got %v", errBadTraits, count.name, count.value)
+		}
+	}
+	return nil
+}
+
 //-------------------------------------Unit's resource methods
 
 // There are really two assets here: the database  and the scheduler
@@ -210,78 +374,71 @@ func UnmarshalTraits(rawTraits []json.RawMessage) ([]Traits, error) {
 // ServiceRegistryManager manages all service registry operations via channels
 func (ua *UnitAsset) serviceRegistryHandler() {
 	for request := range ua.requests {
-		now := time.Now()
+		now := ua.now()
 		switch request.Action {
 		case "add":
 			rec, ok := request.Record.(*forms.ServiceRecord_v1)
 			if !ok {
-				fmt.Println("Problem unpacking the service registration request")
+				log.Printf("[%s] Problem unpacking the service registration request", request.RequestID)
 				request.Error <- fmt.Errorf("invalid record type")
 				continue
 			}
-			ua.mu.Lock() // Lock the serviceRegistry map
-
-			// Check if the ID exists in the serviceRegistry
-			if _, exists := ua.serviceRegistry[rec.Id]; !exists {
-				rec.Id = 0
+			// checked here rather than by the callers, so that the imported records are held to the same rules
+			if err := ua.checkDefinition(rec.ServiceDefinition); err != nil {
+				request.Error <- err
+				continue
 			}
+			if err := checkPorts(*rec); err != nil {
+				request.Error <- err
+				continue
+			}
+			if err := normalizeSubPath(rec); err != nil {
+				request.Error <- err
+				continue
+			}
+			ua.mu.Lock() // Lock the serviceRegistry map
 
-			if rec.Id == 0 {
-				// In the case recCount had looped, check that there is no record at that position
-				for {
-					currentCount := atomic.LoadInt64(&ua.recCount)
-					_, exists := ua.serviceRegistry[int(currentCount)]
-					if !exists {
-						atomic.StoreInt64(&ua.recCount, currentCount)
-						rec.Id = int(currentCount)
-						break
-					}
-					atomic.AddInt64(&ua.recCount, 1)
-				}
-
-				// Update the record
-				rec.Id = int(ua.recCount)
-				rec.Created = now.Format(time.RFC3339)
-				rec.Updated = now.Format(time.RFC3339)
-				rec.EndOfValidity = now.Add(time.Duration(rec.RegLife) * time.Second).Format(time.RFC3339)
-				log.Printf("The new service %s from system %s has been registered\n", rec.ServiceDefinition, rec.SystemName)
-			} else {
-				// Validate and update existing record
-				dbRec := ua.serviceRegistry[rec.Id]
-				if dbRec.ServiceDefinition != rec.ServiceDefinition {
-					request.Error <- errors.New("mismatch between definition received record and database record")
-					ua.mu.Unlock()
-					continue
-				}
-				if dbRec.SubPath != rec.SubPath {
-					request.Error <- errors.New("mismatch between path received record and database record")
-					ua.mu.Unlock()
-					continue
-				}
-				recCreated, err := time.Parse(time.RFC3339, rec.Created)
-				if err != nil {
-					request.Error <- errors.New("time parsing problem with updated record")
-					ua.mu.Unlock()
-					continue
-				}
-				dbCreated, err := time.Parse(time.RFC3339, dbRec.Created)
-				if err != nil {
-					request.Error <- errors.New("time parsing problem with archived record")
+			key := ua.registrationKey(request.Key, *rec)
+			id, renewal := ua.existingID(key, *rec)
+			if renewal {
+				if err := ua.checkRegistrant(id, request.Registrant); err != nil {
 					ua.mu.Unlock()
+					request.Error <- err
 					continue
 				}
-				if !recCreated.Equal(dbCreated) {
-					request.Error <- errors.New("mismatch between created received record and database record")
+			}
+			if err := ua.checkAlias(id, *rec); err != nil {
+				ua.mu.Unlock()
+				request.Error <- err
+				continue
+			}
+			stampRegistrant(rec, request.Registrant)
+			ua.carryVerified(rec, id, renewal)
+			undrain(rec)
+			if !ua.isRenewal(key, *rec) {
+				if err := ua.makeRoom(request.RequestID); err != nil {
 					ua.mu.Unlock()
+					request.Error <- err
 					continue
 				}
-				nextExpiration := now.Add(time.Duration(dbRec.RegLife) * time.Second).Format(time.RFC3339)
-				rec.EndOfValidity = nextExpiration
 			}
-			ua.sched.AddTask(now.Add(time.Duration(rec.RegLife)*time.Second), func() { checkExpiration(ua, rec.Id) }, rec.Id)
-			ua.serviceRegistry[rec.Id] = *rec // Add record to the registry
+			if key != "" {
+				ua.assignStableID(key, rec, now)
+				log.Printf("[%s] The service %s from system %s has been registered under the stable ID %d\n", request.RequestID, rec.ServiceDefinition, rec.SystemName, rec.Id)
+			} else if err := ua.assignID(rec, now, request.RequestID); err != nil {
+				request.Error <- err
+				ua.mu.Unlock()
+				continue
+			}
+			// the jitter only delays the check, so that a record is never removed before its end of validity
+			ua.sched.AddTaskWithJitter(now.Add(time.Duration(rec.RegLife)*time.Second), time.Duration(ua.ExpiryJitter)*time.Millisecond,
+				func() { checkExpiration(ua, rec.Id) }, rec.Id)
+			ua.storeRecord(*rec) // Add record to the registry
+			ua.lastSeen[rec.Id] = now
+			ua.registrations++
 			request.Record = rec
 			ua.mu.Unlock()
+			ua.notifyWaiters(*rec)
 			request.Error <- nil // Send success response
 
 		case "read":
@@ -298,20 +455,78 @@ func (ua *UnitAsset) serviceRegistryHandler() {
 			}
 			qform, ok := request.Record.(*forms.ServiceQuest_v1)
 			if !ok {
-				log.Println("Problem unpacking the service quest request")
+				log.Printf("[%s] Problem unpacking the service quest request", request.RequestID)
+				request.Error <- fmt.Errorf("invalid record type")
+				continue
+			}
+			request.Result <- ua.answer(questWaiter(qform, request), now)
+
+		case "lookup":
+			// Read the records with the requested IDs, omitting the unknown ones
+			ua.mu.Lock()
+			found := ua.recordsByID(request.IDs)
+			ua.mu.Unlock()
+			request.Result <- found
+
+		case "heartbeat":
+			// Note that the provider is alive without extending the validity of its record
+			ua.mu.Lock()
+			if _, exists := ua.serviceRegistry[int(request.Id)]; !exists {
+				ua.mu.Unlock()
+				request.Error <- errUnknownRecord
+				continue
+			}
+			ua.lastSeen[int(request.Id)] = now
+			ua.mu.Unlock()
+			request.Error <- nil
+
+		case "watch":
+			// Register a long-polling query, answering it right away if a matching record arrived in the meantime
+			qform, ok := request.Record.(*forms.ServiceQuest_v1)
+			if !ok {
 				request.Error <- fmt.Errorf("invalid record type")
 				continue
 			}
-			matchingRecords := ua.FilterByServiceDefinitionAndDetails(qform.ServiceDefinition, qform.Details)
-			request.Result <- matchingRecords
+			request.Error <- nil
+			w := questWaiter(qform, request)
+			if matchingRecords := ua.answer(w, now); len(matchingRecords) > 0 {
+				request.Result <- matchingRecords
+				continue
+			}
+			ua.waiters[request.Result] = w
+
+		case "unwatch":
+			delete(ua.waiters, request.Result)
 
 		case "delete":
 			// Handle delete record
 			ua.mu.Lock()
+			if request.Key != "" {
+				id, known := ua.keyIDs[request.Key]
+				if !known {
+					ua.mu.Unlock()
+					request.Error <- errUnknownKey
+					continue
+				}
+				request.Id = int64(id)
+			}
+			if err := ua.checkRegistrant(int(request.Id), request.Registrant); err != nil {
+				ua.mu.Unlock()
+				request.Error <- err
+				continue
+			}
+			if window := ua.drainWindow(); window > 0 {
+				if ua.drain(int(request.Id), now.Add(window)) {
+					log.Printf("[%s] The service with ID %d is draining until its removal in %v.", request.RequestID, request.Id, window)
+				}
+				ua.mu.Unlock()
+				request.Error <- nil
+				continue
+			}
 			ua.sched.RemoveTask(int(request.Id))
-			delete(ua.serviceRegistry, int(request.Id))
+			ua.deleteRecord(int(request.Id))
 			if _, exists := ua.serviceRegistry[int(request.Id)]; !exists {
-				log.Printf("The service with ID %d has been deleted.", request.Id)
+				log.Printf("[%s] The service with ID %d has been deleted.", request.RequestID, request.Id)
 			}
 			ua.mu.Unlock()
 			request.Error <- nil // Send success response
@@ -319,101 +534,1381 @@ func (ua *UnitAsset) serviceRegistryHandler() {
 	}
 }
 
-func compareDetails(reqDetails []string, availDetails []string) bool {
-	for _, requiredValue := range reqDetails {
-		if slices.Contains(availDetails, requiredValue) {
-			return true
+// assignID gives a new record the next free ID or validates the renewal of an existing one (the caller holds the lock)
+func (ua *UnitAsset) assignID(rec *forms.ServiceRecord_v1, now time.Time, reqID string) error {
+	// Check if the ID exists in the serviceRegistry
+	if _, exists := ua.serviceRegistry[rec.Id]; !exists {
+		rec.Id = 0
+	}
+
+	if rec.Id == 0 {
+		rec.Id = ua.nextFreeID()
+		rec.Created = now.Format(time.RFC3339)
+		rec.Updated = now.Format(time.RFC3339)
+		rec.EndOfValidity = now.Add(time.Duration(rec.RegLife) * time.Second).Format(time.RFC3339)
+		log.Printf("[%s] The new service %s from system %s has been registered\n", reqID, rec.ServiceDefinition, rec.SystemName)
+		return nil
+	}
+
+	// Validate and update existing record
+	dbRec := ua.serviceRegistry[rec.Id]
+	if dbRec.ServiceDefinition != rec.ServiceDefinition {
+		return errors.New("mismatch between definition received record and database record")
+	}
+	if dbRec.SubPath != rec.SubPath {
+		return errors.New("mismatch between path received record and database record")
+	}
+	recCreated, err := time.Parse(time.RFC3339, rec.Created)
+	if err != nil {
+		return errors.New("time parsing problem with updated record")
+	}
+	dbCreated, err := time.Parse(time.RFC3339, dbRec.Created)
+	if err != nil {
+		return errors.New("time parsing problem with archived record")
+	}
+	if !recCreated.Equal(dbCreated) {
+		return errors.New("mismatch between created received record and database record")
+	}
+	// the registrar's clock is authoritative, so a provider with a skewed clock neither expires early nor lingers
+	rec.Updated = now.Format(time.RFC3339)
+	rec.EndOfValidity = now.Add(time.Duration(dbRec.RegLife) * time.Second).Format(time.RFC3339)
+	return nil
+}
+
+// nextFreeID returns the next ID that is neither in use nor reserved by a registration key (the caller holds the lock)
+func (ua *UnitAsset) nextFreeID() int {
+	// In the case recCount had looped, check that there is no record at that position
+	for {
+		currentCount := int(atomic.LoadInt64(&ua.recCount))
+		_, exists := ua.serviceRegistry[currentCount]
+		_, reserved := ua.idKeys[currentCount]
+		if !exists && !reserved {
+			return currentCount
 		}
+		atomic.AddInt64(&ua.recCount, 1)
 	}
-	return false
 }
 
-// FilterByServiceDefinitionAndDetails returns a list of services with the given service definition and details TODO: protocols
-func (ua *UnitAsset) FilterByServiceDefinitionAndDetails(desiredDefinition string, requiredDetails map[string][]string) []forms.ServiceRecord_v1 {
-	ua.mu.Lock() // Ensure thread safety
-	defer ua.mu.Unlock()
+// capacity policies applied when the registry holds MaxRecords records
+const (
+	capacityReject = "reject" // refuse new registrations until records expire or are deleted
+	capacityEvict  = "evict"  // remove the record nearest to its end of validity
+)
 
-	var matchingRecords []forms.ServiceRecord_v1
+// errRegistryFull is returned when a new registration is refused because the registry is at capacity
+var errRegistryFull = errors.New("service registry is full")
 
-	for _, record := range ua.serviceRegistry {
-		if record.ServiceDefinition == desiredDefinition {
-			matchesAllDetails := true
-
-			// Check if all required details match
-			for key, values := range requiredDetails {
-				recordValues, exists := record.Details[key]
-				if !exists {
-					matchesAllDetails = false
-					break
-				}
+// maxPort is the largest valid protocol port
+const maxPort = 65535
 
-				// Ensure at least one value in requiredDetails matches record.Details
-				if !compareDetails(values, recordValues) {
-					matchesAllDetails = false
-					break
-				}
-			}
+// errNoUsablePort is returned when a registration does not offer at least one valid protocol port
+var errNoUsablePort = errors.New("no valid protocol port")
 
-			if matchesAllDetails {
-				matchingRecords = append(matchingRecords, record)
-			}
+// checkPorts verifies that the record offers at least one protocol port within range and none outside it;
+// zero ports mark protocols the provider does not serve and are kept with the record
+func checkPorts(rec forms.ServiceRecord_v1) error {
+	usable := 0
+	for protocol, port := range rec.ProtoPort {
+		if port < 0 || port > maxPort {
+			return fmt.Errorf("%w: %s port %d out of range", errNoUsablePort, protocol, port)
+		}
+		if port > 0 {
+			usable++
 		}
 	}
+	if usable == 0 {
+		return fmt.Errorf("%w: record of %s offers none", errNoUsablePort, rec.SystemName)
+	}
+	return nil
+}
 
-	return matchingRecords
+// errDefinitionRefused is returned when a registration is for a service definition the registrar does not accept
+var errDefinitionRefused = errors.New("service definition not accepted")
+
+// checkDefinition verifies that the registrar accepts registrations for the service definition: a rejected
+// definition is refused, and so is any definition not listed when the accepted ones are.
+// The lists name the definitions without the tenant namespace, which is stripped from a scoped definition
+func (ua *UnitAsset) checkDefinition(definition string) error {
+	if ua.Namespaces != "" {
+		if _, bare, scoped := strings.Cut(definition, namespaceSeparator); scoped {
+			definition = bare
+		}
+	}
+	if slices.Contains(ua.RejectDefinitions, definition) {
+		return fmt.Errorf("%w: %q is rejected", errDefinitionRefused, definition)
+	}
+	if len(ua.AcceptDefinitions) > 0 && !slices.Contains(ua.AcceptDefinitions, definition) {
+		return fmt.Errorf("%w: %q is not among the accepted definitions", errDefinitionRefused, definition)
+	}
+	return nil
 }
 
-// checkExpiration checks if a service has expired and deletes it if it has.
-func checkExpiration(ua *UnitAsset, servId int) {
-	ua.mu.Lock()
-	defer ua.mu.Unlock()
-	dbRec := ua.serviceRegistry[servId]
-	expiration, err := time.Parse(time.RFC3339, dbRec.EndOfValidity)
-	if err != nil {
-		log.Printf("Time parsing problem when checking service expiration")
-		return
+// errBadSubPath is returned when the sub-path of a registration cannot be part of a well-formed service URL
+var errBadSubPath = errors.New("invalid sub-path")
+
+// normalizeSubPath rewrites the sub-path of the record in the form the service URLs are built with: the leading, trailing
+// and repeated slashes are dropped and each segment is escaped, e.g. "/Kitchen//temp/" becomes "Kitchen/temp".
+// A sub-path with whitespace, control characters, query or fragment delimiters, bad escapes or dot segments is refused
+func normalizeSubPath(rec *forms.ServiceRecord_v1) error {
+	var segments []string
+	for _, segment := range strings.Split(rec.SubPath, "/") {
+		if segment == "" {
+			continue
+		}
+		if strings.ContainsAny(segment, "?#") {
+			return fmt.Errorf("%w: %q holds a query or fragment delimiter", errBadSubPath, rec.SubPath)
+		}
+		raw, err := url.PathUnescape(segment)
+		if err != nil {
+			return fmt.Errorf("%w: %q holds a malformed escape", errBadSubPath, rec.SubPath)
+		}
+		if raw == "." || raw == ".." || strings.Contains(raw, "/") {
+			return fmt.Errorf("%w: %q holds the segment %q", errBadSubPath, rec.SubPath, segment)
+		}
+		if strings.IndexFunc(raw, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+			return fmt.Errorf("%w: %q holds whitespace or control characters", errBadSubPath, rec.SubPath)
+		}
+		segments = append(segments, url.PathEscape(raw))
 	}
+	rec.SubPath = strings.Join(segments, "/")
+	return nil
+}
 
-	if time.Now().After(expiration) {
-		if _, exists := ua.serviceRegistry[servId]; !exists {
-			return
+// isRenewal reports whether the registration updates a record already in the registry (the caller holds the lock)
+func (ua *UnitAsset) isRenewal(key string, rec forms.ServiceRecord_v1) bool {
+	_, renewal := ua.existingID(key, rec)
+	return renewal
+}
+
+// existingID returns the ID of the record in the registry the registration updates, if any (the caller holds the lock)
+func (ua *UnitAsset) existingID(key string, rec forms.ServiceRecord_v1) (int, bool) {
+	id := rec.Id
+	if key != "" {
+		var known bool
+		if id, known = ua.keyIDs[key]; !known {
+			return 0, false
 		}
-		delete(ua.serviceRegistry, int(servId))
-		ua.sched.RemoveTask(int(servId))
-		if _, exists := ua.serviceRegistry[servId]; !exists {
-			log.Printf("The service with ID %d has been deleted because it was not renewed.", servId)
+	}
+	_, exists := ua.serviceRegistry[id]
+	return id, id != 0 && exists
+}
+
+// registrantDetail is the detail under which a record keeps the verified identity of the client that registered it
+const registrantDetail = "_registrant"
+
+// errNotRegistrant is returned when a client other than the original registrant tries to modify or delete a record
+var errNotRegistrant = errors.New("not the registrant of the record")
+
+// stampRegistrant records the verified identity of the registrant in the record's details,
+// dropping any such detail sent by the provider itself
+func stampRegistrant(rec *forms.ServiceRecord_v1, registrant string) {
+	if _, claimed := rec.Details[registrantDetail]; claimed || registrant != "" {
+		rec.Details = maps.Clone(rec.Details)
+		delete(rec.Details, registrantDetail)
+	}
+	if registrant != "" {
+		if rec.Details == nil {
+			rec.Details = make(map[string][]string)
 		}
+		rec.Details[registrantDetail] = []string{registrant}
 	}
 }
 
-// getUniqueSystems populates the list of systems in a local cloud
-func getUniqueSystems(ua *UnitAsset) (*forms.SystemRecordList_v1, error) {
-	uniqueSystems := make(map[string]struct{}) // to ensure uniqueness
-	var systemList []string                    // final list of unique systems
+// registrantOf returns the verified identity of the client that registered the record, empty if unknown
+func registrantOf(rec forms.ServiceRecord_v1) string {
+	if values := rec.Details[registrantDetail]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
 
-	ua.mu.Lock() // Ensure thread safety
+// checkRegistrant verifies that the client may modify or delete the record: a record stamped with
+// a registrant may only be changed by it, others by anyone (the caller holds the lock)
+func (ua *UnitAsset) checkRegistrant(id int, registrant string) error {
+	rec, exists := ua.serviceRegistry[id]
+	if !exists {
+		return nil
+	}
+	if owner := registrantOf(rec); owner != "" && owner != registrant {
+		return fmt.Errorf("%w %d (registered by %s)", errNotRegistrant, id, owner)
+	}
+	return nil
+}
+
+// sources of the tenant namespaces of the requests
+const (
+	namespacesFromClient = "client" // the common name of the client's verified certificate
+	namespacesFromHeader = "header" // the X-Registry-Namespace header, set by a gateway that authenticates the tenants
+)
+
+// namespaceSeparator separates the tenant namespace from the service definition of a stored record
+const namespaceSeparator = "/"
+
+// errBadNamespace is returned for a request without a valid tenant namespace while the registry is namespaced
+var errBadNamespace = errors.New("missing or invalid namespace")
+
+// qualify prefixes a service definition with the tenant namespace, leaving it as is without a namespace
+func qualify(namespace, definition string) string {
+	if namespace == "" {
+		return definition
+	}
+	return namespace + namespaceSeparator + definition
+}
+
+// unqualify returns copies of the records of a tenant with their definitions stripped of its namespace
+func unqualify(namespace string, records []forms.ServiceRecord_v1) []forms.ServiceRecord_v1 {
+	if namespace == "" {
+		return records
+	}
+	stripped := make([]forms.ServiceRecord_v1, len(records))
+	for i, rec := range records {
+		rec.ServiceDefinition = strings.TrimPrefix(rec.ServiceDefinition, namespace+namespaceSeparator)
+		stripped[i] = rec
+	}
+	return stripped
+}
+
+// inNamespace reports whether the record belongs to the tenant, any record doing so when the registry is not namespaced
+func inNamespace(namespace string, rec forms.ServiceRecord_v1) bool {
+	return namespace == "" || strings.HasPrefix(rec.ServiceDefinition, namespace+namespaceSeparator)
+}
+
+// ofNamespace keeps the records of the tenant, with their definitions stripped of its namespace
+func ofNamespace(namespace string, records []forms.ServiceRecord_v1) []forms.ServiceRecord_v1 {
+	if namespace == "" {
+		return records
+	}
+	var kept []forms.ServiceRecord_v1
+	for _, rec := range records {
+		if inNamespace(namespace, rec) {
+			kept = append(kept, rec)
+		}
+	}
+	return unqualify(namespace, kept)
+}
+
+// recordsOf returns the records of the tenant, with their definitions stripped of its namespace
+func (ua *UnitAsset) recordsOf(namespace string) []forms.ServiceRecord_v1 {
+	ua.mu.Lock()
 	defer ua.mu.Unlock()
-	for _, record := range ua.serviceRegistry {
-		var sAddress string
+	var records []forms.ServiceRecord_v1
+	for _, rec := range ua.serviceRegistry {
+		if inNamespace(namespace, rec) {
+			records = append(records, rec)
+		}
+	}
+	return unqualify(namespace, records)
+}
 
-		// Check for HTTPS
-		if port := record.ProtoPort["https"]; port != 0 {
-			sAddress = "https://" + record.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + record.SystemName
-		} else if port := record.ProtoPort["http"]; port != 0 { // Check for HTTP
-			sAddress = "http://" + record.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + record.SystemName
-		} else {
-			fmt.Printf("Warning: %s cannot be modeled\n", record.SystemName)
+// aliasDetail is the detail under which a provider gives its service a human-friendly alias (e.g., "kitchen-temp")
+const aliasDetail = "alias"
+
+// errAliasTaken is returned when a registration reuses the alias of another record
+var errAliasTaken = errors.New("alias already in use")
+
+// aliasOf returns the alias of the record, empty if it has none
+func aliasOf(rec forms.ServiceRecord_v1) string {
+	if values := rec.Details[aliasDetail]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// aliasKey returns the key of the record in the alias index, empty if it has none. The alias is qualified
+// with the namespace of the record, so that the tenants of a namespaced registry may use the same aliases
+func (ua *UnitAsset) aliasKey(rec forms.ServiceRecord_v1) string {
+	alias := aliasOf(rec)
+	if alias == "" || ua.Namespaces == "" {
+		return alias
+	}
+	if namespace, _, scoped := strings.Cut(rec.ServiceDefinition, namespaceSeparator); scoped {
+		return qualify(namespace, alias)
+	}
+	return alias
+}
+
+// checkAlias verifies that the alias of the registration, if any, is not held by a record other than
+// the one with the given ID, so that aliases stay unique in the cloud (the caller holds the lock)
+func (ua *UnitAsset) checkAlias(id int, rec forms.ServiceRecord_v1) error {
+	key := ua.aliasKey(rec)
+	if key == "" {
+		return nil
+	}
+	if owner, taken := ua.aliasIDs[key]; taken && owner != id {
+		return fmt.Errorf("%w: %q is the alias of record %d", errAliasTaken, aliasOf(rec), owner)
+	}
+	return nil
+}
+
+// dropAlias removes the alias of the record from the alias index (the caller holds the lock)
+func (ua *UnitAsset) dropAlias(rec forms.ServiceRecord_v1) {
+	if key := ua.aliasKey(rec); key != "" && ua.aliasIDs[key] == rec.Id {
+		delete(ua.aliasIDs, key)
+	}
+}
+
+// drainingDetail marks a record unregistered during the drain window with the time of its removal
+const drainingDetail = "_draining"
+
+// drainWindow returns how long an unregistered record is kept as draining, zero if it is removed at once
+func (ua *UnitAsset) drainWindow() time.Duration {
+	return time.Duration(ua.DrainWindow) * time.Millisecond
+}
+
+// isDraining reports whether the record was unregistered and awaits its removal
+func isDraining(rec forms.ServiceRecord_v1) bool {
+	_, draining := rec.Details[drainingDetail]
+	return draining
+}
+
+// undrain drops a draining mark from a registration, whether the provider sent one itself or registers again
+func undrain(rec *forms.ServiceRecord_v1) {
+	if isDraining(*rec) {
+		rec.Details = maps.Clone(rec.Details)
+		delete(rec.Details, drainingDetail)
+	}
+}
+
+// verifiedDetail marks a record whose provider answered the registrar's announcement with the time it did
+const verifiedDetail = "_verified"
+
+// serviceProtocols are the protocols with which the registrar builds the service URLs, in order of preference
+var serviceProtocols = []string{"http", "https"}
+
+// serviceURL builds the location of the service described by the record with the first preferred protocol it offers,
+// as the orchestrator does for the consumers
+func serviceURL(rec forms.ServiceRecord_v1, protocols []string) (string, error) {
+	if len(rec.IPAddresses) == 0 || rec.IPAddresses[0] == "" {
+		return "", fmt.Errorf("record %d of %s has no IP address", rec.Id, rec.SystemName)
+	}
+	for _, protocol := range protocols {
+		port := rec.ProtoPort[protocol]
+		if port <= 0 || port > 65535 {
 			continue
 		}
+		return protocol + "://" + rec.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + rec.SystemName + "/" + rec.SubPath, nil
+	}
+	return "", fmt.Errorf("record %d of %s has no port for any of the protocols %v", rec.Id, rec.SystemName, protocols)
+}
 
-		// Ensure uniqueness
-		if _, added := uniqueSystems[sAddress]; !added {
-			uniqueSystems[sAddress] = struct{}{}
-			systemList = append(systemList, sAddress)
+// carryVerified drops a verified mark sent by the provider itself and keeps the one of the renewed record,
+// so that a provider is only announced until it answered once (the caller holds the lock)
+func (ua *UnitAsset) carryVerified(rec *forms.ServiceRecord_v1, id int, renewal bool) {
+	if _, claimed := rec.Details[verifiedDetail]; claimed {
+		rec.Details = maps.Clone(rec.Details)
+		delete(rec.Details, verifiedDetail)
+	}
+	if !renewal {
+		return
+	}
+	if verified := ua.serviceRegistry[id].Details[verifiedDetail]; len(verified) > 0 {
+		rec.Details = maps.Clone(rec.Details)
+		if rec.Details == nil {
+			rec.Details = make(map[string][]string)
 		}
+		rec.Details[verifiedDetail] = verified
 	}
-	return &forms.SystemRecordList_v1{
-		List:    systemList,
-		Version: "SystemRecordList_v1",
-	}, nil
+}
+
+// errNotServing is returned when a newly registered service does not answer the registrar's announcement as expected
+var errNotServing = errors.New("service not serving")
+
+// announce calls the service of a newly registered record to check that its provider is actually serving it.
+// Any reply but a server error or a 404 Not Found shows that it is
+func (ua *UnitAsset) announce(ctx context.Context, reqID string, rec forms.ServiceRecord_v1) error {
+	location, err := serviceURL(rec, serviceProtocols)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(ua.AnnounceTimeout)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(requestIDHeader, reqID)
+	client := ua.announcer
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s answered %s", errNotServing, location, resp.Status)
+	}
+	return nil
+}
+
+// verify announces a newly registered record, unless its provider already answered, and marks it as verified
+// in the registry and in the registration's reply. It reports whether the provider is known to be serving
+func (ua *UnitAsset) verify(ctx context.Context, reqID string, rec *forms.ServiceRecord_v1) bool {
+	if len(rec.Details[verifiedDetail]) > 0 {
+		return true
+	}
+	if err := ua.announce(ctx, reqID, *rec); err != nil {
+		log.Printf("[%s] Warning: the newly registered service %s of %s is not reachable: %v", reqID, rec.ServiceDefinition, rec.SystemName, err)
+		return false
+	}
+	verified := []string{ua.now().Format(time.RFC3339)}
+	ua.mu.Lock()
+	if stored, exists := ua.serviceRegistry[rec.Id]; exists && !isDraining(stored) {
+		stored.Details = maps.Clone(stored.Details)
+		if stored.Details == nil {
+			stored.Details = make(map[string][]string)
+		}
+		stored.Details[verifiedDetail] = verified
+		ua.storeRecord(stored)
+	}
+	ua.mu.Unlock()
+	rec.Details = maps.Clone(rec.Details)
+	if rec.Details == nil {
+		rec.Details = make(map[string][]string)
+	}
+	rec.Details[verifiedDetail] = verified
+	return true
+}
+
+// selections of the provider answering a single-provider quest
+const (
+	selectFirst      = "first"      // the provider with the lowest record ID, i.e., registered first
+	selectRoundRobin = "roundrobin" // each provider in turn, in the order of their record IDs
+)
+
+// errNoProvider is returned when none of the records of a single-provider quest has a service URL that can be built
+var errNoProvider = errors.New("no usable provider")
+
+// selectProvider picks the provider that answers a single-provider quest for the definition among the records,
+// in the order of their record IDs, skipping the records whose service URL cannot be built
+func (ua *UnitAsset) selectProvider(definition string, records []forms.ServiceRecord_v1) (forms.ServicePoint_v1, error) {
+	var sp forms.ServicePoint_v1
+	slices.SortFunc(records, func(a, b forms.ServiceRecord_v1) int { return a.Id - b.Id })
+	var usable []forms.ServiceRecord_v1
+	var locations []string
+	for _, rec := range records {
+		location, err := serviceURL(rec, serviceProtocols)
+		if err != nil {
+			continue
+		}
+		usable = append(usable, rec)
+		locations = append(locations, location)
+	}
+	if len(usable) == 0 {
+		return sp, fmt.Errorf("%w: none of the %d records of %s has a service URL", errNoProvider, len(records), definition)
+	}
+	pick := 0
+	if ua.Selection == selectRoundRobin {
+		ua.mu.Lock()
+		if ua.rotation == nil {
+			ua.rotation = make(map[string]int)
+		}
+		pick = ua.rotation[definition] % len(usable)
+		ua.rotation[definition] = pick + 1
+		ua.mu.Unlock()
+	}
+	rec := usable[pick]
+	sp.NewForm()
+	sp.ProviderName = rec.SystemName
+	sp.ServiceDefinition = rec.ServiceDefinition
+	sp.Details = rec.Details
+	sp.ServLocation = locations[pick]
+	sp.ServNode = rec.ServiceNode
+	return sp, nil
+}
+
+// withoutDraining leaves out the draining records, which are no longer offered to new consumers
+func withoutDraining(records []forms.ServiceRecord_v1) []forms.ServiceRecord_v1 {
+	return slices.DeleteFunc(records, isDraining)
+}
+
+// drain marks the record as draining and schedules its removal in place of its expiration, and reports whether it did.
+// A record already draining keeps its first removal time (the caller holds the lock)
+func (ua *UnitAsset) drain(id int, until time.Time) bool {
+	rec, exists := ua.serviceRegistry[id]
+	if !exists || isDraining(rec) {
+		return false
+	}
+	rec.Details = maps.Clone(rec.Details)
+	if rec.Details == nil {
+		rec.Details = make(map[string][]string)
+	}
+	rec.Details[drainingDetail] = []string{until.Format(time.RFC3339)}
+	ua.storeRecord(rec)
+	ua.sched.AddTask(until, func() { ua.removeDrained(id) }, id)
+	return true
+}
+
+// removeDrained removes the record at the end of its drain window, unless it was registered again in the meantime
+func (ua *UnitAsset) removeDrained(id int) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if rec, exists := ua.serviceRegistry[id]; !exists || !isDraining(rec) {
+		return
+	}
+	ua.deleteRecord(id)
+	log.Printf("The draining service with ID %d has been removed.", id)
+}
+
+// recordsByID returns the records with the given IDs in the order asked for, skipping unknown and repeated IDs (the caller holds the lock)
+func (ua *UnitAsset) recordsByID(ids []int) []forms.ServiceRecord_v1 {
+	found := make([]forms.ServiceRecord_v1, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		record, exists := ua.serviceRegistry[id]
+		if !exists || seen[id] {
+			continue
+		}
+		seen[id] = true
+		found = append(found, record)
+	}
+	return found
+}
+
+// recordByAlias returns the record registered under the alias key (see aliasKey)
+func (ua *UnitAsset) recordByAlias(key string) (forms.ServiceRecord_v1, bool) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	id, known := ua.aliasIDs[key]
+	if !known {
+		return forms.ServiceRecord_v1{}, false
+	}
+	rec, exists := ua.serviceRegistry[id]
+	return rec, exists
+}
+
+// defaultIdempotencyWindow is how long the reply to a keyed registration is replayed when no window is configured
+const defaultIdempotencyWindow = 60 * time.Second
+
+// errKeyReused is returned when an idempotency key comes back with another registration than the one it was first sent with
+var errKeyReused = errors.New("idempotency key reused for another registration")
+
+// idempotencyKey scopes the key sent by a client to its tenant namespace and verified identity, so that clients cannot
+// replay each other's replies, even when several tenants come through the certificate of one gateway
+type idempotencyKey struct {
+	namespace  string
+	registrant string
+	key        string
+}
+
+// idempotentReply is the reply to a keyed registration, replayed when the client retries it
+type idempotentReply struct {
+	digest      [sha256.Size]byte // digest of the registration body, which a retry must repeat
+	contentType string
+	body        []byte
+	task        int // ID of the task forgetting the reply
+}
+
+// idempotencyWindow returns how long the replies to the keyed registrations are remembered
+func (ua *UnitAsset) idempotencyWindow() time.Duration {
+	if ua.IdempotencyWindow == 0 {
+		return defaultIdempotencyWindow
+	}
+	return time.Duration(ua.IdempotencyWindow) * time.Second
+}
+
+// replay returns the reply remembered under the key, provided the retry sends the same registration body
+func (ua *UnitAsset) replay(key idempotencyKey, body []byte) (idempotentReply, bool, error) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	reply, found := ua.idempotent[key]
+	if found && reply.digest != sha256.Sum256(body) {
+		return idempotentReply{}, false, fmt.Errorf("%w: %q", errKeyReused, key.key)
+	}
+	return reply, found, nil
+}
+
+// nextCleanupTask returns the ID of a new cleanup task. The cleanup tasks take negative IDs so that
+// they do not replace the expiration checks of the records (the caller holds the lock)
+func (ua *UnitAsset) nextCleanupTask() int {
+	ua.cleanupTasks++
+	return -ua.cleanupTasks
+}
+
+// remember keeps the reply to a keyed registration for the idempotency window and schedules its removal.
+func (ua *UnitAsset) remember(key idempotencyKey, body []byte, contentType string, reply []byte) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.idempotent == nil {
+		ua.idempotent = make(map[idempotencyKey]idempotentReply)
+	}
+	if old, found := ua.idempotent[key]; found {
+		ua.sched.RemoveTask(old.task)
+	}
+	task := ua.nextCleanupTask()
+	ua.idempotent[key] = idempotentReply{digest: sha256.Sum256(body), contentType: contentType, body: reply, task: task}
+	ua.sched.AddTask(ua.now().Add(ua.idempotencyWindow()), func() { ua.forget(key, task) }, task)
+}
+
+// forget drops the reply remembered under the key once its window is over, unless it was replaced in the meantime
+func (ua *UnitAsset) forget(key idempotencyKey, task int) {
+	ua.sched.RemoveTask(task)
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if reply, found := ua.idempotent[key]; found && reply.task == task {
+		delete(ua.idempotent, key)
+	}
+}
+
+// maxRequesters bounds the requesters remembered per service definition, the least recent being forgotten first
+const maxRequesters = 100
+
+// requester is a consumer that recently sent a quest for a service definition
+type requester struct {
+	seen time.Time
+	task int // ID of the task forgetting the requester
+}
+
+// requesterSeen is a recent requester of a service definition, as listed by the requesters lookup
+type requesterSeen struct {
+	RequesterName string    `json:"requesterName"`
+	LastQuery     time.Time `json:"lastQuery"`
+}
+
+// noteRequester records that a consumer sent a quest for the definition, if the requesters are tracked,
+// and schedules it to be forgotten once it has been quiet for the tracking window
+func (ua *UnitAsset) noteRequester(definition, name string) {
+	if ua.TrackRequesters <= 0 || name == "" {
+		return
+	}
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.requesters == nil {
+		ua.requesters = make(map[string]map[string]requester)
+	}
+	seen := ua.requesters[definition]
+	if seen == nil {
+		seen = make(map[string]requester)
+		ua.requesters[definition] = seen
+	}
+	if old, found := seen[name]; found {
+		ua.sched.RemoveTask(old.task)
+	} else if len(seen) >= maxRequesters {
+		ua.dropLeastRecent(seen)
+	}
+	now := ua.now()
+	task := ua.nextCleanupTask()
+	seen[name] = requester{seen: now, task: task}
+	ua.sched.AddTask(now.Add(time.Duration(ua.TrackRequesters)*time.Second), func() { ua.forgetRequester(definition, name, task) }, task)
+}
+
+// dropLeastRecent forgets the requester of a definition that was seen the longest ago (the caller holds the lock)
+func (ua *UnitAsset) dropLeastRecent(seen map[string]requester) {
+	var oldest string
+	for name, req := range seen {
+		if oldest == "" || req.seen.Before(seen[oldest].seen) {
+			oldest = name
+		}
+	}
+	ua.sched.RemoveTask(seen[oldest].task)
+	delete(seen, oldest)
+}
+
+// forgetRequester drops a requester once its tracking window is over, unless it sent another quest in the meantime
+func (ua *UnitAsset) forgetRequester(definition, name string, task int) {
+	ua.sched.RemoveTask(task)
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	seen := ua.requesters[definition]
+	if req, found := seen[name]; found && req.task == task {
+		delete(seen, name)
+		if len(seen) == 0 {
+			delete(ua.requesters, definition)
+		}
+	}
+}
+
+// recentRequesters lists the requesters of the definition within the tracking window, the most recent first
+func (ua *UnitAsset) recentRequesters(definition string) []requesterSeen {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	list := make([]requesterSeen, 0, len(ua.requesters[definition]))
+	for name, req := range ua.requesters[definition] {
+		list = append(list, requesterSeen{RequesterName: name, LastQuery: req.seen})
+	}
+	slices.SortFunc(list, func(a, b requesterSeen) int {
+		if order := b.LastQuery.Compare(a.LastQuery); order != 0 {
+			return order
+		}
+		return strings.Compare(a.RequesterName, b.RequesterName)
+	})
+	return list
+}
+
+// makeRoom ensures a new record fits in the registry, evicting the records nearest to expiry
+// when the policy allows it (the caller holds the lock)
+func (ua *UnitAsset) makeRoom(reqID string) error {
+	for ua.MaxRecords > 0 && len(ua.serviceRegistry) >= ua.MaxRecords {
+		if ua.CapacityPolicy != capacityEvict {
+			return errRegistryFull
+		}
+		id := ua.nearestToExpiry()
+		ua.sched.RemoveTask(id)
+		ua.deleteRecord(id)
+		log.Printf("[%s] The service with ID %d has been evicted to make room for a new registration", reqID, id)
+	}
+	return nil
+}
+
+// nearestToExpiry returns the ID of the record whose validity ends first, a record with an unreadable
+// end of validity coming first (the caller holds the lock and the registry is not empty)
+func (ua *UnitAsset) nearestToExpiry() int {
+	nearest, nearestEnd := 0, time.Time{}
+	for _, id := range slices.Sorted(maps.Keys(ua.serviceRegistry)) {
+		end, err := time.Parse(time.RFC3339, ua.serviceRegistry[id].EndOfValidity)
+		if err != nil {
+			return id
+		}
+		if nearest == 0 || end.Before(nearestEnd) {
+			nearest, nearestEnd = id, end
+		}
+	}
+	return nearest
+}
+
+// errUnknownKey is returned when a deletion names a registration key the registrar has never seen
+var errUnknownKey = errors.New("unknown registration key")
+
+// registrationKey returns the key under which a record keeps a stable ID: the one chosen by the provider,
+// or when StableIDs is set, one derived from the record fields of the configured identity
+func (ua *UnitAsset) registrationKey(requested string, rec forms.ServiceRecord_v1) string {
+	if requested != "" || !ua.StableIDs {
+		return requested
+	}
+	fields := ua.Identity
+	if len(fields) == 0 {
+		fields = defaultIdentity
+	}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		values[i] = identityValue(field, rec)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(values, "/")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// defaultIdentity are the record fields identifying a registration when the Identity trait is empty
+var defaultIdentity = []string{"systemName", "definition", "subpath"}
+
+// identityDetailPrefix introduces a detail key in the Identity trait, e.g. "details.Location"
+const identityDetailPrefix = "details."
+
+// errBadIdentity is returned when the Identity trait names a field that cannot identify a registration
+var errBadIdentity = errors.New("invalid registration identity")
+
+// checkIdentity verifies that the configured identity only names known record fields
+func checkIdentity(fields []string) error {
+	for _, field := range fields {
+		switch {
+		case field == "systemName", field == "definition", field == "subpath", field == "serviceNode":
+		case strings.HasPrefix(field, identityDetailPrefix) && len(field) > len(identityDetailPrefix):
+		default:
+			return fmt.Errorf("%w: unknown field %q, expected systemName, definition, subpath, serviceNode or details.<key>", errBadIdentity, field)
+		}
+	}
+	return nil
+}
+
+// identityValue returns the value of a record field of the identity, the values of a detail being joined by commas
+func identityValue(field string, rec forms.ServiceRecord_v1) string {
+	switch field {
+	case "systemName":
+		return rec.SystemName
+	case "definition":
+		return rec.ServiceDefinition
+	case "subpath":
+		return rec.SubPath
+	case "serviceNode":
+		return rec.ServiceNode
+	}
+	return strings.Join(rec.Details[strings.TrimPrefix(field, identityDetailPrefix)], ",")
+}
+
+// assignStableID gives the record the ID reserved for its key, reserving a new one the first time the key is seen.
+// The reservation outlives the record, so a provider that restarts gets its former ID back (the caller holds the lock)
+func (ua *UnitAsset) assignStableID(key string, rec *forms.ServiceRecord_v1, now time.Time) {
+	id, known := ua.keyIDs[key]
+	if !known {
+		id = ua.nextFreeID()
+		ua.keyIDs[key] = id
+		ua.idKeys[id] = key
+	}
+	rec.Id = id
+	rec.Created = now.Format(time.RFC3339)
+	if dbRec, exists := ua.serviceRegistry[id]; exists {
+		rec.Created = dbRec.Created
+	}
+	rec.Updated = now.Format(time.RFC3339)
+	rec.EndOfValidity = now.Add(time.Duration(rec.RegLife) * time.Second).Format(time.RFC3339)
+}
+
+// waiter is a quest with the filters of its query, kept while a long-polling query waits for a matching record
+type waiter struct {
+	quest  *forms.ServiceQuest_v1
+	match  matchMode
+	fresh  time.Duration      // if positive, only records heard from within this window answer the quest
+	window registrationWindow // only records created or updated after these times answer the quest
+	node   string             // if not empty, only records of this service node answer the quest
+	subnet *net.IPNet         // if not nil, only records with an address within this subnet answer the quest
+}
+
+// questWaiter returns the quest of a read or watch request together with the filters of the request
+func questWaiter(quest *forms.ServiceQuest_v1, request ServiceRegistryRequest) waiter {
+	return waiter{
+		quest:  quest,
+		match:  request.Match,
+		fresh:  request.Fresh,
+		window: request.Window,
+		node:   request.Node,
+		subnet: request.Subnet,
+	}
+}
+
+// answer returns the records answering the quest: those matching its definition and details that are not draining,
+// narrowed down by the freshness, the registration window, the service node and the subnet of the query
+func (ua *UnitAsset) answer(w waiter, now time.Time) []forms.ServiceRecord_v1 {
+	records := withoutDraining(ua.FilterByServiceDefinitionAndDetails(w.quest.ServiceDefinition, w.quest.Details, w.match))
+	if w.fresh > 0 {
+		records = ua.seenWithin(records, w.fresh, now)
+	}
+	if !w.window.isZero() {
+		records = w.window.filter(records)
+	}
+	if w.node != "" {
+		records = onNode(records, w.node)
+	}
+	if w.subnet != nil {
+		records = inSubnet(records, w.subnet)
+	}
+	return records
+}
+
+// notifyWaiters answers the long-polling queries the new record matches, once the filters of their query keep a record
+func (ua *UnitAsset) notifyWaiters(rec forms.ServiceRecord_v1) {
+	now := ua.now()
+	for result, w := range ua.waiters {
+		if !recordMatches(ua.normalizedRecord(rec), w.quest.ServiceDefinition, ua.normalizeDetails(w.quest.Details), w.match) {
+			continue
+		}
+		records := ua.answer(w, now)
+		if len(records) == 0 {
+			continue // e.g., registered on another service node, the query keeps waiting
+		}
+		result <- records
+		delete(ua.waiters, result)
+	}
+}
+
+// detailsWithin reports whether every detail key of inner, except those managed by the registrar, is in outer with all its values
+func detailsWithin(inner, outer map[string][]string) bool {
+	for key, values := range inner {
+		if strings.HasPrefix(key, "_") {
+			continue
+		}
+		outerValues, exists := outer[key]
+		if !exists {
+			return false
+		}
+		for _, value := range values {
+			if !slices.Contains(outerValues, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func compareDetails(reqDetails []string, availDetails []string) bool {
+	for _, requiredValue := range reqDetails {
+		if slices.Contains(availDetails, requiredValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMode selects how the details of a quest are matched against those of a record
+type matchMode string
+
+const (
+	// matchSubset (the default) requires every queried detail key in the record, with at least one of the queried values
+	matchSubset matchMode = "subset"
+	// matchExact requires the record to have exactly the queried detail keys, each with the same set of values
+	matchExact matchMode = "exact"
+	// matchSuperset requires every detail key of the record to be queried, with all its values among the queried ones
+	matchSuperset matchMode = "superset"
+)
+
+// errBadMatchMode is returned for a matching mode other than subset, exact or superset
+var errBadMatchMode = errors.New("unknown details matching mode")
+
+// parseMatchMode returns the matching mode of a query, subset if none is given
+func parseMatchMode(s string) (matchMode, error) {
+	switch mode := matchMode(s); mode {
+	case "":
+		return matchSubset, nil
+	case matchSubset, matchExact, matchSuperset:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w: %s", errBadMatchMode, s)
+	}
+}
+
+// FilterByServiceDefinitionAndDetails returns a list of services with the given service definition and details,
+// matched according to the mode (subset if empty) TODO: protocols
+func (ua *UnitAsset) FilterByServiceDefinitionAndDetails(desiredDefinition string, requiredDetails map[string][]string, mode matchMode) []forms.ServiceRecord_v1 {
+	ua.mu.Lock() // Ensure thread safety
+	defer ua.mu.Unlock()
+
+	var matchingRecords []forms.ServiceRecord_v1
+	requiredDetails = ua.normalizeDetails(requiredDetails)
+
+	// Consult the index if the query filters on an indexed detail key, which a superset match does not require in the record
+	if mode != matchSuperset {
+		if candidates, indexed := ua.detailIndex.lookup(requiredDetails); indexed {
+			for id := range candidates {
+				if record := ua.serviceRegistry[id]; recordMatches(ua.normalizedRecord(record), desiredDefinition, requiredDetails, mode) {
+					matchingRecords = append(matchingRecords, record)
+				}
+			}
+			return matchingRecords
+		}
+	}
+
+	for _, record := range ua.serviceRegistry {
+		if recordMatches(ua.normalizedRecord(record), desiredDefinition, requiredDetails, mode) {
+			matchingRecords = append(matchingRecords, record)
+		}
+	}
+
+	return matchingRecords
+}
+
+// recordMatches checks if a record has the given service definition and details, matched according to the mode.
+// The details managed by the registrar (e.g., _registrant) are ignored by the exact and superset modes
+func recordMatches(record forms.ServiceRecord_v1, desiredDefinition string, requiredDetails map[string][]string, mode matchMode) bool {
+	if record.ServiceDefinition != desiredDefinition {
+		return false
+	}
+
+	switch mode {
+	case matchExact:
+		return detailsWithin(record.Details, requiredDetails) && detailsWithin(requiredDetails, record.Details)
+	case matchSuperset:
+		return detailsWithin(record.Details, requiredDetails)
+	}
+
+	// Check if all required details match
+	for key, values := range requiredDetails {
+		recordValues, exists := record.Details[key]
+		if !exists {
+			return false
+		}
+
+		// Ensure at least one value in requiredDetails matches record.Details
+		if !compareDetails(values, recordValues) {
+			return false
+		}
+	}
+	return true
+}
+
+// storeRecord adds or replaces a record in the registry and keeps the detail and alias indexes up to date (the caller holds the lock)
+func (ua *UnitAsset) storeRecord(rec forms.ServiceRecord_v1) {
+	if old, exists := ua.serviceRegistry[rec.Id]; exists {
+		ua.detailIndex.remove(ua.normalizedRecord(old))
+		ua.dropAlias(old)
+	}
+	ua.serviceRegistry[rec.Id] = rec
+	ua.detailIndex.add(ua.normalizedRecord(rec))
+	if key := ua.aliasKey(rec); key != "" {
+		if ua.aliasIDs == nil {
+			ua.aliasIDs = make(map[string]int)
+		}
+		ua.aliasIDs[key] = rec.Id
+	}
+	ua.revision++
+}
+
+// deleteRecord removes a record from the registry and from the detail and alias indexes (the caller holds the lock)
+func (ua *UnitAsset) deleteRecord(id int) {
+	if old, exists := ua.serviceRegistry[id]; exists {
+		ua.detailIndex.remove(ua.normalizedRecord(old))
+		ua.dropAlias(old)
+		ua.revision++
+	}
+	delete(ua.serviceRegistry, id)
+	delete(ua.lastSeen, id)
+}
+
+// registrationWindow selects the records created or updated after the given times (a zero time does not filter)
+type registrationWindow struct {
+	createdAfter time.Time
+	updatedAfter time.Time
+}
+
+func (win registrationWindow) isZero() bool {
+	return win.createdAfter.IsZero() && win.updatedAfter.IsZero()
+}
+
+// filter drops the records older than the window, as well as those whose timestamps cannot be parsed
+func (win registrationWindow) filter(records []forms.ServiceRecord_v1) []forms.ServiceRecord_v1 {
+	var recent []forms.ServiceRecord_v1
+	for _, record := range records {
+		if after(record.Created, win.createdAfter, record.Id) && after(record.Updated, win.updatedAfter, record.Id) {
+			recent = append(recent, record)
+		}
+	}
+	return recent
+}
+
+// after checks that a record's RFC3339 timestamp is later than the limit, which a zero limit always is
+func after(timestamp string, limit time.Time, id int) bool {
+	if limit.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		log.Printf("Skipping the service with ID %d, its timestamp %q cannot be parsed: %v", id, timestamp, err)
+		return false
+	}
+	return t.After(limit)
+}
+
+// errUnknownRecord is returned by a heartbeat for a record that is not (or no longer) in the registry
+var errUnknownRecord = errors.New("unknown service record")
+
+// seenWithin keeps the records whose provider registered or sent a heartbeat within the window
+func (ua *UnitAsset) seenWithin(records []forms.ServiceRecord_v1, window time.Duration, now time.Time) []forms.ServiceRecord_v1 {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	var fresh []forms.ServiceRecord_v1
+	for _, record := range records {
+		if seen, ok := ua.lastSeen[record.Id]; ok && now.Sub(seen) <= window {
+			fresh = append(fresh, record)
+		}
+	}
+	return fresh
+}
+
+// normalizeDetails returns the details as they are compared, alike for the indexed records and the queries:
+// as they are, or with FoldDetails a copy whose values are trimmed and lower-cased (e.g., " Kitchen" as "kitchen")
+func (ua *UnitAsset) normalizeDetails(details map[string][]string) map[string][]string {
+	if !ua.FoldDetails || details == nil {
+		return details
+	}
+	folded := make(map[string][]string, len(details))
+	for key, values := range details {
+		folded[key] = make([]string, len(values))
+		for i, value := range values {
+			folded[key][i] = strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return folded
+}
+
+// normalizedRecord returns the record with its details as they are compared, leaving the stored record untouched
+func (ua *UnitAsset) normalizedRecord(rec forms.ServiceRecord_v1) forms.ServiceRecord_v1 {
+	rec.Details = ua.normalizeDetails(rec.Details)
+	return rec
+}
+
+// detailIndex maps the indexed detail keys to the IDs of the records per detail value
+type detailIndex map[string]map[string]map[int]struct{}
+
+// newDetailIndex returns an index over the given detail keys, or nil if there are none
+func newDetailIndex(keys []string) detailIndex {
+	if len(keys) == 0 {
+		return nil
+	}
+	idx := make(detailIndex, len(keys))
+	for _, key := range keys {
+		idx[key] = make(map[string]map[int]struct{})
+	}
+	return idx
+}
+
+// add indexes the record under each value of its indexed details
+func (idx detailIndex) add(rec forms.ServiceRecord_v1) {
+	for key, values := range idx {
+		for _, value := range rec.Details[key] {
+			if values[value] == nil {
+				values[value] = make(map[int]struct{})
+			}
+			values[value][rec.Id] = struct{}{}
+		}
+	}
+}
+
+// remove drops the record from the index
+func (idx detailIndex) remove(rec forms.ServiceRecord_v1) {
+	for key, values := range idx {
+		for _, value := range rec.Details[key] {
+			delete(values[value], rec.Id)
+			if len(values[value]) == 0 {
+				delete(values, value)
+			}
+		}
+	}
+}
+
+// lookup returns the IDs of the records having any of the required values of the first indexed key found in the required details.
+// It returns false if none of the required keys is indexed, in which case the registry has to be scanned.
+func (idx detailIndex) lookup(requiredDetails map[string][]string) (map[int]struct{}, bool) {
+	for key, required := range requiredDetails {
+		values, indexed := idx[key]
+		if !indexed {
+			continue
+		}
+		candidates := make(map[int]struct{})
+		for _, value := range required {
+			for id := range values[value] {
+				candidates[id] = struct{}{}
+			}
+		}
+		return candidates, true
+	}
+	return nil, false
+}
+
+// startup promotions, letting a registrar lead before its first election round is over
+const (
+	promoteSolo  = "solo"  // lead at once when no peer registrar is configured
+	promoteForce = "force" // lead at once even with peers, the election still hands the lead over to a peer that leads
+)
+
+// promotesOnStartup reports whether the registrar takes the lead without waiting for the election given its number of peers
+func (ua *UnitAsset) promotesOnStartup(peers int) bool {
+	return ua.PromoteOnStartup == promoteForce || (ua.PromoteOnStartup == promoteSolo && peers == 0)
+}
+
+// takeLead makes the registrar the leader from now on
+func (ua *UnitAsset) takeLead(now time.Time) {
+	ua.leading = true
+	ua.leadingSince = now
+	ua.leadingRegistrar = nil
+	log.Printf("Taking the service registry lead at %s\n", ua.leadingSince)
+}
+
+// loseLead puts the registrar back on standby, adding the term that ends now to the time spent leading
+func (ua *UnitAsset) loseLead(now time.Time) {
+	if ua.leading {
+		ua.ledFor += now.Sub(ua.leadingSince)
+	}
+	ua.leading = false
+	ua.leadingSince = time.Time{}
+}
+
+// leadTime returns the time spent leading so far, including the current term
+func (ua *UnitAsset) leadTime(now time.Time) time.Duration {
+	if ua.leading {
+		return ua.ledFor + now.Sub(ua.leadingSince)
+	}
+	return ua.ledFor
+}
+
+// shutdownSummary is the final statistics line of the registrar, as key=value pairs that log aggregators can parse
+func (ua *UnitAsset) shutdownSummary(now time.Time) string {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return fmt.Sprintf("shutdown summary: records=%d registrations=%d leading=%t ledFor=%s uptime=%s",
+		len(ua.serviceRegistry), ua.registrations, ua.leading,
+		ua.leadTime(now).Round(time.Second), now.Sub(ua.startedAt).Round(time.Second))
+}
+
+// now returns the time of the registry's clock
+func (ua *UnitAsset) now() time.Time {
+	if ua.clock == nil {
+		return time.Now()
+	}
+	return ua.clock.Now()
+}
+
+// checkExpiration checks if a service has expired and deletes it if it has.
+func checkExpiration(ua *UnitAsset, servId int) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	dbRec := ua.serviceRegistry[servId]
+	expiration, err := time.Parse(time.RFC3339, dbRec.EndOfValidity)
+	if err != nil {
+		log.Printf("Time parsing problem when checking service expiration")
+		return
+	}
+
+	if !ua.now().Before(expiration) { // the check is scheduled at the end of validity
+		if _, exists := ua.serviceRegistry[servId]; !exists {
+			return
+		}
+		ua.deleteRecord(servId)
+		ua.sched.RemoveTask(int(servId))
+		if _, exists := ua.serviceRegistry[servId]; !exists {
+			log.Printf("The service with ID %d has been deleted because it was not renewed.", servId)
+		}
+	}
+}
+
+// getUniqueSystems populates the list of systems in a local cloud, or in the namespace of a tenant
+func getUniqueSystems(ua *UnitAsset, namespace string) (*forms.SystemRecordList_v1, error) {
+	uniqueSystems := make(map[string]struct{}) // to ensure uniqueness
+	var systemList []string                    // final list of unique systems
+
+	for _, record := range ua.recordsOf(namespace) {
+		var sAddress string
+
+		// Check for HTTPS
+		if port := record.ProtoPort["https"]; port != 0 {
+			sAddress = "https://" + record.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + record.SystemName
+		} else if port := record.ProtoPort["http"]; port != 0 { // Check for HTTP
+			sAddress = "http://" + record.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + record.SystemName
+		} else {
+			fmt.Printf("Warning: %s cannot be modeled\n", record.SystemName)
+			continue
+		}
+
+		// Ensure uniqueness
+		if _, added := uniqueSystems[sAddress]; !added {
+			uniqueSystems[sAddress] = struct{}{}
+			systemList = append(systemList, sAddress)
+		}
+	}
+	return &forms.SystemRecordList_v1{
+		List:    systemList,
+		Version: "SystemRecordList_v1",
+	}, nil
+}
+
+// definitionCount is a service definition offered in the local cloud with the number of records offering it
+type definitionCount struct {
+	Definition string `json:"definition"`
+	Count      int    `json:"count"`
+}
+
+// getUniqueDefinitions lists the distinct service definitions in the registry, or in the namespace of a tenant,
+// sorted by name, with their record count
+func getUniqueDefinitions(ua *UnitAsset, namespace string) []definitionCount {
+	counts := make(map[string]int)
+	for _, record := range ua.recordsOf(namespace) {
+		counts[record.ServiceDefinition]++
+	}
+
+	definitions := make([]definitionCount, 0, len(counts))
+	for _, definition := range slices.Sorted(maps.Keys(counts)) {
+		definitions = append(definitions, definitionCount{Definition: definition, Count: counts[definition]})
+	}
+	return definitions
+}
+
+// onNode keeps the records of the given service node
+func onNode(records []forms.ServiceRecord_v1, node string) []forms.ServiceRecord_v1 {
+	var kept []forms.ServiceRecord_v1
+	for _, rec := range records {
+		if rec.ServiceNode == node {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// inSubnet keeps the records with an address within the subnet, each with only those of its addresses,
+// so that a consumer is not handed endpoints it cannot reach
+func inSubnet(records []forms.ServiceRecord_v1, subnet *net.IPNet) []forms.ServiceRecord_v1 {
+	var kept []forms.ServiceRecord_v1
+	for _, rec := range records {
+		var reachable []string
+		for _, addr := range rec.IPAddresses {
+			if ip := net.ParseIP(addr); ip != nil && subnet.Contains(ip) {
+				reachable = append(reachable, addr)
+			}
+		}
+		if len(reachable) > 0 {
+			rec.IPAddresses = reachable
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// nodeSummary is a service node of the local cloud with the number of records it hosts and their systems
+type nodeSummary struct {
+	Node    string   `json:"node"`
+	Count   int      `json:"count"`
+	Systems []string `json:"systems"`
+}
+
+// getNodeSummaries groups the records of the registry, or of the namespace of a tenant, per service node, sorted by node name.
+// Records without a service node are grouped under the empty name.
+func getNodeSummaries(ua *UnitAsset, namespace string) []nodeSummary {
+	counts := make(map[string]int)
+	systems := make(map[string]map[string]struct{})
+	for _, record := range ua.recordsOf(namespace) {
+		counts[record.ServiceNode]++
+		if systems[record.ServiceNode] == nil {
+			systems[record.ServiceNode] = make(map[string]struct{})
+		}
+		systems[record.ServiceNode][record.SystemName] = struct{}{}
+	}
+
+	nodes := make([]nodeSummary, 0, len(counts))
+	for _, node := range slices.Sorted(maps.Keys(counts)) {
+		nodes = append(nodes, nodeSummary{Node: node, Count: counts[node], Systems: slices.Sorted(maps.Keys(systems[node]))})
+	}
+	return nodes
+}
+
+// defaultMaxBodySize is the largest request body accepted when the traits do not set a limit (1 MiB)
+const defaultMaxBodySize = 1 << 20
+
+// maxBodySize returns the largest request body accepted, in bytes
+func (ua *UnitAsset) maxBodySize() int64 {
+	if ua.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return int64(ua.MaxBodySize)
+}
+
+// defaultQueryTimeout bounds the wait of a query for the registry when the traits do not set a timeout
+const defaultQueryTimeout = 5 * time.Second
+
+// queryTimeout returns how long a query waits for the registry to take and answer it
+func (ua *UnitAsset) queryTimeout() time.Duration {
+	if ua.QueryTimeout <= 0 {
+		return defaultQueryTimeout
+	}
+	return time.Duration(ua.QueryTimeout) * time.Millisecond
+}
+
+// exportRecords lists all the records of the registry by ID, e.g., for a backup or a migration
+func (ua *UnitAsset) exportRecords() forms.ServiceRecordList_v1 {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	list := forms.ServiceRecordList_v1{Version: "ServiceRecordList_v1"}
+	for _, id := range slices.Sorted(maps.Keys(ua.serviceRegistry)) {
+		list.List = append(list.List, ua.serviceRegistry[id])
+	}
+	return list
+}
+
+// importRecords feeds the records through the add path as new registrations, which assigns their IDs and
+// recomputes their validity, and returns how many were imported
+func (ua *UnitAsset) importRecords(list forms.ServiceRecordList_v1, reqID string) (imported int, failed int) {
+	for _, rec := range list.List {
+		rec.Id = 0
+		rec.Created = ""
+		request := ServiceRegistryRequest{
+			Action:     "add",
+			Record:     &rec,
+			RequestID:  reqID,
+			Registrant: registrantOf(rec), // the records keep their registrant across a migration
+			Error:      make(chan error),
+		}
+		ua.requests <- request
+		if err := <-request.Error; err != nil {
+			log.Printf("[%s] Unable to import the service %s from system %s: %v", reqID, rec.ServiceDefinition, rec.SystemName, err)
+			failed++
+			continue
+		}
+		imported++
+	}
+	return imported, failed
 }
@@ -4,7 +4,11 @@ import (
 	"context"
 	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"slices"
 	"testing"
 	"time"
 
@@ -34,11 +38,21 @@ func createConfAssetMultipleTraits() usecases.ConfigurableAsset {
 		Name:     "testRegistrar",
 		Details:  map[string][]string{"testDetail": {"detail1", "detail2"}},
 		Services: []components.Service{},
-		Traits:   []json.RawMessage{json.RawMessage(`{"recCount": 0}`), json.RawMessage(`{"leading": false}`)},
+		Traits:   []json.RawMessage{json.RawMessage(`{"maxRecords": 0}`), json.RawMessage(`{"priority": 1}`)},
 	}
 	return uac
 }
 
+// newTestResource creates a registrar unit asset, failing the test if its configuration is refused
+func newTestResource(t *testing.T, configuredAsset usecases.ConfigurableAsset, sys *components.System) (components.UnitAsset, func()) {
+	t.Helper()
+	ua, shutdown, err := newResource(configuredAsset, sys)
+	if err != nil {
+		t.Fatalf("Expected the configuration to be accepted, got: %v", err)
+	}
+	return ua, shutdown
+}
+
 func createTestSystem() components.System {
 	ctx := context.Background()
 	sys := components.NewSystem("testsys", ctx)
@@ -253,7 +267,7 @@ func TestServiceRegistryHandlerAdd(t *testing.T) {
 		// Setup
 		temp := createConfAssetMultipleTraits()
 		sys := createNewSys()
-		res, shutdown := newResource(temp, &sys)
+		res, shutdown := newTestResource(t, temp, &sys)
 		ua, _ := res.(*UnitAsset)
 
 		// Test and check
@@ -269,6 +283,456 @@ func TestServiceRegistryHandlerAdd(t *testing.T) {
 	}
 }
 
+func sendKeyedAddRequest(key string, def string, ch chan ServiceRegistryRequest) (*forms.ServiceRecord_v1, error) {
+	rec := &forms.ServiceRecord_v1{
+		ServiceDefinition: def,
+		SystemName:        "System",
+		ProtoPort:         map[string]int{"http": 8870},
+		SubPath:           def,
+		RegLife:           25,
+		Version:           "ServiceRecord_v1",
+	}
+	req := ServiceRegistryRequest{
+		Action: "add",
+		Record: rec,
+		Key:    key,
+		Error:  make(chan error),
+	}
+	ch <- req
+	return rec, <-req.Error
+}
+
+func sendKeyedDeleteRequest(id int64, key string, ch chan ServiceRegistryRequest) error {
+	req := ServiceRegistryRequest{
+		Action: "delete",
+		Id:     id,
+		Key:    key,
+		Error:  make(chan error),
+	}
+	ch <- req
+	return <-req.Error
+}
+
+func TestServiceRegistryHandlerStableIDs(t *testing.T) {
+	temp := createConfAssetMultipleTraits()
+	sys := createNewSys()
+	res, shutdown := newTestResource(t, temp, &sys)
+	defer shutdown()
+	ua, _ := res.(*UnitAsset)
+
+	first, err := sendKeyedAddRequest("pump-flow", "flow", ua.requests)
+	if err != nil {
+		t.Fatalf("Expected no errors registering with a key: %v", err)
+	}
+	created := first.Created
+
+	// A renewal with the key lands on the same ID and keeps the creation time
+	renewal, err := sendKeyedAddRequest("pump-flow", "flow", ua.requests)
+	if err != nil || renewal.Id != first.Id || renewal.Created != created {
+		t.Errorf("Expected the renewal to keep ID %d created at %s, got ID %d created at %s (%v)",
+			first.Id, created, renewal.Id, renewal.Created, err)
+	}
+
+	// After the record is gone (e.g., the provider restarted), the ID is reserved for the key
+	if err := sendKeyedDeleteRequest(int64(first.Id), "", ua.requests); err != nil {
+		t.Fatalf("Expected no errors deleting the record: %v", err)
+	}
+	other, err := sendKeyedAddRequest("", "pressure", ua.requests)
+	if err != nil || other.Id == first.Id {
+		t.Errorf("Expected an unkeyed provider not to reuse the reserved ID %d, got: %d (%v)", first.Id, other.Id, err)
+	}
+	restart, err := sendKeyedAddRequest("pump-flow", "flow", ua.requests)
+	if err != nil || restart.Id != first.Id {
+		t.Errorf("Expected the restarted provider to get ID %d back, got: %d (%v)", first.Id, restart.Id, err)
+	}
+
+	// A different key gets a different ID
+	second, err := sendKeyedAddRequest("pump-level", "level", ua.requests)
+	if err != nil || second.Id == first.Id || second.Id == other.Id {
+		t.Errorf("Expected a new ID for a new key, got: %d (%v)", second.Id, err)
+	}
+
+	// Deleting by key removes the record behind it
+	if err := sendKeyedDeleteRequest(0, "pump-flow", ua.requests); err != nil {
+		t.Errorf("Expected no errors deleting by key: %v", err)
+	}
+	ua.mu.Lock()
+	_, exists := ua.serviceRegistry[first.Id]
+	ua.mu.Unlock()
+	if exists {
+		t.Errorf("Expected the record with ID %d to be deleted by its key", first.Id)
+	}
+	if err := sendKeyedDeleteRequest(0, "no-such-key", ua.requests); !errors.Is(err, errUnknownKey) {
+		t.Errorf("Expected errUnknownKey deleting an unknown key, got: %v", err)
+	}
+}
+
+func TestServiceRegistryHandlerAlias(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+
+	aliased := func(def string) *forms.ServiceRecord_v1 {
+		return &forms.ServiceRecord_v1{ServiceDefinition: def, SystemName: "System", SubPath: def, RegLife: 30,
+			ProtoPort: map[string]int{"http": 1234}, Details: map[string][]string{aliasDetail: {"kitchen-temp"}}}
+	}
+	first := aliased("temperature")
+	if err := sendAddRequestRecord(first, "", ua.requests); err != nil {
+		t.Fatalf("Expected the aliased record to be registered, got: %v", err)
+	}
+	if err := sendAddRequestRecord(aliased("humidity"), "", ua.requests); !errors.Is(err, errAliasTaken) {
+		t.Errorf("Expected a conflict for a reused alias, got: %v", err)
+	}
+	renewal := *first
+	if err := sendAddRequestRecord(&renewal, "", ua.requests); err != nil {
+		t.Errorf("Expected the record to renew under its own alias, got: %v", err)
+	}
+	if rec, found := ua.recordByAlias("kitchen-temp"); !found || rec.Id != first.Id {
+		t.Errorf("Expected the alias to resolve to record %d, got: %v and %t", first.Id, rec.Id, found)
+	}
+
+	// The alias is released with its record
+	if err := sendKeyedDeleteRequest(int64(first.Id), "", ua.requests); err != nil {
+		t.Fatalf("Unexpected error deleting the record: %v", err)
+	}
+	if _, found := ua.recordByAlias("kitchen-temp"); found {
+		t.Errorf("Expected the alias to be released with its record")
+	}
+	if err := sendAddRequestRecord(aliased("humidity"), "", ua.requests); err != nil {
+		t.Errorf("Expected the released alias to be reusable, got: %v", err)
+	}
+}
+
+func TestServiceRegistryHandlerDrain(t *testing.T) {
+	sys := createTestSystem()
+	confAsset := createConfAssetMultipleTraits()
+	confAsset.Traits = []json.RawMessage{json.RawMessage(`{"drainWindow": 200}`)}
+	temp, shutdown := newTestResource(t, confAsset, &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	clock := useFakeClock(ua, time.Now())
+
+	rec := &forms.ServiceRecord_v1{ServiceDefinition: "temperature", SystemName: "System", SubPath: "temp", RegLife: 30,
+		ProtoPort: map[string]int{"http": 1234}, Details: map[string][]string{"Unit": {"Celsius"}}}
+	if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+		t.Fatalf("Unexpected error registering: %v", err)
+	}
+	if err := sendKeyedDeleteRequest(int64(rec.Id), "", ua.requests); err != nil {
+		t.Fatalf("Unexpected error unregistering: %v", err)
+	}
+
+	// While draining, the record is no longer offered but still known by its ID
+	read := ServiceRegistryRequest{
+		Action: "read",
+		Record: &forms.ServiceQuest_v1{ServiceDefinition: "temperature"},
+		Result: make(chan []forms.ServiceRecord_v1),
+		Error:  make(chan error),
+	}
+	ua.requests <- read
+	if records := <-read.Result; len(records) != 0 {
+		t.Errorf("Expected the draining record to be left out of queries, got: %v", records)
+	}
+	ua.mu.Lock()
+	found := ua.recordsByID([]int{rec.Id})
+	ua.mu.Unlock()
+	if len(found) != 1 || !isDraining(found[0]) || found[0].Details["Unit"][0] != "Celsius" {
+		t.Errorf("Expected the record to be kept with a draining mark, got: %v", found)
+	}
+
+	clock.Advance(200 * time.Millisecond)
+	ua.mu.Lock()
+	_, exists := ua.serviceRegistry[rec.Id]
+	ua.mu.Unlock()
+	if exists {
+		t.Errorf("Expected the record to be removed after the drain window")
+	}
+}
+
+func TestUndrain(t *testing.T) {
+	rec := forms.ServiceRecord_v1{Details: map[string][]string{drainingDetail: {"2025-03-04T12:00:00Z"}, "Unit": {"Celsius"}}}
+	claimed := rec.Details
+	undrain(&rec)
+	if isDraining(rec) || len(rec.Details["Unit"]) != 1 {
+		t.Errorf("Expected only the draining mark to be dropped, got: %v", rec.Details)
+	}
+	if _, kept := claimed[drainingDetail]; !kept {
+		t.Errorf("Expected the provider's details to be left untouched")
+	}
+}
+
+func TestRegistrationKey(t *testing.T) {
+	ua := &UnitAsset{}
+	rec := forms.ServiceRecord_v1{SystemName: "System", ServiceDefinition: "flow", SubPath: "flow"}
+
+	if key := ua.registrationKey("", rec); key != "" {
+		t.Errorf("Expected no key without StableIDs, got: %s", key)
+	}
+	if key := ua.registrationKey("chosen", rec); key != "chosen" {
+		t.Errorf("Expected the provider's key, got: %s", key)
+	}
+	ua.StableIDs = true
+	derived := ua.registrationKey("", rec)
+	if derived == "" || derived != ua.registrationKey("", rec) {
+		t.Errorf("Expected a stable derived key, got: %s", derived)
+	}
+	rec.SubPath = "other"
+	if ua.registrationKey("", rec) == derived {
+		t.Errorf("Expected a different key for a different subpath")
+	}
+}
+
+type newResourceParams struct {
+	traits      string
+	expectError error
+	testCase    string
+}
+
+func TestNewResourceTraits(t *testing.T) {
+	params := []newResourceParams{
+		{`{"maxRecords": 10, "capacityPolicy": "evict"}`, nil, "Good case, valid traits"},
+		{`{}`, nil, "Good case, defaults"},
+		{`{"recCount": 0}`, errBadTraits, "Bad case, runtime field"},
+		{`{"maxRecord": 10}`, errBadTraits, "Bad case, misspelled trait"},
+		{`{"maxRecords": "10"}`, errBadTraits, "Bad case, wrong type"},
+		{`{"capacityPolicy": "drop"}`, errBadTraits, "Bad case, unknown capacity policy"},
+		{`{"promoteOnStartup": "always"}`, errBadTraits, "Bad case, unknown startup promotion"},
+		{`{"identity": ["ipAddresses"]}`, errBadIdentity, "Bad case, unknown identity field"},
+		{`{"namespaces": "tenant"}`, errBadTraits, "Bad case, unknown namespace source"},
+		{`{"selection": "random"}`, errBadTraits, "Bad case, unknown selection"},
+		{`{"drainWindow": -1}`, errBadTraits, "Bad case, negative drain window"},
+		{`{"trackRequesters": -1}`, errBadTraits, "Bad case, negative requester tracking window"},
+	}
+	for _, c := range params {
+		conf := createConfAssetMultipleTraits()
+		conf.Traits = []json.RawMessage{json.RawMessage(c.traits)}
+		sys := createNewSys()
+		ua, shutdown, err := newResource(conf, &sys)
+		if c.expectError == nil {
+			if err != nil || ua == nil {
+				t.Errorf("Expected the registrar to start, got: %v in '%s'", err, c.testCase)
+				continue
+			}
+			shutdown()
+			continue
+		}
+		if !errors.Is(err, c.expectError) || ua != nil || shutdown != nil {
+			t.Errorf("Expected %v, got: %v in '%s'", c.expectError, err, c.testCase)
+		}
+	}
+}
+
+type checkIdentityParams struct {
+	identity    []string
+	expectError bool
+	testCase    string
+}
+
+func TestCheckIdentity(t *testing.T) {
+	params := []checkIdentityParams{
+		{nil, false, "Good case, default identity"},
+		{[]string{"systemName", "definition", "subpath", "serviceNode", "details.Location"}, false, "Good case, every field"},
+		{[]string{"systemName", "ipAddresses"}, true, "Bad case, unknown field"},
+		{[]string{"details."}, true, "Bad case, detail without a key"},
+	}
+	for _, c := range params {
+		err := checkIdentity(c.identity)
+		if (err != nil) != c.expectError || (err != nil && !errors.Is(err, errBadIdentity)) {
+			t.Errorf("Expected error %t, got: %v in '%s'", c.expectError, err, c.testCase)
+		}
+	}
+}
+
+func TestRegistrationKeyIdentity(t *testing.T) {
+	rec := forms.ServiceRecord_v1{SystemName: "System", ServiceDefinition: "flow", SubPath: "flow",
+		Details: map[string][]string{"Location": {"kitchen"}, "Unit": {"l/min"}}}
+	ua := &UnitAsset{Traits: Traits{StableIDs: true}}
+	derived := ua.registrationKey("", rec)
+	ua.Identity = defaultIdentity
+	if key := ua.registrationKey("", rec); key != derived {
+		t.Errorf("Expected the default identity to derive the same key, got: %s and %s", derived, key)
+	}
+
+	ua.Identity = []string{"systemName", "definition", "details.Location"}
+	derived = ua.registrationKey("", rec)
+	tweaked := rec
+	tweaked.SubPath = "flow/v2"
+	tweaked.Details = map[string][]string{"Location": {"kitchen"}, "Unit": {"m3/h"}}
+	if key := ua.registrationKey("", tweaked); key != derived {
+		t.Errorf("Expected fields outside the identity to keep the key, got: %s and %s", derived, key)
+	}
+	tweaked.Details = map[string][]string{"Location": {"hall"}}
+	if key := ua.registrationKey("", tweaked); key == derived {
+		t.Errorf("Expected a different key for a different location")
+	}
+}
+
+func TestServiceRegistryHandlerIdentity(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	ua.StableIDs = true
+	ua.Identity = []string{"systemName", "definition"}
+	register := func(subPath, location string) (*forms.ServiceRecord_v1, error) {
+		rec := &forms.ServiceRecord_v1{ServiceDefinition: "flow", SystemName: "System", SubPath: subPath, RegLife: 25,
+			ProtoPort: map[string]int{"http": 8870}, Details: map[string][]string{"Location": {location}}, Version: "ServiceRecord_v1"}
+		req := ServiceRegistryRequest{Action: "add", Record: rec, Error: make(chan error)}
+		ua.requests <- req
+		return rec, <-req.Error
+	}
+
+	first, err := register("flow", "kitchen")
+	if err != nil {
+		t.Fatalf("Expected no errors registering: %v", err)
+	}
+	// The provider renamed its subpath and moved, without sending its record ID
+	tweaked, err := register("flow/v2", "hall")
+	if err != nil || tweaked.Id != first.Id || tweaked.Created != first.Created {
+		t.Errorf("Expected an update of record %d created at %s, got record %d created at %s (%v)",
+			first.Id, first.Created, tweaked.Id, tweaked.Created, err)
+	}
+	ua.mu.Lock()
+	stored, count := ua.serviceRegistry[first.Id], len(ua.serviceRegistry)
+	ua.mu.Unlock()
+	if count != 1 || stored.SubPath != "flow/v2" || stored.Details["Location"][0] != "hall" {
+		t.Errorf("Expected the single record to be updated in place, got %d records and %+v", count, stored)
+	}
+}
+
+// --------------------------------------------------------------------------------- //
+// Help functions and structs to test the heartbeat part of serviceRegistryHandler()
+// --------------------------------------------------------------------------------- //
+
+func sendHeartbeatRequest(id int, ch chan ServiceRegistryRequest) error {
+	req := ServiceRegistryRequest{
+		Action: "heartbeat",
+		Id:     int64(id),
+		Error:  make(chan error),
+	}
+	ch <- req
+	return <-req.Error
+}
+
+func TestServiceRegistryHandlerHeartbeat(t *testing.T) {
+	temp := createConfAssetMultipleTraits()
+	sys := createNewSys()
+	res, shutdown := newTestResource(t, temp, &sys)
+	defer shutdown()
+	ua, _ := res.(*UnitAsset)
+
+	rec, err := sendKeyedAddRequest("", "flow", ua.requests)
+	if err != nil {
+		t.Fatalf("Expected no errors registering: %v", err)
+	}
+	ua.mu.Lock()
+	registeredAt, seen := ua.lastSeen[rec.Id]
+	ua.lastSeen[rec.Id] = registeredAt.Add(-time.Minute) // pretend the provider was last heard from a minute ago
+	validity := ua.serviceRegistry[rec.Id].EndOfValidity
+	ua.mu.Unlock()
+	if !seen {
+		t.Fatalf("Expected the registration to count as the provider being seen")
+	}
+
+	if err := sendHeartbeatRequest(rec.Id, ua.requests); err != nil {
+		t.Fatalf("Expected no errors sending the heartbeat: %v", err)
+	}
+	ua.mu.Lock()
+	lastSeen := ua.lastSeen[rec.Id]
+	dbRec := ua.serviceRegistry[rec.Id]
+	ua.mu.Unlock()
+	if !lastSeen.After(registeredAt.Add(-time.Minute)) {
+		t.Errorf("Expected the heartbeat to bump lastSeen, got: %s", lastSeen)
+	}
+	if dbRec.EndOfValidity != validity {
+		t.Errorf("Expected the heartbeat to keep the end of validity %s, got: %s", validity, dbRec.EndOfValidity)
+	}
+
+	if err := sendHeartbeatRequest(rec.Id+100, ua.requests); !errors.Is(err, errUnknownRecord) {
+		t.Errorf("Expected errUnknownRecord for a heartbeat of an unknown record, got: %v", err)
+	}
+}
+
+func TestServiceRegistryHandlerFreshness(t *testing.T) {
+	temp := createConfAssetMultipleTraits()
+	sys := createNewSys()
+	res, shutdown := newTestResource(t, temp, &sys)
+	defer shutdown()
+	ua, _ := res.(*UnitAsset)
+
+	quiet, _ := sendKeyedAddRequest("", "flow", ua.requests)
+	recent, _ := sendKeyedAddRequest("", "flow", ua.requests)
+	ua.mu.Lock()
+	ua.lastSeen[quiet.Id] = time.Now().Add(-2 * time.Minute)
+	ua.mu.Unlock()
+
+	table := []struct {
+		fresh       time.Duration
+		expectedIDs []int
+	}{
+		// No freshness window, all records
+		{0, []int{quiet.Id, recent.Id}},
+		// Only the provider heard from within the last minute
+		{time.Minute, []int{recent.Id}},
+		// Both providers heard from within the last hour
+		{time.Hour, []int{quiet.Id, recent.Id}},
+	}
+	for _, test := range table {
+		req := ServiceRegistryRequest{
+			Action: "read",
+			Record: &forms.ServiceQuest_v1{ServiceDefinition: "flow"},
+			Fresh:  test.fresh,
+			Result: make(chan []forms.ServiceRecord_v1),
+			Error:  make(chan error),
+		}
+		ua.requests <- req
+		list := <-req.Result
+		var ids []int
+		for _, rec := range list {
+			ids = append(ids, rec.Id)
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, test.expectedIDs) {
+			t.Errorf("Expected records %v within %s, got: %v", test.expectedIDs, test.fresh, ids)
+		}
+	}
+}
+
+type registrationWindowParams struct {
+	window      registrationWindow
+	expectedIDs []int
+	testCase    string
+}
+
+func TestRegistrationWindowFilter(t *testing.T) {
+	base := time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC)
+	records := []forms.ServiceRecord_v1{
+		{Id: 1, Created: base.Add(-10 * time.Minute).Format(time.RFC3339), Updated: base.Add(-time.Minute).Format(time.RFC3339)},
+		{Id: 2, Created: base.Add(-90 * time.Second).Format(time.RFC3339), Updated: base.Add(-90 * time.Second).Format(time.RFC3339)},
+		{Id: 3, Created: base.Add(-30 * time.Second).Format(time.RFC3339), Updated: base.Add(-30 * time.Second).Format(time.RFC3339)},
+		{Id: 4, Created: "yesterday", Updated: base.Format(time.RFC3339)},
+	}
+	params := []registrationWindowParams{
+		{registrationWindow{}, []int{1, 2, 3, 4}, "Good case, no window keeps all records"},
+		{registrationWindow{createdAfter: base.Add(-2 * time.Minute)}, []int{2, 3}, "Good case, created in the last 2 minutes"},
+		{registrationWindow{createdAfter: base.Add(-time.Minute)}, []int{3}, "Good case, created in the last minute"},
+		{registrationWindow{updatedAfter: base.Add(-70 * time.Second)}, []int{1, 3, 4}, "Good case, updated in the last 70 seconds"},
+		{registrationWindow{createdAfter: base.Add(-time.Hour), updatedAfter: base.Add(-70 * time.Second)}, []int{1, 3},
+			"Good case, both limits, skipping the unparseable creation time"},
+		{registrationWindow{createdAfter: base}, nil, "Good case, nothing created after the limit"},
+	}
+
+	for _, c := range params {
+		var ids []int
+		for _, rec := range c.window.filter(records) {
+			ids = append(ids, rec.Id)
+		}
+		if !slices.Equal(ids, c.expectedIDs) {
+			t.Errorf("Expected records %v, got: %v in '%s'", c.expectedIDs, ids, c.testCase)
+		}
+	}
+}
+
 // --------------------------------------------------------------------------- //
 // Help functions and structs to test the read part of serviceRegistryHandler()
 // --------------------------------------------------------------------------- //
@@ -409,9 +873,8 @@ func TestServiceRegistryHandlerRead(t *testing.T) {
 		// Setup
 		temp := createConfAssetMultipleTraits()
 		sys := createNewSys()
-		res, shutdown := newResource(temp, &sys)
+		res, shutdown := newTestResource(t, temp, &sys)
 		ua, _ := res.(*UnitAsset)
-		time.Sleep(25 * time.Millisecond)
 		// Add some services to the serviceregistrar with details: detail1 detail2 ... detailN
 		sendAddRequestWithDetails(1, "test", "sub1", time.Now().Format(time.RFC3339), ua.requests)
 		sendAddRequestWithDetails(4, "test", "sub2", time.Now().Format(time.RFC3339), ua.requests)
@@ -435,26 +898,43 @@ func TestServiceRegistryHandlerRead(t *testing.T) {
 // Help functions and structs to test delete in serviceRegistryHandler()
 // ------------------------------------------------------------------------ //
 
-func sendDeleteRequest(id int, ch chan ServiceRegistryRequest) {
-	ch <- ServiceRegistryRequest{
+func sendDeleteRequest(id int, ch chan ServiceRegistryRequest) error {
+	req := ServiceRegistryRequest{
 		Action: "delete",
 		Id:     int64(id),
+		Error:  make(chan error),
 	}
+	ch <- req
+	return <-req.Error
 }
 
 func TestServiceRegistryHandlerDelete(t *testing.T) {
 	// Setup
 	temp := createConfAssetMultipleTraits()
 	sys := createNewSys()
-	res, shutdown := newResource(temp, &sys)
+	res, shutdown := newTestResource(t, temp, &sys)
+	defer shutdown()
 	ua, _ := res.(*UnitAsset)
-	time.Sleep(25 * time.Millisecond)
-	// Add a services to the serviceregistrar
-	sendAddRequestWithDetails(1, "test", "sub1", time.Now().Format(time.RFC3339), ua.requests)
-
-	sendDeleteRequest(0, ua.requests)
+	// Add a services to the serviceregistrar, the handler having received the request once the send returns
+	if err := sendAddRequestWithDetails(1, "test", "sub1", time.Now().Format(time.RFC3339), ua.requests); err != nil {
+		t.Fatalf("Expected no errors registering: %v", err)
+	}
+	ua.mu.Lock()
+	ids := slices.Collect(maps.Keys(ua.serviceRegistry))
+	ua.mu.Unlock()
+	if len(ids) != 1 {
+		t.Fatalf("Expected 1 record, got: %d", len(ids))
+	}
 
-	shutdown()
+	if err := sendDeleteRequest(ids[0], ua.requests); err != nil {
+		t.Errorf("Expected no errors deleting record %d: %v", ids[0], err)
+	}
+	ua.mu.Lock()
+	remaining := len(ua.serviceRegistry)
+	ua.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected the record to be deleted, got: %d records", remaining)
+	}
 }
 
 // ------------------------------------------------------------------------ //
@@ -514,7 +994,7 @@ func TestFilterByServiceDefAndDetails(t *testing.T) {
 			t.Errorf("Failed during setup in '%s'", c.testCase)
 		}
 		checkLoc := map[string][]string{"Location": {"Livingroom"}}
-		lst := ua.FilterByServiceDefinitionAndDetails("testDef", checkLoc)
+		lst := ua.FilterByServiceDefinitionAndDetails("testDef", checkLoc, matchSubset)
 		if (c.expectMatch == true) && (len(lst) < 1) {
 			t.Errorf("Expected atleast 1 service")
 		}
@@ -524,17 +1004,131 @@ func TestFilterByServiceDefAndDetails(t *testing.T) {
 	}
 }
 
+func TestRecordMatchesManagedDetails(t *testing.T) {
+	record := forms.ServiceRecord_v1{
+		ServiceDefinition: "testDef",
+		Details:           map[string][]string{"Location": {"Kitchen"}, registrantDetail: {"thermostat"}},
+	}
+	quest := map[string][]string{"Location": {"Kitchen"}}
+	for _, mode := range []matchMode{matchSubset, matchExact, matchSuperset} {
+		if !recordMatches(record, "testDef", quest, mode) {
+			t.Errorf("Expected the details managed by the registrar to be ignored in mode '%s'", mode)
+		}
+	}
+}
+
+// Creates an asset with a large registry, indexing the Location detail if asked to
+func createLargeRegistry(records int, indexed bool) *UnitAsset {
+	ua := initTemplate().(*UnitAsset)
+	ua.serviceRegistry = make(map[int]forms.ServiceRecord_v1)
+	if indexed {
+		ua.detailIndex = newDetailIndex([]string{"Location"})
+	}
+	for i := 0; i < records; i++ {
+		var form forms.ServiceRecord_v1
+		form.Id = i
+		form.ServiceDefinition = "testDef"
+		form.SystemName = fmt.Sprintf("testSystem%d", i)
+		form.Details = map[string][]string{"Location": {fmt.Sprintf("Room%d", i%100)}}
+		ua.storeRecord(form)
+	}
+	return ua
+}
+
+func TestFilterByServiceDefAndDetailsIndexed(t *testing.T) {
+	scanned := createLargeRegistry(1000, false)
+	indexed := createLargeRegistry(1000, true)
+	checkLoc := map[string][]string{"Location": {"Room7", "Room42"}}
+
+	want := len(scanned.FilterByServiceDefinitionAndDetails("testDef", checkLoc, matchSubset))
+	got := len(indexed.FilterByServiceDefinitionAndDetails("testDef", checkLoc, matchSubset))
+	if want != 20 || got != want {
+		t.Errorf("Expected 20 matches from both lookups, got %d (scan) and %d (index)", want, got)
+	}
+
+	// Replacing and deleting records must keep the index up to date
+	moved := indexed.serviceRegistry[7]
+	moved.Details = map[string][]string{"Location": {"Room8"}}
+	indexed.storeRecord(moved)
+	indexed.deleteRecord(42)
+	if got := len(indexed.FilterByServiceDefinitionAndDetails("testDef", checkLoc, matchSubset)); got != 18 {
+		t.Errorf("Expected 18 matches after updating the registry, got %d", got)
+	}
+}
+
+type foldDetailsParams struct {
+	fold        bool
+	indexed     bool
+	quest       map[string][]string
+	mode        matchMode
+	expectMatch bool
+	testCase    string
+}
+
+func TestFilterByServiceDefAndDetailsFolded(t *testing.T) {
+	params := []foldDetailsParams{
+		{false, false, map[string][]string{"Location": {"kitchen"}}, matchSubset, false, "Good case, exact by default"},
+		{false, false, map[string][]string{"Location": {"Kitchen"}}, matchSubset, true, "Good case, same case by default"},
+		{true, false, map[string][]string{"Location": {"kitchen"}}, matchSubset, true, "Good case, folded case"},
+		{true, false, map[string][]string{"Location": {" KITCHEN "}}, matchSubset, true, "Good case, folded whitespace"},
+		{true, true, map[string][]string{"Location": {"kitchen"}}, matchSubset, true, "Good case, folded index"},
+		{true, false, map[string][]string{"Location": {"kitchen"}, "Unit": {"celsius"}}, matchExact, true, "Good case, folded exact mode"},
+		{true, false, map[string][]string{"location": {"kitchen"}}, matchSubset, false, "Bad case, keys are not folded"},
+		{true, true, map[string][]string{"Location": {"hall"}}, matchSubset, false, "Bad case, other value"},
+	}
+	for _, c := range params {
+		ua := initTemplate().(*UnitAsset)
+		ua.FoldDetails = c.fold
+		ua.serviceRegistry = make(map[int]forms.ServiceRecord_v1)
+		if c.indexed {
+			ua.detailIndex = newDetailIndex([]string{"Location"})
+		}
+		ua.storeRecord(forms.ServiceRecord_v1{Id: 1, ServiceDefinition: "testDef",
+			Details: map[string][]string{"Location": {"Kitchen"}, "Unit": {" Celsius"}}})
+
+		lst := ua.FilterByServiceDefinitionAndDetails("testDef", c.quest, c.mode)
+		if got := len(lst) == 1; got != c.expectMatch {
+			t.Errorf("Expected a match %t, got: %v in '%s'", c.expectMatch, lst, c.testCase)
+		}
+		if len(lst) == 1 && lst[0].Details["Unit"][0] != " Celsius" {
+			t.Errorf("Expected the record to be returned as registered, got: %v in '%s'", lst[0].Details, c.testCase)
+		}
+	}
+}
+
+func BenchmarkFilterByServiceDefAndDetailsScan(b *testing.B) {
+	ua := createLargeRegistry(10000, false)
+	checkLoc := map[string][]string{"Location": {"Room42"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ua.FilterByServiceDefinitionAndDetails("testDef", checkLoc, matchSubset)
+	}
+}
+
+func BenchmarkFilterByServiceDefAndDetailsIndexed(b *testing.B) {
+	ua := createLargeRegistry(10000, true)
+	checkLoc := map[string][]string{"Location": {"Room42"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ua.FilterByServiceDefinitionAndDetails("testDef", checkLoc, matchSubset)
+	}
+}
+
 // ---------------------------------------------------- //
 // Help functions and structs to test checkExpiration()
 // ---------------------------------------------------- //
 
 func createRegistryWithService(year any) (ua *UnitAsset, cancel func(), err error) {
 	sys := createNewSys()
-	temp, cancel := newResource(createConfAssetMultipleTraits(), &sys)
+	temp, cancel, err := newResource(createConfAssetMultipleTraits(), &sys)
+	if err != nil {
+		return nil, nil, err
+	}
 	ua, ok := temp.(*UnitAsset)
 	if !ok {
 		return nil, nil, fmt.Errorf("Failed while typecasting to local UnitAsset")
 	}
+	useFakeClock(ua, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
 
 	var test forms.ServiceRecord_v1
 	test.SystemName = "testSystem"
@@ -587,6 +1181,209 @@ func TestCheckExpiration(t *testing.T) {
 	}
 }
 
+func TestServiceRegistryHandlerExpiry(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	clock := useFakeClock(ua, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	rec := &forms.ServiceRecord_v1{ServiceDefinition: "temperature", SystemName: "thermostat", SubPath: "temp",
+		ProtoPort: map[string]int{"http": 1234}, RegLife: 30, Version: "ServiceRecord_v1"}
+	if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+		t.Fatalf("Unexpected error registering: %v", err)
+	}
+	present := func() bool {
+		ua.mu.Lock()
+		defer ua.mu.Unlock()
+		_, exists := ua.serviceRegistry[rec.Id]
+		return exists
+	}
+
+	clock.Advance(29 * time.Second)
+	if !present() {
+		t.Fatalf("Expected the record to be kept before its end of validity")
+	}
+
+	// A renewal pushes the end of validity back
+	if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+		t.Fatalf("Unexpected error renewing: %v", err)
+	}
+	clock.Advance(29 * time.Second)
+	if !present() {
+		t.Fatalf("Expected the renewed record to be kept")
+	}
+	clock.Advance(time.Second)
+	if present() {
+		t.Errorf("Expected the record to be removed at its end of validity")
+	}
+}
+
+func TestServiceRegistryHandlerRegistrations(t *testing.T) {
+	sys := createTestSystem()
+	temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+	defer shutdown()
+	ua := temp.(*UnitAsset)
+	useFakeClock(ua, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	rec := &forms.ServiceRecord_v1{ServiceDefinition: "temperature", SystemName: "thermostat", SubPath: "temp",
+		ProtoPort: map[string]int{"http": 1234}, RegLife: 30, Version: "ServiceRecord_v1"}
+	for range 2 { // a registration and its renewal
+		if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+			t.Fatalf("Unexpected error registering: %v", err)
+		}
+	}
+	invalid := ServiceRegistryRequest{Action: "add", Record: &forms.ServiceQuest_v1{}, Error: make(chan error)}
+	ua.requests <- invalid
+	if err := <-invalid.Error; err == nil {
+		t.Fatalf("Expected an error registering an invalid record")
+	}
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.registrations != 2 {
+		t.Errorf("Expected 2 registrations to be counted, got %d", ua.registrations)
+	}
+}
+
+type leadTimeParams struct {
+	terms    []time.Duration // lengths of the terms, the last one still running unless stepDown is set
+	stepDown bool
+	expected time.Duration
+	testCase string
+}
+
+type promotesOnStartupParams struct {
+	promotion string
+	peers     int
+	expected  bool
+	testCase  string
+}
+
+func TestPromotesOnStartup(t *testing.T) {
+	params := []promotesOnStartupParams{
+		{"", 0, false, "Good case, waits for the election by default"},
+		{promoteSolo, 0, true, "Good case, sole registrar"},
+		{promoteSolo, 2, false, "Good case, solo with peers waits for the election"},
+		{promoteForce, 2, true, "Good case, forced with peers"},
+	}
+	for _, c := range params {
+		ua := &UnitAsset{Traits: Traits{PromoteOnStartup: c.promotion}}
+		if got := ua.promotesOnStartup(c.peers); got != c.expected {
+			t.Errorf("Expected %t, got: %t in '%s'", c.expected, got, c.testCase)
+		}
+	}
+}
+
+func TestPromoteOnStartup(t *testing.T) {
+	for promotion, sys := range map[string]components.System{promoteSolo: createNewSys(), promoteForce: createTestSystem()} {
+		conf := createConfAssetMultipleTraits()
+		conf.Traits = []json.RawMessage{json.RawMessage(`{"promoteOnStartup": "` + promotion + `"}`)}
+		temp, shutdown := newTestResource(t, conf, &sys)
+		ua := temp.(*UnitAsset)
+		if !ua.leading || ua.leadingSince.IsZero() || ua.leadingRegistrar != nil {
+			t.Errorf("Expected the registrar to lead right after its construction in '%s'", promotion)
+		}
+		shutdown()
+	}
+}
+
+func TestLeadTime(t *testing.T) {
+	params := []leadTimeParams{
+		{nil, false, 0, "Good case, never led"},
+		{[]time.Duration{time.Minute}, false, time.Minute, "Good case, current term"},
+		{[]time.Duration{time.Minute}, true, time.Minute, "Good case, ended term"},
+		{[]time.Duration{time.Minute, time.Hour}, false, time.Hour + time.Minute, "Good case, ended and current terms"},
+		{[]time.Duration{time.Minute, time.Hour}, true, time.Hour + time.Minute, "Good case, two ended terms"},
+	}
+	for _, c := range params {
+		ua := &UnitAsset{}
+		now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+		for i, term := range c.terms {
+			ua.leading = true
+			ua.leadingSince = now
+			now = now.Add(term)
+			if i < len(c.terms)-1 || c.stepDown {
+				ua.loseLead(now)
+				now = now.Add(time.Second) // on standby between the terms
+			}
+		}
+		if c.stepDown {
+			ua.loseLead(now) // losing the lead again while on standby adds nothing
+		}
+		if got := ua.leadTime(now); got != c.expected {
+			t.Errorf("%s: expected a lead time of %s, got %s", c.testCase, c.expected, got)
+		}
+	}
+}
+
+func TestShutdownSummary(t *testing.T) {
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	ua := &UnitAsset{}
+	ua.serviceRegistry = map[int]forms.ServiceRecord_v1{1: {}, 2: {}}
+	ua.registrations = 5
+	ua.startedAt = start
+	ua.leading = true
+	ua.leadingSince = start.Add(time.Hour)
+
+	got := ua.shutdownSummary(start.Add(90 * time.Minute))
+	expected := "shutdown summary: records=2 registrations=5 leading=true ledFor=30m0s uptime=1h30m0s"
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+type clockSkewParams struct {
+	skew     time.Duration
+	testCase string
+}
+
+func TestServiceRegistryHandlerClockSkew(t *testing.T) {
+	params := []clockSkewParams{
+		{-time.Hour, "Good case, provider clock behind"},
+		{time.Hour, "Good case, provider clock ahead"},
+		{0, "Good case, provider clock in sync"},
+	}
+
+	for _, c := range params {
+		sys := createTestSystem()
+		temp, shutdown := newTestResource(t, createConfAssetMultipleTraits(), &sys)
+		ua := temp.(*UnitAsset)
+
+		providerNow := time.Now().Add(c.skew)
+		rec := &forms.ServiceRecord_v1{ServiceDefinition: "temperature", SystemName: "thermostat", SubPath: "temp",
+			ProtoPort: map[string]int{"http": 1234}, RegLife: 30, Version: "ServiceRecord_v1",
+			Updated: providerNow.Format(time.RFC3339), EndOfValidity: providerNow.Add(30 * time.Second).Format(time.RFC3339)}
+		if err := sendAddRequestRecord(rec, "", ua.requests); err != nil {
+			t.Fatalf("Unexpected error registering: %v in '%s'", err, c.testCase)
+		}
+
+		// The renewal also carries the provider's skewed timestamps
+		renewal := *rec
+		renewal.Updated = providerNow.Add(10 * time.Second).Format(time.RFC3339)
+		renewal.EndOfValidity = providerNow.Add(40 * time.Second).Format(time.RFC3339)
+		if err := sendAddRequestRecord(&renewal, "", ua.requests); err != nil {
+			t.Fatalf("Unexpected error renewing: %v in '%s'", err, c.testCase)
+		}
+
+		checkExpiration(ua, rec.Id)
+		ua.mu.Lock()
+		stored, exists := ua.serviceRegistry[rec.Id]
+		ua.mu.Unlock()
+		if !exists {
+			t.Fatalf("Expected the record not to expire prematurely in '%s'", c.testCase)
+		}
+		end, err := time.Parse(time.RFC3339, stored.EndOfValidity)
+		if err != nil || end.Sub(time.Now().Add(30*time.Second)).Abs() > 2*time.Second {
+			t.Errorf("Expected the validity to follow the registrar's clock, got: %s in '%s'", stored.EndOfValidity, c.testCase)
+		}
+		updated, err := time.Parse(time.RFC3339, stored.Updated)
+		if err != nil || time.Since(updated).Abs() > 2*time.Second {
+			t.Errorf("Expected the update time to follow the registrar's clock, got: %s in '%s'", stored.Updated, c.testCase)
+		}
+		shutdown()
+	}
+}
+
 // ----------------------------------------------------- //
 // Help functions and structs to test getUniqueSystems()
 // ----------------------------------------------------- //
@@ -668,7 +1465,7 @@ func TestGetUniqueSystems(t *testing.T) {
 		if err != nil {
 			t.Errorf("Failed during setup in '%s' with error: %v", c.testCase, err)
 		}
-		_, err = getUniqueSystems(ua)
+		_, err = getUniqueSystems(ua, "")
 		if c.expectError == false && err != nil {
 			t.Errorf("Failed while getting unique systems in '%s': %v", c.testCase, err)
 		}
@@ -677,3 +1474,137 @@ func TestGetUniqueSystems(t *testing.T) {
 		}
 	}
 }
+
+func sendAddRequestRecord(rec *forms.ServiceRecord_v1, key string, ch chan ServiceRegistryRequest) error {
+	req := ServiceRegistryRequest{
+		Action: "add",
+		Record: rec,
+		Key:    key,
+		Error:  make(chan error),
+	}
+	ch <- req
+	return <-req.Error
+}
+
+type capacityParams struct {
+	policy          string
+	expectedErr     error
+	expectedRecords []string
+	testCase        string
+}
+
+func TestServiceRegistryHandlerCapacity(t *testing.T) {
+	params := []capacityParams{
+		{capacityReject, errRegistryFull, []string{"flow", "level"}, "Bad case, reject policy at capacity"},
+		{"", errRegistryFull, []string{"flow", "level"}, "Bad case, rejecting by default at capacity"},
+		{capacityEvict, nil, []string{"level", "pressure"}, "Good case, evict policy at capacity"},
+	}
+	for _, c := range params {
+		temp := createConfAssetMultipleTraits()
+		temp.Traits = []json.RawMessage{json.RawMessage(`{"maxRecords": 2, "capacityPolicy": "` + c.policy + `"}`)}
+		sys := createNewSys()
+		res, shutdown := newTestResource(t, temp, &sys)
+		ua, _ := res.(*UnitAsset)
+
+		flow, _ := sendKeyedAddRequest("", "flow", ua.requests)
+		if _, err := sendKeyedAddRequest("pump-level", "level", ua.requests); err != nil {
+			t.Fatalf("Expected no errors below capacity, got: %v in '%s'", err, c.testCase)
+		}
+
+		// Renewals of existing records always succeed, by ID or by registration key
+		renewal := *flow
+		if err := sendAddRequestRecord(&renewal, "", ua.requests); err != nil || renewal.Id != flow.Id {
+			t.Errorf("Expected the renewal of ID %d to succeed at capacity, got ID %d (%v) in '%s'", flow.Id, renewal.Id, err, c.testCase)
+		}
+		if _, err := sendKeyedAddRequest("pump-level", "level", ua.requests); err != nil {
+			t.Errorf("Expected the keyed renewal to succeed at capacity, got: %v in '%s'", err, c.testCase)
+		}
+
+		_, err := sendKeyedAddRequest("", "pressure", ua.requests)
+		if !errors.Is(err, c.expectedErr) {
+			t.Errorf("Expected error %v, got: %v in '%s'", c.expectedErr, err, c.testCase)
+		}
+		ua.mu.Lock()
+		var definitions []string
+		for _, rec := range ua.serviceRegistry {
+			definitions = append(definitions, rec.ServiceDefinition)
+		}
+		ua.mu.Unlock()
+		slices.Sort(definitions)
+		if !slices.Equal(definitions, c.expectedRecords) {
+			t.Errorf("Expected the records %v, got: %v in '%s'", c.expectedRecords, definitions, c.testCase)
+		}
+		shutdown()
+	}
+}
+
+type normalizeSubPathParams struct {
+	subPath     string
+	expected    string
+	expectedErr error
+	testCase    string
+}
+
+func TestNormalizeSubPath(t *testing.T) {
+	params := []normalizeSubPathParams{
+		{"Kitchen/temperature", "Kitchen/temperature", nil, "Good case, clean sub-path kept"},
+		{"/Kitchen//temperature/", "Kitchen/temperature", nil, "Good case, surrounding and repeated slashes dropped"},
+		{"", "", nil, "Good case, empty sub-path kept"},
+		{"Küche/temp;raw", "K%C3%BCche/temp%3Braw", nil, "Good case, segments escaped"},
+		{"K%C3%BCche/temp", "K%C3%BCche/temp", nil, "Good case, escaped segments not escaped twice"},
+		{"Kitchen/temp erature", "", errBadSubPath, "Bad case, space"},
+		{"Kitchen/temp%20erature", "", errBadSubPath, "Bad case, escaped space"},
+		{"Kitchen/temp\n", "", errBadSubPath, "Bad case, control character"},
+		{"Kitchen/temp?unit=C", "", errBadSubPath, "Bad case, query delimiter"},
+		{"Kitchen/temp#now", "", errBadSubPath, "Bad case, fragment delimiter"},
+		{"Kitchen/../admin", "", errBadSubPath, "Bad case, dot segment"},
+		{"Kitchen/a%2Fb", "", errBadSubPath, "Bad case, escaped slash"},
+		{"Kitchen/100%", "", errBadSubPath, "Bad case, malformed escape"},
+	}
+	for _, c := range params {
+		rec := forms.ServiceRecord_v1{SubPath: c.subPath}
+		err := normalizeSubPath(&rec)
+		if !errors.Is(err, c.expectedErr) {
+			t.Errorf("Expected the error %v, got: %v in '%s'", c.expectedErr, err, c.testCase)
+			continue
+		}
+		if err == nil && rec.SubPath != c.expected {
+			t.Errorf("Expected the sub-path %q, got: %q in '%s'", c.expected, rec.SubPath, c.testCase)
+		}
+	}
+}
+
+type inSubnetParams struct {
+	subnet    string
+	addresses []string
+	expected  []string
+	testCase  string
+}
+
+func TestInSubnet(t *testing.T) {
+	params := []inSubnetParams{
+		{"10.0.1.0/24", []string{"10.0.1.7"}, []string{"10.0.1.7"}, "Good case, address within"},
+		{"10.0.1.0/24", []string{"10.0.2.7"}, nil, "Good case, address out of the subnet dropped"},
+		{"10.0.1.0/24", []string{"192.168.1.2", "10.0.1.7"}, []string{"10.0.1.7"}, "Good case, only the reachable address kept"},
+		{"fd00:1::/64", []string{"fd00:1::5", "10.0.1.7"}, []string{"fd00:1::5"}, "Good case, IPv6 subnet"},
+		{"10.0.1.0/24", []string{"thermostat.local"}, nil, "Bad case, host name instead of an address"},
+		{"10.0.1.0/24", nil, nil, "Bad case, no address"},
+	}
+	for _, c := range params {
+		_, subnet, err := net.ParseCIDR(c.subnet)
+		if err != nil {
+			t.Fatalf("Failed parsing the subnet %s: %v", c.subnet, err)
+		}
+		records := []forms.ServiceRecord_v1{{Id: 1, IPAddresses: c.addresses}}
+		kept := inSubnet(records, subnet)
+		if c.expected == nil {
+			if len(kept) != 0 {
+				t.Errorf("Expected the record to be dropped, got: %v in '%s'", kept, c.testCase)
+			}
+			continue
+		}
+		if len(kept) != 1 || !slices.Equal(kept[0].IPAddresses, c.expected) {
+			t.Errorf("Expected the addresses %v, got: %v in '%s'", c.expected, kept, c.testCase)
+		}
+	}
+}
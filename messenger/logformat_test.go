@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"testing"
+	"time"
+)
+
+// --------------------------------- //
+// Tests for the JSON log formatter
+// --------------------------------- //
+
+type jsonLogWriterTestStruct struct {
+	entry         string
+	expectedLevel string
+	expectedMsg   string
+	testName      string
+}
+
+var jsonLogWriterTestParams = []jsonLogWriterTestStruct{
+	{"The system is up\n", "info", "The system is up", "Good case, info entry"},
+	{"Warning: could not unmarshal traits\n", "warn", "Warning: could not unmarshal traits", "Good case, warning entry"},
+	{"Error reading the request body: EOF\n", "error", "Error reading the request body: EOF", "Good case, error entry"},
+	{"say \"hi\"\tnow\n\n", "info", "say \"hi\"\tnow", "Good case, quotes and blank lines are escaped or trimmed"},
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	stamp := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, testCase := range jsonLogWriterTestParams {
+		var buf bytes.Buffer
+		w := &jsonLogWriter{out: &buf, system: "testsys", now: func() time.Time { return stamp }}
+
+		n, err := w.Write([]byte(testCase.entry))
+		if err != nil || n != len(testCase.entry) {
+			t.Errorf("In test case: %s: Expected %d bytes written without error, got: %d, %v", testCase.testName, len(testCase.entry), n, err)
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("}\n")) || bytes.Count(buf.Bytes(), []byte("\n")) != 1 {
+			t.Errorf("In test case: %s: Expected a single JSON line, got: %q", testCase.testName, buf.String())
+		}
+		var line logLine
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("In test case: %s: Expected valid JSON, got: %q (%v)", testCase.testName, buf.String(), err)
+		}
+		expected := logLine{Ts: "2025-03-04T05:06:07Z", Level: testCase.expectedLevel, Sys: "testsys", Msg: testCase.expectedMsg}
+		if line != expected {
+			t.Errorf("In test case: %s: Expected %+v, got: %+v", testCase.testName, expected, line)
+		}
+	}
+}
+
+func TestJSONLogWriterWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&jsonLogWriter{out: &buf, system: "testsys", now: time.Now}, "", 0)
+	logger.Printf("first %d", 1)
+	logger.Println("second")
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 JSON lines, got: %q", buf.String())
+	}
+	for i, expectedMsg := range []string{"first 1", "second"} {
+		var line logLine
+		if err := json.Unmarshal(lines[i], &line); err != nil || line.Msg != expectedMsg {
+			t.Errorf("Expected message %q, got: %q (%v)", expectedMsg, line.Msg, err)
+		}
+	}
+}
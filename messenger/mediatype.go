@@ -0,0 +1,80 @@
+/*******************************************************************************
+ * Copyright (c) 2025 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// supportedMediaTypes are the media types the forms can be packed in and unpacked from
+var supportedMediaTypes = []string{"application/json", "application/xml"}
+
+// defaultMediaTypes are the media types accepted when the traits do not list any
+var defaultMediaTypes = []string{"application/json"}
+
+// errUnsupportedMediaType is returned when a request body is in a media type that is not accepted
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// acceptedMediaTypes returns the configured media types that the forms support, or the default ones if none is configured
+func acceptedMediaTypes(configured []string) []string {
+	var accepted []string
+	for _, mediaType := range configured {
+		if slices.Contains(supportedMediaTypes, mediaType) {
+			accepted = append(accepted, mediaType)
+		}
+	}
+	if len(accepted) == 0 {
+		return defaultMediaTypes
+	}
+	return accepted
+}
+
+// checkMediaTypes warns about the configured media types that the forms do not support, which are ignored
+func checkMediaTypes(configured []string) {
+	for _, mediaType := range configured {
+		if !slices.Contains(supportedMediaTypes, mediaType) {
+			log.Printf("Warning: ignoring the unsupported media type %q, the forms support %s\n", mediaType, strings.Join(supportedMediaTypes, ", "))
+		}
+	}
+}
+
+// negotiateMediaType returns the media type of the Content-Type header if it is one of the accepted ones,
+// or an error naming the accepted media types
+func negotiateMediaType(contentType string, accepted []string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("malformed content type %q: %w", contentType, err)
+	}
+	if !slices.Contains(accepted, mediaType) {
+		return "", fmt.Errorf("%w %s, the accepted media types are %s", errUnsupportedMediaType, mediaType, strings.Join(accepted, ", "))
+	}
+	return mediaType, nil
+}
+
+// mediaTypeStatus maps a failed negotiation to the HTTP status of the reply
+func mediaTypeStatus(err error) int {
+	if errors.Is(err, errUnsupportedMediaType) {
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
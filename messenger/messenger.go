@@ -5,9 +5,14 @@ import (
 	"context"
 	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,6 +26,7 @@ func main() {
 	defer cancel()
 
 	sys := components.NewSystem("messenger", ctx)
+	setLogFormat(sys.Name) // emit JSON lines instead of text when LOG_FORMAT=json
 	sys.Husk = &components.Husk{
 		Description: "is a logging system that recieves log messages from other systems.",
 		Details:     map[string][]string{"Developer": {"alex"}},
@@ -62,11 +68,25 @@ func main() {
 
 	usecases.RequestCertificate(&sys)
 	usecases.RegisterServices(&sys)
-	go usecases.SetoutServers(&sys)
+	go setoutServers(&sys)
 	<-sys.Sigs
 	usecases.LogInfo(&sys, "shutting down %s", sys.Name)
 	cancel()
-	time.Sleep(2 * time.Second)
+	time.Sleep(shutdownGrace(2 * time.Second))
+	for _, ua := range sys.UAssets {
+		if messenger, ok := (*ua).(*UnitAsset); ok {
+			usecases.LogInfo(&sys, "%s", messenger.shutdownSummary())
+		}
+	}
+}
+
+// shutdownGrace returns how long the goroutines are given to end once the context is cancelled.
+// The SHUTDOWN_GRACE environment variable (e.g., "5s") overrides the default; an invalid value is ignored.
+func shutdownGrace(defaultGrace time.Duration) time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE")); err == nil && grace >= 0 {
+		return grace
+	}
+	return defaultGrace
 }
 
 func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath string) {
@@ -75,6 +95,14 @@ func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath
 		ua.handleNewMessage(w, r)
 	case "dashboard":
 		ua.handleDashboard(w, r)
+	case "metrics":
+		ua.handleMetrics(w, r)
+	case "export":
+		ua.handleExport(w, r)
+	case "summary":
+		ua.handleSummary(w, r)
+	case "errors":
+		ua.handleErrorRates(w, r)
 	default:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
@@ -85,7 +113,12 @@ func (ua *UnitAsset) handleNewMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
 	body, err := io.ReadAll(r.Body)
+	if bodyTooLarge(err) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError),
 			http.StatusInternalServerError)
@@ -93,17 +126,103 @@ func (ua *UnitAsset) handleNewMessage(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
+	if _, err := negotiateMediaType(r.Header.Get("Content-Type"), acceptedMediaTypes(ua.MediaTypes)); errors.Is(err, errUnsupportedMediaType) {
+		writeIntakeError(w, errUnsupportedType, err.Error())
+		return
+	}
 	form, err := usecases.Unpack(body, r.Header.Get("Content-Type"))
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		// Not a single form, but it might be a batch of messages
+		ua.handleMessageBatch(w, r, body)
 		return
 	}
 	msg, ok := form.(*forms.SystemMessage_v1)
 	if !ok {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeIntakeError(w, errWrongForm, fmt.Sprintf("expected a SystemMessage_v1 form, got %T", form))
+		return
+	}
+	if msg.System == "" {
+		writeIntakeError(w, errMissingField, "the system of the message is empty")
+		return
+	}
+	if !ua.accepts(*msg) {
+		// Too noisy, drop it without telling the sender to reconfigure
+		w.WriteHeader(http.StatusAccepted)
 		return
 	}
 	ua.addMessage(*msg) // Don't want to have to deal with pointers, hence the *
+	if r.Header.Get(forwardedHeader) == "" {
+		ua.queueUpstream(*msg)
+	}
+}
+
+// handleMessageBatch stores a JSON array of SystemMessage forms, sent for example by a system replaying
+// the messages it buffered while the messenger was unreachable, and replies with the count accepted.
+// The whole batch is rejected if any of its messages is not a SystemMessage form, while messages
+// below the minimum level are accepted but not stored.
+func (ua *UnitAsset) handleMessageBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/json") {
+		writeIntakeError(w, errUnparsable, fmt.Sprintf("cannot unpack a message with content type %q", contentType))
+		return
+	}
+	var batch []forms.SystemMessage_v1
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeIntakeError(w, errUnparsable, "the body is neither a message form nor an array of them")
+		return
+	}
+	for i, msg := range batch {
+		if msg.Version != "SystemMessage_v1" {
+			writeIntakeError(w, errWrongForm, fmt.Sprintf("message %d: expected a SystemMessage_v1 form, got %q", i, msg.Version))
+			return
+		}
+		if msg.System == "" {
+			writeIntakeError(w, errMissingField, fmt.Sprintf("message %d: the system of the message is empty", i))
+			return
+		}
+	}
+	forwarded := r.Header.Get(forwardedHeader) != ""
+	for _, msg := range batch {
+		if ua.accepts(msg) {
+			ua.addMessage(msg)
+			if !forwarded {
+				ua.queueUpstream(msg)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"accepted":%d}`, len(batch))
+}
+
+// Kinds of invalid messages, letting a misconfigured sender know what it did wrong
+const (
+	errUnparsable   = "unparsable"    // The content type or body couldn't be unpacked
+	errWrongForm    = "wrong_form"    // The body was unpacked, but isn't a SystemMessage form
+	errMissingField = "missing_field" // A required field of the form is empty
+
+	errUnsupportedType = "unsupported_media_type" // The content type isn't one of the accepted media types
+)
+
+// intakeError is the JSON body of the reply to an invalid message, a 400 or a 415 for an unsupported media type
+type intakeError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func writeIntakeError(w http.ResponseWriter, kind, message string) {
+	status := http.StatusBadRequest
+	if kind == errUnsupportedType {
+		status = http.StatusUnsupportedMediaType
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(intakeError{Error: kind, Message: message})
+}
+
+// bodyTooLarge reports whether reading a request body failed because it exceeds the size limit
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
 }
 
 // Encapsulates the regular bytes.Buffer, in order to allow causing mock errors
@@ -125,16 +244,38 @@ func (mock *mockableBuffer) Write(body []byte) (int, error) {
 
 const testBufferHeader string = "x-testing-buffer"
 
+// allowCORS sets the CORS headers for requests from an allowed origin and answers
+// their preflight requests, returning true if the request has been answered.
+func (ua *UnitAsset) allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !(slices.Contains(ua.AllowedOrigins, origin) || slices.Contains(ua.AllowedOrigins, "*")) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
 func (ua *UnitAsset) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r) {
+		return
+	}
 	if r.Method != http.MethodGet {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	errors, warnings, latest := ua.filterLogs()
+	errors, warnings, latest, systems := ua.filterLogs()
 	data := map[string]any{
 		"Errors":   errors,
 		"Warnings": warnings,
 		"Latest":   latest,
+		"Systems":  systems,
 	}
 
 	buf := &mockableBuffer{}
@@ -150,3 +291,81 @@ func (ua *UnitAsset) handleDashboard(w http.ResponseWriter, r *http.Request) {
 	}
 	buf.WriteTo(w) // Ignoring errors, can't do much with them anyways if the transfer fails
 }
+
+// handleSummary returns the data shown on the dashboard as JSON, for teams building their own UI
+func (ua *UnitAsset) handleSummary(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.Marshal(newDashboardSummary(ua.filterLogs()))
+	if err != nil {
+		usecases.LogError(ua.Owner, "marshal dashboard summary: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// handleErrorRates returns the systems ranked by their warnings and errors within the error window as JSON,
+// telling the on-call engineers which system is erroring most right now
+func (ua *UnitAsset) handleErrorRates(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.Marshal(ua.rankErrorRates(time.Now()))
+	if err != nil {
+		usecases.LogError(ua.Owner, "marshal error rates: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (ua *UnitAsset) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	ua.writeMetrics(w)
+}
+
+// handleExport streams the log of the system given by the "system" query parameter,
+// or of all systems if omitted, as newline-delimited JSON for download
+func (ua *UnitAsset) handleExport(w http.ResponseWriter, r *http.Request) {
+	if ua.allowCORS(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	system := r.URL.Query().Get("system")
+	msgs, found := ua.snapshotLogs(system)
+	if !found {
+		http.Error(w, "no messages from system "+system, http.StatusNotFound)
+		return
+	}
+	filename := "messages.ndjson"
+	if system != "" {
+		filename = system + ".ndjson"
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if err := writeExport(w, msgs); err != nil {
+		usecases.LogWarn(ua.Owner, "export messages: %s", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -9,8 +10,10 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
 )
 
 type errorReader struct{}
@@ -29,24 +32,39 @@ func TestHandleNewMessage(t *testing.T) {
 		method         string
 		content        string
 		body           io.ReadCloser
+		expectedError  string
 	}{
 		// Method not post
-		{http.StatusMethodNotAllowed, http.MethodGet, "", nil},
+		{http.StatusMethodNotAllowed, http.MethodGet, "", nil, ""},
 		// Read body error
-		{http.StatusInternalServerError, http.MethodPost, "", &errorReader{}},
+		{http.StatusInternalServerError, http.MethodPost, "", &errorReader{}, ""},
 		// Unpack error
-		{http.StatusBadRequest, http.MethodPost, "bad type", nil},
+		{http.StatusBadRequest, http.MethodPost, "bad type", nil, errUnparsable},
+		// Unsupported media type
+		{http.StatusUnsupportedMediaType, http.MethodPost, "text/plain",
+			io.NopCloser(strings.NewReader(`{"version":"SystemMessage_v1","system":"test"}`)), errUnsupportedType,
+		},
 		// Wrong form
 		{http.StatusBadRequest, http.MethodPost, "application/json",
-			io.NopCloser(strings.NewReader(`{"version":"MessengerRegistration_v1"}`)),
+			io.NopCloser(strings.NewReader(`{"version":"MessengerRegistration_v1"}`)), errWrongForm,
+		},
+		// Empty system
+		{http.StatusBadRequest, http.MethodPost, "application/json",
+			io.NopCloser(strings.NewReader(`{"version":"SystemMessage_v1","body":"who am I?"}`)), errMissingField,
+		},
+		// Body too large
+		{http.StatusRequestEntityTooLarge, http.MethodPost, "application/json",
+			io.NopCloser(strings.NewReader(`{"version":"SystemMessage_v1","system":"test","body":"` +
+				strings.Repeat("x", 1024) + `"}`)), "",
 		},
 		// All ok
 		{http.StatusOK, http.MethodPost, "application/json",
-			io.NopCloser(strings.NewReader(`{"version":"SystemMessage_v1","system":"test"}`)),
+			io.NopCloser(strings.NewReader(`{"version":"SystemMessage_v1","system":"test"}`)), "",
 		},
 	}
 
 	ua := &UnitAsset{
+		Traits:   Traits{MaxBodySize: 1024},
 		messages: make(map[string][]message),
 	}
 	for _, test := range table {
@@ -59,6 +77,175 @@ func TestHandleNewMessage(t *testing.T) {
 		if got, want := res.StatusCode, test.expectedStatus; got != want {
 			t.Errorf("expected status %d, got %d", want, got)
 		}
+		if test.expectedError == "" {
+			continue
+		}
+		var body intakeError
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Errorf("expected a JSON error body, got %v", err)
+			continue
+		}
+		if body.Error != test.expectedError || body.Message == "" {
+			t.Errorf("expected error %q with a message, got %+v", test.expectedError, body)
+		}
+	}
+	if _, found := ua.messages[""]; found {
+		t.Errorf("expected no messages stored under an empty system name")
+	}
+}
+
+func TestHandleNewMessageBatch(t *testing.T) {
+	table := []struct {
+		expectedStatus int
+		content        string
+		body           string
+		expectedStored int
+	}{
+		// Not json
+		{http.StatusUnsupportedMediaType, "text/plain", `[{"version":"SystemMessage_v1","system":"a"}]`, 0},
+		// Not an array
+		{http.StatusBadRequest, "application/json", `{"system":"a"}`, 0},
+		// Wrong form in the batch
+		{http.StatusBadRequest, "application/json",
+			`[{"version":"SystemMessage_v1","system":"a"},{"version":"MessengerRegistration_v1"}]`, 0,
+		},
+		// Empty system in the batch
+		{http.StatusBadRequest, "application/json",
+			`[{"version":"SystemMessage_v1","system":"a"},{"version":"SystemMessage_v1"}]`, 0,
+		},
+		// All ok
+		{http.StatusOK, "application/json",
+			`[{"version":"SystemMessage_v1","system":"a","body":"1"},{"version":"SystemMessage_v1","system":"b"}]`, 2,
+		},
+	}
+
+	for _, test := range table {
+		ua := &UnitAsset{
+			messages: make(map[string][]message),
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.content)
+		ua.handleNewMessage(rec, req)
+
+		res := rec.Result()
+		if got, want := res.StatusCode, test.expectedStatus; got != want {
+			t.Errorf("expected status %d, got %d", want, got)
+		}
+		stored := 0
+		for _, msgs := range ua.messages {
+			stored += len(msgs)
+		}
+		if got, want := stored, test.expectedStored; got != want {
+			t.Errorf("expected %d stored messages, got %d", want, got)
+		}
+	}
+}
+
+func TestHandleNewMessageBatchTrimmed(t *testing.T) {
+	var entries []string
+	total := maxMessages + 3
+	for i := 0; i < total; i++ {
+		entries = append(entries, fmt.Sprintf(`{"version":"SystemMessage_v1","system":"replay","body":"%d"}`, i))
+	}
+	body := "[" + strings.Join(entries, ",") + "]"
+
+	ua := &UnitAsset{
+		messages: make(map[string][]message),
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	ua.handleNewMessage(rec, req)
+
+	if got, want := rec.Body.String(), fmt.Sprintf(`{"accepted":%d}`, total); got != want {
+		t.Errorf("expected response %s, got %s", want, got)
+	}
+	log := ua.messages["replay"]
+	if got, want := len(log), maxMessages; got != want {
+		t.Fatalf("expected %d messages after trimming, got %d", want, got)
+	}
+	if got, want := log[0].body, "3"; got != want {
+		t.Errorf("expected the oldest kept message to be %s, got %s", want, got)
+	}
+	if got, want := log[len(log)-1].body, fmt.Sprint(total-1); got != want {
+		t.Errorf("expected the latest message to be %s, got %s", want, got)
+	}
+}
+
+// Passes the bodies of the forwarded messages on to the test
+type transForwarded struct {
+	bodies chan string
+}
+
+func (mock *transForwarded) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	req.Body.Close()
+	mock.bodies <- string(body)
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(http.StatusOK)
+	return rec.Result(), nil
+}
+
+func TestHandleNewMessageUpstream(t *testing.T) {
+	mock := &transForwarded{bodies: make(chan string, 10)}
+	http.DefaultClient.Transport = mock
+	defer func() { http.DefaultClient.Transport = nil }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys := components.NewSystem("messenger", ctx)
+	ua := &UnitAsset{
+		Owner:    &sys,
+		Traits:   Traits{Upstream: "http://parent/messenger/log/message", UpstreamLevel: "warn"},
+		messages: make(map[string][]message),
+	}
+	if err := ua.parseLevels(); err != nil {
+		t.Fatal(err)
+	}
+	ua.upstream = make(chan forms.SystemMessage_v1, upstreamQueueSize)
+	go ua.runUpstream()
+
+	table := []struct {
+		body      string
+		forwarded bool
+	}{
+		// Already forwarded by a child messenger
+		{`{"version":"SystemMessage_v1","system":"a","level":3,"body":"from a child"}`, true},
+		{`[{"version":"SystemMessage_v1","system":"a","level":3,"body":"from a child's batch"}]`, true},
+		// Below the upstream level
+		{`{"version":"SystemMessage_v1","system":"a","level":1,"body":"info"}`, false},
+		// Forwarded
+		{`{"version":"SystemMessage_v1","system":"a","level":3,"body":"error"}`, false},
+		{`[{"version":"SystemMessage_v1","system":"b","level":1},{"version":"SystemMessage_v1","system":"b","level":2,"body":"warn"}]`, false},
+	}
+	for _, test := range table {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+		if test.forwarded {
+			req.Header.Set(forwardedHeader, "child")
+		}
+		ua.handleNewMessage(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	// The messages are forwarded in order, so nothing else was sent before these two
+	for _, want := range []string{`"body": "error"`, `"body": "warn"`} {
+		select {
+		case got := <-mock.bodies:
+			if !strings.Contains(got, want) {
+				t.Errorf("expected the forwarded message %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message %s to be forwarded", want)
+		}
+	}
+	for _, system := range []string{"a", "b"} {
+		if len(ua.messages[system]) == 0 {
+			t.Errorf("expected the messages of %s stored locally too", system)
+		}
 	}
 }
 
@@ -101,3 +288,335 @@ func TestHandleDashboard(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleDashboardGrouped(t *testing.T) {
+	tmpl, err := template.New("dashboard").Parse(
+		`{{range $system, $messages := .Systems}}{{$system}}:{{range $messages}}{{.Level}},{{end}};{{end}}`)
+	if err != nil {
+		t.Fatalf("expected no error from template.Parse, got %v", err)
+	}
+	sys := components.NewSystem("test sys", context.Background())
+	ua := &UnitAsset{
+		Owner:         &sys,
+		messages:      make(map[string][]message),
+		tmplDashboard: tmpl,
+	}
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelInfo, System: "pump"})
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelError, System: "pump"})
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelWarn, System: "fan"})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+	ua.handleDashboard(rec, req)
+
+	// Systems are listed by name, each with its latest message first
+	if got, want := rec.Body.String(), "fan:WARN,;pump:ERROR,INFO,;"; got != want {
+		t.Errorf("expected grouped output %q, got %q", want, got)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	ua := &UnitAsset{
+		messages: make(map[string][]message),
+	}
+	rec := httptest.NewRecorder()
+	ua.handleMetrics(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("expected status %d, got %d", want, got)
+	}
+
+	levels := []forms.MessageLevel{forms.LevelDebug, forms.LevelError, forms.LevelError, forms.LevelWarn}
+	for _, level := range levels {
+		ua.addMessage(forms.SystemMessage_v1{Level: level, System: "pump"})
+	}
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelInfo, System: `fan "2"`})
+
+	rec = httptest.NewRecorder()
+	ua.handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("expected status %d, got %d", want, got)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("expected a text/plain content type, got %s", got)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`messenger_messages_total{level="debug"} 1`,
+		`messenger_messages_total{level="info"} 1`,
+		`messenger_messages_total{level="warn"} 1`,
+		`messenger_messages_total{level="error"} 2`,
+		`messenger_system_messages_total{system="fan \"2\""} 1`,
+		`messenger_system_messages_total{system="pump"} 4`,
+		`messenger_systems 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected metric line %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestHandleNewMessageMinLevel(t *testing.T) {
+	ua := &UnitAsset{
+		messages: make(map[string][]message),
+		Traits: Traits{
+			MinLevel:     "warn",
+			SystemLevels: map[string]string{"chatty": "error", "debugged": "debug"},
+		},
+	}
+	if err := ua.parseLevels(); err != nil {
+		t.Fatalf("expected no error from parseLevels, got %v", err)
+	}
+
+	table := []struct {
+		system         string
+		level          forms.MessageLevel
+		expectedStatus int
+		expectStored   bool
+	}{
+		{"pump", forms.LevelDebug, http.StatusAccepted, false},
+		{"pump", forms.LevelInfo, http.StatusAccepted, false},
+		{"pump", forms.LevelWarn, http.StatusOK, true},
+		{"pump", forms.LevelError, http.StatusOK, true},
+		// Per system overrides
+		{"chatty", forms.LevelWarn, http.StatusAccepted, false},
+		{"chatty", forms.LevelError, http.StatusOK, true},
+		{"debugged", forms.LevelDebug, http.StatusOK, true},
+	}
+	for _, test := range table {
+		before := len(ua.messages[test.system])
+		body := fmt.Sprintf(`{"version":"SystemMessage_v1","system":"%s","level":%d}`, test.system, test.level)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/message", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		ua.handleNewMessage(rec, req)
+
+		if got, want := rec.Code, test.expectedStatus; got != want {
+			t.Errorf("%s/%d: expected status %d, got %d", test.system, test.level, want, got)
+		}
+		if got, want := len(ua.messages[test.system]) > before, test.expectStored; got != want {
+			t.Errorf("%s/%d: expected stored %v, got %v", test.system, test.level, want, got)
+		}
+	}
+}
+
+func TestAllowCORS(t *testing.T) {
+	table := []struct {
+		allowed        []string
+		method         string
+		origin         string
+		preflight      bool
+		expectedStatus int
+		expectedOrigin string
+	}{
+		// CORS is off by default
+		{nil, http.MethodGet, "https://admin.local", false, http.StatusOK, ""},
+		// GET from an allowed origin
+		{[]string{"https://admin.local"}, http.MethodGet, "https://admin.local", false, http.StatusOK, "https://admin.local"},
+		// GET from another origin
+		{[]string{"https://admin.local"}, http.MethodGet, "https://evil.example", false, http.StatusOK, ""},
+		// Any origin allowed
+		{[]string{"*"}, http.MethodGet, "https://admin.local", false, http.StatusOK, "https://admin.local"},
+		// Preflight from an allowed origin
+		{[]string{"https://admin.local"}, http.MethodOptions, "https://admin.local", true, http.StatusNoContent, "https://admin.local"},
+		// Preflight from another origin
+		{[]string{"https://admin.local"}, http.MethodOptions, "https://evil.example", true, http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, test := range table {
+		ua := &UnitAsset{
+			Traits:   Traits{AllowedOrigins: test.allowed},
+			messages: make(map[string][]message),
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(test.method, "/metrics", nil)
+		req.Header.Set("Origin", test.origin)
+		if test.preflight {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		ua.handleMetrics(rec, req)
+
+		if got, want := rec.Code, test.expectedStatus; got != want {
+			t.Errorf("expected status %d, got %d", want, got)
+		}
+		if got, want := rec.Header().Get("Access-Control-Allow-Origin"), test.expectedOrigin; got != want {
+			t.Errorf("expected allowed origin %q, got %q", want, got)
+		}
+		if test.expectedStatus == http.StatusNoContent && rec.Header().Get("Access-Control-Allow-Methods") == "" {
+			t.Errorf("expected the allowed methods in the preflight response")
+		}
+	}
+}
+
+func TestHandleExport(t *testing.T) {
+	ua := &UnitAsset{
+		messages: make(map[string][]message),
+	}
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelInfo, System: "pump", Body: "started"})
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelError, System: "pump", Body: "stalled"})
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelWarn, System: "fan", Body: "slow"})
+
+	tests := []struct {
+		query          string
+		expectedStatus int
+		expectedBodies []string
+		expectedFile   string
+	}{
+		// Exports a single system's log
+		{"?system=pump", http.StatusOK, []string{"started", "stalled"}, "pump.ndjson"},
+		// Exports every system when none is given
+		{"", http.StatusOK, []string{"started", "stalled", "slow"}, "messages.ndjson"},
+		// Unknown systems have nothing to export
+		{"?system=boiler", http.StatusNotFound, nil, ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		ua.handleExport(rec, httptest.NewRequest(http.MethodGet, "/export"+test.query, nil))
+		if rec.Code != test.expectedStatus {
+			t.Errorf("query %q: expected status %d, got %d", test.query, test.expectedStatus, rec.Code)
+			continue
+		}
+		if test.expectedStatus != http.StatusOK {
+			continue
+		}
+		if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, test.expectedFile) {
+			t.Errorf("query %q: expected a download of %s, got %q", test.query, test.expectedFile, got)
+		}
+		seen := make(map[string]int)
+		for _, line := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n") {
+			var m exportedMessage
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Fatalf("query %q: expected a JSON message per line, got %q: %v", test.query, line, err)
+			}
+			if m.Time.IsZero() || m.Level == "" || m.System == "" {
+				t.Errorf("query %q: expected time, level and system in %q", test.query, line)
+			}
+			seen[m.Body]++
+		}
+		if len(seen) != len(test.expectedBodies) {
+			t.Errorf("query %q: expected %d messages, got %v", test.query, len(test.expectedBodies), seen)
+		}
+		for _, body := range test.expectedBodies {
+			if seen[body] != 1 {
+				t.Errorf("query %q: expected message %q once, got %d times", test.query, body, seen[body])
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	ua.handleExport(rec, httptest.NewRequest(http.MethodPost, "/export", nil))
+	if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("expected status %d, got %d", want, got)
+	}
+}
+
+func TestHandleSummary(t *testing.T) {
+	ua := &UnitAsset{
+		messages: make(map[string][]message),
+	}
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelInfo, System: "pump", Body: "started"})
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelError, System: "pump", Body: "stalled"})
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelWarn, System: "fan", Body: "slow"})
+
+	rec := httptest.NewRecorder()
+	ua.handleSummary(rec, httptest.NewRequest(http.MethodGet, "/summary", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("expected status %d, got %d", want, got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected a JSON reply, got content type %q", got)
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &keys); err != nil {
+		t.Fatalf("expected a JSON object, got %q: %v", rec.Body.String(), err)
+	}
+	for _, key := range []string{"errors", "warnings", "latest", "systems"} {
+		if _, found := keys[key]; !found {
+			t.Errorf("expected the key %q in %s", key, rec.Body.String())
+		}
+	}
+
+	// The summary mirrors the data given to the dashboard template
+	var got dashboardSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("expected a dashboard summary, got %q: %v", rec.Body.String(), err)
+	}
+	errs, warnings, latest, systems := ua.filterLogs()
+	same := func(m message, e exportedMessage) bool {
+		return m.time.Equal(e.Time) && m.Level() == e.Level && m.system == e.System && m.body == e.Body
+	}
+	if len(got.Errors) != len(errs) || !same(errs["pump"], got.Errors["pump"]) {
+		t.Errorf("expected the errors %v, got %v", errs, got.Errors)
+	}
+	if len(got.Warnings) != len(warnings) || !same(warnings["fan"], got.Warnings["fan"]) {
+		t.Errorf("expected the warnings %v, got %v", warnings, got.Warnings)
+	}
+	if len(got.Latest) != len(latest) {
+		t.Fatalf("expected %d latest messages, got %d", len(latest), len(got.Latest))
+	}
+	for i := range latest {
+		if !same(latest[i], got.Latest[i]) {
+			t.Errorf("expected latest message %d to be %v, got %v", i, latest[i], got.Latest[i])
+		}
+	}
+	for system, group := range systems {
+		if len(got.Systems[system]) != len(group) {
+			t.Errorf("expected %d messages of %s, got %d", len(group), system, len(got.Systems[system]))
+			continue
+		}
+		for i := range group {
+			if !same(group[i], got.Systems[system][i]) {
+				t.Errorf("expected message %d of %s to be %v, got %v", i, system, group[i], got.Systems[system][i])
+			}
+		}
+	}
+
+	// An empty log still has the keys, with an empty list of latest messages
+	empty := &UnitAsset{messages: make(map[string][]message)}
+	rec = httptest.NewRecorder()
+	empty.handleSummary(rec, httptest.NewRequest(http.MethodGet, "/summary", nil))
+	if got, want := rec.Body.String(), `{"errors":{},"warnings":{},"latest":[],"systems":{}}`; got != want {
+		t.Errorf("expected %s for an empty log, got %s", want, got)
+	}
+
+	rec = httptest.NewRecorder()
+	ua.handleSummary(rec, httptest.NewRequest(http.MethodPost, "/summary", nil))
+	if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("expected status %d, got %d", want, got)
+	}
+}
+
+func TestHandleErrorRates(t *testing.T) {
+	ua := &UnitAsset{
+		messages: make(map[string][]message),
+	}
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelInfo, System: "pump", Body: "started"})
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelError, System: "fan", Body: "stalled"})
+
+	rec := httptest.NewRecorder()
+	ua.Serving(rec, httptest.NewRequest(http.MethodGet, "/errors", nil), "errors")
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("expected status %d, got %d", want, got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected a JSON reply, got content type %q", got)
+	}
+	want := `{"window":"5m0s","systems":[{"system":"fan","errors":1,"warnings":0,"perMinute":0.2},` +
+		`{"system":"pump","errors":0,"warnings":0,"perMinute":0}]}`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	// An empty log still has the keys, with an empty list of systems
+	empty := &UnitAsset{messages: make(map[string][]message)}
+	rec = httptest.NewRecorder()
+	empty.handleErrorRates(rec, httptest.NewRequest(http.MethodGet, "/errors", nil))
+	if got, want := rec.Body.String(), `{"window":"5m0s","systems":[]}`; got != want {
+		t.Errorf("expected %s for an empty log, got %s", want, got)
+	}
+
+	rec = httptest.NewRecorder()
+	ua.handleErrorRates(rec, httptest.NewRequest(http.MethodPost, "/errors", nil))
+	if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("expected status %d, got %d", want, got)
+	}
+}
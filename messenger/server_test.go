@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+)
+
+type serverPolicyParams struct {
+	env             map[string]string
+	expectedSet     bool
+	expectError     bool
+	expectedTimeout time.Duration // read timeout
+	testCase        string
+}
+
+func TestServerPolicyFromEnv(t *testing.T) {
+	params := []serverPolicyParams{
+		{map[string]string{}, false, false, defaultServerPolicy.ReadTimeout, "Good case, no policy"},
+		{map[string]string{"SERVER_READ_TIMEOUT": "10s"}, true, false, 10 * time.Second, "Good case, timeout set"},
+		{map[string]string{"SERVER_IDLE_TIMEOUT": "1m"}, true, false, defaultServerPolicy.ReadTimeout, "Good case, default kept"},
+		{map[string]string{"SERVER_READ_TIMEOUT": "soon"}, true, true, 0, "Bad case, invalid duration"},
+		{map[string]string{"SERVER_READ_TIMEOUT": "-1s"}, true, true, 0, "Bad case, negative duration"},
+		{map[string]string{"SERVER_CERT_FILE": "cert.pem"}, true, true, 0, "Bad case, certificate without key"},
+		{map[string]string{"SERVER_TLS_MIN_VERSION": "1.3"}, true, false, defaultServerPolicy.ReadTimeout, "Good case, TLS version set"},
+		{map[string]string{"SERVER_TLS_MIN_VERSION": "1.0"}, true, true, 0, "Bad case, outdated TLS version"},
+		{map[string]string{"SERVER_TLS_CIPHER_SUITES": "TLS_RSA_WITH_RC4_128_SHA"}, true, true, 0, "Bad case, insecure cipher suite"},
+	}
+	for _, c := range params {
+		policy, set, err := serverPolicyFromEnv(func(name string) string { return c.env[name] })
+		if (err != nil) != c.expectError {
+			t.Errorf("Expected error %t, got: %v in '%s'", c.expectError, err, c.testCase)
+			continue
+		}
+		if set != c.expectedSet {
+			t.Errorf("Expected the policy to be set %t, got: %t in '%s'", c.expectedSet, set, c.testCase)
+		}
+		if err == nil && policy.ReadTimeout != c.expectedTimeout {
+			t.Errorf("Expected the read timeout %v, got: %v in '%s'", c.expectedTimeout, policy.ReadTimeout, c.testCase)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	policy := serverPolicy{ReadHeaderTimeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second, IdleTimeout: 4 * time.Second}
+	srv := newServer(8870, http.NotFoundHandler(), policy)
+	if srv.Addr != ":8870" {
+		t.Errorf("Expected the server to listen on :8870, got: %s", srv.Addr)
+	}
+	if srv.ReadHeaderTimeout != time.Second || srv.ReadTimeout != 2*time.Second || srv.WriteTimeout != 3*time.Second || srv.IdleTimeout != 4*time.Second {
+		t.Errorf("Expected the timeouts of the policy, got: %v %v %v %v", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	// The defaults bound every phase of a request
+	srv = newServer(8870, http.NotFoundHandler(), defaultServerPolicy)
+	if srv.ReadHeaderTimeout == 0 || srv.ReadTimeout == 0 || srv.WriteTimeout == 0 || srv.IdleTimeout == 0 {
+		t.Errorf("Expected every default timeout to be set, got: %v %v %v %v", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
+
+func TestServerTLSPolicy(t *testing.T) {
+	policy, _, err := serverPolicyFromEnv(func(name string) string {
+		return map[string]string{
+			"SERVER_TLS_MIN_VERSION":   "1.3",
+			"SERVER_TLS_CIPHER_SUITES": "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+		}[name]
+	})
+	if err != nil {
+		t.Fatalf("Expected the TLS policy to be accepted, got: %v", err)
+	}
+	srv := newServer(8871, http.NotFoundHandler(), policy)
+	if srv.TLSConfig == nil || srv.TLSConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("Expected the server to accept TLS 1.3 and above, got: %+v", srv.TLSConfig)
+	}
+	expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if !slices.Equal(srv.TLSConfig.CipherSuites, expected) {
+		t.Errorf("Expected the cipher suites %v, got: %v", expected, srv.TLSConfig.CipherSuites)
+	}
+
+	// The default accepts TLS 1.2 and leaves the cipher suites to crypto/tls
+	srv = newServer(8871, http.NotFoundHandler(), defaultServerPolicy)
+	if srv.TLSConfig.MinVersion != tls.VersionTLS12 || srv.TLSConfig.CipherSuites != nil {
+		t.Errorf("Expected the default TLS policy, got: %+v", srv.TLSConfig)
+	}
+}
+
+type assetHandlerParams struct {
+	path         string
+	expectedCode int
+	testCase     string
+}
+
+func TestAssetHandler(t *testing.T) {
+	sys := components.NewSystem("testsys", context.Background())
+	params := []assetHandlerParams{
+		{"/testsys/unknown/service", http.StatusNotFound, "Bad case, unknown asset"},
+		{"/othersys/unknown/service", http.StatusNotFound, "Bad case, another system"},
+		{"/testsys/", http.StatusNotFound, "Bad case, no asset"},
+	}
+	for _, c := range params {
+		w := httptest.NewRecorder()
+		assetHandler(&sys).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost"+c.path, nil))
+		if w.Code != c.expectedCode {
+			t.Errorf("Expected statuscode %d, got: %d in '%s'", c.expectedCode, w.Code, c.testCase)
+		}
+	}
+}
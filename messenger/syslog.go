@@ -0,0 +1,154 @@
+/*******************************************************************************
+ * Copyright (c) 2025 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sdoque/mbaigo/forms"
+	"github.com/sdoque/mbaigo/usecases"
+)
+
+// syslogFacility is the facility of the mirrored messages, "user-level messages" in RFC 5424
+const syslogFacility int = 1
+
+// syslogQueueSize is how many messages can wait for the syslog endpoint before new ones get dropped
+const syslogQueueSize int = 100
+
+// syslogTimeout bounds the connection to the syslog endpoint and each write to it, so an unreachable
+// or stalled endpoint doesn't hold up the queue
+var syslogTimeout = 5 * time.Second
+
+// syslogSeverity maps a message level to its RFC 5424 severity
+func syslogSeverity(level forms.MessageLevel) int {
+	switch level {
+	case forms.LevelDebug:
+		return 7 // debug
+	case forms.LevelInfo:
+		return 6 // informational
+	case forms.LevelWarn:
+		return 4 // warning
+	default:
+		return 3 // error
+	}
+}
+
+// syslogNetwork checks the configured transport to the syslog endpoint, UDP when none is set
+func syslogNetwork(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", "udp":
+		return "udp", nil
+	case "tcp":
+		return "tcp", nil
+	}
+	return "", fmt.Errorf("unknown syslog network %q, expected udp or tcp", name)
+}
+
+// syslogField makes a header field of a syslog record out of a name, which must be printable ASCII
+// without spaces and no longer than the given length. An empty name becomes the nil value "-".
+func syslogField(name string, length int) string {
+	field := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, name)
+	if field == "" {
+		return "-"
+	}
+	if len(field) > length {
+		field = field[:length]
+	}
+	return field
+}
+
+// formatSyslog writes a message as an RFC 5424 record, with the messenger's host as the hostname
+// and the message's system as the application name
+func formatSyslog(m message, host string) string {
+	return fmt.Sprintf("<%d>1 %s %s %s - - - %s",
+		syslogFacility*8+syslogSeverity(m.level),
+		m.time.UTC().Format(time.RFC3339Nano),
+		syslogField(host, 255),
+		syslogField(m.system, 48),
+		m.body,
+	)
+}
+
+// queueSyslog hands a message over to the syslog mirror, if there's a syslog endpoint.
+// It never blocks the intake: the message is dropped if the queue is full.
+func (ua *UnitAsset) queueSyslog(m message) {
+	if ua.syslog == nil {
+		return
+	}
+	select {
+	case ua.syslog <- m:
+	default:
+		// The endpoint is lagging behind, losing the mirrored record is better than stalling the senders
+	}
+}
+
+// runSyslog mirrors the queued messages to the syslog endpoint until the system shuts down.
+// The connection is opened on the first message and again after a failed write.
+func (ua *UnitAsset) runSyslog(network string) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	host := "-"
+	if ua.Owner.Host != nil {
+		host = ua.Owner.Host.Name
+	}
+	for {
+		select {
+		case m := <-ua.syslog:
+			var err error
+			if conn == nil {
+				conn, err = net.DialTimeout(network, ua.SyslogTarget, syslogTimeout)
+			}
+			if err == nil {
+				err = writeSyslog(conn, network, formatSyslog(m, host))
+			}
+			if err != nil {
+				usecases.LogWarn(ua.Owner, "dropped a message from %s for the syslog endpoint: %s", m.system, err)
+				if conn != nil {
+					conn.Close()
+					conn = nil
+				}
+			}
+		case <-ua.Owner.Ctx.Done():
+			return
+		}
+	}
+}
+
+// writeSyslog sends one record, as a datagram over UDP or with the octet counting framing of RFC 6587 over TCP.
+// A write that doesn't complete in time fails, so that the connection is reopened for the next record
+func writeSyslog(conn net.Conn, network, record string) error {
+	if network == "tcp" {
+		record = fmt.Sprintf("%d %s", len(record), record)
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(syslogTimeout)); err != nil {
+		return err
+	}
+	_, err := conn.Write([]byte(record))
+	return err
+}
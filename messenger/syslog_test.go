@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// --------------------------------- //
+// Tests for the syslog mirror
+// --------------------------------- //
+
+type formatSyslogTestStruct struct {
+	level          forms.MessageLevel
+	system         string
+	expectedRecord string
+	testName       string
+}
+
+var formatSyslogTestParams = []formatSyslogTestStruct{
+	{forms.LevelDebug, "pump", "<15>1 2025-03-04T05:06:07Z host pump - - - pressure ok", "Good case, debug is severity 7"},
+	{forms.LevelInfo, "pump", "<14>1 2025-03-04T05:06:07Z host pump - - - pressure ok", "Good case, info is severity 6"},
+	{forms.LevelWarn, "pump", "<12>1 2025-03-04T05:06:07Z host pump - - - pressure ok", "Good case, warn is severity 4"},
+	{forms.LevelError, "pump", "<11>1 2025-03-04T05:06:07Z host pump - - - pressure ok", "Good case, error is severity 3"},
+	{forms.LevelInfo, "water pump", "<14>1 2025-03-04T05:06:07Z host water_pump - - - pressure ok", "Good case, spaces are replaced in the app name"},
+	{forms.LevelInfo, "", "<14>1 2025-03-04T05:06:07Z host - - - - pressure ok", "Good case, an empty app name is the nil value"},
+}
+
+func TestFormatSyslog(t *testing.T) {
+	stamp := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, testCase := range formatSyslogTestParams {
+		m := message{time: stamp, level: testCase.level, system: testCase.system, body: "pressure ok"}
+		if got := formatSyslog(m, "host"); got != testCase.expectedRecord {
+			t.Errorf("In test case: %s: Expected %q, got: %q", testCase.testName, testCase.expectedRecord, got)
+		}
+	}
+}
+
+type syslogNetworkTestStruct struct {
+	name            string
+	expectedNetwork string
+	expectErr       bool
+	testName        string
+}
+
+var syslogNetworkTestParams = []syslogNetworkTestStruct{
+	{"", "udp", false, "Good case, defaults to udp"},
+	{"TCP", "tcp", false, "Good case, case insensitive"},
+	{"quic", "", true, "Bad case, unknown network"},
+}
+
+func TestSyslogNetwork(t *testing.T) {
+	for _, testCase := range syslogNetworkTestParams {
+		network, err := syslogNetwork(testCase.name)
+		if (err != nil) != testCase.expectErr || network != testCase.expectedNetwork {
+			t.Errorf("In test case: %s: Expected %q and error %v, got: %q, %v", testCase.testName, testCase.expectedNetwork, testCase.expectErr, network, err)
+		}
+	}
+}
+
+// mirrorOne starts the syslog mirror of a messenger towards the target and adds a warning to its log
+func mirrorOne(t *testing.T, network, target string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sys := components.NewSystem("test messenger", ctx)
+	ua := &UnitAsset{
+		Owner:    &sys,
+		Traits:   Traits{SyslogTarget: target},
+		messages: make(map[string][]message),
+		syslog:   make(chan message, syslogQueueSize),
+	}
+	go ua.runSyslog(network)
+	ua.addMessage(forms.SystemMessage_v1{Level: forms.LevelWarn, System: "pump", Body: "pressure low"})
+}
+
+// checkRecord verifies the record the mock syslog listener received for the warning added by mirrorOne
+func checkRecord(t *testing.T, testName, record string) {
+	prefix, suffix := "<12>1 ", " host pump - - - pressure low"
+	if !strings.HasPrefix(record, prefix) || !strings.HasSuffix(record, suffix) {
+		t.Errorf("In test case: %s: Expected a warning record from pump, got: %q", testName, record)
+		return
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(record, prefix), suffix)
+	if _, err := time.Parse(time.RFC3339Nano, stamp); err != nil {
+		t.Errorf("In test case: %s: Expected an RFC 3339 timestamp, got: %q", testName, stamp)
+	}
+}
+
+func TestRunSyslogUDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on udp: %v", err)
+	}
+	defer listener.Close()
+	mirrorOne(t, "udp", listener.LocalAddr().String())
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("In test case: udp: Expected a datagram, got: %v", err)
+	}
+	checkRecord(t, "udp", string(buf[:n]))
+}
+
+func TestRunSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on tcp: %v", err)
+	}
+	defer listener.Close()
+	mirrorOne(t, "tcp", listener.Addr().String())
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("In test case: tcp: Expected a connection, got: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Octet counting framing: the length of the record, a space and the record
+	reader := bufio.NewReader(conn)
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		t.Fatalf("In test case: tcp: Expected a frame length, got: %v", err)
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil || size <= 0 {
+		t.Fatalf("In test case: tcp: Expected a frame length, got: %q", length)
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(reader, record); err != nil {
+		t.Fatalf("In test case: tcp: Expected a %d byte record, got: %v", size, err)
+	}
+	checkRecord(t, "tcp", string(record))
+}
+
+func TestWriteSyslogStalled(t *testing.T) {
+	defer func(timeout time.Duration) { syslogTimeout = timeout }(syslogTimeout)
+	syslogTimeout = 50 * time.Millisecond
+	// Nobody reads the other end of the pipe, like an endpoint that stopped reading its connection
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- writeSyslog(conn, "tcp", "<12>1 - - pump - - - pressure low") }()
+	select {
+	case err := <-done:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("In test case: stalled endpoint: Expected a timeout, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("In test case: stalled endpoint: Expected the write to give up")
+	}
+}
+
+func TestQueueSyslog(t *testing.T) {
+	// Without a syslog endpoint nothing is queued
+	ua := &UnitAsset{}
+	ua.queueSyslog(message{level: forms.LevelError, system: "pump"})
+
+	ua = &UnitAsset{syslog: make(chan message, 1)}
+	ua.queueSyslog(message{level: forms.LevelError, system: "pump", body: "first"})
+	ua.queueSyslog(message{level: forms.LevelError, system: "pump", body: "second"})
+	// The second message didn't fit in the queue
+	if got, want := len(ua.syslog), 1; got != want {
+		t.Fatalf("In test case: full queue: Expected %d queued messages, got: %d", want, got)
+	}
+	if got := (<-ua.syslog).body; got != "first" {
+		t.Errorf("In test case: full queue: Expected the first message queued, got: %s", got)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -35,17 +37,54 @@ func (m message) String() string {
 	)
 }
 
+// Level returns the name of the message's level, used by the dashboard to color code it.
+func (m message) Level() string {
+	return forms.LevelToString(m.level)
+}
+
+// Traits are the configurable parameters of the messenger.
+type Traits struct {
+	MinLevel       string            `json:"minLevel"`       // Messages below this level are dropped at intake
+	SystemLevels   map[string]string `json:"systemLevels"`   // Overrides the minimum level per system name
+	AllowedOrigins []string          `json:"allowedOrigins"` // Browser origins allowed to read the dashboard and metrics, "*" for any
+	Reannounce     int               `json:"reannounce"`     // Seconds before notified systems get the registration again, 0 for every beacon
+	MaxBodySize    int               `json:"maxBodySize"`    // Largest message body accepted in bytes, 0 for 1 MiB
+	MediaTypes     []string          `json:"mediaTypes"`     // Media types accepted for the messages, application/json and/or application/xml, empty for application/json
+	Upstream       string            `json:"upstream"`       // URL of a parent messenger's message service receiving a copy of the messages, empty to keep them local
+	UpstreamLevel  string            `json:"upstreamLevel"`  // Messages below this level aren't forwarded upstream
+	ErrorWindow    int               `json:"errorWindow"`    // Seconds over which the error rates of the systems are counted, 0 for 5 minutes
+	SendAttempts   int               `json:"sendAttempts"`   // Attempts at each request to the registrar and the notified systems, 0 for a single one
+	SendRetryWait  int               `json:"sendRetryWait"`  // Milliseconds before the first retry of a request, doubled with each following one, 0 for 500 ms
+	SyslogTarget   string            `json:"syslogTarget"`   // Address (host:port) of a syslog endpoint receiving a copy of the messages, empty to not mirror them
+	SyslogNetwork  string            `json:"syslogNetwork"`  // Transport to the syslog endpoint, udp or tcp, empty for udp
+}
+
 type UnitAsset struct {
 	Name        string              `json:"name"`
 	Owner       *components.System  `json:"-"`
 	Details     map[string][]string `json:"details"`
 	ServicesMap components.Services `json:"-"`
 	CervicesMap components.Cervices `json:"-"`
+	Traits
+
+	minLevel     forms.MessageLevel            // Parsed MinLevel
+	systemLevels map[string]forms.MessageLevel // Parsed SystemLevels
+	upLevel      forms.MessageLevel            // Parsed UpstreamLevel
+
+	upstream chan forms.SystemMessage_v1 // Messages waiting to be forwarded to the parent messenger, nil without one
+	syslog   chan message                // Messages waiting to be mirrored to the syslog endpoint, nil without one
 
-	cachedRegMsg  []byte               // Caches the MessengerRegistration form
-	messages      map[string][]message // Per system msg log
-	mutex         sync.RWMutex         // Protects concurrent access to previous field
-	tmplDashboard *template.Template   // The HTML template loaded from file
+	cachedRegMsg  []byte                        // Caches the MessengerRegistration form
+	messages      map[string][]message          // Per system msg log
+	levelCounts   map[forms.MessageLevel]uint64 // Count of all received messages per level
+	systemCounts  map[string]uint64             // Count of all received messages per system
+	recent        map[string][]message          // Warnings and errors per system within the error window, in chronological order
+	mutex         sync.RWMutex                  // Protects concurrent access to previous fields
+	tmplDashboard *template.Template            // The HTML template loaded from file
+
+	notified    map[string]time.Time // When each system last received the registration (only used by the beacon)
+	notifiedReg []byte               // The registration those systems received
+	beaconFails int                  // Consecutive failures to fetch the system list (only used by the beacon)
 }
 
 func (ua *UnitAsset) GetName() string { return ua.Name }
@@ -56,6 +95,8 @@ func (ua *UnitAsset) GetCervices() components.Cervices { return ua.CervicesMap }
 
 func (ua *UnitAsset) GetDetails() map[string][]string { return ua.Details }
 
+func (ua *UnitAsset) GetTraits() any { return ua.Traits }
+
 var _ components.UnitAsset = (*UnitAsset)(nil)
 
 func initTemplate() components.UnitAsset {
@@ -70,6 +111,13 @@ func initTemplate() components.UnitAsset {
 		Name:        "log",
 		Details:     map[string][]string{},
 		ServicesMap: components.Services{service.SubPath: &service},
+		Traits: Traits{
+			MinLevel:       "debug",
+			SystemLevels:   map[string]string{},
+			AllowedOrigins: []string{},
+			Reannounce:     600,
+			MaxBodySize:    defaultMaxBodySize,
+		},
 	}
 }
 
@@ -87,7 +135,22 @@ func newResource(ca usecases.ConfigurableAsset, sys *components.System) (compone
 		messages:    make(map[string][]message),
 	}
 
-	var err error
+	traits, err := UnmarshalTraits(ca.Traits)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(traits) > 0 {
+		ua.Traits = traits[0]
+	}
+	if err = ua.parseLevels(); err != nil {
+		return nil, nil, err
+	}
+	checkMediaTypes(ua.MediaTypes)
+	network, err := syslogNetwork(ua.SyslogNetwork)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	ua.tmplDashboard, err = template.New("dashboard").Parse(tmplDashboard)
 	if err != nil {
 		return nil, nil, err
@@ -97,10 +160,73 @@ func newResource(ca usecases.ConfigurableAsset, sys *components.System) (compone
 		return nil, nil, err
 	}
 	go ua.runBeacon()
+	if ua.Upstream != "" {
+		ua.upstream = make(chan forms.SystemMessage_v1, upstreamQueueSize)
+		go ua.runUpstream()
+	}
+	if ua.SyslogTarget != "" {
+		ua.syslog = make(chan message, syslogQueueSize)
+		go ua.runSyslog(network)
+	}
 	f := func() {}
 	return ua, f, nil
 }
 
+// UnmarshalTraits unmarshals a slice of json.RawMessage into a slice of Traits.
+func UnmarshalTraits(rawTraits []json.RawMessage) ([]Traits, error) {
+	var traitsList []Traits
+	for _, raw := range rawTraits {
+		var t Traits
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal trait: %w", err)
+		}
+		traitsList = append(traitsList, t)
+	}
+	return traitsList, nil
+}
+
+// parseLevels converts the configured minimum levels into message levels.
+// An empty level accepts all messages.
+func (ua *UnitAsset) parseLevels() (err error) {
+	ua.minLevel, err = parseLevel(ua.MinLevel)
+	if err != nil {
+		return
+	}
+	ua.systemLevels = make(map[string]forms.MessageLevel)
+	for system, name := range ua.SystemLevels {
+		ua.systemLevels[system], err = parseLevel(name)
+		if err != nil {
+			return fmt.Errorf("system %s: %w", system, err)
+		}
+	}
+	ua.upLevel, err = parseLevel(ua.UpstreamLevel)
+	if err != nil {
+		return fmt.Errorf("upstream: %w", err)
+	}
+	return nil
+}
+
+func parseLevel(name string) (forms.MessageLevel, error) {
+	if name == "" {
+		return forms.LevelDebug, nil
+	}
+	for _, level := range metricLevels {
+		if strings.EqualFold(name, forms.LevelToString(level)) {
+			return level, nil
+		}
+	}
+	return forms.LevelDebug, fmt.Errorf("unknown message level: %s", name)
+}
+
+// accepts reports whether a message is at or above the minimum level for its system.
+func (ua *UnitAsset) accepts(msg forms.SystemMessage_v1) bool {
+	threshold, found := ua.systemLevels[msg.System]
+	if !found {
+		threshold = ua.minLevel
+	}
+	return msg.Level >= threshold
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // newRegMsg creates a new MessengerRegistration form filled with the system's URL.
@@ -128,40 +254,90 @@ func newRegMsg(sys *components.System) ([]byte, error) {
 
 const beaconPeriod int = 30
 
+// maxBeaconBackoff caps the wait between beacons while the system list cannot be fetched
+const maxBeaconBackoff = 10 * time.Minute
+
 // runBeacon runs periodically in the background (in a goroutine at startup).
 // It fetches a list of systems and then sends out a MessengerRegistration to each.
 func (ua *UnitAsset) runBeacon() {
 	for {
 		systems, err := ua.fetchSystems()
+		wait := ua.beaconWait(err)
 		if err != nil {
-			usecases.LogInfo(ua.Owner, "error fetching system list: %s", err)
+			usecases.LogInfo(ua.Owner, "error fetching system list (retrying in %s): %s", wait, err)
+		} else {
+			ua.notifySystems(systems)
 		}
-		ua.notifySystems(systems)
+		timer := time.NewTimer(wait)
 		select {
-		case <-time.Tick(time.Duration(beaconPeriod) * time.Second):
+		case <-timer.C:
 		case <-ua.Owner.Ctx.Done():
+			timer.Stop()
 			return
 		}
 	}
 }
 
+// beaconWait returns how long the beacon waits before its next round given the outcome of fetching the system list.
+// The wait doubles with each consecutive failure, up to maxBeaconBackoff, and is back to beaconPeriod after a success.
+func (ua *UnitAsset) beaconWait(fetchErr error) time.Duration {
+	wait := time.Duration(beaconPeriod) * time.Second
+	if fetchErr == nil {
+		ua.beaconFails = 0
+		return wait
+	}
+	ua.beaconFails++
+	for i := 1; i < ua.beaconFails && wait < maxBeaconBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBeaconBackoff)
+}
+
+// defaultSendRetryWait is the wait before the first retry of a request when the traits do not set one
+const defaultSendRetryWait = 500 * time.Millisecond
+
 // sendRequest is a helper for sending json web requests.
+// A request that fails in transit or with a 5xx reply is made up to SendAttempts times in all,
+// the wait between attempts doubling each time, while a 4xx reply is returned right away.
 // It returns either error or the response body as a byte array.
-func sendRequest(method, url string, body []byte) ([]byte, error) {
-	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+func (ua *UnitAsset) sendRequest(method, url string, body []byte) ([]byte, error) {
+	wait := time.Duration(ua.SendRetryWait) * time.Millisecond
+	if wait <= 0 {
+		wait = defaultSendRetryWait
+	}
+	for attempt := 1; ; attempt++ {
+		data, retry, err := sendOnce(ua.Owner.Ctx, method, url, body)
+		if err == nil || !retry || attempt >= ua.SendAttempts {
+			return data, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ua.Owner.Ctx.Done():
+			timer.Stop()
+			return nil, ua.Owner.Ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// sendOnce makes a single attempt at a json web request, reporting whether a failure is worth retrying.
+func sendOnce(ctx context.Context, method, url string, body []byte) (data []byte, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, ctx.Err() == nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, fmt.Errorf("bad response: %s", resp.Status)
+		return nil, resp.StatusCode >= 500, fmt.Errorf("bad response: %s", resp.Status)
 	}
-	return io.ReadAll(resp.Body)
+	data, err = io.ReadAll(resp.Body)
+	return data, err != nil, err
 }
 
 // fetchSystems asks the registrar for a list of online systems.
@@ -171,7 +347,7 @@ func (ua *UnitAsset) fetchSystems() (systems []string, err error) {
 	if err != nil {
 		return
 	}
-	body, err := sendRequest("GET", url+"/syslist", nil)
+	body, err := ua.sendRequest("GET", url+"/syslist", nil)
 	if err != nil {
 		return
 	}
@@ -189,7 +365,26 @@ func (ua *UnitAsset) fetchSystems() (systems []string, err error) {
 
 // notifySystems sends a pre-packed MessengerRegistration form to a list of online systems.
 // Any systems with incorrect URLs, any messengers, and any http errors will be ignored.
+// Systems that received the current registration are skipped until the reannounce
+// interval elapses, while new systems are notified right away.
 func (ua *UnitAsset) notifySystems(list []string) {
+	now := time.Now()
+	if ua.notified == nil || !bytes.Equal(ua.notifiedReg, ua.cachedRegMsg) {
+		// The registration changed, every system has to get the new one
+		ua.notified = make(map[string]time.Time)
+		ua.notifiedReg = ua.cachedRegMsg
+	}
+	online := make(map[string]bool, len(list))
+	for _, sys := range list {
+		online[sys] = true
+	}
+	for sys := range ua.notified {
+		if !online[sys] {
+			delete(ua.notified, sys) // It might have restarted and forgotten us once it's back
+		}
+	}
+	reannounce := time.Duration(ua.Reannounce) * time.Second
+
 	for _, sys := range list {
 		sysURL, err := url.Parse(sys)
 		if err != nil {
@@ -198,9 +393,14 @@ func (ua *UnitAsset) notifySystems(list []string) {
 		if strings.HasPrefix(sysURL.Path, "/"+ua.Owner.Name) {
 			continue // Skip itself and other messengers
 		}
-		// Don't care about any errors or any systems that don't want to talk with us
-		// (using empty variable names to shut up the linter warning about unhandled errors)
-		_, _ = sendRequest("POST", sys+"/msg", ua.cachedRegMsg)
+		if last, found := ua.notified[sys]; found && now.Sub(last) < reannounce {
+			continue // Already knows about us
+		}
+		// Don't care about any errors or any systems that don't want to talk with us,
+		// they'll simply be tried again with the next beacon
+		if _, err := ua.sendRequest("POST", sys+"/msg", ua.cachedRegMsg); err == nil {
+			ua.notified[sys] = now
+		}
 	}
 }
 
@@ -210,31 +410,267 @@ const maxMessages int = 10
 // oldest, if the log's size is larger than maxMessages.
 // Note that this function sets the timestamp of the incoming msg too.
 func (ua *UnitAsset) addMessage(msg forms.SystemMessage_v1) {
+	at := time.Now()
+	ua.recordMessage(msg, at)
+	ua.queueSyslog(message{time: at, level: msg.Level, system: msg.System, body: msg.Body})
+}
+
+// recordMessage adds the message received at the given time to the log, the counters and,
+// for a warning or an error, to the system's recent problems.
+func (ua *UnitAsset) recordMessage(msg forms.SystemMessage_v1, at time.Time) {
 	ua.mutex.Lock()
 	defer ua.mutex.Unlock()
-	ua.messages[msg.System] = append(ua.messages[msg.System], message{
-		time:   time.Now(),
+	m := message{
+		time:   at,
 		level:  msg.Level,
 		system: msg.System,
 		body:   msg.Body,
-	})
+	}
+	ua.messages[msg.System] = append(ua.messages[msg.System], m)
 	if len(ua.messages[msg.System]) > maxMessages {
 		// Strips the oldest msg from the front of the slice
 		ua.messages[msg.System] = ua.messages[msg.System][1:]
 	}
+	if ua.levelCounts == nil {
+		ua.levelCounts = make(map[forms.MessageLevel]uint64)
+		ua.systemCounts = make(map[string]uint64)
+	}
+	ua.levelCounts[msg.Level]++
+	ua.systemCounts[msg.System]++
+	if msg.Level >= forms.LevelWarn {
+		if ua.recent == nil {
+			ua.recent = make(map[string][]message)
+		}
+		m.body = "" // only the time and level are needed for the rates
+		ua.recent[msg.System] = append(withinWindow(ua.recent[msg.System], at, ua.errorWindow()), m)
+	}
+}
+
+// defaultErrorWindow is the window of the error rates when the traits do not set one
+const defaultErrorWindow = 5 * time.Minute
+
+// errorWindow returns the window over which the error rates are counted
+func (ua *UnitAsset) errorWindow() time.Duration {
+	if ua.ErrorWindow <= 0 {
+		return defaultErrorWindow
+	}
+	return time.Duration(ua.ErrorWindow) * time.Second
+}
+
+// withinWindow drops the leading messages of a chronological list that are older than the window ending at now.
+// A message exactly one window old is already out of it.
+func withinWindow(msgs []message, now time.Time, window time.Duration) []message {
+	start := now.Add(-window)
+	for len(msgs) > 0 && !msgs[0].time.After(start) {
+		msgs = msgs[1:]
+	}
+	return msgs
+}
+
+// errorRate is the count of a system's recent warnings and errors
+type errorRate struct {
+	System    string  `json:"system"`
+	Errors    int     `json:"errors"`
+	Warnings  int     `json:"warnings"`
+	PerMinute float64 `json:"perMinute"` // Warnings and errors per minute over the window
+}
+
+// errorRates is the JSON summary of the error rates, the most erroring system first
+type errorRates struct {
+	Window  string      `json:"window"`
+	Systems []errorRate `json:"systems"`
+}
+
+// rankErrorRates counts the warnings and errors of every system within the window ending at now.
+// The systems are ranked by warnings and errors, then by errors alone and then by name.
+// Systems that sent messages but no recent warning or error are listed with a zero rate.
+func (ua *UnitAsset) rankErrorRates(now time.Time) errorRates {
+	window := ua.errorWindow()
+	ua.mutex.RLock()
+	rates := make([]errorRate, 0, len(ua.systemCounts))
+	for system := range ua.systemCounts {
+		rate := errorRate{System: system}
+		for _, m := range withinWindow(ua.recent[system], now, window) {
+			if m.time.After(now) {
+				continue
+			}
+			if m.level >= forms.LevelError {
+				rate.Errors++
+			} else {
+				rate.Warnings++
+			}
+		}
+		rate.PerMinute = float64(rate.Errors+rate.Warnings) / window.Minutes()
+		rates = append(rates, rate)
+	}
+	ua.mutex.RUnlock()
+	sort.Slice(rates, func(i, j int) bool {
+		a, b := rates[i], rates[j]
+		if a.Errors+a.Warnings != b.Errors+b.Warnings {
+			return a.Errors+a.Warnings > b.Errors+b.Warnings
+		}
+		if a.Errors != b.Errors {
+			return a.Errors > b.Errors
+		}
+		return a.System < b.System
+	})
+	return errorRates{Window: window.String(), Systems: rates}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// forwardedHeader marks the messages a messenger forwards to its parent, with the name of the forwarding system.
+// The parent stores those messages but never forwards them further, so two messengers configured as
+// each other's parent can't bounce the same messages back and forth.
+const forwardedHeader string = "X-Forwarded-By"
+
+// upstreamQueueSize is how many messages can wait for the parent messenger before new ones get dropped
+const upstreamQueueSize int = 100
+
+// upstreamAttempts is how many times a message is sent to an unreachable parent before it's dropped
+const upstreamAttempts int = 3
+
+// upstreamRetryWait is the wait before the first retry, doubled with each of the following ones
+var upstreamRetryWait = time.Second
+
+// queueUpstream hands a message over to the forwarder, if there's a parent messenger and the message is at
+// or above the upstream level. It never blocks the intake: the message is dropped if the queue is full.
+func (ua *UnitAsset) queueUpstream(msg forms.SystemMessage_v1) {
+	if ua.upstream == nil || msg.Level < ua.upLevel {
+		return
+	}
+	select {
+	case ua.upstream <- msg:
+	default:
+		// The parent is lagging behind, losing its copy is better than stalling the senders
+	}
+}
+
+// runUpstream forwards the queued messages to the parent messenger until the system shuts down.
+func (ua *UnitAsset) runUpstream() {
+	for {
+		select {
+		case msg := <-ua.upstream:
+			if err := ua.forwardUpstream(msg); err != nil {
+				usecases.LogWarn(ua.Owner, "dropped a message from %s for the upstream messenger: %s", msg.System, err)
+			}
+		case <-ua.Owner.Ctx.Done():
+			return
+		}
+	}
+}
+
+// forwardUpstream sends a message to the parent messenger, retrying while the parent is unreachable or
+// failing. A message the parent refuses (a 4xx reply) is not retried, as resending it wouldn't help.
+func (ua *UnitAsset) forwardUpstream(msg forms.SystemMessage_v1) error {
+	body, err := usecases.Pack(msg.NewForm(), "application/json")
+	if err != nil {
+		return err
+	}
+	wait := upstreamRetryWait
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = ua.postUpstream(body)
+		if err == nil || !retry || attempt == upstreamAttempts {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ua.Owner.Ctx.Done():
+			timer.Stop()
+			return ua.Owner.Ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// postUpstream makes a single attempt at sending a packed message to the parent messenger,
+// reporting whether a failure is worth retrying.
+func (ua *UnitAsset) postUpstream(body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ua.Owner.Ctx, "POST", ua.Upstream, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(forwardedHeader, ua.Owner.Name)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, fmt.Errorf("bad response: %s", resp.Status)
+	}
+	return false, nil
+}
+
+var metricLevels = []forms.MessageLevel{forms.LevelDebug, forms.LevelInfo, forms.LevelWarn, forms.LevelError}
+
+// Escapes the backslashes, quotes and newlines of a Prometheus label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the message counters per level and per system, and the
+// number of systems currently logging, in the Prometheus text format.
+func (ua *UnitAsset) writeMetrics(w io.Writer) {
+	ua.mutex.RLock()
+	defer ua.mutex.RUnlock()
+
+	fmt.Fprintln(w, "# HELP messenger_messages_total Messages received per level.")
+	fmt.Fprintln(w, "# TYPE messenger_messages_total counter")
+	for _, level := range metricLevels {
+		fmt.Fprintf(w, "messenger_messages_total{level=\"%s\"} %d\n",
+			strings.ToLower(forms.LevelToString(level)), ua.levelCounts[level])
+	}
+
+	systems := make([]string, 0, len(ua.systemCounts))
+	for system := range ua.systemCounts {
+		systems = append(systems, system)
+	}
+	sort.Strings(systems)
+	fmt.Fprintln(w, "# HELP messenger_system_messages_total Messages received per system.")
+	fmt.Fprintln(w, "# TYPE messenger_system_messages_total counter")
+	for _, system := range systems {
+		fmt.Fprintf(w, "messenger_system_messages_total{system=\"%s\"} %d\n",
+			labelEscaper.Replace(system), ua.systemCounts[system])
+	}
+
+	fmt.Fprintln(w, "# HELP messenger_systems Systems with messages in the log.")
+	fmt.Fprintln(w, "# TYPE messenger_systems gauge")
+	fmt.Fprintf(w, "messenger_systems %d\n", len(ua.messages))
+}
+
+// shutdownSummary is the final statistics line of the messenger, as key=value pairs that log aggregators
+// can parse: the messages handled since the start, in total and per level, and the systems that sent any.
+func (ua *UnitAsset) shutdownSummary() string {
+	ua.mutex.RLock()
+	defer ua.mutex.RUnlock()
+	var total uint64
+	perLevel := make([]string, 0, len(metricLevels))
+	for _, level := range metricLevels {
+		total += ua.levelCounts[level]
+		perLevel = append(perLevel, fmt.Sprintf("%s=%d", strings.ToLower(forms.LevelToString(level)), ua.levelCounts[level]))
+	}
+	return fmt.Sprintf("shutdown summary: messages=%d %s systems=%d", total, strings.Join(perLevel, " "), len(ua.systemCounts))
 }
 
 // filterLogs fetches the latest errors/warnings/all messages from the log.
 // The log is appended to in a chronological order already, so the latest error
 // and warning for each system will be returned and "all" will be in reverse
-// chronological order.
+// chronological order, as will each system's group of messages in "systems".
 // NOTE: No tests are provided for this function, as it's most likely subject
 // to later changes.
-func (ua *UnitAsset) filterLogs() (errors, warnings map[string]message, all []message) {
+func (ua *UnitAsset) filterLogs() (errors, warnings map[string]message, all []message, systems map[string][]message) {
 	errors = make(map[string]message)
 	warnings = make(map[string]message)
+	systems = make(map[string][]message)
 	ua.mutex.RLock()
 	for system := range ua.messages {
+		group := make([]message, 0, len(ua.messages[system]))
+		for i := len(ua.messages[system]) - 1; i >= 0; i-- {
+			group = append(group, ua.messages[system][i])
+		}
+		systems[system] = group
 		for _, msg := range ua.messages[system] {
 			all = append(all, msg)
 			switch msg.level {
@@ -252,3 +688,102 @@ func (ua *UnitAsset) filterLogs() (errors, warnings map[string]message, all []me
 	})
 	return
 }
+
+// exportedMessage is the JSON line of a logged message in an export
+type exportedMessage struct {
+	Time   time.Time `json:"time"`
+	Level  string    `json:"level"`
+	System string    `json:"system"`
+	Body   string    `json:"body"`
+}
+
+// snapshotLogs copies the log of the given system, or of all systems if empty,
+// in chronological order. The second result is false if the system has no log.
+func (ua *UnitAsset) snapshotLogs(system string) ([]message, bool) {
+	var msgs []message
+	ua.mutex.RLock()
+	if system != "" {
+		entries, found := ua.messages[system]
+		msgs = append(msgs, entries...)
+		ua.mutex.RUnlock()
+		return msgs, found
+	}
+	for _, entries := range ua.messages {
+		msgs = append(msgs, entries...)
+	}
+	ua.mutex.RUnlock()
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if msgs[i].time.Equal(msgs[j].time) {
+			return msgs[i].system < msgs[j].system
+		}
+		return msgs[i].time.Before(msgs[j].time)
+	})
+	return msgs, true
+}
+
+// writeExport writes the messages as newline-delimited JSON, one message per line
+func writeExport(w io.Writer, msgs []message) error {
+	enc := json.NewEncoder(w)
+	for _, m := range msgs {
+		if err := enc.Encode(m.exported()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exported converts the message to its JSON form
+func (m message) exported() exportedMessage {
+	return exportedMessage{
+		Time:   m.time,
+		Level:  forms.LevelToString(m.level),
+		System: m.system,
+		Body:   m.body,
+	}
+}
+
+// dashboardSummary is the JSON form of the data given to the dashboard template, for custom UIs
+type dashboardSummary struct {
+	Errors   map[string]exportedMessage   `json:"errors"`   // Latest error per system
+	Warnings map[string]exportedMessage   `json:"warnings"` // Latest warning per system
+	Latest   []exportedMessage            `json:"latest"`   // All messages in reverse chronological order
+	Systems  map[string][]exportedMessage `json:"systems"`  // Messages per system in reverse chronological order
+}
+
+// newDashboardSummary converts the output of filterLogs() to its JSON form
+func newDashboardSummary(errors, warnings map[string]message, latest []message, systems map[string][]message) dashboardSummary {
+	summary := dashboardSummary{
+		Errors:   make(map[string]exportedMessage, len(errors)),
+		Warnings: make(map[string]exportedMessage, len(warnings)),
+		Latest:   make([]exportedMessage, 0, len(latest)),
+		Systems:  make(map[string][]exportedMessage, len(systems)),
+	}
+	for system, m := range errors {
+		summary.Errors[system] = m.exported()
+	}
+	for system, m := range warnings {
+		summary.Warnings[system] = m.exported()
+	}
+	for _, m := range latest {
+		summary.Latest = append(summary.Latest, m.exported())
+	}
+	for system, group := range systems {
+		msgs := make([]exportedMessage, 0, len(group))
+		for _, m := range group {
+			msgs = append(msgs, m.exported())
+		}
+		summary.Systems[system] = msgs
+	}
+	return summary
+}
+
+// defaultMaxBodySize is the largest request body accepted when the traits do not set a limit (1 MiB)
+const defaultMaxBodySize = 1 << 20
+
+// maxBodySize returns the largest request body accepted, in bytes
+func (ua *UnitAsset) maxBodySize() int64 {
+	if ua.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return int64(ua.MaxBodySize)
+}
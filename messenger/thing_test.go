@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/sdoque/mbaigo/components"
 	"github.com/sdoque/mbaigo/forms"
@@ -96,12 +97,14 @@ func TestSendRequest(t *testing.T) {
 		{http.MethodGet, nil, http.StatusOK, strings.NewReader(bodyMock), false},
 	}
 
+	sys := components.NewSystem("test sys", context.Background())
+	ua := &UnitAsset{Owner: &sys}
 	mock := newTransSendRequest()
 	for _, test := range table {
 		mock.errResponse = test.err
 		mock.status = test.status
 		mock.body = test.body
-		body, err := sendRequest(test.method, "/test/url", nil)
+		body, err := ua.sendRequest(test.method, "/test/url", nil)
 
 		if got, want := err != nil, test.expectErr; got != want {
 			t.Errorf("expected error %v, got: %v", want, err)
@@ -147,6 +150,81 @@ func (mock *transFetchSystems) RoundTrip(req *http.Request) (*http.Response, err
 	return rec.Result(), nil
 }
 
+// Fails the first requests with the given replies, a 0 failing like an unreachable system, then succeeds
+type transFlaky struct {
+	failures []int
+	attempts int
+}
+
+func (mock *transFlaky) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Body.Close()
+	mock.attempts++
+	rec := httptest.NewRecorder()
+	if mock.attempts <= len(mock.failures) {
+		status := mock.failures[mock.attempts-1]
+		if status == 0 {
+			return nil, errMock
+		}
+		rec.WriteHeader(status)
+		return rec.Result(), nil
+	}
+	rec.WriteString(bodyMock)
+	return rec.Result(), nil
+}
+
+func TestSendRequestRetries(t *testing.T) {
+	defer func() { http.DefaultClient.Transport = nil }()
+	sys := components.NewSystem("test sys", context.Background())
+
+	table := []struct {
+		attempts         int
+		failures         []int
+		expectedAttempts int
+		expectErr        bool
+	}{
+		// A single attempt by default
+		{0, []int{0}, 1, true},
+		// Recovers after transport errors and 5xx replies
+		{4, []int{0, http.StatusServiceUnavailable, http.StatusBadGateway}, 4, false},
+		// Gives up after the last attempt
+		{3, []int{0, 0, 0, 0}, 3, true},
+		// A 4xx reply isn't retried
+		{3, []int{http.StatusNotFound}, 1, true},
+		// Nothing to retry
+		{3, nil, 1, false},
+	}
+	for i, test := range table {
+		mock := &transFlaky{failures: test.failures}
+		http.DefaultClient.Transport = mock
+		ua := &UnitAsset{Owner: &sys, Traits: Traits{SendAttempts: test.attempts, SendRetryWait: 1}}
+		body, err := ua.sendRequest(http.MethodPost, "http://test/msg", []byte("{}"))
+
+		if got, want := err != nil, test.expectErr; got != want {
+			t.Errorf("case %d: expected error %v, got: %v", i, want, err)
+		}
+		if !test.expectErr && string(body) != bodyMock {
+			t.Errorf("case %d: expected body '%s', got '%s'", i, bodyMock, string(body))
+		}
+		if got, want := mock.attempts, test.expectedAttempts; got != want {
+			t.Errorf("case %d: expected %d attempts, got %d", i, want, got)
+		}
+	}
+
+	// The retries stop with the system
+	ctx, cancel := context.WithCancel(context.Background())
+	stopping := components.NewSystem("test sys", ctx)
+	http.DefaultClient.Transport = &transFlaky{failures: []int{0, 0}}
+	ua := &UnitAsset{Owner: &stopping, Traits: Traits{SendAttempts: 3, SendRetryWait: 60_000}}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := ua.sendRequest(http.MethodPost, "http://test/msg", nil); err != context.Canceled {
+		t.Errorf("expected the retries to be cancelled, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the retries to stop with the system, took %v", elapsed)
+	}
+}
+
 func TestFetchSystems(t *testing.T) {
 	table := []struct {
 		coreStatus int
@@ -214,6 +292,131 @@ func TestNotifySystems(t *testing.T) {
 	}
 }
 
+// Counts the registrations received per system, failing for the systems that are down
+type transNotify struct {
+	received map[string]int
+	down     map[string]bool
+}
+
+func (mock *transNotify) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Body.Close()
+	sys := strings.TrimSuffix(req.URL.String(), "/msg")
+	if mock.down[sys] {
+		return nil, errMock
+	}
+	mock.received[sys]++
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(http.StatusOK)
+	return rec.Result(), nil
+}
+
+func TestNotifySystemsCoalesced(t *testing.T) {
+	mock := &transNotify{received: make(map[string]int), down: make(map[string]bool)}
+	http.DefaultClient.Transport = mock
+	defer func() { http.DefaultClient.Transport = nil }()
+	sys := components.NewSystem("test messenger", context.Background())
+	ua := &UnitAsset{
+		Owner:        &sys,
+		Traits:       Traits{Reannounce: 600},
+		cachedRegMsg: []byte(`{"version":"MessengerRegistration_v1"}`),
+	}
+
+	table := []struct {
+		systems  []string
+		down     string
+		age      time.Duration // Rewinds the previous notifications
+		regMsg   string
+		expected map[string]int
+	}{
+		// New systems are notified, except those that are down
+		{[]string{"http://a", "http://b"}, "http://b", 0, "",
+			map[string]int{"http://a": 1}},
+		// Already notified systems are skipped, new and previously failed ones are notified
+		{[]string{"http://a", "http://b", "http://c"}, "", 0, "",
+			map[string]int{"http://a": 1, "http://b": 1, "http://c": 1}},
+		// Nothing changed
+		{[]string{"http://a", "http://b", "http://c"}, "", time.Minute, "",
+			map[string]int{"http://a": 1, "http://b": 1, "http://c": 1}},
+		// The reannounce interval elapsed
+		{[]string{"http://a", "http://b"}, "", 11 * time.Minute, "",
+			map[string]int{"http://a": 2, "http://b": 2, "http://c": 1}},
+		// A system that went offline is notified again when it's back
+		{[]string{"http://a", "http://b", "http://c"}, "", 0, "",
+			map[string]int{"http://a": 2, "http://b": 2, "http://c": 2}},
+		// The registration changed
+		{[]string{"http://a", "http://b", "http://c"}, "", 0, `{"version":"MessengerRegistration_v1","url":"new"}`,
+			map[string]int{"http://a": 3, "http://b": 3, "http://c": 3}},
+	}
+	for i, test := range table {
+		mock.down = map[string]bool{test.down: true}
+		for sys, last := range ua.notified {
+			ua.notified[sys] = last.Add(-test.age)
+		}
+		if test.regMsg != "" {
+			ua.cachedRegMsg = []byte(test.regMsg)
+		}
+		ua.notifySystems(test.systems)
+
+		if got, want := fmt.Sprint(mock.received), fmt.Sprint(test.expected); got != want {
+			t.Errorf("case %d: expected notifications %s, got %s", i, want, got)
+		}
+	}
+}
+
+func TestNotifySystemsEveryBeacon(t *testing.T) {
+	mock := &transNotify{received: make(map[string]int)}
+	http.DefaultClient.Transport = mock
+	defer func() { http.DefaultClient.Transport = nil }()
+	sys := components.NewSystem("test messenger", context.Background())
+	ua := &UnitAsset{Owner: &sys, cachedRegMsg: []byte("{}")}
+
+	// Without a reannounce interval, every beacon notifies all systems
+	for range 3 {
+		ua.notifySystems([]string{"http://a"})
+	}
+	if got, want := mock.received["http://a"], 3; got != want {
+		t.Errorf("expected %d notifications, got %d", want, got)
+	}
+}
+
+func TestBeaconWait(t *testing.T) {
+	ua := &UnitAsset{}
+	base := time.Duration(beaconPeriod) * time.Second
+	failure := fmt.Errorf("registrar down")
+
+	// Consecutive failures double the wait until it is capped
+	expected := []time.Duration{base, 2 * base, 4 * base, 8 * base, 16 * base, maxBeaconBackoff, maxBeaconBackoff}
+	for i, want := range expected {
+		if got := ua.beaconWait(failure); got != want {
+			t.Errorf("failure %d: expected wait %s, got %s", i+1, want, got)
+		}
+	}
+	// A success resets the wait to the beacon period
+	if got := ua.beaconWait(nil); got != base {
+		t.Errorf("expected wait %s after a success, got %s", base, got)
+	}
+	if got := ua.beaconWait(failure); got != base {
+		t.Errorf("expected wait %s after a new failure, got %s", base, got)
+	}
+}
+
+func TestRunBeaconStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sys := components.NewSystem("test messenger", ctx)
+	ua := &UnitAsset{Owner: &sys}
+	done := make(chan struct{})
+	go func() {
+		ua.runBeacon() // fails to fetch the system list as there is no registrar
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the beacon to stop with the system")
+	}
+}
+
 func TestAddMessage(t *testing.T) {
 	sys := "test"
 	ua := &UnitAsset{
@@ -241,3 +444,187 @@ func TestAddMessage(t *testing.T) {
 		t.Errorf("expected newest msg '%s', got '%s'", want, got)
 	}
 }
+
+func TestRankErrorRates(t *testing.T) {
+	ua := &UnitAsset{
+		messages: make(map[string][]message),
+		Traits:   Traits{ErrorWindow: 60},
+	}
+	now := time.Date(2025, 3, 4, 12, 0, 0, 0, time.UTC)
+	sent := []struct {
+		system string
+		level  forms.MessageLevel
+		ago    time.Duration
+	}{
+		{"pump", forms.LevelError, 2 * time.Minute}, // long gone
+		{"pump", forms.LevelWarn, 30 * time.Second},
+		{"fan", forms.LevelError, 60 * time.Second}, // exactly one window old
+		{"fan", forms.LevelError, 59 * time.Second},
+		{"fan", forms.LevelWarn, 10 * time.Second},
+		{"valve", forms.LevelWarn, 50 * time.Second},
+		{"valve", forms.LevelError, 5 * time.Second},
+		{"clock", forms.LevelInfo, 5 * time.Second},
+		{"clock", forms.LevelDebug, time.Second},
+	}
+	for _, m := range sent {
+		ua.recordMessage(forms.SystemMessage_v1{Level: m.level, System: m.system, Body: "body"}, now.Add(-m.ago))
+	}
+
+	got := ua.rankErrorRates(now)
+	want := []errorRate{
+		{System: "fan", Errors: 1, Warnings: 1, PerMinute: 2},
+		{System: "valve", Errors: 1, Warnings: 1, PerMinute: 2},
+		{System: "pump", Errors: 0, Warnings: 1, PerMinute: 1},
+		{System: "clock", Errors: 0, Warnings: 0, PerMinute: 0},
+	}
+	if got.Window != "1m0s" {
+		t.Errorf("expected the window 1m0s, got %s", got.Window)
+	}
+	if len(got.Systems) != len(want) {
+		t.Fatalf("expected %d systems, got %v", len(want), got.Systems)
+	}
+	for i := range want {
+		if got.Systems[i] != want[i] {
+			t.Errorf("expected rank %d to be %+v, got %+v", i+1, want[i], got.Systems[i])
+		}
+	}
+
+	// Once the window has moved past them, the problems no longer count
+	later := ua.rankErrorRates(now.Add(time.Minute))
+	for _, rate := range later.Systems {
+		if rate.Errors != 0 || rate.Warnings != 0 || rate.PerMinute != 0 {
+			t.Errorf("expected no recent problems a window later, got %+v", rate)
+		}
+	}
+	if got, want := (&UnitAsset{}).errorWindow(), defaultErrorWindow; got != want {
+		t.Errorf("expected the default window %v, got %v", want, got)
+	}
+}
+
+// Replies to the forwarded messages with the next status in line, or fails like an unreachable parent for a 0
+type transUpstream struct {
+	replies   []int
+	attempts  int
+	forwarder string
+}
+
+func (mock *transUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Body.Close()
+	mock.forwarder = req.Header.Get(forwardedHeader)
+	status := mock.replies[min(mock.attempts, len(mock.replies)-1)]
+	mock.attempts++
+	if status == 0 {
+		return nil, errMock
+	}
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(status)
+	return rec.Result(), nil
+}
+
+func TestForwardUpstream(t *testing.T) {
+	defer func(wait time.Duration) { upstreamRetryWait = wait }(upstreamRetryWait)
+	upstreamRetryWait = time.Millisecond
+	defer func() { http.DefaultClient.Transport = nil }()
+	sys := components.NewSystem("test messenger", context.Background())
+	ua := &UnitAsset{Owner: &sys, Traits: Traits{Upstream: "http://parent/messenger/log/message"}}
+
+	table := []struct {
+		replies          []int
+		expectedAttempts int
+		expectErr        bool
+	}{
+		// Forwarded right away
+		{[]int{http.StatusOK}, 1, false},
+		// The parent recovers
+		{[]int{http.StatusServiceUnavailable, 0, http.StatusOK}, 3, false},
+		// The parent stays unreachable
+		{[]int{0}, upstreamAttempts, true},
+		// The parent refuses the message, no point in sending it again
+		{[]int{http.StatusBadRequest}, 1, true},
+	}
+	for i, test := range table {
+		mock := &transUpstream{replies: test.replies}
+		http.DefaultClient.Transport = mock
+		err := ua.forwardUpstream(forms.SystemMessage_v1{Level: forms.LevelError, System: "pump"})
+		if got, want := err != nil, test.expectErr; got != want {
+			t.Errorf("case %d: expected error %v, got: %v", i, want, err)
+		}
+		if got, want := mock.attempts, test.expectedAttempts; got != want {
+			t.Errorf("case %d: expected %d attempts, got %d", i, want, got)
+		}
+		if got, want := mock.forwarder, sys.Name; got != want {
+			t.Errorf("case %d: expected the message marked as forwarded by %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestQueueUpstream(t *testing.T) {
+	// Without a parent messenger nothing is queued
+	ua := &UnitAsset{}
+	ua.queueUpstream(forms.SystemMessage_v1{Level: forms.LevelError, System: "pump"})
+
+	ua = &UnitAsset{upLevel: forms.LevelWarn, upstream: make(chan forms.SystemMessage_v1, 2)}
+	for i, level := range []forms.MessageLevel{forms.LevelInfo, forms.LevelWarn, forms.LevelError, forms.LevelError} {
+		ua.queueUpstream(forms.SystemMessage_v1{Level: level, System: "pump", Body: fmt.Sprint(i)})
+	}
+	// The info message is below the upstream level and the last error didn't fit in the queue
+	if got, want := len(ua.upstream), 2; got != want {
+		t.Fatalf("expected %d queued messages, got %d", want, got)
+	}
+	for _, want := range []string{"1", "2"} {
+		if got := (<-ua.upstream).Body; got != want {
+			t.Errorf("expected queued message %s, got %s", want, got)
+		}
+	}
+}
+
+func TestShutdownSummary(t *testing.T) {
+	ua := &UnitAsset{
+		messages: make(map[string][]message),
+	}
+	if got, want := ua.shutdownSummary(), "shutdown summary: messages=0 debug=0 info=0 warn=0 error=0 systems=0"; got != want {
+		t.Errorf("expected summary %q, got %q", want, got)
+	}
+
+	levels := []forms.MessageLevel{forms.LevelInfo, forms.LevelInfo, forms.LevelWarn, forms.LevelError}
+	for i := range maxMessages * 2 {
+		ua.addMessage(forms.SystemMessage_v1{
+			Level:  levels[i%len(levels)],
+			System: fmt.Sprintf("system%d", i%3),
+			Body:   fmt.Sprintf("%d", i),
+		})
+	}
+	// The trimmed messages still count as handled
+	if got, want := ua.shutdownSummary(), "shutdown summary: messages=20 debug=0 info=10 warn=5 error=5 systems=3"; got != want {
+		t.Errorf("expected summary %q, got %q", want, got)
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	table := []struct {
+		minLevel     string
+		systemLevels map[string]string
+		expectErr    bool
+	}{
+		// Defaults to accepting all
+		{"", nil, false},
+		// Known levels, case insensitive
+		{"Warn", map[string]string{"pump": "ERROR"}, false},
+		// Unknown minimum level
+		{"loud", nil, true},
+		// Unknown system level
+		{"info", map[string]string{"pump": "loud"}, true},
+	}
+
+	for _, test := range table {
+		ua := &UnitAsset{Traits: Traits{MinLevel: test.minLevel, SystemLevels: test.systemLevels}}
+		err := ua.parseLevels()
+		if got, want := err != nil, test.expectErr; got != want {
+			t.Errorf("expected error %v, got: %v", want, err)
+		}
+	} // Unknown upstream level
+	ua := &UnitAsset{Traits: Traits{UpstreamLevel: "loud"}}
+	if err := ua.parseLevels(); err == nil {
+		t.Errorf("expected an error for an unknown upstream level")
+	}
+}
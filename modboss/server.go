@@ -0,0 +1,211 @@
+/*******************************************************************************
+ * Copyright (c) 2025 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/usecases"
+)
+
+// serverPolicy bounds how long a client may take over its requests to the servers of the system,
+// so that slow clients cannot hold the connections open (slowloris), and sets the TLS policy of the https server
+type serverPolicy struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	CertFile          string   // certificate of the https server
+	KeyFile           string   // private key of the https server
+	MinVersion        uint16   // lowest TLS version accepted
+	CipherSuites      []uint16 // TLS 1.2 cipher suites accepted, those of crypto/tls when empty
+}
+
+// defaultServerPolicy holds the settings of a hardened server that are not configured.
+// The write timeout stays above the longest long-polling quest of the registrar (60 s).
+var defaultServerPolicy = serverPolicy{
+	ReadHeaderTimeout: 5 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	WriteTimeout:      90 * time.Second,
+	IdleTimeout:       120 * time.Second,
+	MinVersion:        tls.VersionTLS12,
+}
+
+// tlsVersions are the TLS versions a server policy may set as its minimum
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// serverPolicyVariables are the environment variables that configure the server policy
+var serverPolicyVariables = []string{"SERVER_READ_HEADER_TIMEOUT", "SERVER_READ_TIMEOUT", "SERVER_WRITE_TIMEOUT",
+	"SERVER_IDLE_TIMEOUT", "SERVER_CERT_FILE", "SERVER_KEY_FILE", "SERVER_TLS_MIN_VERSION", "SERVER_TLS_CIPHER_SUITES"}
+
+// serverPolicyFromEnv reads the server policy from the environment (e.g., SERVER_READ_TIMEOUT=10s), starting from the defaults.
+// It reports whether any of its variables is set, the servers being left to mbaigo otherwise.
+func serverPolicyFromEnv(getenv func(string) string) (policy serverPolicy, set bool, err error) {
+	policy = defaultServerPolicy
+	for _, name := range serverPolicyVariables {
+		if getenv(name) != "" {
+			set = true
+		}
+	}
+	timeouts := map[string]*time.Duration{
+		"SERVER_READ_HEADER_TIMEOUT": &policy.ReadHeaderTimeout,
+		"SERVER_READ_TIMEOUT":        &policy.ReadTimeout,
+		"SERVER_WRITE_TIMEOUT":       &policy.WriteTimeout,
+		"SERVER_IDLE_TIMEOUT":        &policy.IdleTimeout,
+	}
+	for name, timeout := range timeouts {
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return policy, set, fmt.Errorf("invalid %s %q, expected a positive duration such as 10s", name, value)
+		}
+		*timeout = d
+	}
+	policy.CertFile = getenv("SERVER_CERT_FILE")
+	policy.KeyFile = getenv("SERVER_KEY_FILE")
+	if (policy.CertFile == "") != (policy.KeyFile == "") {
+		return policy, set, errors.New("SERVER_CERT_FILE and SERVER_KEY_FILE must be set together")
+	}
+	if value := getenv("SERVER_TLS_MIN_VERSION"); value != "" {
+		version, known := tlsVersions[value]
+		if !known {
+			return policy, set, fmt.Errorf("invalid SERVER_TLS_MIN_VERSION %q, expected 1.2 or 1.3", value)
+		}
+		policy.MinVersion = version
+	}
+	if value := getenv("SERVER_TLS_CIPHER_SUITES"); value != "" {
+		suites, err := cipherSuites(value)
+		if err != nil {
+			return policy, set, err
+		}
+		policy.CipherSuites = suites
+	}
+	return policy, set, nil
+}
+
+// cipherSuites returns the IDs of the comma-separated cipher suites (e.g., TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256),
+// refusing those crypto/tls deems insecure
+func cipherSuites(names string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q in SERVER_TLS_CIPHER_SUITES", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// tlsConfig returns the TLS configuration of the https server. The TLS 1.3 cipher suites are not configurable in crypto/tls.
+func (p serverPolicy) tlsConfig() *tls.Config {
+	return &tls.Config{MinVersion: p.MinVersion, CipherSuites: p.CipherSuites}
+}
+
+// newServer builds a server of the system with the timeouts and the TLS policy of the policy
+func newServer(port int, handler http.Handler, policy serverPolicy) *http.Server {
+	return &http.Server{
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           handler,
+		ReadHeaderTimeout: policy.ReadHeaderTimeout,
+		ReadTimeout:       policy.ReadTimeout,
+		WriteTimeout:      policy.WriteTimeout,
+		IdleTimeout:       policy.IdleTimeout,
+		TLSConfig:         policy.tlsConfig(),
+	}
+}
+
+// assetHandler passes the requests for /<system>/<asset>/<service> to the Serving method of the unit asset
+func assetHandler(sys *components.System) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+		if len(parts) < 3 || parts[0] != sys.Name {
+			http.NotFound(w, r)
+			return
+		}
+		ua, found := sys.UAssets[parts[1]]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		(*ua).Serving(w, r, parts[2])
+	})
+}
+
+// setoutServers starts the servers of the system. Without a server policy in the environment they are left to
+// usecases.SetoutServers; with one, the system serves its unit assets itself with the policy applied, since mbaigo
+// does not expose its servers. The hardened servers do not serve mbaigo's system pages and /msg endpoint.
+func setoutServers(sys *components.System) {
+	policy, set, err := serverPolicyFromEnv(os.Getenv)
+	if err != nil {
+		log.Fatalf("Server policy error: %v\n", err)
+	}
+	if !set {
+		usecases.SetoutServers(sys)
+		return
+	}
+	var servers []*http.Server
+	for protocol, port := range sys.Husk.ProtoPort {
+		if port == 0 || (protocol != "http" && protocol != "https") {
+			continue
+		}
+		if protocol == "https" && policy.CertFile == "" {
+			log.Printf("The https server of %s needs SERVER_CERT_FILE and SERVER_KEY_FILE, skipping it", sys.Name)
+			continue
+		}
+		srv := newServer(port, assetHandler(sys), policy)
+		servers = append(servers, srv)
+		go func() {
+			var err error
+			if protocol == "https" {
+				err = srv.ListenAndServeTLS(policy.CertFile, policy.KeyFile)
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("The %s server of %s stopped: %v", protocol, sys.Name, err)
+			}
+		}()
+		log.Printf("The %s server of %s listens on port %d", protocol, sys.Name, port)
+	}
+	<-sys.Ctx.Done()
+	for _, srv := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down a server of %s: %v", sys.Name, err)
+		}
+		cancel()
+	}
+}
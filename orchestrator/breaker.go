@@ -0,0 +1,117 @@
+/*******************************************************************************
+ * Copyright (c) 2025 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// defaultBreakerCooldown is how long the circuit of a failing registrar stays open when no cooldown is configured
+const defaultBreakerCooldown = 30 * time.Second
+
+// errCircuitOpen is returned when a registrar is skipped because its circuit breaker is open
+var errCircuitOpen = errors.New("circuit open")
+
+// states of the circuit breaker of a registrar, as reported by the registrar status
+const (
+	circuitClosed   = "closed"    // the registrar is queried
+	circuitOpen     = "open"      // the registrar failed too often and is skipped until the cooldown is over
+	circuitHalfOpen = "half-open" // the cooldown is over and a single trial query tests the registrar's recovery
+)
+
+// breaker counts the consecutive failures of the queries to a registrar and, once open, when it can be tried again
+type breaker struct {
+	failures  int
+	openUntil time.Time // zero while the circuit is closed
+	probing   bool      // a trial query is under way in the half-open state
+}
+
+// breakerCooldown returns how long the circuit of a failing registrar stays open
+func (ua *UnitAsset) breakerCooldown() time.Duration {
+	if ua.BreakerCooldown <= 0 {
+		return defaultBreakerCooldown
+	}
+	return time.Duration(ua.BreakerCooldown) * time.Millisecond
+}
+
+// allowQuery reports whether the registrar may be queried: always while its circuit is closed, never while it is open,
+// and once its cooldown is over for a single trial at a time
+func (ua *UnitAsset) allowQuery(registrar string, now time.Time) bool {
+	if ua.BreakerThreshold <= 0 {
+		return true
+	}
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	b := ua.breakers[registrar]
+	if b == nil || b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// noteOutcome updates the circuit of the registrar with the outcome of a query: the registrar answering, even without
+// a provider, closes it, while a failure counts towards opening it or, for a trial, opens it again for another cooldown.
+// A query the consumer gave up on says nothing about the registrar
+func (ua *UnitAsset) noteOutcome(ctx context.Context, registrar string, err error, now time.Time) {
+	if ua.BreakerThreshold <= 0 {
+		return
+	}
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	failed := errors.Is(err, errRegistrarUnreachable) || errors.Is(err, errBadRegistrarResponse)
+	if !failed || ctx.Err() != nil {
+		if b := ua.breakers[registrar]; b != nil {
+			b.probing = false
+			if err == nil || errors.Is(err, errNoSuchService) {
+				delete(ua.breakers, registrar)
+			}
+		}
+		return
+	}
+	if ua.breakers == nil {
+		ua.breakers = make(map[string]*breaker)
+	}
+	b := ua.breakers[registrar]
+	if b == nil {
+		b = &breaker{}
+		ua.breakers[registrar] = b
+	}
+	b.failures++
+	if b.probing || b.failures >= ua.BreakerThreshold {
+		b.openUntil = now.Add(ua.breakerCooldown())
+	}
+	b.probing = false
+}
+
+// circuitState returns the state of the circuit breaker of the registrar (the caller holds the lock)
+func (ua *UnitAsset) circuitState(registrar string, now time.Time) string {
+	b := ua.breakers[registrar]
+	switch {
+	case b == nil || b.openUntil.IsZero():
+		return circuitClosed
+	case now.Before(b.openUntil):
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
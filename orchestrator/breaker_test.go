@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// ------------------------------------ //
+// Tests for the registrar circuit breaker
+// ------------------------------------ //
+
+type noteOutcomeTestStruct struct {
+	err           error
+	after         time.Duration // time of the query since the start
+	expectedAllow bool          // whether the query was let through
+	expectedState string        // state of the circuit after the query
+	testName      string
+}
+
+// Each case runs in order on the same breaker, with a threshold of 2 and a cooldown of 10 s
+var noteOutcomeTestParams = []noteOutcomeTestStruct{
+	{errRegistrarUnreachable, 0, true, circuitClosed, "Good case, first failure keeps the circuit closed"},
+	{nil, time.Second, true, circuitClosed, "Good case, success resets the count"},
+	{errBadRegistrarResponse, 2 * time.Second, true, circuitClosed, "Good case, failure counted again from zero"},
+	{errRegistrarUnreachable, 3 * time.Second, true, circuitOpen, "Good case, threshold opens the circuit"},
+	{nil, 5 * time.Second, false, circuitOpen, "Good case, open circuit short-circuits"},
+	{errRegistrarUnreachable, 13 * time.Second, true, circuitOpen, "Good case, failed trial opens the circuit again"},
+	{fmt.Errorf("%w: temperature", errNoSuchService), 24 * time.Second, true, circuitClosed, "Good case, registrar answering closes the circuit"},
+}
+
+func TestNoteOutcome(t *testing.T) {
+	ua := createUnitAsset()
+	ua.BreakerThreshold = 2
+	ua.BreakerCooldown = 10000
+	registrar := "http://localhost:20102/serviceregistrar/registry"
+	start := time.Now()
+	for _, testCase := range noteOutcomeTestParams {
+		now := start.Add(testCase.after)
+		allowed := ua.allowQuery(registrar, now)
+		if allowed != testCase.expectedAllow {
+			t.Errorf("In test case: %s: Expected the query allowed %t, got: %t", testCase.testName, testCase.expectedAllow, allowed)
+		}
+		if allowed {
+			ua.noteOutcome(context.Background(), registrar, testCase.err, now)
+		}
+		ua.mu.Lock()
+		state := ua.circuitState(registrar, now)
+		ua.mu.Unlock()
+		if state != testCase.expectedState {
+			t.Errorf("In test case: %s: Expected the circuit %s, got: %s", testCase.testName, testCase.expectedState, state)
+		}
+	}
+}
+
+func TestNoteOutcomeHalfOpen(t *testing.T) {
+	ua := createUnitAsset()
+	ua.BreakerThreshold = 1
+	registrar := "http://localhost:20102/serviceregistrar/registry"
+	start := time.Now()
+	ua.noteOutcome(context.Background(), registrar, errRegistrarUnreachable, start)
+
+	// Once the cooldown is over, a single trial is let through at a time
+	after := start.Add(defaultBreakerCooldown)
+	if !ua.allowQuery(registrar, after) || ua.allowQuery(registrar, after) {
+		t.Fatalf("Expected a single trial query in the half-open state")
+	}
+	// A consumer giving up on the trial leaves the circuit half-open for another trial
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ua.noteOutcome(ctx, registrar, errRegistrarUnreachable, after)
+	if !ua.allowQuery(registrar, after) {
+		t.Errorf("Expected another trial query after the consumer gave up")
+	}
+
+	// Without a threshold, the breaker is off
+	ua.BreakerThreshold = 0
+	if !ua.allowQuery(registrar, after) {
+		t.Errorf("Expected the queries to be let through with the breaker off")
+	}
+}
+
+// unavailableRegistrar answers every query like a registrar on standby, counting them
+type unavailableRegistrar struct {
+	queries int
+	healthy bool
+}
+
+func (ur *unavailableRegistrar) RoundTrip(req *http.Request) (*http.Response, error) {
+	ur.queries++
+	if ur.healthy {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": []string{"application/json"}},
+			Body: io.NopCloser(bytes.NewReader(createTestServiceRecordListForm())), Request: req}, nil
+	}
+	return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{},
+		Body: io.NopCloser(bytes.NewReader([]byte("Service Unavailable"))), Request: req}, nil
+}
+
+func TestQueryRegistrarBreaker(t *testing.T) {
+	ua := createUnitAsset()
+	ua.BreakerThreshold = 3
+	ua.BreakerCooldown = 50
+	transport := &unavailableRegistrar{}
+	ua.client = &http.Client{Transport: transport}
+	ua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+	quest := serviceQuestForm
+	quest.ServiceDefinition = "temperature"
+
+	for i := range 3 {
+		if _, err := ua.queryRegistrar(context.Background(), quest); !errors.Is(err, errBadRegistrarResponse) {
+			t.Fatalf("Expected failure %d of the registrar, got: %v", i+1, err)
+		}
+	}
+	// During the cooldown, the registrar is skipped without being queried
+	for range 5 {
+		_, err := ua.queryRegistrar(context.Background(), quest)
+		if !errors.Is(err, errCircuitOpen) || !errors.Is(err, errRegistrarUnreachable) {
+			t.Errorf("Expected the open circuit to fail fast, got: %v", err)
+		}
+	}
+	if transport.queries != 3 {
+		t.Errorf("Expected the registrar to be queried 3 times, got: %d", transport.queries)
+	}
+	if status := ua.status(); status.Circuit != circuitOpen {
+		t.Errorf("Expected the status to report the open circuit, got: %+v", status)
+	}
+
+	// After the cooldown, a successful trial closes the circuit
+	time.Sleep(60 * time.Millisecond)
+	transport.healthy = true
+	if _, err := ua.queryRegistrar(context.Background(), quest); err != nil {
+		t.Fatalf("Expected the trial query to succeed, got: %v", err)
+	}
+	if status := ua.status(); status.Circuit != circuitClosed || transport.queries != 4 {
+		t.Errorf("Expected the circuit closed after 4 queries, got: %+v and %d", status, transport.queries)
+	}
+}
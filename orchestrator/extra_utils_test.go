@@ -10,7 +10,9 @@ import (
 )
 
 // mockTransport is used for replacing the default network Transport (used by
-// http.DefaultClient) and it will intercept network requests.
+// http.DefaultClient) and it will intercept network requests. It covers the lookup
+// of the leading registrar by mbaigo as well as the queries of unit assets without
+// a client of their own; tests of a single call set the unit asset's client instead.
 type mockTransport struct {
 	respFunc func() *http.Response
 	hits     int
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ------------------------------------ //
+// Tests for the media type negotiation
+// ------------------------------------ //
+
+type negotiateMediaTypeTestStruct struct {
+	contentType    string
+	configured     []string
+	expectedType   string
+	expectedStatus int // status of the reply to a failed negotiation, 0 if it succeeds
+	testName       string
+}
+
+var negotiateMediaTypeTestParams = []negotiateMediaTypeTestStruct{
+	{"application/json", nil, "application/json", 0, "Good case, json accepted by default"},
+	{"application/json; charset=utf-8", nil, "application/json", 0, "Good case, parameters ignored"},
+	{"application/xml", []string{"application/json", "application/xml"}, "application/xml", 0, "Good case, configured xml"},
+	{"application/xml", nil, "", http.StatusUnsupportedMediaType, "Bad case, xml not accepted by default"},
+	{"text/plain", []string{"application/xml"}, "", http.StatusUnsupportedMediaType, "Bad case, type not configured"},
+	{"application/json", []string{"text/csv"}, "application/json", 0, "Good case, unsupported configuration falls back to json"},
+	{"", nil, "", http.StatusBadRequest, "Bad case, missing content type"},
+	{"json;;", nil, "", http.StatusBadRequest, "Bad case, malformed content type"},
+}
+
+func TestNegotiateMediaType(t *testing.T) {
+	for _, testCase := range negotiateMediaTypeTestParams {
+		accepted := acceptedMediaTypes(testCase.configured)
+		mediaType, err := negotiateMediaType(testCase.contentType, accepted)
+		if testCase.expectedStatus == 0 {
+			if err != nil || mediaType != testCase.expectedType {
+				t.Errorf("In test case: %s: Expected %s, got: %s and %v", testCase.testName, testCase.expectedType, mediaType, err)
+			}
+			continue
+		}
+		if err == nil || mediaTypeStatus(err) != testCase.expectedStatus {
+			t.Errorf("In test case: %s: Expected a failure with status %d, got: %v", testCase.testName, testCase.expectedStatus, err)
+			continue
+		}
+		if errors.Is(err, errUnsupportedMediaType) && !strings.Contains(err.Error(), strings.Join(accepted, ", ")) {
+			t.Errorf("In test case: %s: Expected the error to name the accepted media types, got: %v", testCase.testName, err)
+		}
+	}
+	if accepted := acceptedMediaTypes(nil); !slices.Equal(accepted, defaultMediaTypes) {
+		t.Errorf("Expected the default media types, got: %v", accepted)
+	}
+}
+
+type acceptsJSONTestStruct struct {
+	accept   string
+	expected bool
+	testName string
+}
+
+var acceptsJSONTestParams = []acceptsJSONTestStruct{
+	{"application/json", true, "Good case, json asked for"},
+	{"text/html, application/json;q=0.9", true, "Good case, json among other types"},
+	{"", false, "Good case, no Accept header"},
+	{"*/*", false, "Good case, wildcard keeps plain text"},
+	{"text/plain", false, "Good case, plain text asked for"},
+	{"application/json;q=0", false, "Good case, json refused"},
+	{"json;;", false, "Bad case, malformed Accept header"},
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	for _, testCase := range acceptsJSONTestParams {
+		if got := acceptsJSON(testCase.accept); got != testCase.expected {
+			t.Errorf("In test case: %s: Expected %t, got: %t", testCase.testName, testCase.expected, got)
+		}
+	}
+}
@@ -17,10 +17,15 @@ import (
 	"context"
 	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sdoque/mbaigo/components"
@@ -35,6 +40,7 @@ func main() {
 
 	// instantiate the System
 	sys := components.NewSystem("orchestrator", ctx)
+	setLogFormat(sys.Name) // emit JSON lines instead of text when LOG_FORMAT=json
 
 	// Instantiate the husk
 	sys.Husk = &components.Husk{
@@ -80,42 +86,166 @@ func main() {
 	// Register the (system) and its services
 	usecases.RegisterServices(&sys)
 
-	// start the http handler and server
-	go usecases.SetoutServers(&sys)
+	// start the http handler and server, with the server policy of the environment if any (see server.go)
+	go setoutServers(&sys)
 
 	// wait for shutdown signal, and gracefully close properly goroutines with context
 	<-sys.Sigs // wait for a SIGINT (Ctrl+C) signal
 	log.Println("shutting down system", sys.Name)
+	deadline := time.Now().Add(shutdownGrace(2 * time.Second))
+	// refuse new quests and let those in flight end within the grace period
+	for _, ua := range sys.UAssets {
+		if orch, ok := (*ua).(*UnitAsset); ok && !orch.drain(time.Until(deadline)) {
+			log.Printf("%d quests of %s were still in flight at the end of the grace period\n", orch.drainState().InFlight, orch.Name)
+		}
+	}
 	cancel() // signal the goroutines to stop
 	// allow the go routines to be executed, which might take more time than the main routine to end
-	time.Sleep(2 * time.Second)
+	time.Sleep(time.Until(deadline))
+}
+
+// shutdownGrace returns how long the goroutines are given to end once the context is cancelled.
+// The SHUTDOWN_GRACE environment variable (e.g., "5s") overrides the default; an invalid value is ignored.
+func shutdownGrace(defaultGrace time.Duration) time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE")); err == nil && grace >= 0 {
+		return grace
+	}
+	return defaultGrace
 }
 
 // Serving handles the resources services. NOTE: it expects those names from the request URL path
 func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath string) {
 	switch servicePath {
 	case "squest":
-		ua.orchestrate(w, r)
+		ua.serveQuest(w, r, ua.orchestrate)
 	case "squests":
-		ua.orchestrateMultiple(w, r)
+		ua.serveQuest(w, r, ua.orchestrateMultiple)
+	case "squestlist":
+		ua.serveQuest(w, r, ua.orchestrateList)
+	case "squestforward":
+		ua.serveQuest(w, r, ua.orchestrateForward)
+	case "drain":
+		ua.drainInfo(w, r)
+	case "registrar":
+		ua.registrarInfo(w, r)
+	case "health":
+		ua.healthInfo(w, r)
+	case "metrics":
+		ua.metricsInfo(w, r)
 	default:
 		http.Error(w, "Invalid service request [Do not modify the services subpath in the configuration file]", http.StatusBadRequest)
 	}
 }
 
+// serveQuest hands a quest to its handler and keeps track of it until it is answered,
+// or refuses it with 503 and a Retry-After header while the orchestrator is draining
+func (ua *UnitAsset) serveQuest(w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request)) {
+	if !ua.admitQuest() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(drainRetryAfter/time.Second)))
+		http.Error(w, "The orchestrator is draining for maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	defer ua.finishQuest()
+	handler(w, r)
+}
+
+// drainInfo reports (GET), starts (POST) or ends (DELETE) the drain of the orchestrator during maintenance.
+// While draining, new quests are refused and those in flight are let to complete.
+func (ua *UnitAsset) drainInfo(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		ua.setDraining(true)
+		status = http.StatusAccepted
+	case http.MethodDelete:
+		ua.setDraining(false)
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	payload, err := json.Marshal(ua.drainState())
+	if err != nil {
+		http.Error(w, "Error packing the drain status", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// registrarInfo reports (GET) the registrar the orchestrator is currently using, when it was looked up and whether the last query succeeded
+func (ua *UnitAsset) registrarInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	payload, err := json.Marshal(ua.status())
+	if err != nil {
+		http.Error(w, "Error packing the registrar status", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// healthInfo probes (GET) the core systems of the local cloud and reports whether its core is healthy.
+// The reply is 200 when healthy and 503 otherwise, the body detailing each core system either way.
+func (ua *UnitAsset) healthInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	summary := ua.checkCores(r.Context())
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		http.Error(w, "Error packing the health summary", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !summary.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
+	}
+}
+
+// metricsInfo reports (GET) the quests handled per service definition in the Prometheus text format
+func (ua *UnitAsset) metricsInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	ua.writeMetrics(w)
+}
+
 // orchestrate receives a service discovery request and responds with the selected service location if found
 func (ua *UnitAsset) orchestrate(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		contentType := r.Header.Get("Content-Type")
-		mediaType, _, err := mime.ParseMediaType(contentType)
+		ctx, span := ua.tracer.startServerSpan(r, "orchestrate")
+		var failure error
+		defer func() { span.end(failure) }()
+		mediaType, err := negotiateMediaType(r.Header.Get("Content-Type"), acceptedMediaTypes(ua.MediaTypes))
 		if err != nil {
-			log.Println("Error parsing media type:", err)
+			log.Println("Error negotiating the media type:", err)
+			failQuest(w, r, "", err, mediaTypeStatus(err))
 			return
 		}
 
 		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
 		bodyBytes, err := io.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			failQuest(w, r, "", errQuestTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil {
 			log.Printf("error reading discovery request body: %v\n", err)
 			return
@@ -130,11 +260,27 @@ func (ua *UnitAsset) orchestrate(w http.ResponseWriter, r *http.Request) {
 			log.Println("Problem unpacking the service discovery request form")
 			return
 		}
+		span.setAttribute("service.definition", qf.ServiceDefinition)
 
-		servLocation, err := ua.getServiceURL(*qf)
+		if err := ua.authorize(consumerIdentity(r, *qf), qf.ServiceDefinition); err != nil {
+			log.Println(err)
+			failure = err
+			failQuest(w, r, qf.ServiceDefinition, err, http.StatusForbidden)
+			return
+		}
+		wait, err := questWait(r)
 		if err != nil {
 			log.Println(err)
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			failQuest(w, r, qf.ServiceDefinition, errBadWait, http.StatusBadRequest)
+			return
+		}
+
+		servLocation, err := ua.getServiceURLAt(ctx, registrarOverride(r), *qf, wait, sessionKey(r, *qf))
+		ua.countResolution(qf.ServiceDefinition, err)
+		if err != nil {
+			log.Println(err)
+			failure = err
+			failQuest(w, r, qf.ServiceDefinition, err, locateStatus(err))
 			return
 		}
 
@@ -146,22 +292,137 @@ func (ua *UnitAsset) orchestrate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	default:
-		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		failQuest(w, r, "", errMethodNotSupported, http.StatusNotFound)
+	}
+}
+
+// maxQuestWait bounds how long a quest may wait for a provider to be registered, as the registrar does
+const maxQuestWait = 60 * time.Second
+
+// questWait returns how long the quest may wait for a provider to be registered (e.g., ?wait=10s), zero if it should not wait
+func questWait(r *http.Request) (time.Duration, error) {
+	waitStr := r.URL.Query().Get("wait")
+	if waitStr == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(waitStr)
+	if err != nil {
+		return 0, err
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("negative wait duration %s", waitStr)
+	}
+	return min(wait, maxQuestWait), nil
+}
+
+// locateStatus maps a failure to locate a service to the HTTP status of the reply: a service the registrar
+// does not know of is not found, an unreadable reply of the registrar is a bad gateway, while a registrar
+// that cannot be reached leaves the orchestrator unavailable
+func locateStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoSuchService):
+		return http.StatusNotFound
+	case errors.Is(err, errBadRegistrarResponse):
+		return http.StatusBadGateway
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// Failures of the quests that carry no cause of their own, in the words of their plain text replies
+var (
+	errQuestTooLarge      = errors.New("Discovery request body too large")
+	errBadWait            = errors.New("Invalid wait duration")
+	errMethodNotSupported = errors.New("Method is not supported.")
+	errUnreadableQuest    = errors.New("Error reading discovery request body")
+	errBadQuestList       = errors.New("Error extracting the discovery requests")
+	errForwardTooLarge    = errors.New("Forward request body too large")
+	errBadForwardRequest  = errors.New("Error extracting the forward request")
+	errForwardFailed      = errors.New("Error forwarding the request to the provider")
+	errProviderTooLarge   = errors.New("Provider response too large")
+)
+
+// questError is the body of a failed quest for a consumer that accepts JSON
+type questError struct {
+	Error      string `json:"error"`
+	Definition string `json:"definition,omitempty"`
+	Code       int    `json:"code"`
+}
+
+// questFailure returns the message of a failed quest for its JSON body: a failed lookup is reported by its kind,
+// its cause (such as the transport error of a registrar) being left to the log
+func questFailure(err error) string {
+	for _, kind := range []error{errNoSuchService, errRegistrarUnreachable, errBadRegistrarResponse} {
+		if errors.Is(err, kind) {
+			return kind.Error()
+		}
+	}
+	return err.Error()
+}
+
+// failQuest answers a failed quest with a questError when the consumer accepts JSON, and in plain text otherwise
+func failQuest(w http.ResponseWriter, r *http.Request, definition string, err error, code int) {
+	if !acceptsJSON(r.Header.Get("Accept")) {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	payload, mErr := json.Marshal(questError{Error: questFailure(err), Definition: definition, Code: code})
+	if mErr != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if _, err := w.Write(payload); err != nil {
+		log.Printf("Error occurred while writing to responsewriter: %v", err)
 	}
 }
 
+// bodyTooLarge reports whether reading a request body failed because it exceeds the size limit
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// registrarOverrideHeader lets a consumer target a specific registrar instead of the leading one
+const registrarOverrideHeader = "X-Registrar-URL"
+
+// registrarOverride returns the registrar URL requested by the consumer through the X-Registrar-URL header
+// or the "registrar" query parameter, or an empty string if there is none or it is not a valid http(s) URL
+func registrarOverride(r *http.Request) string {
+	override := r.Header.Get(registrarOverrideHeader)
+	if override == "" {
+		override = r.URL.Query().Get("registrar")
+	}
+	if override == "" {
+		return ""
+	}
+	u, err := url.Parse(override)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Printf("Ignoring the malformed registrar override %q\n", override)
+		return ""
+	}
+	return strings.TrimSuffix(override, "/")
+}
+
 func (ua *UnitAsset) orchestrateMultiple(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		contentType := r.Header.Get("Content-Type")
-		mediaType, _, err := mime.ParseMediaType(contentType)
+		mediaType, err := negotiateMediaType(r.Header.Get("Content-Type"), acceptedMediaTypes(ua.MediaTypes))
 		if err != nil {
-			log.Println("Error parsing media type:", err)
+			log.Println("Error negotiating the media type:", err)
+			failQuest(w, r, "", err, mediaTypeStatus(err))
 			return
 		}
 
 		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
 		bodyBytes, err := io.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			failQuest(w, r, "", errQuestTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil {
 			log.Printf("error reading discovery request body: %v\n", err)
 			return
@@ -177,10 +438,17 @@ func (ua *UnitAsset) orchestrateMultiple(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		servLocation, err := ua.getServicesURL(*qf)
+		if err := ua.authorize(consumerIdentity(r, *qf), qf.ServiceDefinition); err != nil {
+			log.Println(err)
+			failQuest(w, r, qf.ServiceDefinition, err, http.StatusForbidden)
+			return
+		}
+
+		servLocation, err := ua.getServicesURL(r.Context(), *qf)
+		ua.countResolution(qf.ServiceDefinition, err)
 		if err != nil {
 			log.Println(err)
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			failQuest(w, r, qf.ServiceDefinition, err, locateStatus(err))
 			return
 		}
 
@@ -192,6 +460,120 @@ func (ua *UnitAsset) orchestrateMultiple(w http.ResponseWriter, r *http.Request)
 			return
 		}
 	default:
-		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		failQuest(w, r, "", errMethodNotSupported, http.StatusNotFound)
+	}
+}
+
+// orchestrateList receives a list of service discovery requests and responds with the outcome of each one, in the order of the list
+func (ua *UnitAsset) orchestrateList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		if _, err := negotiateMediaType(r.Header.Get("Content-Type"), listMediaTypes); err != nil {
+			log.Println("Error negotiating the media type:", err)
+			failQuest(w, r, "", err, mediaTypeStatus(err))
+			return
+		}
+
+		defer r.Body.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
+		bodyBytes, err := io.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			failQuest(w, r, "", errQuestTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Printf("error reading discovery request body: %v\n", err)
+			failQuest(w, r, "", errUnreadableQuest, http.StatusBadRequest)
+			return
+		}
+
+		var quests []forms.ServiceQuest_v1
+		if err := json.Unmarshal(bodyBytes, &quests); err != nil {
+			log.Printf("error extracting the discovery requests %v\n", err)
+			failQuest(w, r, "", errBadQuestList, http.StatusBadRequest)
+			return
+		}
+
+		for i := range quests {
+			quests[i].RequesterName = consumerIdentity(r, quests[i]) // a verified identity prevails over the named one
+		}
+		payload, err := json.MarshalIndent(ua.resolveQuests(r.Context(), quests), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(payload) // respond with the outcome of each quest
+		if err != nil {
+			log.Printf("error while writing response: %v", err)
+		}
+	default:
+		failQuest(w, r, "", errMethodNotSupported, http.StatusNotFound)
+	}
+}
+
+// serviceLocationHeader tells the consumer of a forwarded request which provider answered it
+const serviceLocationHeader = "X-Service-Location"
+
+// orchestrateForward receives a service quest with a request, forwards the request to the selected provider and
+// streams the provider's response back, saving the consumer a round trip
+func (ua *UnitAsset) orchestrateForward(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		failQuest(w, r, "", errMethodNotSupported, http.StatusNotFound)
+		return
+	}
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
+	var fr forwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&fr); err != nil {
+		if bodyTooLarge(err) {
+			failQuest(w, r, "", errForwardTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("error extracting the forward request %v\n", err)
+		failQuest(w, r, "", errBadForwardRequest, http.StatusBadRequest)
+		return
+	}
+	definition := fr.Quest.ServiceDefinition
+
+	if err := ua.authorize(consumerIdentity(r, fr.Quest), definition); err != nil {
+		log.Println(err)
+		failQuest(w, r, definition, err, http.StatusForbidden)
+		return
+	}
+
+	sp, err := ua.locateServiceAt(r.Context(), registrarOverride(r), fr.Quest, 0, sessionKey(r, fr.Quest))
+	if err != nil {
+		log.Println(err)
+		failQuest(w, r, definition, err, locateStatus(err))
+		return
+	}
+	resp, err := forwardTo(r.Context(), ua.httpClient(), sp, fr)
+	if errors.Is(err, errBadForward) {
+		failQuest(w, r, definition, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		if r.Context().Err() != nil {
+			return // the consumer is gone
+		}
+		log.Printf("error forwarding the request to %s: %v\n", sp.ServLocation, err)
+		failQuest(w, r, definition, errForwardFailed, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > ua.maxBodySize() {
+		failQuest(w, r, definition, errProviderTooLarge, http.StatusBadGateway)
+		return
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set(serviceLocationHeader, sp.ServLocation)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, io.LimitReader(resp.Body, ua.maxBodySize())); err != nil {
+		log.Printf("error streaming the provider's response: %v", err)
 	}
 }
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/sdoque/mbaigo/components"
 	"github.com/sdoque/mbaigo/forms"
 )
 
@@ -123,9 +132,15 @@ func createTestServiceRecordListForm() []byte {
 	return fakebody
 }
 
-var getServiceURLErrorMessage = "core system 'serviceregistrar' not found: verifying registrar: Get " +
-	"\"http://localhost:20102/serviceregistrar/registry/status\": http: RoundTripper implementation " +
-	"(*main.mockTransport) returned a nil *Response with a nil error\n"
+// replyBody returns the body of a reply, cut down to the kind of failure for error replies,
+// whose cause is left to the registrar lookup
+func replyBody(w *httptest.ResponseRecorder) string {
+	body := w.Body.String()
+	if w.Code == http.StatusServiceUnavailable {
+		body, _, _ = strings.Cut(body, ":")
+	}
+	return body
+}
 
 type orchestrateTestStruct struct {
 	inputBody        io.ReadCloser
@@ -141,13 +156,16 @@ var orchestrateTestParams = []orchestrateTestStruct{
 	{io.NopCloser(strings.NewReader(string(createTestServiceQuestForm()))), "POST",
 		"application/json", 3, 200, string(createTestServicePointForm()), "Best case, everything passes"},
 	{io.NopCloser(strings.NewReader(string(createTestServiceQuestForm()))), "POST",
-		"", 3, 200, "", "Bad case, header content type is wrong"},
+		"", 3, 400, "malformed content type \"\": mime: no media type\n", "Bad case, header content type is wrong"},
+	{io.NopCloser(strings.NewReader(string(createTestServiceQuestForm()))), "POST",
+		"text/plain", 3, 415, "unsupported media type text/plain, the accepted media types are application/json\n",
+		"Bad case, unsupported media type"},
 	{io.NopCloser(errorReader{}), "POST",
 		"application/json", 3, 200, "", "Bad case, ReadAll on header body fails"},
 	{io.NopCloser(strings.NewReader(string("hej hej"))), "POST",
-		"text/plain", 3, 200, "", "Bad case, Unpack and type assertion to ServiceQuest_v1 fails"},
+		"application/json", 3, 200, "", "Bad case, Unpack and type assertion to ServiceQuest_v1 fails"},
 	{io.NopCloser(strings.NewReader(string(createTestServiceQuestForm()))), "POST",
-		"application/json", 1, 503, getServiceURLErrorMessage, "Bad case, getServiceURL fails"},
+		"application/json", 1, 503, errRegistrarUnreachable.Error(), "Bad case, getServiceURL fails"},
 	{io.NopCloser(strings.NewReader(string(""))), "PUT",
 		"", 0, 404, "Method is not supported.\n", "Bad case, wrong http method"},
 }
@@ -164,7 +182,7 @@ func TestOrchestrate(t *testing.T) {
 		inputW.Header()
 		mua.orchestrate(inputW, inputR)
 
-		if inputW.Body.String() != testCase.expectedOutput || inputW.Result().StatusCode != testCase.expectedCode {
+		if replyBody(inputW) != testCase.expectedOutput || inputW.Result().StatusCode != testCase.expectedCode {
 			t.Errorf("In test case: %s: Expected %s, got: %s",
 				testCase.testName, testCase.expectedOutput, inputW.Body.String())
 		}
@@ -199,13 +217,16 @@ var orchestrateMultipleTestParams = []orchestrateMultipleTestStruct{
 	{io.NopCloser(strings.NewReader(string(createTestServiceQuestForm()))), "POST",
 		"application/json", 3, 200, string(createTestServiceRecordListForm()), "Best case, everything passes"},
 	{io.NopCloser(strings.NewReader(string(createTestServiceQuestForm()))), "POST",
-		"", 3, 200, "", "Bad case, header content type is wrong"},
+		"", 3, 400, "malformed content type \"\": mime: no media type\n", "Bad case, header content type is wrong"},
+	{io.NopCloser(strings.NewReader(string(createTestServiceQuestForm()))), "POST",
+		"text/plain", 3, 415, "unsupported media type text/plain, the accepted media types are application/json\n",
+		"Bad case, unsupported media type"},
 	{io.NopCloser(errorReader{}), "POST",
 		"application/json", 3, 200, "", "Bad case, ReadAll on header body fails"},
 	{io.NopCloser(strings.NewReader(string("hej hej"))), "POST",
-		"text/plain", 3, 200, "", "Bad case, Unpack and type assertion to ServiceQuest_v1 fails"},
+		"application/json", 3, 200, "", "Bad case, Unpack and type assertion to ServiceQuest_v1 fails"},
 	{io.NopCloser(strings.NewReader(string(createTestServiceQuestForm()))), "POST",
-		"application/json", 1, 503, getServiceURLErrorMessage, "Bad case, getServiceURL fails"},
+		"application/json", 1, 503, errRegistrarUnreachable.Error(), "Bad case, getServiceURL fails"},
 	{io.NopCloser(strings.NewReader(string(""))), "PUT",
 		"", 0, 404, "Method is not supported.\n", "Bad case, wrong http method"},
 }
@@ -220,7 +241,7 @@ func TestOrchestrateMultiple(t *testing.T) {
 		inputW := httptest.NewRecorder()
 		mua.orchestrateMultiple(inputW, inputR)
 
-		if inputW.Body.String() != testCase.expectedOutput || inputW.Code != testCase.expectedCode {
+		if replyBody(inputW) != testCase.expectedOutput || inputW.Code != testCase.expectedCode {
 			t.Errorf("In test case: %s: Expected %s, got: %s",
 				testCase.testName, testCase.expectedOutput, inputW.Body.String())
 		}
@@ -241,3 +262,1005 @@ func TestOrchestrateMultiple(t *testing.T) {
 			inputW.ResponseRecorder.Body.String(), inputW.ResponseRecorder.Code)
 	}
 }
+
+type questErrorTestStruct struct {
+	handler          string
+	httpMethod       string
+	contentType      string
+	accept           string
+	mockTransportErr int
+	expectedCode     int
+	expectedBody     questError // zero if the reply is in plain text
+	testName         string
+}
+
+var questErrorTestParams = []questErrorTestStruct{
+	{"orchestrate", "POST", "application/json", "application/json", 1, 503,
+		questError{Error: errRegistrarUnreachable.Error(), Definition: "temperature", Code: 503}, "Good case, registrar unreachable"},
+	{"orchestrate", "POST", "text/plain", "application/json", 3, 415,
+		questError{Error: "unsupported media type text/plain, the accepted media types are application/json", Code: 415},
+		"Good case, unsupported media type"},
+	{"orchestrate", "PUT", "", "application/json", 0, 404,
+		questError{Error: errMethodNotSupported.Error(), Code: 404}, "Good case, wrong http method"},
+	{"orchestrateMultiple", "POST", "application/json", "text/html, application/json", 1, 503,
+		questError{Error: errRegistrarUnreachable.Error(), Definition: "temperature", Code: 503}, "Good case, multiple quest"},
+	{"orchestrate", "POST", "application/json", "*/*", 1, 503, questError{}, "Good case, plain text kept for a wildcard"},
+	{"orchestrateList", "POST", "application/json", "application/json", 0, 400,
+		questError{Error: errBadQuestList.Error(), Code: 400}, "Good case, quest list not a list"},
+	{"orchestrateList", "POST", "text/plain", "application/json", 0, 415,
+		questError{Error: "unsupported media type text/plain, the accepted media types are application/json", Code: 415},
+		"Good case, quest list in an unsupported media type"},
+	{"orchestrateList", "PUT", "", "application/json", 0, 404,
+		questError{Error: errMethodNotSupported.Error(), Code: 404}, "Good case, quest list with a wrong http method"},
+	{"orchestrateForward", "POST", "application/json", "application/json", 1, 503,
+		questError{Error: errRegistrarUnreachable.Error(), Definition: "temperature", Code: 503}, "Good case, forward with the registrar unreachable"},
+	{"orchestrateForward", "PUT", "", "application/json", 0, 404,
+		questError{Error: errMethodNotSupported.Error(), Code: 404}, "Good case, forward with a wrong http method"},
+}
+
+func TestQuestErrorBody(t *testing.T) {
+	var quest forms.ServiceQuest_v1
+	quest.NewForm()
+	quest.ServiceDefinition = "temperature"
+	body, err := json.Marshal(quest)
+	if err != nil {
+		t.Fatalf("Fail marshal at start of test: %v", err)
+	}
+	for _, testCase := range questErrorTestParams {
+		reqBody := string(body)
+		if testCase.handler == "orchestrateForward" {
+			reqBody = `{"quest":` + reqBody + `}`
+		}
+		inputR := httptest.NewRequest(testCase.httpMethod, "/test123", strings.NewReader(reqBody))
+		inputR.Header.Set("Content-Type", testCase.contentType)
+		inputR.Header.Set("Accept", testCase.accept)
+		mua := createUnitAsset()
+		newMockTransport(createMultiHTTPResponse(2, false, string(createTestServiceRecordListForm())),
+			testCase.mockTransportErr, nil)
+		inputW := httptest.NewRecorder()
+		switch testCase.handler {
+		case "orchestrate":
+			mua.orchestrate(inputW, inputR)
+		case "orchestrateList":
+			mua.orchestrateList(inputW, inputR)
+		case "orchestrateForward":
+			mua.orchestrateForward(inputW, inputR)
+		default:
+			mua.orchestrateMultiple(inputW, inputR)
+		}
+
+		if inputW.Code != testCase.expectedCode {
+			t.Errorf("In test case: %s: Expected code %d, got: %d", testCase.testName, testCase.expectedCode, inputW.Code)
+		}
+		if testCase.expectedBody == (questError{}) {
+			if strings.HasPrefix(inputW.Header().Get("Content-Type"), "application/json") || strings.HasPrefix(inputW.Body.String(), "{") {
+				t.Errorf("In test case: %s: Expected a plain text error, got: %s", testCase.testName, inputW.Body.String())
+			}
+			continue
+		}
+		var got questError
+		if inputW.Header().Get("Content-Type") != "application/json" || json.Unmarshal(inputW.Body.Bytes(), &got) != nil {
+			t.Errorf("In test case: %s: Expected a JSON error, got: %s", testCase.testName, inputW.Body.String())
+			continue
+		}
+		if got != testCase.expectedBody {
+			t.Errorf("In test case: %s: Expected %+v, got: %+v", testCase.testName, testCase.expectedBody, got)
+		}
+	}
+}
+
+type orchestrateLocateStatusTestStruct struct {
+	transport    http.RoundTripper
+	handler      func(*UnitAsset) http.HandlerFunc
+	expectedCode int
+	testName     string
+}
+
+func TestOrchestrateLocateStatus(t *testing.T) {
+	orchestrate := func(ua *UnitAsset) http.HandlerFunc { return ua.orchestrate }
+	multiple := func(ua *UnitAsset) http.HandlerFunc { return ua.orchestrateMultiple }
+	unreachable := func() http.RoundTripper {
+		return newMockTransport(createMultiHTTPResponse(2, false, ""), 1, fmt.Errorf("connection refused"))
+	}
+	garbled := func() http.RoundTripper {
+		return newMockTransport(createMultiHTTPResponse(2, false, "hej hej"), 0, nil)
+	}
+	params := []orchestrateLocateStatusTestStruct{
+		{questTransport{known: "temperature"}, orchestrate, 404, "Bad case, the registrar knows no such service"},
+		{questTransport{known: "temperature"}, multiple, 404, "Bad case, the registrar lists no such service"},
+		{unreachable(), orchestrate, 503, "Bad case, the registrar is unreachable"},
+		{unreachable(), multiple, 503, "Bad case, the registrar is unreachable for the list"},
+		{garbled(), orchestrate, 502, "Bad case, the registrar's reply is unreadable"},
+		{garbled(), multiple, 502, "Bad case, the registrar's list is unreadable"},
+	}
+	defer func() { http.DefaultClient.Transport = nil }()
+
+	for _, testCase := range params {
+		http.DefaultClient.Transport = testCase.transport
+		mua := createUnitAsset()
+		mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+		inputR := httptest.NewRequest(http.MethodPost, "/squest",
+			strings.NewReader(`{"serviceDefinition":"rotation","version":"ServiceQuest_v1"}`))
+		inputR.Header.Set("Content-Type", "application/json")
+		inputW := httptest.NewRecorder()
+		testCase.handler(mua)(inputW, inputR)
+
+		if inputW.Code != testCase.expectedCode {
+			t.Errorf("In test case: %s: Expected code %d, got: %d", testCase.testName, testCase.expectedCode, inputW.Code)
+		}
+	}
+}
+
+// questTransport answers registrar queries with a service record list only for known service definitions
+type questTransport struct {
+	known string
+}
+
+func (qt questTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer req.Body.Close()
+	var quest forms.ServiceQuest_v1
+	if err := json.NewDecoder(req.Body).Decode(&quest); err != nil {
+		return nil, err
+	}
+	body := createEmptyServiceRecordListForm()
+	if quest.ServiceDefinition == qt.known {
+		body = createTestServiceRecordListForm()
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(body))),
+		Request:    req,
+	}, nil
+}
+
+type orchestrateListTestStruct struct {
+	inputBody    string
+	contentType  string
+	httpMethod   string
+	expectedCode int
+	testName     string
+}
+
+var orchestrateListTestParams = []orchestrateListTestStruct{
+	{`[{"serviceDefinition":"temperature","version":"ServiceQuest_v1"},{"serviceDefinition":"rotation","version":"ServiceQuest_v1"}]`,
+		"application/json", "POST", 200, "Good case, partial results"},
+	{`{"serviceDefinition":"temperature"}`, "application/json", "POST", 400, "Bad case, body is not a list"},
+	{`[]`, "text/plain", "POST", 415, "Bad case, unsupported media type"},
+	{"", "", "GET", 404, "Bad case, wrong http method"},
+	{"[" + strings.Repeat(" ", defaultMaxBodySize) + "]", "application/json", "POST", 413, "Bad case, body too large"},
+}
+
+func TestOrchestrateList(t *testing.T) {
+	for _, testCase := range orchestrateListTestParams {
+		mua := createUnitAsset()
+		mua.client = &http.Client{Transport: questTransport{known: "temperature"}}
+		mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+		inputR := httptest.NewRequest(testCase.httpMethod, "/squestlist", strings.NewReader(testCase.inputBody))
+		inputR.Header.Set("Content-Type", testCase.contentType)
+		inputW := httptest.NewRecorder()
+		mua.orchestrateList(inputW, inputR)
+
+		if inputW.Code != testCase.expectedCode {
+			t.Errorf("In test case: %s: Expected code %d, got: %d", testCase.testName, testCase.expectedCode, inputW.Code)
+		}
+		if inputW.Code != 200 {
+			continue
+		}
+		var results []questResult
+		if err := json.Unmarshal(inputW.Body.Bytes(), &results); err != nil || len(results) != 2 {
+			t.Fatalf("In test case: %s: Expected two results, got: %s (%v)", testCase.testName, inputW.Body.String(), err)
+		}
+		if res := results[0]; res.Definition != "temperature" || res.ServicePoint == nil || res.Error != "" {
+			t.Errorf("In test case: %s: Expected a service point for temperature, got: %+v", testCase.testName, res)
+		}
+		if res := results[1]; res.Definition != "rotation" || res.ServicePoint != nil || res.Error == "" {
+			t.Errorf("In test case: %s: Expected an error for rotation, got: %+v", testCase.testName, res)
+		}
+	}
+}
+
+// registrarTransport answers registrar queries and remembers which registrar was queried
+type registrarTransport struct {
+	queried []string
+}
+
+func (rt *registrarTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	rt.queried = append(rt.queried, req.URL.String())
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(createTestServiceRecordListForm()))),
+		Request:    req,
+	}, nil
+}
+
+type registrarOverrideTestStruct struct {
+	header        string
+	query         string
+	expectedQuery string
+	testName      string
+}
+
+var registrarOverrideTestParams = []registrarOverrideTestStruct{
+	{"", "", "http://leader:20102/serviceregistrar/registry/query", "Good case, no override"},
+	{"http://other:20102/serviceregistrar/registry", "", "http://other:20102/serviceregistrar/registry/query",
+		"Good case, header override"},
+	{"", "http://other:20102/serviceregistrar/registry/", "http://other:20102/serviceregistrar/registry/query",
+		"Good case, query parameter override"},
+	{"other:20102", "", "http://leader:20102/serviceregistrar/registry/query", "Bad case, override without scheme"},
+	{"ftp://other/registry", "", "http://leader:20102/serviceregistrar/registry/query", "Bad case, override not http"},
+	{"http://%zz", "", "http://leader:20102/serviceregistrar/registry/query", "Bad case, unparsable override"},
+}
+
+func TestOrchestrateRegistrarOverride(t *testing.T) {
+	for _, testCase := range registrarOverrideTestParams {
+		rt := &registrarTransport{}
+		mua := createUnitAsset()
+		mua.client = &http.Client{Transport: rt}
+		leader := "http://leader:20102/serviceregistrar/registry"
+		mua.leadingRegistrar = leader
+
+		target := "/squest"
+		if testCase.query != "" {
+			target += "?registrar=" + url.QueryEscape(testCase.query)
+		}
+		inputR := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(createTestServiceQuestForm()))
+		inputR.Header.Set("Content-Type", "application/json")
+		if testCase.header != "" {
+			inputR.Header.Set(registrarOverrideHeader, testCase.header)
+		}
+		inputW := httptest.NewRecorder()
+		mua.orchestrate(inputW, inputR)
+
+		if inputW.Code != http.StatusOK {
+			t.Errorf("In test case: %s: Expected code %d, got: %d", testCase.testName, http.StatusOK, inputW.Code)
+		}
+		if len(rt.queried) != 1 || rt.queried[0] != testCase.expectedQuery {
+			t.Errorf("In test case: %s: Expected a query to %s, got: %v", testCase.testName, testCase.expectedQuery, rt.queried)
+		}
+		if mua.leadingRegistrar != leader {
+			t.Errorf("In test case: %s: Expected the leading registrar to stay %s, got: %s",
+				testCase.testName, leader, mua.leadingRegistrar)
+		}
+	}
+}
+
+type orchestrateWaitTestStruct struct {
+	wait           string
+	expectedStatus int
+	expectedWait   string
+	testName       string
+}
+
+var orchestrateWaitTestParams = []orchestrateWaitTestStruct{
+	{"", http.StatusOK, "", "Good case, no wait"},
+	{"5s", http.StatusOK, "5s", "Good case, the wait is passed on to the registrar"},
+	{"5m", http.StatusOK, "1m0s", "Good case, the wait is bounded"},
+	{"soon", http.StatusBadRequest, "", "Bad case, unparsable wait"},
+	{"-1s", http.StatusBadRequest, "", "Bad case, negative wait"},
+}
+
+func TestOrchestrateWait(t *testing.T) {
+	for _, testCase := range orchestrateWaitTestParams {
+		reg := &capabilityRegistrar{info: `{"capabilities": ["wait"]}`}
+		server := httptest.NewServer(reg)
+		mua := createUnitAsset()
+		mua.client = server.Client()
+		mua.leadingRegistrar = server.URL + "/serviceregistrar/registry"
+
+		target := "/squest"
+		if testCase.wait != "" {
+			target += "?wait=" + testCase.wait
+		}
+		inputR := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(createTestServiceQuestForm()))
+		inputR.Header.Set("Content-Type", "application/json")
+		inputW := httptest.NewRecorder()
+		mua.orchestrate(inputW, inputR)
+
+		if inputW.Code != testCase.expectedStatus {
+			t.Errorf("In test case: %s: Expected code %d, got: %d", testCase.testName, testCase.expectedStatus, inputW.Code)
+		}
+		reg.mu.Lock()
+		if reg.lastWait != testCase.expectedWait {
+			t.Errorf("In test case: %s: Expected the registrar to be asked to wait %q, got: %q", testCase.testName, testCase.expectedWait, reg.lastWait)
+		}
+		reg.mu.Unlock()
+		server.Close()
+	}
+}
+
+func TestOrchestrateAffinity(t *testing.T) {
+	server := httptest.NewServer(&rotatingRegistrar{providers: []string{"A", "B", "C"}})
+	defer server.Close()
+	mua := createUnitAsset()
+	mua.client = server.Client()
+	mua.leadingRegistrar = server.URL + "/serviceregistrar/registry"
+	mua.Affinity = 60
+
+	var locations []string
+	for range 3 {
+		inputR := httptest.NewRequest(http.MethodPost, "/squest", bytes.NewReader(createTestServiceQuestForm()))
+		inputR.Header.Set("Content-Type", "application/json")
+		inputR.Header.Set(sessionHeader, "session-1")
+		inputW := httptest.NewRecorder()
+		mua.orchestrate(inputW, inputR)
+		if inputW.Code != http.StatusOK {
+			t.Fatalf("Expected code %d, got: %d", http.StatusOK, inputW.Code)
+		}
+		var sp forms.ServicePoint_v1
+		if err := json.Unmarshal(inputW.Body.Bytes(), &sp); err != nil {
+			t.Fatalf("Unexpected reply %s: %v", inputW.Body.String(), err)
+		}
+		locations = append(locations, sp.ServLocation)
+	}
+	if locations[0] != locations[1] || locations[1] != locations[2] {
+		t.Errorf("Expected the session to stick to one provider, got: %v", locations)
+	}
+}
+
+func TestOrchestrateTracing(t *testing.T) {
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(traceparentHeader)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(createTestServiceRecordListForm())
+	}))
+	defer server.Close()
+	var out bytes.Buffer
+	mua := createUnitAsset()
+	mua.client = server.Client()
+	mua.leadingRegistrar = server.URL + "/serviceregistrar/registry"
+	mua.tracer = &tracer{out: &out}
+
+	inputR := httptest.NewRequest(http.MethodPost, "/squest", bytes.NewReader(createTestServiceQuestForm()))
+	inputR.Header.Set("Content-Type", "application/json")
+	inputR.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	inputW := httptest.NewRecorder()
+	mua.orchestrate(inputW, inputR)
+
+	if inputW.Code != http.StatusOK {
+		t.Fatalf("Expected code %d, got: %d", http.StatusOK, inputW.Code)
+	}
+	sc, ok := parseTraceparent(traceparent)
+	if !ok || sc.traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.spanID == "00f067aa0ba902b7" {
+		t.Errorf("Expected the registrar call to carry the consumer's trace with a span of its own, got: %q", traceparent)
+	}
+	spans := exportedSpans(t, &out)
+	if len(spans) != 2 || spans[0].SpanID != sc.spanID || spans[0].ParentID != spans[1].SpanID || spans[1].Name != "orchestrate" {
+		t.Errorf("Expected the registrar query and the orchestration spans, got: %+v", spans)
+	}
+}
+
+// blockingTransport holds registrar queries until their context is done, as an unresponsive registrar would
+type blockingTransport struct {
+	aborted chan error
+}
+
+func (bt blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-req.Context().Done():
+		bt.aborted <- req.Context().Err()
+		return nil, req.Context().Err()
+	case <-time.After(5 * time.Second):
+		bt.aborted <- nil
+		return nil, fmt.Errorf("registrar query was not aborted")
+	}
+}
+
+func TestOrchestrateCancelled(t *testing.T) {
+	bt := blockingTransport{aborted: make(chan error, 1)}
+	mua := createUnitAsset()
+	mua.client = &http.Client{Transport: bt}
+	mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+	mua.QueryTimeout = 10000 // the consumer's cancellation must end the query long before this
+
+	ctx, cancel := context.WithCancel(context.Background())
+	inputR := httptest.NewRequest(http.MethodPost, "/squest", bytes.NewReader(createTestServiceQuestForm()))
+	inputR = inputR.WithContext(ctx)
+	inputR.Header.Set("Content-Type", "application/json")
+	inputW := httptest.NewRecorder()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	mua.orchestrate(inputW, inputR)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the registrar query to abort with the request, took %v", elapsed)
+	}
+	if err := <-bt.aborted; err != context.Canceled {
+		t.Errorf("Expected the registrar query to be cancelled, got: %v", err)
+	}
+	if inputW.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected code %d, got: %d", http.StatusServiceUnavailable, inputW.Code)
+	}
+	if mua.leadingRegistrar == "" {
+		t.Errorf("Expected the leading registrar to be kept when the consumer cancels")
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	bt := blockingTransport{aborted: make(chan error, 1)}
+	mua := createUnitAsset()
+	mua.client = &http.Client{Transport: bt}
+	mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+	mua.QueryTimeout = 50
+
+	_, err := mua.getServicesURL(context.Background(), createTestServiceQuest())
+	if err == nil {
+		t.Errorf("Expected an error when the registrar query times out")
+	}
+	if err := <-bt.aborted; err != context.DeadlineExceeded {
+		t.Errorf("Expected the registrar query to exceed its deadline, got: %v", err)
+	}
+}
+
+// failoverTransport fails the queries to a registrar that went down and answers those to the running one
+type failoverTransport struct {
+	down string
+}
+
+func (ft *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if strings.HasPrefix(req.URL.String(), ft.down) {
+		return nil, fmt.Errorf("registrar unreachable")
+	}
+	body := string(createTestServiceRecordListForm())
+	if strings.HasSuffix(req.URL.Path, "/status") {
+		body = components.ServiceRegistrarLeader
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func readRegistrarStatus(t *testing.T, mua *UnitAsset) registrarStatus {
+	w := httptest.NewRecorder()
+	mua.Serving(w, httptest.NewRequest(http.MethodGet, "/registrar", nil), "registrar")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code %d, got: %d", http.StatusOK, w.Code)
+	}
+	var status registrarStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed while unmarshalling the registrar status: %v", err)
+	}
+	return status
+}
+
+func TestRegistrarStatus(t *testing.T) {
+	ft := &failoverTransport{down: "http://old:20102"}
+	http.DefaultClient.Transport = ft
+	defer func() { http.DefaultClient.Transport = nil }()
+	mua := createUnitAsset()
+	mua.leadingRegistrar = "http://old:20102/serviceregistrar/registry"
+
+	// Nothing was queried yet
+	if status := readRegistrarStatus(t, mua); status.Succeeded || status.LastQueryAt != "" {
+		t.Errorf("Expected no query in the status, got: %+v", status)
+	}
+
+	// The cached registrar went down, it is forgotten
+	if _, err := mua.getServiceURL(context.Background(), createTestServiceQuest()); err == nil {
+		t.Fatalf("Expected an error querying the unreachable registrar")
+	}
+	status := readRegistrarStatus(t, mua)
+	if status.Registrar != "" || status.Succeeded || status.LastError == "" || status.LastQueryAt == "" {
+		t.Errorf("Expected a failed query and no registrar, got: %+v", status)
+	}
+
+	// The next quest looks up the running registrar again
+	if _, err := mua.getServiceURL(context.Background(), createTestServiceQuest()); err != nil {
+		t.Fatalf("Expected no error after the re-resolution, got: %v", err)
+	}
+	status = readRegistrarStatus(t, mua)
+	leader := "http://localhost:20102/serviceregistrar/registry"
+	if status.Registrar != leader || !status.Succeeded || status.LastError != "" || status.ResolvedAt == "" {
+		t.Errorf("Expected a successful query to %s after the re-resolution, got: %+v", leader, status)
+	}
+
+	w := httptest.NewRecorder()
+	mua.Serving(w, httptest.NewRequest(http.MethodPost, "/registrar", nil), "registrar")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected code %d for a POST, got: %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// forwardTransport answers registrar queries with a single provider and plays that provider for forwarded requests
+type forwardTransport struct {
+	providerStatus int
+	providerErr    error
+	forwarded      []*http.Request
+	bodies         []string
+}
+
+func (ft *forwardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		body = string(b)
+	}
+	if strings.HasSuffix(req.URL.Path, "/query") {
+		var list forms.ServiceRecordList_v1
+		list.NewForm()
+		list.List = []forms.ServiceRecord_v1{{
+			SystemName:        "thermostat",
+			ServiceDefinition: "temperature",
+			SubPath:           "kitchen/temperature",
+			IPAddresses:       []string{"10.0.0.5"},
+			ProtoPort:         map[string]int{"http": 8870},
+		}}
+		records, _ := json.Marshal(list)
+		return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": []string{"application/json"}},
+			Body: io.NopCloser(bytes.NewReader(records)), Request: req}, nil
+	}
+	ft.forwarded = append(ft.forwarded, req)
+	ft.bodies = append(ft.bodies, body)
+	if ft.providerErr != nil {
+		return nil, ft.providerErr
+	}
+	return &http.Response{StatusCode: ft.providerStatus, Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"value":21}`)), Request: req}, nil
+}
+
+type orchestrateForwardTestStruct struct {
+	inputBody       string
+	providerStatus  int
+	providerErr     error
+	expectedCode    int
+	expectedMethod  string
+	expectedURL     string
+	expectedForward string
+	testName        string
+}
+
+var orchestrateForwardTestParams = []orchestrateForwardTestStruct{
+	{`{"quest":{"serviceDefinition":"temperature"}}`, 200, nil, 200,
+		"GET", "http://10.0.0.5:8870/thermostat/kitchen/temperature", "", "Good case, GET by default"},
+	{`{"quest":{"serviceDefinition":"temperature"},"method":"put","path":"/setpoint","body":{"value":22,"version":"SignalA_v1.0"}}`,
+		200, nil, 200, "PUT", "http://10.0.0.5:8870/thermostat/kitchen/temperature/setpoint",
+		`{"value":22,"version":"SignalA_v1.0"}`, "Good case, PUT with a path and a body"},
+	{`{"quest":{"serviceDefinition":"temperature"}}`, 404, nil, 404,
+		"GET", "http://10.0.0.5:8870/thermostat/kitchen/temperature", "", "Good case, the provider's status is passed on"},
+	{`{"quest":{"serviceDefinition":"temperature"}}`, 200, errors.New("connection refused"), 502,
+		"GET", "http://10.0.0.5:8870/thermostat/kitchen/temperature", "", "Bad case, the provider is unreachable"},
+	{`{"quest":{"serviceDefinition":"temperature"},"method":"PATCH"}`, 200, nil, 400, "", "", "", "Bad case, method not forwarded"},
+	{`{"quest":{"serviceDefinition":"temperature"},"path":"/../../serviceregistrar/registry/unregister"}`, 200, nil, 400,
+		"", "", "", "Bad case, path leaving the service location"},
+	{`{"quest":`, 200, nil, 400, "", "", "", "Bad case, body is not a forward request"},
+	{`{"quest":{"serviceDefinition":"temperature"},"body":"` + strings.Repeat("x", defaultMaxBodySize) + `"}`, 200, nil, 413,
+		"", "", "", "Bad case, body too large"},
+}
+
+func TestOrchestrateForward(t *testing.T) {
+	for _, testCase := range orchestrateForwardTestParams {
+		ft := &forwardTransport{providerStatus: testCase.providerStatus, providerErr: testCase.providerErr}
+		mua := createUnitAsset()
+		mua.client = &http.Client{Transport: ft}
+		mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+		inputR := httptest.NewRequest(http.MethodPost, "/squestforward", strings.NewReader(testCase.inputBody))
+		inputW := httptest.NewRecorder()
+
+		mua.Serving(inputW, inputR, "squestforward")
+
+		if inputW.Code != testCase.expectedCode {
+			t.Errorf("In test case: %s: Expected code %d, got: %d (%s)", testCase.testName, testCase.expectedCode, inputW.Code, inputW.Body.String())
+		}
+		if testCase.expectedMethod == "" {
+			if len(ft.forwarded) != 0 {
+				t.Errorf("In test case: %s: Expected nothing forwarded, got: %d requests", testCase.testName, len(ft.forwarded))
+			}
+			continue
+		}
+		if len(ft.forwarded) != 1 {
+			t.Fatalf("In test case: %s: Expected one forwarded request, got: %d", testCase.testName, len(ft.forwarded))
+		}
+		fwd := ft.forwarded[0]
+		if fwd.Method != testCase.expectedMethod || fwd.URL.String() != testCase.expectedURL || ft.bodies[0] != testCase.expectedForward {
+			t.Errorf("In test case: %s: Expected %s %s with body %s, got: %s %s with body %s", testCase.testName,
+				testCase.expectedMethod, testCase.expectedURL, testCase.expectedForward, fwd.Method, fwd.URL, ft.bodies[0])
+		}
+		if inputW.Code < 300 && (inputW.Body.String() != `{"value":21}` || inputW.Header().Get(serviceLocationHeader) == "") {
+			t.Errorf("In test case: %s: Expected the provider's response with its location, got: %s", testCase.testName, inputW.Body.String())
+		}
+	}
+}
+
+type forwardErrorTestStruct struct {
+	providerErr  error
+	policy       map[string][]string
+	expectedBody questError
+	testName     string
+}
+
+var forwardErrorTestParams = []forwardErrorTestStruct{
+	{nil, map[string][]string{"thermostat": {"pressure"}},
+		questError{Error: `consumer not authorized: "thermostat" may not resolve temperature`, Definition: "temperature", Code: 403}, "Good case, denied consumer"},
+	{errors.New("connection refused"), nil,
+		questError{Error: errForwardFailed.Error(), Definition: "temperature", Code: 502}, "Good case, provider unreachable"},
+}
+
+func TestOrchestrateForwardErrorBody(t *testing.T) {
+	for _, testCase := range forwardErrorTestParams {
+		mua := createUnitAsset()
+		mua.client = &http.Client{Transport: &forwardTransport{providerStatus: 200, providerErr: testCase.providerErr}}
+		mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+		mua.Policy = testCase.policy
+		inputR := httptest.NewRequest(http.MethodPost, "/squestforward",
+			strings.NewReader(`{"quest":{"requesterName":"thermostat","serviceDefinition":"temperature"}}`))
+		inputR.Header.Set("Accept", "application/json")
+		inputW := httptest.NewRecorder()
+
+		mua.orchestrateForward(inputW, inputR)
+
+		var got questError
+		if inputW.Header().Get("Content-Type") != "application/json" || json.Unmarshal(inputW.Body.Bytes(), &got) != nil {
+			t.Errorf("In test case: %s: Expected a JSON error, got: %s", testCase.testName, inputW.Body.String())
+			continue
+		}
+		if got != testCase.expectedBody {
+			t.Errorf("In test case: %s: Expected %+v, got: %+v", testCase.testName, testCase.expectedBody, got)
+		}
+	}
+}
+
+func TestOrchestrateForwardCancelled(t *testing.T) {
+	aborted := make(chan error, 1)
+	mua := createUnitAsset()
+	mua.client = &http.Client{Transport: blockingTransport{aborted: aborted}}
+	mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	inputR := httptest.NewRequest(http.MethodPost, "/squestforward",
+		strings.NewReader(`{"quest":{"serviceDefinition":"temperature"}}`)).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		mua.orchestrateForward(httptest.NewRecorder(), inputR)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the forward to end with the consumer's request")
+	}
+}
+
+type orchestratePolicyTestStruct struct {
+	requester    string
+	certName     string
+	expectedCode int
+	testName     string
+}
+
+var orchestratePolicyTestParams = []orchestratePolicyTestStruct{
+	{"thermostat", "", 200, "Good case, allowed consumer"},
+	{"intruder", "", 403, "Bad case, denied consumer"},
+	{"", "", 403, "Bad case, anonymous consumer"},
+	{"intruder", "thermostat", 200, "Good case, verified certificate prevails"},
+	{"thermostat", "intruder", 403, "Bad case, verified certificate of a denied consumer"},
+}
+
+func TestOrchestratePolicy(t *testing.T) {
+	for _, testCase := range orchestratePolicyTestParams {
+		rt := &registrarTransport{}
+		mua := createUnitAsset()
+		mua.client = &http.Client{Transport: rt}
+		mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+		mua.Policy = map[string][]string{"thermostat": {"temperature"}}
+
+		quest := createTestServiceQuest()
+		quest.RequesterName = testCase.requester
+		body, _ := json.Marshal(quest)
+		inputR := httptest.NewRequest(http.MethodPost, "/squest", bytes.NewReader(body))
+		inputR.Header.Set("Content-Type", "application/json")
+		if testCase.certName != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: testCase.certName}}
+			inputR.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		inputW := httptest.NewRecorder()
+
+		mua.orchestrate(inputW, inputR)
+
+		if inputW.Code != testCase.expectedCode {
+			t.Errorf("In test case: %s: Expected code %d, got: %d", testCase.testName, testCase.expectedCode, inputW.Code)
+		}
+		if testCase.expectedCode == 403 && len(rt.queried) != 0 {
+			t.Errorf("In test case: %s: Expected no registrar query for a denied consumer, got: %v", testCase.testName, rt.queried)
+		}
+	}
+}
+
+func TestOrchestrateListPolicy(t *testing.T) {
+	mua := createUnitAsset()
+	mua.client = &http.Client{Transport: questTransport{known: "temperature"}}
+	mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+	mua.Policy = map[string][]string{"thermostat": {"temperature", "rotation"}}
+
+	body := `[{"requesterName":"thermostat","serviceDefinition":"temperature","version":"ServiceQuest_v1"},` +
+		`{"requesterName":"thermostat","serviceDefinition":"pressure","version":"ServiceQuest_v1"}]`
+	inputR := httptest.NewRequest(http.MethodPost, "/squestlist", strings.NewReader(body))
+	inputR.Header.Set("Content-Type", "application/json")
+	inputW := httptest.NewRecorder()
+	mua.orchestrateList(inputW, inputR)
+
+	var results []questResult
+	if err := json.Unmarshal(inputW.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Fatalf("Expected a list of two results, got: %s", inputW.Body.String())
+	}
+	if results[0].ServicePoint == nil {
+		t.Errorf("Expected a service point for the allowed definition, got: %+v", results[0])
+	}
+	if res := results[1]; res.ServicePoint != nil || !strings.Contains(res.Error, errNotAuthorized.Error()) {
+		t.Errorf("Expected the denied definition to be refused, got: %+v", res)
+	}
+}
+
+func TestOrchestrateListSameDefinition(t *testing.T) {
+	mua := createUnitAsset()
+	mua.client = &http.Client{Transport: questTransport{known: "temperature"}}
+	mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+	mua.Policy = map[string][]string{"thermostat": {"temperature"}}
+
+	// Two quests for the same definition from different requesters each keep their own outcome
+	body := `[{"requesterName":"thermostat","serviceDefinition":"temperature","version":"ServiceQuest_v1"},` +
+		`{"requesterName":"intruder","serviceDefinition":"temperature","version":"ServiceQuest_v1"}]`
+	inputR := httptest.NewRequest(http.MethodPost, "/squestlist", strings.NewReader(body))
+	inputR.Header.Set("Content-Type", "application/json")
+	inputW := httptest.NewRecorder()
+	mua.orchestrateList(inputW, inputR)
+
+	var results []questResult
+	if err := json.Unmarshal(inputW.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Fatalf("Expected a result per quest, got: %s", inputW.Body.String())
+	}
+	if res := results[0]; res.Definition != "temperature" || res.ServicePoint == nil {
+		t.Errorf("Expected a service point for the thermostat, got: %+v", res)
+	}
+	if res := results[1]; res.Definition != "temperature" || res.ServicePoint != nil || !strings.Contains(res.Error, errNotAuthorized.Error()) {
+		t.Errorf("Expected the quest of the intruder to be refused, got: %+v", res)
+	}
+}
+
+// healthTransport plays the core systems, answering per host with a status and a body or failing
+type healthTransport struct {
+	answers map[string]string // body per host, a missing host is unreachable
+	codes   map[string]int
+}
+
+func (ht healthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := ht.answers[req.URL.Host]
+	if !ok {
+		return nil, fmt.Errorf("dial tcp %s: connection refused", req.URL.Host)
+	}
+	code := http.StatusOK
+	if c, set := ht.codes[req.URL.Host]; set {
+		code = c
+	}
+	return &http.Response{StatusCode: code, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+type healthTestStruct struct {
+	answers         map[string]string
+	codes           map[string]int
+	expectedCode    int
+	expectedReach   []bool
+	expectedLeading []bool
+	testName        string
+}
+
+var healthTestParams = []healthTestStruct{
+	{map[string]string{"reg1:20102": components.ServiceRegistrarLeader + " 2025", "reg2:20102": "On standby", "msg:20104": "ok"}, nil,
+		200, []bool{true, true, true}, []bool{true, false}, "Good case, all cores up with a leading registrar"},
+	{map[string]string{"reg1:20102": components.ServiceRegistrarLeader + " 2025", "reg2:20102": "On standby"}, nil,
+		503, []bool{true, true, false}, []bool{true, false}, "Bad case, messenger unreachable"},
+	{map[string]string{"reg1:20102": "On standby", "reg2:20102": "On standby", "msg:20104": "ok"}, nil,
+		503, []bool{true, true, true}, []bool{false, false}, "Bad case, no registrar leads"},
+	{map[string]string{"reg1:20102": components.ServiceRegistrarLeader + " 2025", "reg2:20102": "On standby", "msg:20104": "oops"},
+		map[string]int{"msg:20104": 500}, 503, []bool{true, true, false}, []bool{true, false}, "Bad case, messenger failing"},
+}
+
+func TestHealthInfo(t *testing.T) {
+	for _, testCase := range healthTestParams {
+		sys := createSystemWithUnitAsset()
+		sys.CoreS = []*components.CoreSystem{
+			{Name: components.ServiceRegistrarName, Url: "http://reg1:20102/serviceregistrar/registry"},
+			{Name: components.ServiceRegistrarName, Url: "http://reg2:20102/serviceregistrar/registry"},
+			{Name: "messenger", Url: "http://msg:20104/messenger/log"},
+		}
+		mua := createUnitAsset()
+		mua.Owner = &sys
+		mua.client = &http.Client{Transport: healthTransport{answers: testCase.answers, codes: testCase.codes}}
+		inputW := httptest.NewRecorder()
+
+		mua.Serving(inputW, httptest.NewRequest(http.MethodGet, "/health", nil), "health")
+
+		if inputW.Code != testCase.expectedCode {
+			t.Errorf("In test case: %s: Expected code %d, got: %d", testCase.testName, testCase.expectedCode, inputW.Code)
+		}
+		var summary healthSummary
+		if err := json.Unmarshal(inputW.Body.Bytes(), &summary); err != nil || len(summary.Cores) != 3 {
+			t.Fatalf("In test case: %s: Expected a summary of three cores, got: %s", testCase.testName, inputW.Body.String())
+		}
+		for i, core := range summary.Cores {
+			if core.Reachable != testCase.expectedReach[i] {
+				t.Errorf("In test case: %s: Expected %s reachable %t, got: %+v", testCase.testName, core.URL, testCase.expectedReach[i], core)
+			}
+			if i < 2 && (core.Leading == nil || *core.Leading != testCase.expectedLeading[i]) {
+				t.Errorf("In test case: %s: Expected %s leading %t, got: %+v", testCase.testName, core.URL, testCase.expectedLeading[i], core)
+			}
+			if i == 2 && core.Leading != nil {
+				t.Errorf("In test case: %s: Expected no leader status for the messenger, got: %+v", testCase.testName, core)
+			}
+		}
+	}
+}
+
+func TestHealthInfoCancelled(t *testing.T) {
+	sys := createSystemWithUnitAsset()
+	mua := createUnitAsset()
+	mua.Owner = &sys
+	mua.client = &http.Client{Transport: blockingTransport{aborted: make(chan error, 1)}}
+	mua.QueryTimeout = 10000 // the consumer's cancellation must end the probe long before this
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	inputW := httptest.NewRecorder()
+	start := time.Now()
+	mua.healthInfo(inputW, httptest.NewRequest(http.MethodGet, "/health", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the probes to end with the request, took %v", elapsed)
+	}
+	if inputW.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected code %d, got: %d", http.StatusServiceUnavailable, inputW.Code)
+	}
+}
+
+func TestMetricsInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var quest forms.ServiceQuest_v1
+		json.NewDecoder(r.Body).Decode(&quest)
+		w.Header().Set("Content-Type", "application/json")
+		if quest.ServiceDefinition == "missing" {
+			w.Write([]byte(`{"version": "ServiceRecordList_v1", "listofRecords": []}`))
+			return
+		}
+		w.Write(createTestServiceRecordListForm())
+	}))
+	defer server.Close()
+	mua := createUnitAsset()
+	mua.client = server.Client()
+	mua.leadingRegistrar = server.URL + "/serviceregistrar/registry"
+
+	quests := []struct {
+		path       string
+		definition string
+	}{
+		{"squest", "temperature"}, {"squest", "temperature"}, {"squests", "temperature"},
+		{"squest", "flow"}, {"squests", "flow"}, {"squest", "missing"},
+	}
+	for _, quest := range quests {
+		body, _ := json.Marshal(forms.ServiceQuest_v1{ServiceDefinition: quest.definition, Version: "ServiceQuest_v1"})
+		inputR := httptest.NewRequest(http.MethodPost, "/"+quest.path, bytes.NewReader(body))
+		inputR.Header.Set("Content-Type", "application/json")
+		mua.Serving(httptest.NewRecorder(), inputR, quest.path)
+	}
+
+	inputW := httptest.NewRecorder()
+	mua.Serving(inputW, httptest.NewRequest(http.MethodGet, "/metrics", nil), "metrics")
+	expected := "# HELP orchestrator_quests_total Quests handled per service definition and outcome.\n" +
+		"# TYPE orchestrator_quests_total counter\n" +
+		"orchestrator_quests_total{definition=\"flow\",outcome=\"resolved\"} 2\n" +
+		"orchestrator_quests_total{definition=\"missing\",outcome=\"failed\"} 1\n" +
+		"orchestrator_quests_total{definition=\"temperature\",outcome=\"resolved\"} 3\n"
+	if inputW.Code != http.StatusOK || inputW.Body.String() != expected {
+		t.Errorf("Expected code %d and the metrics\n%s\ngot: %d and\n%s", http.StatusOK, expected, inputW.Code, inputW.Body.String())
+	}
+
+	inputW = httptest.NewRecorder()
+	mua.Serving(inputW, httptest.NewRequest(http.MethodPost, "/metrics", nil), "metrics")
+	if inputW.Code != http.StatusNotFound {
+		t.Errorf("Expected code %d for a POST, got: %d", http.StatusNotFound, inputW.Code)
+	}
+}
+
+// gateTransport holds registrar queries until the gate is opened, then answers them with the service record list
+type gateTransport struct {
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (gt gateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case gt.entered <- struct{}{}:
+	default:
+	}
+	<-gt.gate
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(createTestServiceRecordListForm())),
+		Request:    req,
+	}, nil
+}
+
+// serveTestQuest sends a quest to the given service of the orchestrator and returns the reply
+func serveTestQuest(mua *UnitAsset, path string) *httptest.ResponseRecorder {
+	inputR := httptest.NewRequest(http.MethodPost, "/"+path, bytes.NewReader(createTestServiceQuestForm()))
+	inputR.Header.Set("Content-Type", "application/json")
+	inputW := httptest.NewRecorder()
+	mua.Serving(inputW, inputR, path)
+	return inputW
+}
+
+func readDrainStatus(t *testing.T, inputW *httptest.ResponseRecorder) drainStatus {
+	t.Helper()
+	var status drainStatus
+	if err := json.Unmarshal(inputW.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Expected a drain status, got: %s", inputW.Body.String())
+	}
+	return status
+}
+
+func TestDrain(t *testing.T) {
+	gt := gateTransport{entered: make(chan struct{}, 1), gate: make(chan struct{})}
+	mua := createUnitAsset()
+	mua.client = &http.Client{Transport: gt}
+	mua.leadingRegistrar = "http://localhost:20102/serviceregistrar/registry"
+
+	// a quest received before the drain is held by the registrar
+	preDrain := make(chan *httptest.ResponseRecorder)
+	go func() { preDrain <- serveTestQuest(mua, "squest") }()
+	<-gt.entered
+
+	inputW := httptest.NewRecorder()
+	mua.Serving(inputW, httptest.NewRequest(http.MethodPost, "/drain", nil), "drain")
+	if status := readDrainStatus(t, inputW); inputW.Code != http.StatusAccepted || !status.Draining || status.InFlight != 1 {
+		t.Fatalf("Expected code %d draining with 1 quest in flight, got: %d %+v", http.StatusAccepted, inputW.Code, status)
+	}
+
+	for _, path := range []string{"squest", "squests", "squestlist", "squestforward"} {
+		refused := serveTestQuest(mua, path)
+		if refused.Code != http.StatusServiceUnavailable || refused.Header().Get("Retry-After") != "10" {
+			t.Errorf("Expected a new %s quest to be refused with code %d and Retry-After 10, got: %d %q",
+				path, http.StatusServiceUnavailable, refused.Code, refused.Header().Get("Retry-After"))
+		}
+	}
+	if mua.drain(20 * time.Millisecond) {
+		t.Errorf("Expected the drain to wait for the quest in flight")
+	}
+
+	close(gt.gate)
+	if completed := <-preDrain; completed.Code != http.StatusOK {
+		t.Errorf("Expected the quest received before the drain to complete with code %d, got: %d", http.StatusOK, completed.Code)
+	}
+	if !mua.drain(time.Second) {
+		t.Errorf("Expected the drain to end once the quest in flight completed")
+	}
+
+	inputW = httptest.NewRecorder()
+	mua.Serving(inputW, httptest.NewRequest(http.MethodDelete, "/drain", nil), "drain")
+	if status := readDrainStatus(t, inputW); inputW.Code != http.StatusOK || status.Draining || status.InFlight != 0 {
+		t.Errorf("Expected code %d resumed with no quest in flight, got: %d %+v", http.StatusOK, inputW.Code, status)
+	}
+	if resumed := serveTestQuest(mua, "squest"); resumed.Code != http.StatusOK {
+		t.Errorf("Expected quests to be served again once resumed, got code: %d", resumed.Code)
+	}
+
+	inputW = httptest.NewRecorder()
+	mua.Serving(inputW, httptest.NewRequest(http.MethodPut, "/drain", nil), "drain")
+	if inputW.Code != http.StatusNotFound {
+		t.Errorf("Expected code %d for a PUT, got: %d", http.StatusNotFound, inputW.Code)
+	}
+}
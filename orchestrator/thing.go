@@ -15,14 +15,21 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
-
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sdoque/mbaigo/components"
@@ -34,7 +41,34 @@ import (
 
 // Traits are Asset-specific configurable parameters and variables
 type Traits struct {
-	leadingRegistrar string
+	Workers             int                 `json:"workers"`             // number of quests of a multi-quest request resolved concurrently
+	QueryTimeout        int                 `json:"queryTimeout"`        // maximum duration of a registrar query in milliseconds
+	Ordering            string              `json:"ordering"`            // order of the returned providers: unsorted, cost, weight, preferred or lru
+	PreferredDetails    map[string][]string `json:"preferredDetails"`    // details of the providers listed first with the preferred ordering
+	LocalCloud          string              `json:"localCloud"`          // name of the orchestrator's local cloud, whose providers are preferred over foreign ones
+	MaxBodySize         int                 `json:"maxBodySize"`         // largest request body accepted in bytes (0 accepts up to 1 MiB)
+	Policy              map[string][]string `json:"policy"`              // service definitions each consumer may resolve, "*" for any consumer or definition; empty allows all
+	Protocols           []string            `json:"protocols"`           // protocols of the advertised location in order of preference (empty uses http only)
+	MaxIdleConns        int                 `json:"maxIdleConns"`        // idle connections kept open across all hosts (0 keeps 100)
+	MaxIdleConnsPerHost int                 `json:"maxIdleConnsPerHost"` // idle connections kept open to each host, e.g. the registrar (0 keeps 32)
+	IdleConnTimeout     int                 `json:"idleConnTimeout"`     // milliseconds an idle connection is kept open (0 keeps it 90 s)
+	MediaTypes          []string            `json:"mediaTypes"`          // media types accepted for the quests, application/json and/or application/xml (empty accepts application/json)
+	TraceExporter       string              `json:"traceExporter"`       // exporter of the request spans, "console" or "none" (empty follows OTEL_TRACES_EXPORTER)
+	Affinity            int                 `json:"affinity"`            // seconds a consumer session keeps being routed to the same provider (0 disables the affinity)
+	ShedLoad            float64             `json:"shedLoad"`            // load ratio from which a provider reporting its "Load" detail is selected after the others (0 disables the shedding)
+	BreakerThreshold    int                 `json:"breakerThreshold"`    // consecutive failed queries that open the circuit of a registrar (0 disables the breaker)
+	BreakerCooldown     int                 `json:"breakerCooldown"`     // milliseconds the circuit of a failing registrar stays open before a trial query (0 keeps it open 30 s)
+	leadingRegistrar    string
+	resolvedAt          time.Time                       // when the leading registrar was last looked up
+	lastQueryAt         time.Time                       // when the leading registrar was last queried
+	lastQueryErr        error                           // outcome of the last query to the leading registrar
+	client              *http.Client                    // client of the calls to the registrars and providers, tuned by the connection traits
+	capabilities        map[string]bool                 // optional features of the leading registrar, nil until they are probed
+	sticky              map[string]stickyProvider       // provider last selected per session and service definition
+	handouts            map[string]map[string]time.Time // when each listed provider location was last handed out, per service definition
+	tracer              *tracer                         // exporter of the request spans, nil when tracing is off
+	resolutions         map[resolutionKey]uint64        // quests handled per service definition and outcome since the start
+	breakers            map[string]*breaker             // circuit breaker per registrar URL, kept while the registrar fails
 }
 
 // UnitAsset type models the unit asset (interface) of the system.
@@ -46,6 +80,10 @@ type UnitAsset struct {
 	CervicesMap components.Cervices `json:"-"`
 	//
 	Traits
+	mu       sync.Mutex    // protects the leading registrar and its status shared by concurrent quests
+	draining bool          // set for maintenance, new quests are then refused
+	inFlight int           // quests being handled
+	drained  chan struct{} // closed once no quest is left in flight during a drain
 }
 
 // GetName returns the name of the Resource.
@@ -88,8 +126,33 @@ func initTemplate() components.UnitAsset {
 		Description: "looks for the desired service described in a quest form (POST)",
 	}
 
+	squestForward := components.Service{
+		Definition:  "squestforward",
+		SubPath:     "squestforward",
+		Details:     map[string][]string{"DefaultForm": {"ServiceQuest_v1"}, "Location": {"LocalCloud"}},
+		Description: "looks for the desired service described in a quest form and forwards the request that comes with it to the selected provider (POST)",
+	}
+
+	squestList := components.Service{
+		Definition:  "squestlist",
+		SubPath:     "squestlist",
+		Details:     map[string][]string{"DefaultForm": {"ServicePoint_v1"}, "Location": {"LocalCloud"}},
+		Description: "looks for several desired services described in a list of quest forms (POST)",
+	}
+
 	assetTraits := Traits{
-		leadingRegistrar: "", // Initialize the leading registrar to nil
+		Workers:             defaultWorkers,
+		QueryTimeout:        int(defaultQueryTimeout / time.Millisecond),
+		Ordering:            orderUnsorted,
+		PreferredDetails:    map[string][]string{},
+		LocalCloud:          "",
+		MaxBodySize:         defaultMaxBodySize,
+		Policy:              map[string][]string{}, // e.g., {"thermostat": {"temperature"}, "*": {"time"}}
+		Protocols:           []string{"http", "https"},
+		MaxIdleConns:        defaultMaxIdleConns,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     int(defaultIdleConnTimeout / time.Millisecond),
+		leadingRegistrar:    "", // Initialize the leading registrar to nil
 	}
 
 	// create the unit asset template
@@ -98,7 +161,9 @@ func initTemplate() components.UnitAsset {
 		Details: map[string][]string{"Platform": {"Independent"}},
 		Traits:  assetTraits,
 		ServicesMap: components.Services{
-			squest.SubPath: &squest, // Inline assignment of the temperature service
+			squest.SubPath:        &squest, // Inline assignment of the temperature service
+			squestList.SubPath:    &squestList,
+			squestForward.SubPath: &squestForward,
 		},
 	}
 	return uat
@@ -122,6 +187,17 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 	} else if len(traits) > 0 {
 		ua.Traits = traits[0] // or handle multiple traits if needed
 	}
+	switch ua.Ordering {
+	case orderUnsorted, orderCost, orderWeight, orderPreferred, orderLRU:
+	case "":
+		ua.Ordering = orderUnsorted
+	default:
+		log.Printf("Warning: unknown ordering %q, the providers are returned unsorted\n", ua.Ordering)
+		ua.Ordering = orderUnsorted
+	}
+	checkMediaTypes(ua.MediaTypes)
+	ua.client = ua.newClient()
+	ua.tracer = newTracer(ua.TraceExporter)
 
 	// start the unit asset(s)
 	// no need to start the algorithm asset
@@ -146,6 +222,18 @@ func UnmarshalTraits(rawTraits []json.RawMessage) ([]Traits, error) {
 
 //-------------------------------------Thing's resource functions
 
+// requestIDHeader carries the correlation ID that ties the orchestrator's query to the registrar's handling
+const requestIDHeader = "X-Request-ID"
+
+// newRequestID generates a random correlation ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
 // getServiceURL retrieves the service URL for a given ServiceQuest_v1.
 // It first checks if the leading registrar is still valid and updates it if necessary.
 // If no leading registrar is found, it iterates through the system's core services
@@ -154,127 +242,951 @@ func UnmarshalTraits(rawTraits []json.RawMessage) ([]Traits, error) {
 // service URL.
 //
 // Parameters:
+// - ctx: The context of the consumer's request, whose cancellation aborts the registrar query.
 // - newQuest: The ServiceQuest_v1 containing the service request details.
 //
 // Returns:
 // - servLoc: A byte slice containing the service location in JSON format.
 // - err: An error if any issues occur during the process.
-func (ua *UnitAsset) getServiceURL(newQuest forms.ServiceQuest_v1) (servLoc []byte, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	sys := ua.Owner
-	if ua.leadingRegistrar == "" {
-		ua.leadingRegistrar, err = components.GetRunningCoreSystemURL(sys, "serviceregistrar")
-		if err != nil {
-			return servLoc, err
-		}
-	}
+func (ua *UnitAsset) getServiceURL(ctx context.Context, newQuest forms.ServiceQuest_v1) (servLoc []byte, err error) {
+	return ua.getServiceURLAt(ctx, "", newQuest, 0, newQuest.RequesterName)
+}
 
-	// Create a new HTTP request to the the Service Registrar
-	mediaType := "application/json"
-	jsonQF, err := usecases.Pack(&newQuest, mediaType)
+// getServiceURLAt retrieves the service URL from the given registrar, or from the leading one if registrar is empty,
+// waiting up to wait for a provider to be registered if the registrar supports it
+func (ua *UnitAsset) getServiceURLAt(ctx context.Context, registrar string, newQuest forms.ServiceQuest_v1, wait time.Duration, session string) (servLoc []byte, err error) {
+	serviceLocation, err := ua.locateServiceAt(ctx, registrar, newQuest, wait, session)
 	if err != nil {
-		return servLoc, err
+		return nil, err
 	}
+	payload, err := json.MarshalIndent(serviceLocation, "", "  ")
+	return payload, err
+}
 
-	srURL := ua.leadingRegistrar + "/query"
-	req, err := http.NewRequest(http.MethodPost, srURL, bytes.NewBuffer(jsonQF))
+// locateService queries the leading registrar and selects the provider of the sought service,
+// the requester of the quest being the session of the provider affinity
+func (ua *UnitAsset) locateService(ctx context.Context, newQuest forms.ServiceQuest_v1) (sp servicePoint, err error) {
+	return ua.locateServiceAt(ctx, "", newQuest, 0, newQuest.RequesterName)
+}
+
+// locateServiceAt queries the given registrar (the leading one if empty) and selects the provider of the sought service,
+// keeping the provider the session was last routed to while the affinity lasts
+func (ua *UnitAsset) locateServiceAt(ctx context.Context, registrar string, newQuest forms.ServiceQuest_v1, wait time.Duration, session string) (sp servicePoint, err error) {
+	serviceList, err := ua.queryRegistrarAt(ctx, registrar, newQuest, wait)
 	if err != nil {
-		return servLoc, err
+		return sp, err
 	}
-	req.Header.Set("Content-Type", mediaType)
-	req = req.WithContext(ctx)
+	return ua.pickProvider(serviceList, session, newQuest.ServiceDefinition, time.Now())
+}
+
+// pickProvider orders the providers listed by the registrar and selects the one to hand out to the session
+func (ua *UnitAsset) pickProvider(serviceList *forms.ServiceRecordList_v1, session, definition string, now time.Time) (sp servicePoint, err error) {
+	ua.orderServices(serviceList)
+	sp, err = ua.selectSticky(session, definition, *serviceList, now)
+	if err == nil && ua.Ordering == orderLRU {
+		ua.noteHandout(serviceList.List, sp, now)
+	}
+	return sp, err
+}
+
+// stickyProvider is the location of the provider last selected for a session, kept until the affinity expires
+type stickyProvider struct {
+	location string
+	expires  time.Time
+}
+
+// sessionHeader carries the token of a consumer session whose quests should keep being routed to the same provider
+const sessionHeader = "X-Session-Token"
 
-	resp, err := http.DefaultClient.Do(req)
+// sessionKey returns the session of the provider affinity: the token of the X-Session-Token header if any,
+// otherwise the identity of the consumer
+func sessionKey(r *http.Request, quest forms.ServiceQuest_v1) string {
+	if token := r.Header.Get(sessionHeader); token != "" {
+		return token
+	}
+	return consumerIdentity(r, quest)
+}
+
+// selectSticky selects the provider the session was last routed to for the service definition if the registrar
+// still lists it, or the best provider of the ordered list otherwise, and remembers the selection for the affinity time
+func (ua *UnitAsset) selectSticky(session, definition string, serviceList forms.ServiceRecordList_v1, now time.Time) (sp servicePoint, err error) {
+	ttl := time.Duration(ua.Affinity) * time.Second
+	if ttl <= 0 || session == "" {
+		return selectService(serviceList, ua.protocols())
+	}
+	key := session + "|" + definition
+	ua.mu.Lock()
+	previous, found := ua.sticky[key]
+	ua.mu.Unlock()
+	if found && now.Before(previous.expires) {
+		for i, rec := range serviceList.List {
+			if location, err := serviceURL(rec, ua.protocols()); err == nil && location == previous.location && !ua.saturated(rec) {
+				// shift the records to put the sticky provider first, keeping the order of the others
+				copy(serviceList.List[1:i+1], serviceList.List[:i])
+				serviceList.List[0] = rec
+				break
+			}
+		}
+	}
+	sp, err = selectService(serviceList, ua.protocols())
 	if err != nil {
-		ua.leadingRegistrar = ""
-		return servLoc, err
+		return sp, err
 	}
-	defer resp.Body.Close()
-	respBytes, err := io.ReadAll(resp.Body)
+
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.sticky == nil {
+		ua.sticky = make(map[string]stickyProvider)
+	}
+	for k, provider := range ua.sticky {
+		if !now.Before(provider.expires) {
+			delete(ua.sticky, k) // forget the sessions that ended
+		}
+	}
+	ua.sticky[key] = stickyProvider{location: sp.ServLocation, expires: now.Add(ttl)}
+	return sp, nil
+}
+
+// defaultMaxBodySize is the largest request body accepted when the traits do not set a limit (1 MiB)
+const defaultMaxBodySize = 1 << 20
+
+// maxBodySize returns the largest request body accepted, in bytes
+func (ua *UnitAsset) maxBodySize() int64 {
+	if ua.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return int64(ua.MaxBodySize)
+}
+
+// defaultQueryTimeout bounds a registrar query when the traits do not set a timeout
+const defaultQueryTimeout = 2 * time.Second
+
+// queryTimeout returns the maximum duration of a registrar query
+func (ua *UnitAsset) queryTimeout() time.Duration {
+	if ua.QueryTimeout <= 0 {
+		return defaultQueryTimeout
+	}
+	return time.Duration(ua.QueryTimeout) * time.Millisecond
+}
+
+// connection pool sizes and idle timeout used when the traits do not set them
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 32 // the orchestrator mostly talks to a single registrar
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newClient builds the HTTP client of the unit asset with its own connection pool, sized by the traits
+func (ua *UnitAsset) newClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = defaultMaxIdleConns
+	if ua.MaxIdleConns > 0 {
+		transport.MaxIdleConns = ua.MaxIdleConns
+	}
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if ua.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = ua.MaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+	if ua.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(ua.IdleConnTimeout) * time.Millisecond
+	}
+	return &http.Client{Transport: transport}
+}
+
+// httpClient returns the client of the unit asset, or the default one for an asset that was not built by newResource
+func (ua *UnitAsset) httpClient() *http.Client {
+	if ua.client == nil {
+		return http.DefaultClient
+	}
+	return ua.client
+}
+
+// registrarURL returns the URL of the leading registrar, looking it up if it is not known yet
+func (ua *UnitAsset) registrarURL() (string, error) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.leadingRegistrar == "" {
+		leader, err := components.GetRunningCoreSystemURL(ua.Owner, "serviceregistrar")
+		if err != nil {
+			return "", err
+		}
+		ua.leadingRegistrar = leader
+		ua.resolvedAt = time.Now()
+	}
+	return ua.leadingRegistrar, nil
+}
+
+// resetRegistrar forgets the leading registrar so that it is looked up again with the next quest, along with its capabilities
+func (ua *UnitAsset) resetRegistrar() {
+	ua.mu.Lock()
+	ua.leadingRegistrar = ""
+	ua.capabilities = nil
+	ua.mu.Unlock()
+}
+
+// capabilityWait is the registrar feature holding a query until a matching record is registered (long polling)
+const capabilityWait = "wait"
+
+// registrarInfo is the part of the registrar's info reply listing the optional features it supports
+type registrarInfo struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// fetchCapabilities asks the registrar which optional features it supports. A registrar predating the capabilities
+// supports none of them; the second result is false if the registrar could not be asked at all.
+func (ua *UnitAsset) fetchCapabilities(parent context.Context, registrar string) (map[string]bool, bool) {
+	ctx, cancel := context.WithTimeout(parent, ua.queryTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, registrar+"/info", nil)
 	if err != nil {
-		return servLoc, err
+		return nil, false
 	}
-	serviceListf, err := usecases.Unpack(respBytes, mediaType)
+	req.Header.Set(requestIDHeader, newRequestID())
+	resp, err := ua.httpClient().Do(req)
 	if err != nil {
-		return servLoc, err
+		return nil, false
+	}
+	defer resp.Body.Close()
+	capabilities := make(map[string]bool)
+	var info registrarInfo
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&info) != nil {
+		return capabilities, true
 	}
+	for _, feature := range info.Capabilities {
+		capabilities[feature] = true
+	}
+	return capabilities, true
+}
 
-	serviceList, ok := serviceListf.(*forms.ServiceRecordList_v1)
-	if !ok {
-		return nil, fmt.Errorf("problem asserting the type of the service list form")
+// supports reports whether the registrar supports the optional feature. The capabilities of the leading registrar
+// are probed once and kept until another leader is looked up, those of a registrar given by the consumer every time.
+func (ua *UnitAsset) supports(ctx context.Context, registrar string, leading bool, feature string) bool {
+	if leading {
+		ua.mu.Lock()
+		capabilities := ua.capabilities
+		ua.mu.Unlock()
+		if capabilities != nil {
+			return capabilities[feature]
+		}
+	}
+	capabilities, asked := ua.fetchCapabilities(ctx, registrar)
+	if leading && asked {
+		ua.mu.Lock()
+		if ua.leadingRegistrar == registrar {
+			ua.capabilities = capabilities
+		}
+		ua.mu.Unlock()
 	}
+	return capabilities[feature]
+}
 
-	if len(serviceList.List) == 0 {
-		return nil, fmt.Errorf("unable to locate any such service: %s", newQuest.ServiceDefinition)
+// noteQuery keeps the outcome of a query to the leading registrar for the registrar status
+func (ua *UnitAsset) noteQuery(err error) {
+	ua.mu.Lock()
+	ua.lastQueryAt = time.Now()
+	ua.lastQueryErr = err
+	ua.mu.Unlock()
+}
+
+// registrarStatus reports which registrar the orchestrator is using and how its last query went
+type registrarStatus struct {
+	Registrar    string   `json:"registrar"`
+	ResolvedAt   string   `json:"resolvedAt,omitempty"`
+	LastQueryAt  string   `json:"lastQueryAt,omitempty"`
+	Succeeded    bool     `json:"lastQuerySucceeded"`
+	LastError    string   `json:"lastError,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"` // optional features of the registrar, once probed
+	Circuit      string   `json:"circuit,omitempty"`      // state of the registrar's circuit breaker, when the breaker is on
+}
+
+// status returns a snapshot of the leading registrar and of the last query sent to it
+func (ua *UnitAsset) status() registrarStatus {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	status := registrarStatus{
+		Registrar: ua.leadingRegistrar,
+		Succeeded: !ua.lastQueryAt.IsZero() && ua.lastQueryErr == nil,
+	}
+	if !ua.resolvedAt.IsZero() {
+		status.ResolvedAt = ua.resolvedAt.Format(time.RFC3339)
+	}
+	if !ua.lastQueryAt.IsZero() {
+		status.LastQueryAt = ua.lastQueryAt.Format(time.RFC3339)
+	}
+	if ua.lastQueryErr != nil {
+		status.LastError = ua.lastQueryErr.Error()
+	}
+	for feature, supported := range ua.capabilities {
+		if supported {
+			status.Capabilities = append(status.Capabilities, feature)
+		}
+	}
+	sort.Strings(status.Capabilities)
+	if ua.BreakerThreshold > 0 && ua.leadingRegistrar != "" {
+		status.Circuit = ua.circuitState(ua.leadingRegistrar, time.Now())
+	}
+	return status
+}
+
+// drainRetryAfter is how long a consumer whose quest is refused during a drain is asked to wait before retrying
+const drainRetryAfter = 10 * time.Second
+
+// admitQuest counts a new quest as in flight, unless the orchestrator is draining
+func (ua *UnitAsset) admitQuest() bool {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.draining {
+		return false
 	}
+	ua.inFlight++
+	return true
+}
 
-	serviceLocation := selectService(*serviceList)
-	payload, err := json.MarshalIndent(serviceLocation, "", "  ")
-	return payload, err
+// finishQuest ends a quest admitted by admitQuest, signaling a drain once the last one is done
+func (ua *UnitAsset) finishQuest() {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	ua.inFlight--
+	if ua.draining && ua.inFlight == 0 {
+		close(ua.drained)
+	}
+}
+
+// setDraining starts (true) or ends (false) refusing new quests and returns the channel closed once none is in flight
+func (ua *UnitAsset) setDraining(on bool) <-chan struct{} {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if on != ua.draining {
+		log.Printf("Draining of the orchestrator is now %t with %d quests in flight\n", on, ua.inFlight)
+	}
+	if on && !ua.draining {
+		ua.drained = make(chan struct{})
+		if ua.inFlight == 0 {
+			close(ua.drained)
+		}
+	}
+	ua.draining = on
+	return ua.drained
+}
+
+// drain refuses new quests and waits up to timeout for those in flight to end, reporting whether they all did
+func (ua *UnitAsset) drain(timeout time.Duration) bool {
+	drained := ua.setDraining(true)
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// drainStatus reports whether the orchestrator is draining and how many quests it is still handling
+type drainStatus struct {
+	Draining bool `json:"draining"`
+	InFlight int  `json:"inFlight"`
+}
+
+// drainState returns a snapshot of the drain
+func (ua *UnitAsset) drainState() drainStatus {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return drainStatus{Draining: ua.draining, InFlight: ua.inFlight}
+}
+
+// resolutionKey identifies a counter of the handled quests
+type resolutionKey struct {
+	definition string
+	resolved   bool // whether a provider location was returned
+}
+
+// countResolution counts a quest for a service definition, as resolved unless locating the service failed
+func (ua *UnitAsset) countResolution(definition string, err error) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.resolutions == nil {
+		ua.resolutions = make(map[resolutionKey]uint64)
+	}
+	ua.resolutions[resolutionKey{definition: definition, resolved: err == nil}]++
+}
+
+// labelEscaper escapes a Prometheus label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the quest counters in the Prometheus text format, sorted by service definition
+func (ua *UnitAsset) writeMetrics(w io.Writer) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	keys := make([]resolutionKey, 0, len(ua.resolutions))
+	for key := range ua.resolutions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].definition != keys[j].definition {
+			return keys[i].definition < keys[j].definition
+		}
+		return keys[i].resolved && !keys[j].resolved
+	})
+	fmt.Fprintln(w, "# HELP orchestrator_quests_total Quests handled per service definition and outcome.")
+	fmt.Fprintln(w, "# TYPE orchestrator_quests_total counter")
+	for _, key := range keys {
+		outcome := "resolved"
+		if !key.resolved {
+			outcome = "failed"
+		}
+		fmt.Fprintf(w, "orchestrator_quests_total{definition=\"%s\",outcome=\"%s\"} %d\n",
+			labelEscaper.Replace(key.definition), outcome, ua.resolutions[key])
+	}
+}
+
+// coreHealth is the outcome of probing one of the core systems of the local cloud
+type coreHealth struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Reachable  bool   `json:"reachable"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Leading    *bool  `json:"leading,omitempty"` // only reported for the registrars
+	Error      string `json:"error,omitempty"`
 }
 
-func selectService(serviceList forms.ServiceRecordList_v1) (sp forms.ServicePoint_v1) {
-	rec := serviceList.List[0]
-	sp.NewForm()
-	sp.ProviderName = rec.SystemName
-	sp.ServiceDefinition = rec.ServiceDefinition
-	sp.Details = rec.Details
-	sp.ServLocation = "http://" + rec.IPAddresses[0] + ":" + strconv.Itoa(rec.ProtoPort["http"]) + "/" + rec.SystemName + "/" + rec.SubPath
-	sp.ServNode = rec.ServiceNode
-	return
+// healthSummary rolls up the health of the core systems: the cloud is healthy when
+// every core system is reachable and, if registrars are configured, one of them leads
+type healthSummary struct {
+	Healthy bool         `json:"healthy"`
+	Cores   []coreHealth `json:"cores"`
 }
 
-func (ua *UnitAsset) getServicesURL(newQuest forms.ServiceQuest_v1) (servLoc []byte, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+// checkCores probes the known core systems concurrently, each within the query timeout and the caller's context
+func (ua *UnitAsset) checkCores(ctx context.Context) healthSummary {
+	var cores []*components.CoreSystem
+	if ua.Owner != nil {
+		cores = ua.Owner.CoreS
+	}
+	summary := healthSummary{Cores: make([]coreHealth, len(cores))}
+	var wg sync.WaitGroup
+	for i, cs := range cores {
+		wg.Add(1)
+		go func(i int, cs *components.CoreSystem) {
+			defer wg.Done()
+			summary.Cores[i] = ua.probeCore(ctx, cs)
+		}(i, cs)
+	}
+	wg.Wait()
+
+	summary.Healthy = true
+	registrars, leaders := 0, 0
+	for _, ch := range summary.Cores {
+		summary.Healthy = summary.Healthy && ch.Reachable
+		if ch.Leading != nil {
+			registrars++
+			if *ch.Leading {
+				leaders++
+			}
+		}
+	}
+	if registrars > 0 && leaders == 0 {
+		summary.Healthy = false
+	}
+	return summary
+}
+
+// probeCore checks that a core system answers. A registrar is asked for its status to learn whether it leads,
+// other core systems are reachable when their URL answers without a server error.
+func (ua *UnitAsset) probeCore(parent context.Context, cs *components.CoreSystem) coreHealth {
+	ch := coreHealth{Name: cs.Name, URL: cs.Url}
+	ctx, cancel := context.WithTimeout(parent, ua.queryTimeout())
 	defer cancel()
-	sys := ua.Owner
-	if ua.leadingRegistrar == "" {
-		ua.leadingRegistrar, err = components.GetRunningCoreSystemURL(sys, "serviceregistrar")
-		if err != nil {
-			return servLoc, err
+	registrar := cs.Name == components.ServiceRegistrarName
+	target := cs.Url
+	if registrar {
+		target += "/status"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		ch.Error = err.Error()
+		return ch
+	}
+	req.Header.Set(requestIDHeader, newRequestID())
+	resp, err := ua.httpClient().Do(req)
+	if err != nil {
+		ch.Error = err.Error()
+		return ch
+	}
+	defer resp.Body.Close()
+	ch.StatusCode = resp.StatusCode
+	ch.Reachable = resp.StatusCode < http.StatusInternalServerError
+	if registrar {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		leading := err == nil && resp.StatusCode == http.StatusOK && strings.HasPrefix(string(body), components.ServiceRegistrarLeader)
+		ch.Leading = &leading
+		ch.Reachable = err == nil && resp.StatusCode == http.StatusOK
+	}
+	return ch
+}
+
+// queryRegistrar sends the service quest to the leading registrar and returns the non empty list of matching service records
+func (ua *UnitAsset) queryRegistrar(ctx context.Context, newQuest forms.ServiceQuest_v1) (*forms.ServiceRecordList_v1, error) {
+	return ua.queryRegistrarAt(ctx, "", newQuest, 0)
+}
+
+// queryRegistrarAt sends the service quest to the given registrar, or to the leading one if registrar is empty.
+// A registrar given by the consumer is neither remembered nor forgotten as the leading one.
+// With a positive wait, a registrar supporting long polling holds the query until a provider is registered or the wait
+// elapses; other registrars answer at once.
+// The query ends when the consumer's context is done or, at the latest, after the configured query timeout (and the wait).
+func (ua *UnitAsset) queryRegistrarAt(parent context.Context, registrar string, newQuest forms.ServiceQuest_v1, wait time.Duration) (serviceList *forms.ServiceRecordList_v1, err error) {
+	if registrar == "" {
+		defer func() { ua.noteQuery(err) }()
+	}
+	leader := registrar
+	if leader == "" {
+		if leader, err = ua.registrarURL(); err != nil {
+			return nil, fmt.Errorf("%w: %w", errRegistrarUnreachable, err)
 		}
 	}
+	if !ua.allowQuery(leader, time.Now()) {
+		return nil, fmt.Errorf("%w: %w for %s", errRegistrarUnreachable, errCircuitOpen, leader)
+	}
+	defer func() { ua.noteOutcome(parent, leader, err, time.Now()) }()
+	srURL := leader + "/query"
+	if wait > 0 && ua.supports(parent, leader, registrar == "", capabilityWait) {
+		srURL += "?wait=" + url.QueryEscape(wait.String())
+	} else {
+		wait = 0
+	}
+	ctx, cancel := context.WithTimeout(parent, ua.queryTimeout()+wait)
+	defer cancel()
 
 	// Create a new HTTP request to the the Service Registrar
 	mediaType := "application/json"
 	jsonQF, err := usecases.Pack(&newQuest, mediaType)
 	if err != nil {
-		return servLoc, err
+		return nil, err
 	}
 
-	srURL := ua.leadingRegistrar + "/query"
 	req, err := http.NewRequest(http.MethodPost, srURL, bytes.NewBuffer(jsonQF))
 	if err != nil {
-		return servLoc, err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", mediaType)
+	req.Header.Set(requestIDHeader, newRequestID())
+	req.Header.Set("Accept-Encoding", "gzip")
 	req = req.WithContext(ctx)
+	span := ua.tracer.startClientSpan(ctx, req, "query registrar")
+	span.setAttribute("registrar.url", leader)
+	defer func() { span.end(err) }()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := ua.httpClient().Do(req)
 	if err != nil {
-		ua.leadingRegistrar = ""
-		return servLoc, err
+		if registrar == "" && parent.Err() == nil { // a consumer giving up says nothing about the registrar
+			ua.resetRegistrar()
+		}
+		return nil, fmt.Errorf("%w: %w", errRegistrarUnreachable, err)
 	}
 	defer resp.Body.Close()
-	respBytes, err := io.ReadAll(resp.Body)
+	respBytes, err := readResponseBody(resp)
 	if err != nil {
-		return servLoc, err
+		return nil, fmt.Errorf("%w: %w", errBadRegistrarResponse, err)
 	}
 	serviceListf, err := usecases.Unpack(respBytes, mediaType)
 	if err != nil {
-		return servLoc, err
+		return nil, fmt.Errorf("%w: %w", errBadRegistrarResponse, err)
 	}
 
 	serviceList, ok := serviceListf.(*forms.ServiceRecordList_v1)
 	if !ok {
-		return nil, fmt.Errorf("problem asserting the type of the service list form")
+		return nil, fmt.Errorf("%w: problem asserting the type of the service list form", errBadRegistrarResponse)
 	}
 
 	if len(serviceList.List) == 0 {
-		return nil, fmt.Errorf("unable to locate any such service: %s", newQuest.ServiceDefinition)
+		return nil, fmt.Errorf("%w: %s", errNoSuchService, newQuest.ServiceDefinition)
+	}
+	return serviceList, nil
+}
+
+// errors returned when locating a service, telling a service nobody provides from a registrar that cannot be used
+var (
+	errNoSuchService        = errors.New("unable to locate any such service")   // the registrar answered without a usable provider
+	errRegistrarUnreachable = errors.New("service registrar unreachable")       // no registrar could be found or queried
+	errBadRegistrarResponse = errors.New("invalid response from the registrar") // the registrar's reply could not be read
+)
+
+// readResponseBody reads the registrar's response body, decompressing it when it is gzip encoded
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return io.ReadAll(resp.Body)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
 	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// servicePoint is the ServicePoint_v1 form extended with the activity cost of the selected provider.
+// The cost fields are omitted when zero so that consumers unaware of them receive the plain form.
+type servicePoint struct {
+	forms.ServicePoint_v1
+	ACost float64 `json:"activityCost,omitempty"`
+	CUnit string  `json:"costUnit,omitempty"`
+}
+
+// defaultProtocols is the protocol preference order used when the traits do not set one
+var defaultProtocols = []string{"http"}
+
+// protocols returns the configured protocol preference order, or the default one if unset
+func (ua *UnitAsset) protocols() []string {
+	if len(ua.Protocols) == 0 {
+		return defaultProtocols
+	}
+	return ua.Protocols
+}
+
+// serviceURL builds the location of the service described by the record with the first preferred protocol it offers
+func serviceURL(rec forms.ServiceRecord_v1, protocols []string) (string, error) {
+	if len(rec.IPAddresses) == 0 || rec.IPAddresses[0] == "" {
+		return "", fmt.Errorf("record %d of %s has no IP address", rec.Id, rec.SystemName)
+	}
+	for _, protocol := range protocols {
+		port := rec.ProtoPort[protocol]
+		if port <= 0 || port > 65535 {
+			continue
+		}
+		return protocol + "://" + rec.IPAddresses[0] + ":" + strconv.Itoa(port) + "/" + rec.SystemName + "/" + rec.SubPath, nil
+	}
+	return "", fmt.Errorf("record %d of %s has no port for any of the protocols %v", rec.Id, rec.SystemName, protocols)
+}
+
+// selectService picks the first provider of the list of service records whose location can be built with one of the
+// protocols, tried in order of preference, and builds its service point
+func selectService(serviceList forms.ServiceRecordList_v1, protocols []string) (sp servicePoint, err error) {
+	for _, rec := range serviceList.List {
+		location, err := serviceURL(rec, protocols)
+		if err != nil {
+			log.Printf("skipping unusable service record: %v", err)
+			continue
+		}
+		sp.NewForm()
+		sp.ProviderName = rec.SystemName
+		sp.ServiceDefinition = rec.ServiceDefinition
+		sp.Details = rec.Details
+		sp.ServLocation = location
+		sp.ServNode = rec.ServiceNode
+		sp.ACost = rec.ACost
+		sp.CUnit = rec.CUnit
+		return sp, nil
+	}
+	return sp, fmt.Errorf("%w: none of the %d service records has a usable location", errNoSuchService, len(serviceList.List))
+}
 
+func (ua *UnitAsset) getServicesURL(ctx context.Context, newQuest forms.ServiceQuest_v1) (servLoc []byte, err error) {
+	serviceList, err := ua.queryRegistrar(ctx, newQuest)
+	if err != nil {
+		return nil, err
+	}
+	ua.orderServices(serviceList)
 	payload, err := json.MarshalIndent(serviceList, "", "  ")
 	return payload, err
 }
+
+// Orderings of the service records returned to the consumer, best provider first
+const (
+	orderUnsorted  = "unsorted"  // as listed by the registrar
+	orderCost      = "cost"      // activity cost ascending
+	orderWeight    = "weight"    // "Weight" detail descending
+	orderPreferred = "preferred" // providers matching the preferred details first
+	orderLRU       = "lru"       // least recently handed out providers first
+)
+
+// orderServices sorts the service records according to the configured ordering.
+// The sort is stable so that equally ranked providers keep the registrar's order.
+// Providers of the local cloud, if configured, come before foreign ones whatever the ordering.
+func (ua *UnitAsset) orderServices(serviceList *forms.ServiceRecordList_v1) {
+	list := serviceList.List
+	switch ua.Ordering {
+	case orderCost:
+		sort.SliceStable(list, func(i, j int) bool { return list[i].ACost < list[j].ACost })
+	case orderWeight:
+		sort.SliceStable(list, func(i, j int) bool { return recordWeight(list[i]) > recordWeight(list[j]) })
+	case orderPreferred:
+		sort.SliceStable(list, func(i, j int) bool {
+			return hasDetails(list[i], ua.PreferredDetails) && !hasDetails(list[j], ua.PreferredDetails)
+		})
+	case orderLRU:
+		ua.orderByHandout(list)
+	}
+	ua.preferLocalCloud(list)
+	ua.shedSaturated(list)
+}
+
+// orderByHandout sorts the records least recently handed out first, those never handed out leading in the registrar's order
+func (ua *UnitAsset) orderByHandout(list []forms.ServiceRecord_v1) {
+	type handout struct {
+		rec forms.ServiceRecord_v1
+		at  time.Time
+	}
+	handouts := make([]handout, len(list))
+	ua.mu.Lock()
+	for i, rec := range list {
+		location, _ := serviceURL(rec, ua.protocols()) // unusable records are skipped at selection
+		handouts[i] = handout{rec: rec, at: ua.handouts[rec.ServiceDefinition][location]}
+	}
+	ua.mu.Unlock()
+	sort.SliceStable(handouts, func(i, j int) bool { return handouts[i].at.Before(handouts[j].at) })
+	for i, h := range handouts {
+		list[i] = h.rec
+	}
+}
+
+// noteHandout records when the selected provider was handed out, forgetting the providers of the service
+// that the registrar no longer lists
+func (ua *UnitAsset) noteHandout(list []forms.ServiceRecord_v1, sp servicePoint, now time.Time) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.handouts == nil {
+		ua.handouts = make(map[string]map[string]time.Time)
+	}
+	previous := ua.handouts[sp.ServiceDefinition]
+	listed := make(map[string]time.Time, len(list))
+	for _, rec := range list {
+		location, err := serviceURL(rec, ua.protocols())
+		if err != nil {
+			continue
+		}
+		if at, found := previous[location]; found {
+			listed[location] = at
+		}
+	}
+	listed[sp.ServLocation] = now
+	ua.handouts[sp.ServiceDefinition] = listed
+}
+
+// preferLocalCloud moves the providers of the orchestrator's local cloud ahead of the foreign ones,
+// so that a foreign provider is only selected when no local one offers the service
+func (ua *UnitAsset) preferLocalCloud(list []forms.ServiceRecord_v1) {
+	if ua.LocalCloud == "" {
+		return
+	}
+	local := map[string][]string{"LocalCloud": {ua.LocalCloud}}
+	sort.SliceStable(list, func(i, j int) bool {
+		return hasDetails(list[i], local) && !hasDetails(list[j], local)
+	})
+}
+
+// loadRatio returns how loaded the provider of the record reports itself: its "Load" detail divided by its "Capacity"
+// detail, or the load itself as a fraction without a capacity. The second result is false if it reports no usable load
+func loadRatio(rec forms.ServiceRecord_v1) (float64, bool) {
+	loads := rec.Details["Load"]
+	if len(loads) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(loads[0], 64)
+	if err != nil || load < 0 {
+		return 0, false
+	}
+	if capacities := rec.Details["Capacity"]; len(capacities) > 0 {
+		capacity, err := strconv.ParseFloat(capacities[0], 64)
+		if err != nil || capacity <= 0 {
+			return 0, false
+		}
+		return load / capacity, true
+	}
+	return load, true
+}
+
+// saturated reports whether the provider of the record reports a load at or above the shedding ratio
+func (ua *UnitAsset) saturated(rec forms.ServiceRecord_v1) bool {
+	ratio, ok := loadRatio(rec)
+	return ua.ShedLoad > 0 && ok && ratio >= ua.ShedLoad
+}
+
+// shedSaturated moves the saturated providers after the others, the least loaded of them first, so that they are
+// only selected when every provider is saturated
+func (ua *UnitAsset) shedSaturated(list []forms.ServiceRecord_v1) {
+	if ua.ShedLoad <= 0 {
+		return
+	}
+	type shed struct {
+		rec       forms.ServiceRecord_v1
+		saturated bool
+		ratio     float64
+	}
+	ranked := make([]shed, len(list))
+	for i, rec := range list {
+		ratio, _ := loadRatio(rec)
+		ranked[i] = shed{rec: rec, saturated: ua.saturated(rec), ratio: ratio}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].saturated != ranked[j].saturated {
+			return !ranked[i].saturated
+		}
+		return ranked[i].saturated && ranked[i].ratio < ranked[j].ratio
+	})
+	for i, r := range ranked {
+		list[i] = r.rec
+	}
+}
+
+// recordWeight returns the numeric value of the record's "Weight" detail, or zero if it has none
+func recordWeight(rec forms.ServiceRecord_v1) float64 {
+	weights := rec.Details["Weight"]
+	if len(weights) == 0 {
+		return 0
+	}
+	w, err := strconv.ParseFloat(weights[0], 64)
+	if err != nil {
+		return 0
+	}
+	return w
+}
+
+// hasDetails reports whether the record has, for every preferred key, at least one of the preferred values
+func hasDetails(rec forms.ServiceRecord_v1, preferred map[string][]string) bool {
+	if len(preferred) == 0 {
+		return false
+	}
+	for key, values := range preferred {
+		found := false
+		for _, value := range values {
+			for _, v := range rec.Details[key] {
+				if v == value {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// questResult is the outcome of one of the service quests of a multi-quest request
+type questResult struct {
+	Definition   string        `json:"definition"`
+	ServicePoint *servicePoint `json:"servicePoint,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// defaultWorkers is the number of quests resolved concurrently when the traits do not set it
+const defaultWorkers = 4
+
+// resolveQuests resolves each service quest with a bounded pool of workers and returns their outcomes in the order of the quests,
+// so that a quest that cannot be resolved does not fail the others and quests for the same definition keep their own outcome
+func (ua *UnitAsset) resolveQuests(ctx context.Context, quests []forms.ServiceQuest_v1) []questResult {
+	workers := ua.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	results := make([]questResult, len(quests))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i, quest := range quests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, q forms.ServiceQuest_v1) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := questResult{Definition: q.ServiceDefinition}
+			sp, err := servicePoint{}, ua.authorize(q.RequesterName, q.ServiceDefinition)
+			if err == nil {
+				sp, err = ua.locateService(ctx, q)
+			}
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.ServicePoint = &sp
+			}
+			results[i] = res // each worker writes its own entry
+		}(i, quest)
+	}
+	wg.Wait()
+	return results
+}
+
+// policyWildcard stands for any consumer as a policy key and for any service definition in a policy rule
+const policyWildcard = "*"
+
+// errNotAuthorized is returned when the consumer may not resolve the sought service
+var errNotAuthorized = errors.New("consumer not authorized")
+
+// consumerIdentity returns who is asking for the service: the common name of the client's verified certificate if any,
+// otherwise the requester named in the quest
+func consumerIdentity(r *http.Request, quest forms.ServiceQuest_v1) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+	return quest.RequesterName
+}
+
+// authorize checks that the consumer may resolve the service definition according to the policy.
+// Consumers without rules of their own follow the "*" rule, if any. Every consumer is allowed when no policy is configured.
+func (ua *UnitAsset) authorize(consumer, definition string) error {
+	if len(ua.Policy) == 0 {
+		return nil
+	}
+	allowed, found := ua.Policy[consumer]
+	if !found {
+		allowed = ua.Policy[policyWildcard]
+	}
+	for _, d := range allowed {
+		if d == definition || d == policyWildcard {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q may not resolve %s", errNotAuthorized, consumer, definition)
+}
+
+// forwardRequest is a service quest with the request to forward to the provider it resolves to
+type forwardRequest struct {
+	Quest       forms.ServiceQuest_v1 `json:"quest"`
+	Method      string                `json:"method"`                // method of the forwarded request, GET if empty
+	Path        string                `json:"path,omitempty"`        // appended to the provider's service location, e.g., "/history?samples=10"
+	ContentType string                `json:"contentType,omitempty"` // media type of the body, application/json if empty
+	Body        json.RawMessage       `json:"body,omitempty"`        // body of the forwarded request, e.g., a SignalA_v1a form
+}
+
+// errBadForward is returned when the forward request cannot be sent to the provider as it is
+var errBadForward = errors.New("invalid forward request")
+
+// forwardTo sends the consumer's request to the provider's service location with the given client.
+// The request ends with the consumer's context, and the caller closes the response body.
+func forwardTo(ctx context.Context, client *http.Client, sp servicePoint, fr forwardRequest) (*http.Response, error) {
+	method := strings.ToUpper(fr.Method)
+	switch method {
+	case "":
+		method = http.MethodGet
+	case http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete:
+	default:
+		return nil, fmt.Errorf("%w: method %s cannot be forwarded", errBadForward, fr.Method)
+	}
+	location, err := url.Parse(sp.ServLocation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service location %s: %w", sp.ServLocation, err)
+	}
+	target, err := url.Parse(sp.ServLocation + fr.Path)
+	if err != nil || target.Host != location.Host || strings.Contains(target.Path, "..") {
+		return nil, fmt.Errorf("%w: path %q leaves the provider's service location", errBadForward, fr.Path)
+	}
+
+	var body io.Reader
+	if len(fr.Body) > 0 {
+		body = bytes.NewReader(fr.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		contentType := fr.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(requestIDHeader, newRequestID())
+	return client.Do(req)
+}
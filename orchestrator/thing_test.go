@@ -2,12 +2,19 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sdoque/mbaigo/forms"
 	"github.com/sdoque/mbaigo/usecases"
@@ -61,23 +68,23 @@ type getServiceURLTestStruct struct {
 	mockTransportErr int
 	errHTTP          error
 	expectedOutput   string
-	expectedErr      bool
+	expectedErr      error
 	testName         string
 }
 
 var getServiceURLTestParams = []getServiceURLTestStruct{
 	{createTestServiceQuest(), string(createTestServiceRecordListForm()), false, false,
-		0, nil, string(createTestServicePointForm()), false, "Good case, everything passes"},
+		0, nil, string(createTestServicePointForm()), nil, "Good case, everything passes"},
 	{createTestServiceQuest(), string(createTestServiceRecordListForm()), false, false,
-		2, errHTTP, "", true, "Bad case, DefaultClient.Do fails"},
+		2, errHTTP, "", errRegistrarUnreachable, "Bad case, DefaultClient.Do fails"},
 	{createTestServiceQuest(), string(createTestServiceRecordListForm()), false, true,
-		0, nil, "", true, "Bad case, ReadAll fails"},
+		0, nil, "", errBadRegistrarResponse, "Bad case, ReadAll fails"},
 	{createTestServiceQuest(), "hej hej", false, false,
-		0, nil, "", true, "Bad case, Unpack fails"},
+		0, nil, "", errBadRegistrarResponse, "Bad case, Unpack fails"},
 	{createTestServiceQuest(), string(createTestServicePointForm()), false, false,
-		0, nil, "", true, "Bad case, type assertion fails"},
+		0, nil, "", errBadRegistrarResponse, "Bad case, type assertion fails"},
 	{createTestServiceQuest(), string(createEmptyServiceRecordListForm()), false, false,
-		0, nil, "", true, "Bad case, the service record list is empty"},
+		0, nil, "", errNoSuchService, "Bad case, the service record list is empty"},
 }
 
 func TestGetServiceURL(t *testing.T) {
@@ -92,10 +99,9 @@ func TestGetServiceURL(t *testing.T) {
 			newMockTransport(createMultiHTTPResponse(2, testCase.writeError, testCase.inputBody),
 				testCase.mockTransportErr, testCase.errHTTP)
 		}
-		servLoc, err := mua.getServiceURL(testCase.inputForm)
-		if string(servLoc) != testCase.expectedOutput || (err == nil && testCase.expectedErr == true) ||
-			(err != nil && testCase.expectedErr == false) {
-			t.Errorf("In test case: %s: Expected %s and error %t, got: %s and %v",
+		servLoc, err := mua.getServiceURL(context.Background(), testCase.inputForm)
+		if string(servLoc) != testCase.expectedOutput || !errors.Is(err, testCase.expectedErr) {
+			t.Errorf("In test case: %s: Expected %s and error %v, got: %s and %v",
 				testCase.testName, testCase.expectedOutput, testCase.expectedErr, string(servLoc), err)
 		}
 	}
@@ -114,7 +120,10 @@ func TestSelectService(t *testing.T) {
 
 	expectedService := createTestServicePointForm()
 
-	receivedServicef := selectService(*serviceList)
+	receivedServicef, err := selectService(*serviceList, defaultProtocols)
+	if err != nil {
+		t.Fatalf("Unexpected error selecting the service: %v", err)
+	}
 
 	receivedService, err := usecases.Pack(&receivedServicef, "application/json")
 	if err != nil {
@@ -126,6 +135,128 @@ func TestSelectService(t *testing.T) {
 	}
 }
 
+type selectServiceSkipTestStruct struct {
+	first            forms.ServiceRecord_v1
+	second           forms.ServiceRecord_v1
+	expectedProvider string
+	expectedErr      bool
+	testName         string
+}
+
+var selectServiceSkipTestParams = []selectServiceSkipTestStruct{
+	{forms.ServiceRecord_v1{SystemName: "noIP", ProtoPort: map[string]int{"http": 8870}},
+		forms.ServiceRecord_v1{SystemName: "valid", IPAddresses: []string{"10.0.0.5"}, ProtoPort: map[string]int{"http": 8870}},
+		"valid", false, "Good case, record without IP address skipped"},
+	{forms.ServiceRecord_v1{SystemName: "noPort", IPAddresses: []string{"10.0.0.4"}, ProtoPort: map[string]int{"https": 8443}},
+		forms.ServiceRecord_v1{SystemName: "valid", IPAddresses: []string{"10.0.0.5"}, ProtoPort: map[string]int{"http": 8870}},
+		"valid", false, "Good case, record without HTTP port skipped"},
+	{forms.ServiceRecord_v1{SystemName: "first", IPAddresses: []string{"10.0.0.4"}, ProtoPort: map[string]int{"http": 8870}},
+		forms.ServiceRecord_v1{SystemName: "valid", IPAddresses: []string{"10.0.0.5"}, ProtoPort: map[string]int{"http": 8870}},
+		"first", false, "Good case, first record usable"},
+	{forms.ServiceRecord_v1{SystemName: "noIP", IPAddresses: []string{""}, ProtoPort: map[string]int{"http": 8870}},
+		forms.ServiceRecord_v1{SystemName: "noPort", IPAddresses: []string{"10.0.0.5"}},
+		"", true, "Bad case, no usable record"},
+}
+
+func TestSelectServiceSkipsUnusable(t *testing.T) {
+	for _, testCase := range selectServiceSkipTestParams {
+		var serviceList forms.ServiceRecordList_v1
+		serviceList.NewForm()
+		serviceList.List = []forms.ServiceRecord_v1{testCase.first, testCase.second}
+
+		sp, err := selectService(serviceList, defaultProtocols)
+		if (err != nil) != testCase.expectedErr || sp.ProviderName != testCase.expectedProvider {
+			t.Errorf("In test case: %s: Expected provider %q and error %t, got: %q and %v",
+				testCase.testName, testCase.expectedProvider, testCase.expectedErr, sp.ProviderName, err)
+		}
+		if testCase.expectedProvider == "valid" && sp.ServLocation != "http://10.0.0.5:8870/valid/" {
+			t.Errorf("In test case: %s: Expected the valid record's location, got: %s", testCase.testName, sp.ServLocation)
+		}
+	}
+}
+
+type selectServiceProtocolTestStruct struct {
+	protoPort        map[string]int
+	protocols        []string
+	expectedLocation string
+	expectedErr      bool
+	testName         string
+}
+
+var selectServiceProtocolTestParams = []selectServiceProtocolTestStruct{
+	{map[string]int{"http": 8870, "https": 8871}, []string{"https", "http"},
+		"https://10.0.0.5:8871/multi/temp", false, "Good case, most preferred protocol chosen"},
+	{map[string]int{"http": 8870, "https": 8871}, defaultProtocols,
+		"http://10.0.0.5:8870/multi/temp", false, "Good case, default preference chooses http"},
+	{map[string]int{"https": 8871}, defaultProtocols,
+		"", true, "Bad case, default preference ignores https"},
+	{map[string]int{"https": 8871}, []string{"http", "https"},
+		"https://10.0.0.5:8871/multi/temp", false, "Good case, falls back to the next protocol"},
+	{map[string]int{"http": 0, "https": 70000, "coap": 5683}, []string{"coap"},
+		"coap://10.0.0.5:5683/multi/temp", false, "Good case, configured protocol outside the defaults"},
+	{map[string]int{"http": 0, "https": 70000}, []string{"http", "https"},
+		"", true, "Bad case, no valid port for a preferred protocol"},
+}
+
+func TestSelectServiceProtocol(t *testing.T) {
+	for _, testCase := range selectServiceProtocolTestParams {
+		var serviceList forms.ServiceRecordList_v1
+		serviceList.NewForm()
+		serviceList.List = []forms.ServiceRecord_v1{{SystemName: "multi", SubPath: "temp",
+			IPAddresses: []string{"10.0.0.5"}, ProtoPort: testCase.protoPort}}
+
+		sp, err := selectService(serviceList, testCase.protocols)
+		if (err != nil) != testCase.expectedErr || sp.ServLocation != testCase.expectedLocation {
+			t.Errorf("In test case: %s: Expected location %q and error %t, got: %q and %v",
+				testCase.testName, testCase.expectedLocation, testCase.expectedErr, sp.ServLocation, err)
+		}
+	}
+}
+
+type selectServiceCostTestStruct struct {
+	aCost       float64
+	cUnit       string
+	expectField bool
+	testName    string
+}
+
+var selectServiceCostTestParams = []selectServiceCostTestStruct{
+	{12.5, "SEK", true, "Good case, cost fields propagate from the chosen record"},
+	{0, "", false, "Good case, no cost fields when the record has none"},
+}
+
+func TestSelectServiceCost(t *testing.T) {
+	for _, testCase := range selectServiceCostTestParams {
+		var rec forms.ServiceRecord_v1
+		rec.NewForm()
+		rec.IPAddresses = []string{"123.456.789"}
+		rec.ProtoPort = map[string]int{"http": 123}
+		rec.ACost = testCase.aCost
+		rec.CUnit = testCase.cUnit
+		var serviceList forms.ServiceRecordList_v1
+		serviceList.NewForm()
+		serviceList.List = []forms.ServiceRecord_v1{rec}
+
+		sp, err := selectService(serviceList, defaultProtocols)
+		if err != nil {
+			t.Fatalf("In test case: %s: Unexpected error: %v", testCase.testName, err)
+		}
+		if sp.ACost != testCase.aCost || sp.CUnit != testCase.cUnit {
+			t.Errorf("In test case: %s: Expected cost %v %s, got: %v %s",
+				testCase.testName, testCase.aCost, testCase.cUnit, sp.ACost, sp.CUnit)
+		}
+
+		payload, err := json.Marshal(sp)
+		if err != nil {
+			t.Fatalf("In test case: %s: Unexpected marshal error: %v", testCase.testName, err)
+		}
+		if strings.Contains(string(payload), "activityCost") != testCase.expectField {
+			t.Errorf("In test case: %s: Expected activityCost in payload to be %t, got: %s",
+				testCase.testName, testCase.expectField, string(payload))
+		}
+	}
+}
+
 func createTestServiceRecordListFormWithSeveral() []byte {
 	var serviceRecordFormTemperature forms.ServiceRecord_v1
 	serviceRecordFormTemperature.NewForm()
@@ -231,7 +362,7 @@ func TestGetServicesURL(t *testing.T) {
 			newMockTransport(createMultiHTTPResponse(2, testCase.writeError, testCase.inputBody),
 				testCase.mockTransportErr, testCase.errHTTP)
 		}
-		servLoc, err := mua.getServicesURL(testCase.inputForm)
+		servLoc, err := mua.getServicesURL(context.Background(), testCase.inputForm)
 		if string(servLoc) != testCase.expectedOutput || (err == nil && testCase.expectedErr == true) ||
 			(err != nil && testCase.expectedErr == false) {
 			t.Errorf("In test case: %s: Expected %s and error %t, got: %s and %v",
@@ -239,3 +370,598 @@ func TestGetServicesURL(t *testing.T) {
 		}
 	}
 }
+
+func createGzipHTTPResponse(limit int, body string) func() *http.Response {
+	count := 0
+	return func() *http.Response {
+		resp := &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+		}
+		count++
+		if count == limit {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write([]byte(body))
+			zw.Close()
+			resp.Header.Set("Content-Encoding", "gzip")
+			resp.Body = io.NopCloser(&buf)
+			return resp
+		}
+		resp.Body = io.NopCloser(strings.NewReader(string("lead Service Registrar since")))
+		return resp
+	}
+}
+
+func TestGetServicesURLGzip(t *testing.T) {
+	mua := createUnitAsset()
+	expected := string(createTestServiceRecordListFormWithSeveral())
+	newMockTransport(createGzipHTTPResponse(2, expected), 0, nil)
+
+	servLoc, err := mua.getServicesURL(context.Background(), createTestServiceQuest())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if string(servLoc) != expected {
+		t.Errorf("Expected %s, got: %s", expected, string(servLoc))
+	}
+}
+
+func createOrderingServiceRecordList() *forms.ServiceRecordList_v1 {
+	var serviceList forms.ServiceRecordList_v1
+	serviceList.NewForm()
+	records := []struct {
+		name     string
+		cost     float64
+		weight   string
+		location string
+	}{
+		{"first", 30, "1", "Garage"},
+		{"second", 10, "", "Kitchen"},
+		{"third", 20, "5", "Kitchen"},
+	}
+	for _, r := range records {
+		var rec forms.ServiceRecord_v1
+		rec.NewForm()
+		rec.SystemName = r.name
+		rec.ACost = r.cost
+		rec.Details = map[string][]string{"Location": {r.location}}
+		if r.weight != "" {
+			rec.Details["Weight"] = []string{r.weight}
+		}
+		serviceList.List = append(serviceList.List, rec)
+	}
+	return &serviceList
+}
+
+type orderServicesTestStruct struct {
+	ordering      string
+	preferred     map[string][]string
+	expectedOrder []string
+	testName      string
+}
+
+var orderServicesTestParams = []orderServicesTestStruct{
+	{orderUnsorted, nil, []string{"first", "second", "third"}, "Good case, unsorted keeps the registrar's order"},
+	{orderCost, nil, []string{"second", "third", "first"}, "Good case, cost ascending"},
+	{orderWeight, nil, []string{"third", "first", "second"}, "Good case, weight descending"},
+	{orderPreferred, map[string][]string{"Location": {"Kitchen"}}, []string{"second", "third", "first"},
+		"Good case, preferred details first"},
+	{orderPreferred, nil, []string{"first", "second", "third"}, "Good case, no preferred details keeps the order"},
+}
+
+func TestOrderServices(t *testing.T) {
+	for _, testCase := range orderServicesTestParams {
+		mua := createUnitAsset()
+		mua.Ordering = testCase.ordering
+		mua.PreferredDetails = testCase.preferred
+		serviceList := createOrderingServiceRecordList()
+
+		mua.orderServices(serviceList)
+		var order []string
+		for _, rec := range serviceList.List {
+			order = append(order, rec.SystemName)
+		}
+		if strings.Join(order, ",") != strings.Join(testCase.expectedOrder, ",") {
+			t.Errorf("In test case: %s: Expected order %v, got: %v", testCase.testName, testCase.expectedOrder, order)
+		}
+	}
+}
+
+func createMixedCloudServiceRecordList() *forms.ServiceRecordList_v1 {
+	var serviceList forms.ServiceRecordList_v1
+	serviceList.NewForm()
+	records := []struct {
+		name  string
+		cost  float64
+		cloud string
+	}{
+		{"foreignCheap", 1, "Stockholm"},
+		{"localDear", 30, "Lulea"},
+		{"unknown", 2, ""},
+		{"localCheap", 10, "Lulea"},
+	}
+	for _, r := range records {
+		var rec forms.ServiceRecord_v1
+		rec.NewForm()
+		rec.SystemName = r.name
+		rec.ACost = r.cost
+		rec.IPAddresses = []string{"123.456.789"}
+		rec.ProtoPort = map[string]int{"http": 123}
+		if r.cloud != "" {
+			rec.Details = map[string][]string{"LocalCloud": {r.cloud}}
+		}
+		serviceList.List = append(serviceList.List, rec)
+	}
+	return &serviceList
+}
+
+type localCloudTestStruct struct {
+	localCloud       string
+	ordering         string
+	expectedOrder    []string
+	expectedSelected string
+	testName         string
+}
+
+var localCloudTestParams = []localCloudTestStruct{
+	{"Lulea", orderUnsorted, []string{"localDear", "localCheap", "foreignCheap", "unknown"}, "localDear",
+		"Good case, local providers first"},
+	{"Lulea", orderCost, []string{"localCheap", "localDear", "foreignCheap", "unknown"}, "localCheap",
+		"Good case, local providers first, each group by cost"},
+	{"Kiruna", orderCost, []string{"foreignCheap", "unknown", "localCheap", "localDear"}, "foreignCheap",
+		"Good case, falls back to foreign providers without a local one"},
+	{"", orderUnsorted, []string{"foreignCheap", "localDear", "unknown", "localCheap"}, "foreignCheap",
+		"Good case, no local cloud configured"},
+}
+
+func TestPreferLocalCloud(t *testing.T) {
+	for _, testCase := range localCloudTestParams {
+		mua := createUnitAsset()
+		mua.LocalCloud = testCase.localCloud
+		mua.Ordering = testCase.ordering
+		serviceList := createMixedCloudServiceRecordList()
+
+		mua.orderServices(serviceList)
+		var order []string
+		for _, rec := range serviceList.List {
+			order = append(order, rec.SystemName)
+		}
+		if strings.Join(order, ",") != strings.Join(testCase.expectedOrder, ",") {
+			t.Errorf("In test case: %s: Expected order %v, got: %v", testCase.testName, testCase.expectedOrder, order)
+		}
+		if sp, _ := selectService(*serviceList, defaultProtocols); sp.ProviderName != testCase.expectedSelected {
+			t.Errorf("In test case: %s: Expected provider %s, got: %s",
+				testCase.testName, testCase.expectedSelected, sp.ProviderName)
+		}
+	}
+}
+
+func createLoadedServiceRecordList() *forms.ServiceRecordList_v1 {
+	var serviceList forms.ServiceRecordList_v1
+	serviceList.NewForm()
+	records := []struct {
+		name     string
+		load     string
+		capacity string
+	}{
+		{"hot", "0.95", ""},
+		{"busy", "30", "40"},
+		{"cool", "0.2", ""},
+		{"full", "40", "40"},
+		{"silent", "", ""},
+	}
+	for _, r := range records {
+		var rec forms.ServiceRecord_v1
+		rec.NewForm()
+		rec.SystemName = r.name
+		rec.IPAddresses = []string{"123.456.789"}
+		rec.ProtoPort = map[string]int{"http": 123}
+		rec.Details = map[string][]string{}
+		if r.load != "" {
+			rec.Details["Load"] = []string{r.load}
+		}
+		if r.capacity != "" {
+			rec.Details["Capacity"] = []string{r.capacity}
+		}
+		serviceList.List = append(serviceList.List, rec)
+	}
+	return &serviceList
+}
+
+type shedSaturatedTestStruct struct {
+	shedLoad         float64
+	onlySaturated    bool // keep only the saturated providers in the list
+	expectedOrder    []string
+	expectedSelected string
+	testName         string
+}
+
+var shedSaturatedTestParams = []shedSaturatedTestStruct{
+	{0, false, []string{"hot", "busy", "cool", "full", "silent"}, "hot", "Good case, no shedding keeps the order"},
+	{0.9, false, []string{"busy", "cool", "silent", "hot", "full"}, "busy", "Good case, saturated providers last"},
+	{0.7, false, []string{"cool", "silent", "busy", "hot", "full"}, "cool", "Good case, load over capacity, least loaded saturated first"},
+	{0.9, true, []string{"hot", "full"}, "hot", "Good case, falls back to the least loaded when all are saturated"},
+}
+
+func TestShedSaturated(t *testing.T) {
+	for _, testCase := range shedSaturatedTestParams {
+		mua := createUnitAsset()
+		mua.ShedLoad = testCase.shedLoad
+		serviceList := createLoadedServiceRecordList()
+		if testCase.onlySaturated {
+			serviceList.List = slices.DeleteFunc(serviceList.List, func(rec forms.ServiceRecord_v1) bool { return !mua.saturated(rec) })
+			slices.Reverse(serviceList.List)
+		}
+
+		mua.orderServices(serviceList)
+		var order []string
+		for _, rec := range serviceList.List {
+			order = append(order, rec.SystemName)
+		}
+		if strings.Join(order, ",") != strings.Join(testCase.expectedOrder, ",") {
+			t.Errorf("In test case: %s: Expected order %v, got: %v", testCase.testName, testCase.expectedOrder, order)
+		}
+		if sp, _ := selectService(*serviceList, defaultProtocols); sp.ProviderName != testCase.expectedSelected {
+			t.Errorf("In test case: %s: Expected provider %s, got: %s",
+				testCase.testName, testCase.expectedSelected, sp.ProviderName)
+		}
+	}
+}
+
+type authorizeTestStruct struct {
+	policy      map[string][]string
+	consumer    string
+	definition  string
+	expectedErr bool
+	testName    string
+}
+
+var authorizeTestParams = []authorizeTestStruct{
+	{nil, "thermostat", "temperature", false, "Good case, no policy allows all"},
+	{map[string][]string{"thermostat": {"temperature"}}, "thermostat", "temperature", false, "Good case, allowed consumer"},
+	{map[string][]string{"thermostat": {"temperature"}}, "thermostat", "rotation", true, "Bad case, definition not allowed"},
+	{map[string][]string{"thermostat": {"temperature"}}, "intruder", "temperature", true, "Bad case, consumer without rules"},
+	{map[string][]string{"thermostat": {"temperature"}, "*": {"time"}}, "intruder", "time", false,
+		"Good case, consumer without rules follows the wildcard rule"},
+	{map[string][]string{"admin": {"*"}}, "admin", "rotation", false, "Good case, consumer allowed any definition"},
+}
+
+func TestAuthorize(t *testing.T) {
+	for _, testCase := range authorizeTestParams {
+		mua := createUnitAsset()
+		mua.Policy = testCase.policy
+		err := mua.authorize(testCase.consumer, testCase.definition)
+		if (err != nil) != testCase.expectedErr || (err != nil && !errors.Is(err, errNotAuthorized)) {
+			t.Errorf("In test case: %s: Expected error %t, got: %v", testCase.testName, testCase.expectedErr, err)
+		}
+	}
+}
+
+type newClientTestStruct struct {
+	traits          Traits
+	expectedIdle    int
+	expectedPerHost int
+	expectedTimeout time.Duration
+	testName        string
+}
+
+var newClientTestParams = []newClientTestStruct{
+	{Traits{}, defaultMaxIdleConns, defaultMaxIdleConnsPerHost, defaultIdleConnTimeout, "Good case, defaults when unset"},
+	{Traits{MaxIdleConns: 10, MaxIdleConnsPerHost: 5, IdleConnTimeout: 1500}, 10, 5, 1500 * time.Millisecond,
+		"Good case, configured pool"},
+}
+
+func TestNewClient(t *testing.T) {
+	for _, testCase := range newClientTestParams {
+		mua := UnitAsset{Traits: testCase.traits}
+		transport, ok := mua.newClient().Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("In test case: %s: Expected an *http.Transport", testCase.testName)
+		}
+		if transport.MaxIdleConns != testCase.expectedIdle || transport.MaxIdleConnsPerHost != testCase.expectedPerHost ||
+			transport.IdleConnTimeout != testCase.expectedTimeout {
+			t.Errorf("In test case: %s: Expected %d, %d and %v, got: %d, %d and %v", testCase.testName,
+				testCase.expectedIdle, testCase.expectedPerHost, testCase.expectedTimeout,
+				transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+		}
+		if transport == http.DefaultTransport {
+			t.Errorf("In test case: %s: Expected a transport of its own", testCase.testName)
+		}
+	}
+}
+
+// benchmarkQueries sends concurrent quests to a local registrar through the given client
+func benchmarkQueries(b *testing.B, client *http.Client) {
+	body := createTestServiceRecordListForm()
+	registrar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer registrar.Close()
+	mua := createUnitAsset()
+	mua.leadingRegistrar = registrar.URL + "/serviceregistrar/registry"
+	mua.client = client
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := mua.queryRegistrar(context.Background(), createTestServiceQuest()); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkQueryRegistrarDefaultClient(b *testing.B) {
+	benchmarkQueries(b, &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()})
+}
+
+func BenchmarkQueryRegistrarPooledClient(b *testing.B) {
+	mua := UnitAsset{}
+	benchmarkQueries(b, mua.newClient())
+}
+
+// capabilityRegistrar is a registrar answering its info path with the given capabilities, counting the probes
+// and keeping the wait parameter of the last query
+type capabilityRegistrar struct {
+	info     string // reply to the info path, empty for a registrar without it
+	probes   int
+	lastWait string
+	mu       sync.Mutex
+}
+
+func (reg *capabilityRegistrar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/info"):
+		reg.probes++
+		if reg.info == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(reg.info))
+	case strings.HasSuffix(r.URL.Path, "/query"):
+		reg.lastWait = r.URL.Query().Get("wait")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(createTestServiceRecordListForm())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type capabilitiesTestStruct struct {
+	info         string
+	wait         time.Duration
+	expectedWait string
+	testName     string
+}
+
+var capabilitiesTestParams = []capabilitiesTestStruct{
+	{`{"version": "v1.2.3", "capabilities": ["wait", "lookup"]}`, 10 * time.Second, "10s", "Good case, long polling is used when the registrar supports it"},
+	{`{"version": "v1.2.3", "capabilities": ["lookup"]}`, 10 * time.Second, "", "Good case, no long polling without the capability"},
+	{`{"version": "v1.0.0"}`, 10 * time.Second, "", "Good case, no long polling with a registrar listing no capabilities"},
+	{"", 10 * time.Second, "", "Bad case, no long polling with a registrar without an info path"},
+	{`{"capabilities": ["wait"]}`, 0, "", "Good case, no long polling without a wait"},
+}
+
+func TestQueryRegistrarCapabilities(t *testing.T) {
+	for _, testCase := range capabilitiesTestParams {
+		reg := &capabilityRegistrar{info: testCase.info}
+		server := httptest.NewServer(reg)
+		mua := createUnitAsset()
+		mua.client = server.Client()
+		mua.leadingRegistrar = server.URL + "/serviceregistrar/registry"
+
+		for range 2 {
+			if _, err := mua.queryRegistrarAt(context.Background(), "", createTestServiceQuest(), testCase.wait); err != nil {
+				t.Errorf("In test case: %s: Unexpected error: %v", testCase.testName, err)
+			}
+		}
+		if status := mua.status(); testCase.expectedWait != "" && !slices.Contains(status.Capabilities, capabilityWait) {
+			t.Errorf("In test case: %s: Expected the capabilities in the registrar status, got: %v", testCase.testName, status.Capabilities)
+		}
+		reg.mu.Lock()
+		if reg.lastWait != testCase.expectedWait {
+			t.Errorf("In test case: %s: Expected the wait %q, got: %q", testCase.testName, testCase.expectedWait, reg.lastWait)
+		}
+		expectedProbes := 1 // the capabilities of the leader are probed once
+		if testCase.wait == 0 {
+			expectedProbes = 0
+		}
+		if reg.probes != expectedProbes {
+			t.Errorf("In test case: %s: Expected %d probes of the capabilities, got: %d", testCase.testName, expectedProbes, reg.probes)
+		}
+		reg.mu.Unlock()
+		server.Close()
+	}
+}
+
+func TestQueryRegistrarCapabilitiesNewLeader(t *testing.T) {
+	reg := &capabilityRegistrar{info: `{"capabilities": ["wait"]}`}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	mua := createUnitAsset()
+	mua.client = server.Client()
+	leader := server.URL + "/serviceregistrar/registry"
+	mua.leadingRegistrar = leader
+	if _, err := mua.queryRegistrarAt(context.Background(), "", createTestServiceQuest(), time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A new leader, here an older version of the registrar, has its capabilities probed again
+	mua.resetRegistrar()
+	reg.mu.Lock()
+	reg.info = ""
+	reg.mu.Unlock()
+	mua.leadingRegistrar = leader
+	if _, err := mua.queryRegistrarAt(context.Background(), "", createTestServiceQuest(), time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.probes != 2 || reg.lastWait != "" {
+		t.Errorf("Expected the new leader to be probed and queried without waiting, got %d probes and the wait %q", reg.probes, reg.lastWait)
+	}
+	if status := mua.status(); len(status.Capabilities) != 0 {
+		t.Errorf("Expected no capabilities reported for the older registrar, got: %v", status.Capabilities)
+	}
+}
+
+// ------------------------------------------------------ //
+// Help functions and structs to test the provider affinity
+// ------------------------------------------------------ //
+
+// rotatingRegistrar is a registrar listing its providers in a different order at every query, as a load balancing one would
+type rotatingRegistrar struct {
+	providers []string
+	queries   int
+	mu        sync.Mutex
+}
+
+func (reg *rotatingRegistrar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var serviceList forms.ServiceRecordList_v1
+	serviceList.NewForm()
+	for i := range reg.providers {
+		var rec forms.ServiceRecord_v1
+		rec.NewForm()
+		rec.SystemName = reg.providers[(reg.queries+i)%len(reg.providers)]
+		rec.ServiceDefinition = "temperature"
+		rec.IPAddresses = []string{"123.456.789"}
+		rec.ProtoPort = map[string]int{"http": 123}
+		serviceList.List = append(serviceList.List, rec)
+	}
+	reg.queries++
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serviceList)
+}
+
+type affinityTestStruct struct {
+	affinity          int
+	sessions          []string
+	expectedProviders []string
+	testName          string
+}
+
+var affinityTestParams = []affinityTestStruct{
+	{0, []string{"s1", "s1", "s1"}, []string{"A", "B", "C"}, "Good case, no affinity follows the registrar's order"},
+	{60, []string{"s1", "s1", "s1"}, []string{"A", "A", "A"}, "Good case, a session sticks to its provider"},
+	{60, []string{"s1", "s2", "s1", "s2"}, []string{"A", "B", "A", "B"}, "Good case, each session sticks to its own provider"},
+	{60, []string{"", "", ""}, []string{"A", "B", "C"}, "Good case, no affinity without a session"},
+}
+
+func TestLocateServiceAffinity(t *testing.T) {
+	for _, testCase := range affinityTestParams {
+		server := httptest.NewServer(&rotatingRegistrar{providers: []string{"A", "B", "C"}})
+		mua := createUnitAsset()
+		mua.client = server.Client()
+		mua.leadingRegistrar = server.URL + "/serviceregistrar/registry"
+		mua.Affinity = testCase.affinity
+
+		var providers []string
+		for _, session := range testCase.sessions {
+			sp, err := mua.locateServiceAt(context.Background(), "", createTestServiceQuest(), 0, session)
+			if err != nil {
+				t.Fatalf("In test case: %s: Unexpected error: %v", testCase.testName, err)
+			}
+			providers = append(providers, sp.ProviderName)
+		}
+		if !slices.Equal(providers, testCase.expectedProviders) {
+			t.Errorf("In test case: %s: Expected the providers %v, got: %v", testCase.testName, testCase.expectedProviders, providers)
+		}
+		server.Close()
+	}
+}
+
+func createAffinityServiceRecordList(providers ...string) forms.ServiceRecordList_v1 {
+	var serviceList forms.ServiceRecordList_v1
+	serviceList.NewForm()
+	for _, provider := range providers {
+		var rec forms.ServiceRecord_v1
+		rec.NewForm()
+		rec.SystemName = provider
+		rec.IPAddresses = []string{"123.456.789"}
+		rec.ProtoPort = map[string]int{"http": 123}
+		serviceList.List = append(serviceList.List, rec)
+	}
+	return serviceList
+}
+
+func TestSelectStickyFallback(t *testing.T) {
+	mua := createUnitAsset()
+	mua.Affinity = 60
+	now := time.Now()
+	if sp, _ := mua.selectSticky("s1", "temperature", createAffinityServiceRecordList("A", "B"), now); sp.ProviderName != "A" {
+		t.Fatalf("Expected the first provider to be selected, got: %s", sp.ProviderName)
+	}
+
+	// The sticky provider is gone, the session moves to the best one left
+	if sp, _ := mua.selectSticky("s1", "temperature", createAffinityServiceRecordList("B", "C"), now); sp.ProviderName != "B" {
+		t.Errorf("Expected the fallback to the first provider left, got: %s", sp.ProviderName)
+	}
+	if sp, _ := mua.selectSticky("s1", "temperature", createAffinityServiceRecordList("A", "C", "B"), now); sp.ProviderName != "B" {
+		t.Errorf("Expected the session to stick to its new provider, got: %s", sp.ProviderName)
+	}
+	// Another service definition of the same session has its own provider
+	if sp, _ := mua.selectSticky("s1", "rotation", createAffinityServiceRecordList("C", "B"), now); sp.ProviderName != "C" {
+		t.Errorf("Expected another service to be selected on its own, got: %s", sp.ProviderName)
+	}
+
+	// Once the affinity expired, the ordered selection applies again and the ended sessions are forgotten
+	later := now.Add(time.Minute)
+	if sp, _ := mua.selectSticky("s2", "temperature", createAffinityServiceRecordList("C", "B"), later); sp.ProviderName != "C" {
+		t.Errorf("Expected the first provider for a new session, got: %s", sp.ProviderName)
+	}
+	if sp, _ := mua.selectSticky("s1", "temperature", createAffinityServiceRecordList("A", "B"), later); sp.ProviderName != "A" {
+		t.Errorf("Expected the affinity to expire, got: %s", sp.ProviderName)
+	}
+	mua.mu.Lock()
+	defer mua.mu.Unlock()
+	if len(mua.sticky) != 2 {
+		t.Errorf("Expected the expired affinities to be forgotten, got: %v", mua.sticky)
+	}
+}
+
+type lruTestStruct struct {
+	providers []string // providers listed by the registrar at this selection
+	expected  string
+}
+
+var lruTestParams = []lruTestStruct{
+	{[]string{"A", "B", "C"}, "A"},
+	{[]string{"A", "B", "C"}, "B"},
+	{[]string{"A", "B", "C"}, "C"},
+	{[]string{"A", "B", "C"}, "A"},
+	{[]string{"C", "B", "D"}, "D"}, // a new provider was never handed out
+	{[]string{"C", "B", "D"}, "B"},
+	{[]string{"A", "B", "C", "D"}, "A"}, // A was forgotten while it was not listed
+	{[]string{"A", "B", "C", "D"}, "C"},
+	{[]string{"B", "D"}, "D"},
+}
+
+func TestPickProviderLRU(t *testing.T) {
+	mua := createUnitAsset()
+	mua.Ordering = orderLRU
+	now := time.Now()
+	for i, step := range lruTestParams {
+		serviceList := createAffinityServiceRecordList(step.providers...)
+		sp, err := mua.pickProvider(&serviceList, "", "temperature", now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("Selection %d: Unexpected error: %v", i, err)
+		}
+		if sp.ProviderName != step.expected {
+			t.Errorf("Selection %d from %v: Expected the provider %s, got: %s", i, step.providers, step.expected, sp.ProviderName)
+		}
+	}
+	mua.mu.Lock()
+	defer mua.mu.Unlock()
+	if len(mua.handouts[""]) != 2 {
+		t.Errorf("Expected only the listed providers to be remembered, got: %v", mua.handouts[""])
+	}
+}
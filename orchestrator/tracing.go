@@ -0,0 +1,191 @@
+/*******************************************************************************
+ * Copyright (c) 2025 Synecdoque
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, subject to the following conditions:
+ *
+ * The software is licensed under the MIT License. See the LICENSE file in this repository for details.
+ *
+ * Contributors:
+ *   Jan A. van Deventer, Luleå - initial implementation
+ *   Thomas Hedeler, Hamburg - initial implementation
+ ***************************************************************************SDG*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceparentHeader carries the W3C trace context (https://www.w3.org/TR/trace-context/), which OpenTelemetry propagates
+const traceparentHeader = "traceparent"
+
+// traceExporterEnv is the OpenTelemetry variable selecting the span exporter when the traits do not set one
+const traceExporterEnv = "OTEL_TRACES_EXPORTER"
+
+// spanContext identifies a span within its trace
+type spanContext struct {
+	traceID string // 32 lowercase hex digits
+	spanID  string // 16 lowercase hex digits
+	sampled bool
+}
+
+// parseTraceparent reads a traceparent header value of the form 00-<trace-id>-<span-id>-<flags>
+func parseTraceparent(value string) (spanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return spanContext{}, false
+	}
+	if !isHexID(parts[0], 2) || !isHexID(parts[1], 32) || !isHexID(parts[2], 16) || !isHexID(parts[3], 2) {
+		return spanContext{}, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return spanContext{traceID: parts[1], spanID: parts[2], sampled: flags[0]&1 == 1}, true
+}
+
+// isHexID reports whether the field has the given number of lowercase hex digits and, for IDs, is not all zeros
+func isHexID(field string, digits int) bool {
+	if len(field) != digits || strings.Trim(field, "0123456789abcdef") != "" {
+		return false
+	}
+	return digits == 2 || strings.Trim(field, "0") != ""
+}
+
+// traceparent formats the span context as a traceparent header value
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + sc.traceID + "-" + sc.spanID + "-" + flags
+}
+
+// span is one timed operation of a trace, exported as a JSON line when it ends
+type span struct {
+	Name       string            `json:"name"`
+	Kind       string            `json:"kind"` // server for a handled request, client for an outgoing one
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentSpanId,omitempty"`
+	Start      time.Time         `json:"startTime"`
+	End        time.Time         `json:"endTime"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	sampled    bool
+	tracer     *tracer
+}
+
+// tracer starts the spans of a unit asset and exports them; a nil tracer turns every span into a no-op
+type tracer struct {
+	mu  sync.Mutex // serializes the exported lines
+	out io.Writer
+}
+
+// newTracer returns the tracer of the exporter ("console" writes the spans to standard error), the exporter of
+// the OTEL_TRACES_EXPORTER variable if none is configured, or nil when tracing is off
+func newTracer(exporter string) *tracer {
+	if exporter == "" {
+		exporter = os.Getenv(traceExporterEnv)
+	}
+	switch exporter {
+	case "", "none":
+		return nil
+	case "console":
+		return &tracer{out: os.Stderr}
+	default:
+		log.Printf("Warning: unknown trace exporter %q, tracing is off\n", exporter)
+		return nil
+	}
+}
+
+// spanKey is the context key of the current span
+type spanKey struct{}
+
+// startServerSpan starts the span of an incoming request, continuing the trace of its traceparent header if any,
+// and returns the request context carrying it
+func (t *tracer) startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+	parent, _ := parseTraceparent(r.Header.Get(traceparentHeader))
+	s := t.newSpan(name, "server", parent)
+	return context.WithValue(r.Context(), spanKey{}, s), s
+}
+
+// startClientSpan starts the span of an outgoing request as a child of the context's span,
+// and injects its trace context in the request headers
+func (t *tracer) startClientSpan(ctx context.Context, req *http.Request, name string) *span {
+	if t == nil {
+		return nil
+	}
+	var parent spanContext
+	if s, ok := ctx.Value(spanKey{}).(*span); ok {
+		parent = spanContext{traceID: s.TraceID, spanID: s.SpanID, sampled: s.sampled}
+	}
+	s := t.newSpan(name, "client", parent)
+	req.Header.Set(traceparentHeader, spanContext{traceID: s.TraceID, spanID: s.SpanID, sampled: s.sampled}.traceparent())
+	return s
+}
+
+// newSpan starts a span continuing the parent's trace, or a new sampled trace if there is no parent
+func (t *tracer) newSpan(name, kind string, parent spanContext) *span {
+	s := &span{Name: name, Kind: kind, TraceID: parent.traceID, ParentID: parent.spanID, sampled: parent.sampled,
+		Start: time.Now(), tracer: t}
+	if s.TraceID == "" {
+		s.TraceID = randomHex(16)
+		s.sampled = true
+	}
+	s.SpanID = randomHex(8)
+	return s
+}
+
+// randomHex returns n random bytes as hex digits
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		b[0] = 1 // keep the ID valid, it only has to be unlikely to collide
+	}
+	return hex.EncodeToString(b)
+}
+
+// setAttribute annotates the span
+func (s *span) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// end closes the span with the error of the operation if any, and exports it if its trace is sampled
+func (s *span) end(err error) {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	line, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.out.Write(append(line, '\n'))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// ------------------------------------ //
+// Tests for the request tracing spans
+// ------------------------------------ //
+
+type parseTraceparentTestStruct struct {
+	value           string
+	expectedContext spanContext
+	expectedOk      bool
+	testName        string
+}
+
+var parseTraceparentTestParams = []parseTraceparentTestStruct{
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		spanContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true}, true, "Good case, sampled"},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		spanContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", false}, true, "Good case, not sampled"},
+	{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future",
+		spanContext{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true}, true, "Good case, later version"},
+	{"", spanContext{}, false, "Bad case, missing"},
+	{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", spanContext{}, false, "Bad case, zero trace ID"},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", spanContext{}, false, "Bad case, zero span ID"},
+	{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", spanContext{}, false, "Bad case, uppercase"},
+	{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", spanContext{}, false, "Bad case, short trace ID"},
+	{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", spanContext{}, false, "Bad case, invalid version"},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", spanContext{}, false, "Bad case, extra field"},
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, testCase := range parseTraceparentTestParams {
+		sc, ok := parseTraceparent(testCase.value)
+		if ok != testCase.expectedOk || sc != testCase.expectedContext {
+			t.Errorf("In test case: %s: Expected %+v and %t, got: %+v and %t",
+				testCase.testName, testCase.expectedContext, testCase.expectedOk, sc, ok)
+		}
+		if ok && strings.HasPrefix(testCase.value, "00-") && sc.traceparent() != testCase.value {
+			t.Errorf("In test case: %s: Expected the header %s to be formatted back, got: %s", testCase.testName, testCase.value, sc.traceparent())
+		}
+	}
+}
+
+// exportedSpans decodes the JSON lines written by a tracer
+func exportedSpans(t *testing.T, out *bytes.Buffer) []span {
+	var spans []span
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var s span
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			t.Fatalf("Unexpected span line %q: %v", line, err)
+		}
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+func TestTracerSpans(t *testing.T) {
+	var out bytes.Buffer
+	tr := &tracer{out: &out}
+	r := httptest.NewRequest("POST", "/squest", nil)
+	r.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := tr.startServerSpan(r, "orchestrate")
+	outgoing := httptest.NewRequest("POST", "http://registrar/query", nil).WithContext(ctx)
+	client := tr.startClientSpan(ctx, outgoing, "query registrar")
+	client.end(nil)
+	server.end(nil)
+
+	spans := exportedSpans(t, &out)
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 exported spans, got: %v", spans)
+	}
+	if spans[1].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[1].ParentID != "00f067aa0ba902b7" || spans[1].Kind != "server" {
+		t.Errorf("Expected the server span to continue the incoming trace, got: %+v", spans[1])
+	}
+	if spans[0].TraceID != spans[1].TraceID || spans[0].ParentID != spans[1].SpanID || spans[0].Kind != "client" {
+		t.Errorf("Expected the client span to be a child of the server span, got: %+v", spans[0])
+	}
+	if expected := "00-" + spans[0].TraceID + "-" + spans[0].SpanID + "-01"; outgoing.Header.Get(traceparentHeader) != expected {
+		t.Errorf("Expected the header %s, got: %s", expected, outgoing.Header.Get(traceparentHeader))
+	}
+
+	// An unsampled trace is propagated but not exported
+	out.Reset()
+	r.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, unsampled := tr.startServerSpan(r, "orchestrate")
+	unsampled.end(nil)
+	if out.Len() != 0 {
+		t.Errorf("Expected no export of an unsampled span, got: %s", out.String())
+	}
+}
+
+func TestTracerOff(t *testing.T) {
+	var tr *tracer
+	r := httptest.NewRequest("POST", "/squest", nil)
+	ctx, server := tr.startServerSpan(r, "orchestrate")
+	outgoing := httptest.NewRequest("POST", "http://registrar/query", nil)
+	client := tr.startClientSpan(ctx, outgoing, "query registrar")
+	client.setAttribute("registrar.url", "http://registrar")
+	client.end(nil)
+	server.end(context.Canceled)
+	if server != nil || client != nil || outgoing.Header.Get(traceparentHeader) != "" {
+		t.Errorf("Expected no spans nor headers while tracing is off")
+	}
+	if newTracer("none") != nil {
+		t.Errorf("Expected no tracer for the none exporter")
+	}
+}
@@ -18,11 +18,14 @@ import (
 	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
 	"github.com/sdoque/mbaigo/usecases"
 )
 
@@ -80,14 +83,23 @@ func main() {
 	// Register the (system) and its services
 	usecases.RegisterServices(&sys)
 
-	// start the http handler and server
-	go usecases.SetoutServers(&sys)
+	// start the http handler and server, with the server policy of the environment if any (see server.go)
+	go setoutServers(&sys)
 
 	// wait for shutdown signal, and gracefully close properly goroutines with context
 	<-sys.Sigs // wait for a SIGINT (Ctrl+C) signal
 	fmt.Println("\nshuting down system", sys.Name)
-	cancel()                    // cancel the context, signaling the goroutines to stop
-	time.Sleep(3 * time.Second) // allow the go routines to be executed, which might take more time than the main routine to end
+	cancel()                                   // cancel the context, signaling the goroutines to stop
+	time.Sleep(shutdownGrace(3 * time.Second)) // allow the go routines to be executed, which might take more time than the main routine to end
+}
+
+// shutdownGrace returns how long the goroutines are given to end once the context is cancelled.
+// The SHUTDOWN_GRACE environment variable (e.g., "5s") overrides the default; an invalid value is ignored.
+func shutdownGrace(defaultGrace time.Duration) time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE")); err == nil && grace >= 0 {
+		return grace
+	}
+	return defaultGrace
 }
 
 // Serving handles the resources services. NOTE: it expects those names from the request URL path
@@ -95,6 +107,12 @@ func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath
 	switch servicePath {
 	case "rotation":
 		ua.rotation(w, r)
+	case "hold":
+		ua.hold(w, r)
+	case "pulsewidth":
+		ua.pulseWidth(w, r)
+	case "status":
+		ua.status(w, r)
 	default:
 		http.Error(w, "Invalid service request [Do not modify the services subpath in the configuration file]", http.StatusBadRequest)
 	}
@@ -130,3 +148,82 @@ func (ua *UnitAsset) rotation(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method is not supported.", http.StatusNotFound)
 	}
 }
+
+// hold reports (GET) or sets (PUT) whether the servo holds its position, e.g., during an emergency
+func (ua *UnitAsset) hold(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		holdForm := ua.getHold()
+		usecases.HTTPProcessGetRequest(w, r, &holdForm)
+	case "PUT":
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		var sig forms.SignalB_v1a
+		if err := json.Unmarshal(body, &sig); err != nil {
+			log.Println("Error with the hold request ", err)
+			http.Error(w, "Expected a SignalB_v1a form", http.StatusBadRequest)
+			return
+		}
+		confirmation := ua.setHold(sig)
+		responseData, err := usecases.Pack(&confirmation, "application/json")
+		if err != nil {
+			log.Printf("Error packing response: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(responseData); err != nil {
+			log.Printf("Error while writing response: %v", err)
+		}
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+	}
+}
+
+// pulseWidth reports (GET) or sets (PUT) the pulse width driven to the servo in microseconds, for fine calibration
+func (ua *UnitAsset) pulseWidth(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		widthForm := ua.getPulseWidth()
+		usecases.HTTPProcessGetRequest(w, r, &widthForm)
+	case "PUT":
+		sig, err := usecases.HTTPProcessSetRequest(w, r)
+		if err != nil {
+			log.Println("Error with the setting request of the pulse width ", err)
+			http.Error(w, "Expected a SignalA_v1a form", http.StatusBadRequest)
+			return
+		}
+		confirmation := ua.setPulseWidth(sig)
+		responseData, err := usecases.Pack(&confirmation, "application/json")
+		if err != nil {
+			log.Printf("Error packing response: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(responseData); err != nil {
+			log.Printf("Error while writing response: %v", err)
+		}
+	default:
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+	}
+}
+
+// status reports (GET) the servo's position, hold and fault line so that consumers can detect a stalled servo
+func (ua *UnitAsset) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	responseData, err := json.Marshal(ua.getStatus())
+	if err != nil {
+		http.Error(w, "Failed to pack the status", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(responseData); err != nil {
+		log.Printf("Error while writing response: %v", err)
+	}
+}
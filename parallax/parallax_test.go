@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"periph.io/x/conn/v3/gpio"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+type holdServiceTestStruct struct {
+	method         string
+	body           string
+	expectedStatus int
+	expectedHeld   bool
+	testName       string
+}
+
+var holdServiceTestParams = []holdServiceTestStruct{
+	{http.MethodGet, "", http.StatusOK, false, "Good case, not held at start"},
+	{http.MethodPut, `{"value": true, "version": "SignalB_v1.0"}`, http.StatusOK, true, "Good case, hold"},
+	{http.MethodGet, "", http.StatusOK, true, "Good case, reports the hold"},
+	{http.MethodPut, `hold`, http.StatusBadRequest, true, "Bad case, body is not a form"},
+	{http.MethodPut, `{"value": false, "version": "SignalB_v1.0"}`, http.StatusOK, false, "Good case, release"},
+	{http.MethodDelete, "", http.StatusNotFound, false, "Bad case, unsupported method"},
+}
+
+func TestHoldService(t *testing.T) {
+	ua := createServo(0, 100)
+	for _, testCase := range holdServiceTestParams {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(testCase.method, "http://localhost/parallax/Servo_1/hold", strings.NewReader(testCase.body))
+		r.Header.Set("Content-Type", "application/json")
+
+		ua.Serving(w, r, "hold")
+
+		if w.Code != testCase.expectedStatus {
+			t.Errorf("In test case: %s: Expected status %d, got: %d", testCase.testName, testCase.expectedStatus, w.Code)
+		}
+		if ua.isHeld() != testCase.expectedHeld {
+			t.Errorf("In test case: %s: Expected held %t, got: %t", testCase.testName, testCase.expectedHeld, ua.isHeld())
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var f forms.SignalB_v1a
+		if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil || f.Value != testCase.expectedHeld {
+			t.Errorf("In test case: %s: Expected a SignalB_v1a form with value %t, got: %s",
+				testCase.testName, testCase.expectedHeld, w.Body.String())
+		}
+	}
+}
+
+type pulseWidthServiceTestStruct struct {
+	method         string
+	body           string
+	expectedStatus int
+	expectedWidth  float64
+	testName       string
+}
+
+var pulseWidthServiceTestParams = []pulseWidthServiceTestStruct{
+	{http.MethodGet, "", http.StatusOK, centerPulseWidth, "Good case, neutral at start"},
+	{http.MethodPut, `{"value": 1234, "unit": "Microseconds", "version": "SignalA_v1.0"}`, http.StatusOK, 1234, "Good case, set"},
+	{http.MethodGet, "", http.StatusOK, 1234, "Good case, reports the pulse width"},
+	{http.MethodPut, `1234`, http.StatusBadRequest, 1234, "Bad case, body is not a form"},
+	{http.MethodDelete, "", http.StatusNotFound, 1234, "Bad case, unsupported method"},
+}
+
+func TestPulseWidthService(t *testing.T) {
+	ua := createServo(0, 100)
+	for _, testCase := range pulseWidthServiceTestParams {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(testCase.method, "http://localhost/parallax/Servo_1/pulsewidth", strings.NewReader(testCase.body))
+		r.Header.Set("Content-Type", "application/json")
+		ua.Serving(w, r, "pulsewidth")
+
+		if w.Code != testCase.expectedStatus {
+			t.Errorf("In test case: %s: Expected status %d, got: %d", testCase.testName, testCase.expectedStatus, w.Code)
+		}
+		if got := ua.getPulseWidth().Value; got != testCase.expectedWidth {
+			t.Errorf("In test case: %s: Expected pulse width %v µs, got: %v", testCase.testName, testCase.expectedWidth, got)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var f forms.SignalA_v1a
+		if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil || f.Value != testCase.expectedWidth {
+			t.Errorf("In test case: %s: Expected a SignalA_v1a form with value %v, got: %s", testCase.testName, testCase.expectedWidth, w.Body.String())
+		}
+	}
+}
+
+func TestStatusService(t *testing.T) {
+	ua := createServo(0, 100)
+	ua.FaultPin = "GPIO17"
+	pin := &fakePin{level: gpio.Low}
+	ua.faultIn = pin
+	movePosition(ua, 25)
+
+	for _, level := range []gpio.Level{gpio.Low, gpio.High} {
+		pin.level = level
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/parallax/Servo_1/status", nil)
+		ua.Serving(w, r, "status")
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Expected a JSON status, got: %d %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		var reply map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("Expected a JSON status, got: %s", w.Body.String())
+		}
+		for _, key := range []string{"position", "unit", "held", "faultPin", "level", "fault", "timestamp", "version"} {
+			if _, ok := reply[key]; !ok {
+				t.Errorf("Expected the status to report %q, got: %s", key, w.Body.String())
+			}
+		}
+		if reply["position"] != 25.0 || reply["fault"] != bool(level) {
+			t.Errorf("Expected position 25 with fault %t, got: %s", bool(level), w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "http://localhost/parallax/Servo_1/status", nil)
+	ua.Serving(w, r, "status")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a PUT, got: %d", http.StatusNotFound, w.Code)
+	}
+}
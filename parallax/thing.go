@@ -18,13 +18,17 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/host/v3"
 
 	"github.com/sdoque/mbaigo/components"
 	"github.com/sdoque/mbaigo/forms"
@@ -34,7 +38,12 @@ import (
 // -------------------------------------Define the unit asset
 // Traits are Asset-specific configurable parameters
 type Traits struct {
+	MinPercent  int        `json:"minPercent"` // lowest position the mechanism can safely reach, in percent of the servo's range
+	MaxPercent  int        `json:"maxPercent"` // highest position the mechanism can safely reach, in percent of the servo's range
+	FaultPin    string     `json:"faultPin"`   // GPIO input wired to the driver's fault or current-sense line (e.g., "GPIO17"), none if empty
+	FaultLow    bool       `json:"faultLow"`   // the fault line is asserted when low (e.g., open-drain outputs) rather than high
 	GpioPin     gpio.PinIO `json:"-"`
+	faultIn     gpio.PinIn `json:"-"`
 	position    int        `json:"-"`
 	dutyChan    chan int   `json:"-"`
 	lastWidthUS int        `json:"-"` // last duty we wrote (µs) to debounce identical updates
@@ -49,6 +58,8 @@ type UnitAsset struct {
 	CervicesMap components.Cervices `json:"-"`
 	//
 	Traits
+	held bool       // while set, the servo stays at its current position and position updates are ignored
+	mu   sync.Mutex // protects the hold flag shared by the HTTP handlers
 }
 
 // GetName returns the name of the Resource.
@@ -91,13 +102,41 @@ func initTemplate() components.UnitAsset {
 		RegPeriod:   30,
 		Description: "informs of the servo's current position (GET) or updates the position (PUT)",
 	}
+	hold := components.Service{
+		Definition:  "hold",
+		SubPath:     "hold",
+		Details:     map[string][]string{"Forms": {"SignalB_v1a"}},
+		RegPeriod:   30,
+		Description: "informs if the servo holds its position (GET) or holds it (PUT true) and releases it (PUT false)",
+	}
+	pulseWidth := components.Service{
+		Definition:  "pulsewidth",
+		SubPath:     "pulsewidth",
+		Details:     map[string][]string{"Forms": {"SignalA_v1a"}, "Unit": {"Microseconds"}},
+		RegPeriod:   30,
+		Description: "informs of the servo's current pulse width (GET) or sets it in microseconds for fine calibration (PUT)",
+	}
+	status := components.Service{
+		Definition:  "status",
+		SubPath:     "status",
+		Details:     map[string][]string{"Forms": {"ServoStatus"}},
+		RegPeriod:   30,
+		Description: "informs of the servo's position, hold and the reading of its fault line if one is wired (GET)",
+	}
 
 	// var uat components.UnitAsset // this is an interface, which we then initialize
 	uat := &UnitAsset{
 		Name:    "Servo_1",
 		Details: map[string][]string{"Model": {"standard servo", "half_circle"}, "Location": {"Kitchen"}},
+		Traits: Traits{
+			MinPercent: 0,   // e.g., 20 if a physical stop prevents the mechanism from going lower
+			MaxPercent: 100, // e.g., 80 if a physical stop prevents the mechanism from going higher
+		},
 		ServicesMap: components.Services{
-			rotation.SubPath: &rotation, // Inline assignment of the rotation service
+			rotation.SubPath:   &rotation, // Inline assignment of the rotation service
+			hold.SubPath:       &hold,
+			pulseWidth.SubPath: &pulseWidth,
+			status.SubPath:     &status,
 		},
 	}
 	return uat
@@ -120,7 +159,17 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 	} else if len(traits) > 0 {
 		ua.Traits = traits[0]
 	}
+	if err := ua.checkSafetyBand(); err != nil {
+		log.Fatalf("Invalid traits for %s: %v", ua.Name, err)
+	}
 	ua.Traits.dutyChan = make(chan int, 1) // buffer=1 enables latest-wins behavior below
+	if ua.FaultPin != "" {
+		pin, err := openFaultPin(ua.FaultPin, ua.FaultLow)
+		if err != nil {
+			log.Fatalf("Fault pin of %s: %v", ua.Name, err)
+		}
+		ua.faultIn = pin
+	}
 
 	// Choose the GPIO you wired the servo to. You currently use P1_12 → GPIO18.
 	const servoGPIO = 18
@@ -182,10 +231,11 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 }
 
 // UnmarshalTraits unmarshals a slice of json.RawMessage into a slice of Traits.
+// Each trait starts from the full range, so that a bound left out of the configuration keeps its edge of the range.
 func UnmarshalTraits(rawTraits []json.RawMessage) ([]Traits, error) {
 	var traitsList []Traits
 	for _, raw := range rawTraits {
-		var t Traits
+		t := Traits{MinPercent: 0, MaxPercent: 100}
 		if err := json.Unmarshal(raw, &t); err != nil {
 			return nil, fmt.Errorf("failed to unmarshal trait: %w", err)
 		}
@@ -259,6 +309,25 @@ func pwmEnable(pwmPath string, on bool) error {
 	return os.WriteFile(filepath.Join(pwmPath, "enable"), []byte(val), 0o644)
 }
 
+// openFaultPin configures the named GPIO as an input, pulled to the inactive level so that an unwired line reads no fault
+func openFaultPin(name string, activeLow bool) (gpio.PinIn, error) {
+	if _, err := host.Init(); err != nil {
+		return nil, fmt.Errorf("could not load the GPIO drivers: %w", err)
+	}
+	pin := gpioreg.ByName(name)
+	if pin == nil {
+		return nil, fmt.Errorf("unknown GPIO %q", name)
+	}
+	pull := gpio.PullDown
+	if activeLow {
+		pull = gpio.PullUp
+	}
+	if err := pin.In(pull, gpio.NoEdge); err != nil {
+		return nil, fmt.Errorf("could not set %s as an input: %w", name, err)
+	}
+	return pin, nil
+}
+
 //-------------------------------------Unit asset's resource functions
 
 // timing constants for the PWM (pulse width modulation)
@@ -269,6 +338,19 @@ const (
 	maxPulseWidth    = 2420
 )
 
+// checkSafetyBand rejects a safety band that is inverted or exceeds the servo's range.
+// A configuration without a band keeps the full range.
+func (t *Traits) checkSafetyBand() error {
+	if t.MinPercent == 0 && t.MaxPercent == 0 {
+		t.MaxPercent = 100
+	}
+	if t.MinPercent < 0 || t.MaxPercent > 100 || t.MinPercent >= t.MaxPercent {
+		return fmt.Errorf("the safety band must satisfy 0 <= minPercent < maxPercent <= 100, got minPercent %d and maxPercent %d",
+			t.MinPercent, t.MaxPercent)
+	}
+	return nil
+}
+
 // getPosition provides an analog signal for the servo position in percent and a timestamp
 func (ua *UnitAsset) getPosition() (f forms.SignalA_v1a) {
 	f.NewForm()
@@ -278,8 +360,14 @@ func (ua *UnitAsset) getPosition() (f forms.SignalA_v1a) {
 	return f
 }
 
-// setPosition updates the PWM pulse size based on the requested position [0-100]%
+// setPosition updates the PWM pulse size based on the requested position [0-100]%, kept within the safety band
 func (ua *UnitAsset) setPosition(f forms.SignalA_v1a) (forms.SignalA_v1a, error) {
+	// Ignore the update while the position is held, the PWM keeps driving the held duty
+	if ua.isHeld() {
+		log.Printf("The position is held, ignoring the new position %+v\n", f)
+		return ua.getPosition(), nil
+	}
+
 	// Clamp 0–100
 	pos := int(f.Value)
 	if pos < 0 {
@@ -287,6 +375,14 @@ func (ua *UnitAsset) setPosition(f forms.SignalA_v1a) (forms.SignalA_v1a, error)
 	} else if pos > 100 {
 		pos = 100
 	}
+	// Clamp to the safety band
+	if pos < ua.MinPercent {
+		log.Printf("The position %d%% is below the safety band and is limited to %d%%\n", pos, ua.MinPercent)
+		pos = ua.MinPercent
+	} else if pos > ua.MaxPercent {
+		log.Printf("The position %d%% is above the safety band and is limited to %d%%\n", pos, ua.MaxPercent)
+		pos = ua.MaxPercent
+	}
 
 	// Log on change
 	if ua.position != pos {
@@ -294,13 +390,26 @@ func (ua *UnitAsset) setPosition(f forms.SignalA_v1a) (forms.SignalA_v1a, error)
 	}
 	ua.position = pos
 
-	// Map [0..100] -> [minPulseWidth..maxPulseWidth] in microseconds
-	widthUS := minPulseWidth + (ua.position*(maxPulseWidth-minPulseWidth))/100
+	ua.sendWidth(percentToWidth(ua.position))
+	f.Timestamp = time.Now()
+	return f, nil
+}
+
+// percentToWidth maps a position [0..100]% to its pulse width [minPulseWidth..maxPulseWidth] in microseconds
+func percentToWidth(pos int) int {
+	return minPulseWidth + (pos*(maxPulseWidth-minPulseWidth))/100
+}
+
+// widthToPercent maps a pulse width in microseconds back to the nearest position in percent
+func widthToPercent(widthUS int) int {
+	return ((widthUS-minPulseWidth)*100 + (maxPulseWidth-minPulseWidth)/2) / (maxPulseWidth - minPulseWidth)
+}
 
+// sendWidth hands the pulse width over to the PWM unless it is the one already driven
+func (ua *UnitAsset) sendWidth(widthUS int) {
 	// Debounce: skip if the duty hasn't changed
 	if widthUS == ua.lastWidthUS {
-		f.Timestamp = time.Now()
-		return f, nil
+		return
 	}
 	ua.lastWidthUS = widthUS
 
@@ -317,6 +426,99 @@ func (ua *UnitAsset) setPosition(f forms.SignalA_v1a) (forms.SignalA_v1a, error)
 		}
 		ua.dutyChan <- widthUS
 	}
+}
+
+// getPulseWidth provides an analog signal for the pulse width driven to the servo in microseconds and a timestamp
+func (ua *UnitAsset) getPulseWidth() (f forms.SignalA_v1a) {
+	f.NewForm()
+	f.Value = float64(ua.lastWidthUS)
+	if ua.lastWidthUS == 0 {
+		f.Value = centerPulseWidth // the PWM starts at the neutral duty
+	}
+	f.Unit = "Microseconds"
 	f.Timestamp = time.Now()
-	return f, nil
+	return f
+}
+
+// setPulseWidth drives the requested pulse width in microseconds straight to the PWM, kept within the pulse widths
+// of the safety band, and updates the position to the percent it maps back to
+func (ua *UnitAsset) setPulseWidth(f forms.SignalA_v1a) forms.SignalA_v1a {
+	if ua.isHeld() {
+		log.Printf("The position is held, ignoring the new pulse width %+v\n", f)
+		return ua.getPulseWidth()
+	}
+
+	widthUS := int(math.Round(f.Value))
+	lowest, highest := percentToWidth(ua.MinPercent), percentToWidth(ua.MaxPercent)
+	if widthUS < lowest {
+		log.Printf("The pulse width %d µs is below the safety band and is limited to %d µs\n", widthUS, lowest)
+		widthUS = lowest
+	} else if widthUS > highest {
+		log.Printf("The pulse width %d µs is above the safety band and is limited to %d µs\n", widthUS, highest)
+		widthUS = highest
+	}
+
+	if widthUS != ua.lastWidthUS {
+		log.Printf("The new pulse width is %d µs\n", widthUS)
+	}
+	ua.position = widthToPercent(widthUS)
+	ua.sendWidth(widthUS)
+	return ua.getPulseWidth()
+}
+
+// isHeld reports whether the servo holds its position
+func (ua *UnitAsset) isHeld() bool {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return ua.held
+}
+
+// getHold provides a binary signal telling if the servo holds its position and a timestamp
+func (ua *UnitAsset) getHold() (f forms.SignalB_v1a) {
+	f.NewForm()
+	f.Value = ua.isHeld()
+	f.Timestamp = time.Now()
+	return f
+}
+
+// setHold holds (true) or releases (false) the current position of the servo
+func (ua *UnitAsset) setHold(f forms.SignalB_v1a) forms.SignalB_v1a {
+	ua.mu.Lock()
+	if ua.held != f.Value {
+		log.Printf("The position hold is now %t at %d%%\n", f.Value, ua.position)
+	}
+	ua.held = f.Value
+	ua.mu.Unlock()
+	return ua.getHold()
+}
+
+// ServoStatus reports the servo's position and hold, and the fault line reading when a fault pin is configured
+type ServoStatus struct {
+	Position  float64   `json:"position"`
+	Unit      string    `json:"unit"`
+	Held      bool      `json:"held"`
+	FaultPin  string    `json:"faultPin,omitempty"`
+	Level     string    `json:"level,omitempty"` // "high" or "low", as read on the fault pin
+	Fault     bool      `json:"fault"`
+	Timestamp time.Time `json:"timestamp"`
+	Version   string    `json:"version"`
+}
+
+// getStatus reads the fault line, if one is wired, and reports it along with the position and the hold
+func (ua *UnitAsset) getStatus() (s ServoStatus) {
+	s.Version = "ServoStatus_v1.0"
+	s.Position = float64(ua.position)
+	s.Unit = "Percent"
+	s.Held = ua.isHeld()
+	if ua.faultIn != nil {
+		level := ua.faultIn.Read()
+		s.FaultPin = ua.FaultPin
+		s.Level = "low"
+		if level == gpio.High {
+			s.Level = "high"
+		}
+		s.Fault = level == gpio.Level(!ua.FaultLow)
+	}
+	s.Timestamp = time.Now()
+	return s
 }
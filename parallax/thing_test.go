@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"periph.io/x/conn/v3/gpio"
+
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// ---------------------------------------------------- //
+// Help functions and structs to test the safety band
+// ---------------------------------------------------- //
+
+func createServo(minPercent, maxPercent int) *UnitAsset {
+	return &UnitAsset{
+		Name: "Servo_1",
+		Traits: Traits{
+			MinPercent: minPercent,
+			MaxPercent: maxPercent,
+			dutyChan:   make(chan int, 1),
+		},
+	}
+}
+
+type checkSafetyBandTestStruct struct {
+	minPercent  int
+	maxPercent  int
+	expectedMax int
+	expectedErr bool
+	testName    string
+}
+
+var checkSafetyBandTestParams = []checkSafetyBandTestStruct{
+	{0, 0, 100, false, "Good case, no band keeps the full range"},
+	{20, 80, 80, false, "Good case, tighter band"},
+	{0, 100, 100, false, "Good case, full range"},
+	{80, 20, 20, true, "Bad case, inverted band"},
+	{50, 50, 50, true, "Bad case, empty band"},
+	{-10, 80, 80, true, "Bad case, band below the range"},
+	{20, 120, 120, true, "Bad case, band above the range"},
+}
+
+func TestCheckSafetyBand(t *testing.T) {
+	for _, testCase := range checkSafetyBandTestParams {
+		ua := createServo(testCase.minPercent, testCase.maxPercent)
+		err := ua.checkSafetyBand()
+		if (err != nil) != testCase.expectedErr {
+			t.Errorf("In test case: %s: Expected error %v, got: %v", testCase.testName, testCase.expectedErr, err)
+		}
+		if ua.MaxPercent != testCase.expectedMax {
+			t.Errorf("In test case: %s: Expected maxPercent %d, got: %d", testCase.testName, testCase.expectedMax, ua.MaxPercent)
+		}
+	}
+}
+
+type unmarshalSafetyBandTestStruct struct {
+	traits      string
+	expectedMin int
+	expectedMax int
+	expectedErr bool
+	testName    string
+}
+
+var unmarshalSafetyBandTestParams = []unmarshalSafetyBandTestStruct{
+	{`{}`, 0, 100, false, "Good case, no bound keeps the full range"},
+	{`{"minPercent": 20}`, 20, 100, false, "Good case, only the lower bound"},
+	{`{"maxPercent": 80}`, 0, 80, false, "Good case, only the upper bound"},
+	{`{"minPercent": 20, "maxPercent": 80}`, 20, 80, false, "Good case, both bounds"},
+	{`{"minPercent": 100}`, 100, 100, true, "Bad case, lower bound at the top of the range"},
+}
+
+func TestUnmarshalSafetyBand(t *testing.T) {
+	for _, testCase := range unmarshalSafetyBandTestParams {
+		traits, err := UnmarshalTraits([]json.RawMessage{json.RawMessage(testCase.traits)})
+		if err != nil || len(traits) != 1 {
+			t.Fatalf("In test case: %s: Unexpected unmarshal error: %v", testCase.testName, err)
+		}
+		err = traits[0].checkSafetyBand()
+		if (err != nil) != testCase.expectedErr {
+			t.Errorf("In test case: %s: Expected error %v, got: %v", testCase.testName, testCase.expectedErr, err)
+		}
+		if traits[0].MinPercent != testCase.expectedMin || traits[0].MaxPercent != testCase.expectedMax {
+			t.Errorf("In test case: %s: Expected the band %d-%d, got: %d-%d", testCase.testName,
+				testCase.expectedMin, testCase.expectedMax, traits[0].MinPercent, traits[0].MaxPercent)
+		}
+	}
+}
+
+type setPositionTestStruct struct {
+	minPercent       int
+	maxPercent       int
+	requested        float64
+	expectedPosition int
+	testName         string
+}
+
+var setPositionTestParams = []setPositionTestStruct{
+	{20, 80, 50, 50, "Good case, command within the band"},
+	{20, 80, 10, 20, "Good case, command below the band is clamped to its lower edge"},
+	{20, 80, 95, 80, "Good case, command above the band is clamped to its upper edge"},
+	{20, 80, -30, 20, "Good case, command below the range is clamped to the band"},
+	{20, 80, 150, 80, "Good case, command above the range is clamped to the band"},
+	{0, 0, 150, 100, "Good case, command above the range without a band"},
+}
+
+func TestSetPosition(t *testing.T) {
+	for _, testCase := range setPositionTestParams {
+		ua := createServo(testCase.minPercent, testCase.maxPercent)
+		if err := ua.checkSafetyBand(); err != nil {
+			t.Fatalf("In test case: %s: Unexpected safety band error: %v", testCase.testName, err)
+		}
+		var f forms.SignalA_v1a
+		f.NewForm()
+		f.Value = testCase.requested
+		if _, err := ua.setPosition(f); err != nil {
+			t.Errorf("In test case: %s: Unexpected error: %v", testCase.testName, err)
+		}
+
+		// the position is reported on the logical 0-100 scale
+		if got := ua.getPosition(); got.Value != float64(testCase.expectedPosition) || got.Unit != "Percent" {
+			t.Errorf("In test case: %s: Expected position %d Percent, got: %v %s",
+				testCase.testName, testCase.expectedPosition, got.Value, got.Unit)
+		}
+		expectedWidth := minPulseWidth + testCase.expectedPosition*(maxPulseWidth-minPulseWidth)/100
+		if width := <-ua.dutyChan; width != expectedWidth {
+			t.Errorf("In test case: %s: Expected pulse width %d µs, got: %d", testCase.testName, expectedWidth, width)
+		}
+	}
+}
+
+func TestSetPositionWhileHolding(t *testing.T) {
+	ua := createServo(0, 100)
+	set := func(pos int) {
+		var f forms.SignalA_v1a
+		f.NewForm()
+		f.Value = float64(pos)
+		ua.setPosition(f)
+	}
+	set(50)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for pos := range 2000 {
+				set((pos + i) % 101)
+			}
+		}()
+	}
+	close(start)
+	var hold forms.SignalB_v1a
+	hold.NewForm()
+	hold.Value = true
+	ua.setHold(hold)
+	held := ua.getPosition()
+	wg.Wait()
+
+	// No update that raced with the hold may move the servo once it is held
+	if got := ua.getPosition(); got.Value != held.Value {
+		t.Errorf("Expected the position to stay at the held %v%%, got: %v%%", held.Value, got.Value)
+	}
+	if got := ua.getPulseWidth(); got.Value != float64(percentToWidth(int(held.Value))) {
+		t.Errorf("Expected the pulse width of the held position, got: %v µs", got.Value)
+	}
+}
+
+type widthToPercentTestStruct struct {
+	widthUS         int
+	expectedPercent int
+	testName        string
+}
+
+var widthToPercentTestParams = []widthToPercentTestStruct{
+	{minPulseWidth, 0, "Good case, shortest pulse"},
+	{centerPulseWidth, 50, "Good case, neutral pulse"},
+	{maxPulseWidth, 100, "Good case, longest pulse"},
+	{minPulseWidth + 18*25, 25, "Good case, pulse of a whole percent"},
+	{minPulseWidth + 18*25 + 8, 25, "Good case, pulse rounded down to the nearest percent"},
+	{minPulseWidth + 18*25 + 10, 26, "Good case, pulse rounded up to the nearest percent"},
+}
+
+func TestWidthToPercent(t *testing.T) {
+	for _, testCase := range widthToPercentTestParams {
+		if got := widthToPercent(testCase.widthUS); got != testCase.expectedPercent {
+			t.Errorf("In test case: %s: Expected %d%%, got: %d%%", testCase.testName, testCase.expectedPercent, got)
+		}
+	}
+	for pos := 0; pos <= 100; pos++ {
+		if got := widthToPercent(percentToWidth(pos)); got != pos {
+			t.Errorf("Expected the pulse width of %d%% to map back to it, got: %d%%", pos, got)
+		}
+	}
+}
+
+type setPulseWidthTestStruct struct {
+	minPercent       int
+	maxPercent       int
+	requested        float64
+	expectedWidth    int
+	expectedPosition int
+	testName         string
+}
+
+var setPulseWidthTestParams = []setPulseWidthTestStruct{
+	{0, 100, 1000, 1000, 21, "Good case, pulse width within the range"},
+	{0, 100, 1000.4, 1000, 21, "Good case, fractional pulse width is rounded"},
+	{0, 100, 100, minPulseWidth, 0, "Good case, pulse width below the range is clamped to its lower bound"},
+	{0, 100, 3000, maxPulseWidth, 100, "Good case, pulse width above the range is clamped to its upper bound"},
+	{20, 80, 700, minPulseWidth + 18*20, 20, "Good case, pulse width below the band is clamped to its lower edge"},
+	{20, 80, 2400, minPulseWidth + 18*80, 80, "Good case, pulse width above the band is clamped to its upper edge"},
+}
+
+func TestSetPulseWidth(t *testing.T) {
+	for _, testCase := range setPulseWidthTestParams {
+		ua := createServo(testCase.minPercent, testCase.maxPercent)
+		if got := ua.getPulseWidth(); got.Value != centerPulseWidth || got.Unit != "Microseconds" {
+			t.Errorf("In test case: %s: Expected the neutral pulse width before any command, got: %v %s", testCase.testName, got.Value, got.Unit)
+		}
+		var f forms.SignalA_v1a
+		f.NewForm()
+		f.Value = testCase.requested
+		confirmation := ua.setPulseWidth(f)
+
+		if confirmation.Value != float64(testCase.expectedWidth) || ua.getPulseWidth().Value != float64(testCase.expectedWidth) {
+			t.Errorf("In test case: %s: Expected pulse width %d µs, got: %v", testCase.testName, testCase.expectedWidth, confirmation.Value)
+		}
+		if width := <-ua.dutyChan; width != testCase.expectedWidth {
+			t.Errorf("In test case: %s: Expected pulse width %d µs sent to the PWM, got: %d", testCase.testName, testCase.expectedWidth, width)
+		}
+		if got := ua.getPosition().Value; got != float64(testCase.expectedPosition) {
+			t.Errorf("In test case: %s: Expected position %d%%, got: %v", testCase.testName, testCase.expectedPosition, got)
+		}
+	}
+
+	// A held servo ignores pulse widths as it ignores positions
+	ua := createServo(0, 100)
+	movePosition(ua, 30)
+	ua.setHold(forms.SignalB_v1a{Value: true})
+	if got := ua.setPulseWidth(forms.SignalA_v1a{Value: 2000}); got.Value != float64(percentToWidth(30)) || len(ua.dutyChan) != 0 {
+		t.Errorf("Expected the held pulse width %d µs, got: %v", percentToWidth(30), got.Value)
+	}
+}
+
+// ------------------------------------------------ //
+// Help functions and structs to test the hold
+// ------------------------------------------------ //
+
+// movePosition requests a position and returns the pulse width sent to the PWM, or -1 if none was sent
+func movePosition(ua *UnitAsset, position float64) int {
+	var f forms.SignalA_v1a
+	f.NewForm()
+	f.Value = position
+	ua.setPosition(f)
+	select {
+	case width := <-ua.dutyChan:
+		return width
+	default:
+		return -1
+	}
+}
+
+func TestHold(t *testing.T) {
+	ua := createServo(0, 100)
+	movePosition(ua, 30)
+
+	if held := ua.setHold(forms.SignalB_v1a{Value: true}); !held.Value || !ua.getHold().Value {
+		t.Fatalf("Expected the servo to hold its position, got: %+v", held)
+	}
+	if width := movePosition(ua, 70); width != -1 {
+		t.Errorf("Expected no pulse width update while held, got: %d", width)
+	}
+	if got := ua.getPosition().Value; got != 30 {
+		t.Errorf("Expected the held position 30, got: %v", got)
+	}
+
+	if released := ua.setHold(forms.SignalB_v1a{Value: false}); released.Value || ua.getHold().Value {
+		t.Fatalf("Expected the servo to be released, got: %+v", released)
+	}
+	expectedWidth := minPulseWidth + 70*(maxPulseWidth-minPulseWidth)/100
+	if width := movePosition(ua, 70); width != expectedWidth {
+		t.Errorf("Expected pulse width %d µs after the release, got: %d", expectedWidth, width)
+	}
+	if got := ua.getPosition().Value; got != 70 {
+		t.Errorf("Expected position 70 after the release, got: %v", got)
+	}
+}
+
+// ------------------------------------------------ //
+// Help functions and structs to test the fault line
+// ------------------------------------------------ //
+
+// fakePin stands in for the GPIO input wired to the servo driver's fault line
+type fakePin struct {
+	level gpio.Level
+}
+
+func (p *fakePin) In(pull gpio.Pull, edge gpio.Edge) error { return nil }
+func (p *fakePin) Read() gpio.Level                        { return p.level }
+func (p *fakePin) Name() string                            { return "GPIO17" }
+
+type getStatusTestStruct struct {
+	faultPin      string
+	faultLow      bool
+	level         gpio.Level
+	expectedLevel string
+	expectedFault bool
+	testName      string
+}
+
+var getStatusTestParams = []getStatusTestStruct{
+	{"", false, gpio.High, "", false, "Good case, no fault pin"},
+	{"GPIO17", false, gpio.Low, "low", false, "Good case, fault line released"},
+	{"GPIO17", false, gpio.High, "high", true, "Good case, fault line asserted"},
+	{"GPIO17", true, gpio.High, "high", false, "Good case, active-low fault line released"},
+	{"GPIO17", true, gpio.Low, "low", true, "Good case, active-low fault line asserted"},
+}
+
+func TestGetStatus(t *testing.T) {
+	for _, testCase := range getStatusTestParams {
+		ua := createServo(0, 100)
+		ua.FaultPin = testCase.faultPin
+		ua.FaultLow = testCase.faultLow
+		if testCase.faultPin != "" {
+			ua.faultIn = &fakePin{level: testCase.level}
+		}
+		movePosition(ua, 40)
+
+		s := ua.getStatus()
+		if s.Position != 40 || s.Unit != "Percent" || s.Held {
+			t.Errorf("In test case: %s: Expected position 40 Percent not held, got: %+v", testCase.testName, s)
+		}
+		if s.FaultPin != testCase.faultPin || s.Level != testCase.expectedLevel || s.Fault != testCase.expectedFault {
+			t.Errorf("In test case: %s: Expected pin %q at level %q with fault %t, got: %+v",
+				testCase.testName, testCase.faultPin, testCase.expectedLevel, testCase.expectedFault, s)
+		}
+	}
+}
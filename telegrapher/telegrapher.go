@@ -20,12 +20,17 @@ import (
 	"context"
 	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
 	"github.com/sdoque/mbaigo/usecases"
 )
 
@@ -36,6 +41,7 @@ func main() {
 
 	// instantiate the System
 	sys := components.NewSystem("telegrapher", ctx)
+	setLogFormat(sys.Name) // emit JSON lines instead of text when LOG_FORMAT=json
 
 	// instantiate the husk
 	sys.Husk = &components.Husk{
@@ -80,20 +86,36 @@ func main() {
 	// Register the (system) and its services
 	usecases.RegisterServices(&sys)
 
-	// start the http handler and server
-	go usecases.SetoutServers(&sys)
+	// start the http handler and server, with the server policy of the environment if any (see server.go)
+	go setoutServers(&sys)
 
 	// wait for shutdown signal, and gracefully close properly goroutines with context
 	<-sys.Sigs // wait for a SIGINT (Ctrl+C) signal
 	fmt.Println("\nshuting down system", sys.Name)
-	cancel()                    // cancel the context, signaling the goroutines to stop
-	time.Sleep(3 * time.Second) // allow the go routines to be executed, which might take more time than the main routine to end
+	cancel()                                   // cancel the context, signaling the goroutines to stop
+	time.Sleep(shutdownGrace(3 * time.Second)) // allow the go routines to be executed, which might take more time than the main routine to end
+	for _, ua := range sys.UAssets {
+		if bridge, ok := (*ua).(*UnitAsset); ok {
+			log.Println(bridge.shutdownSummary())
+		}
+	}
+}
+
+// shutdownGrace returns how long the goroutines are given to end once the context is cancelled.
+// The SHUTDOWN_GRACE environment variable (e.g., "5s") overrides the default; an invalid value is ignored.
+func shutdownGrace(defaultGrace time.Duration) time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE")); err == nil && grace >= 0 {
+		return grace
+	}
+	return defaultGrace
 }
 
 // Serving handles the resources services. NOTE: it exepcts those names from the request URL path
 func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath string) {
 	svrs := ua.GetServices()
-	if svrs[servicePath] != nil {
+	if servicePath == "status" {
+		ua.reportStatus(w, r)
+	} else if svrs[servicePath] != nil {
 		ua.access(w, r, servicePath)
 	} else {
 		http.Error(w, "Invalid service request [Do not modify the services subpath in the configuration file]", http.StatusBadRequest)
@@ -103,34 +125,98 @@ func (ua *UnitAsset) Serving(w http.ResponseWriter, r *http.Request, servicePath
 func (ua *UnitAsset) access(w http.ResponseWriter, r *http.Request, servicePath string) {
 	switch r.Method {
 	case "GET":
-		msg := ua.Message
-		if len(msg) > 0 {
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(msg)
-		} else {
+		msg, age := ua.lastMessage(time.Now())
+		if topic := r.URL.Query().Get("topic"); topic != "" {
+			var found bool
+			if msg, age, found = ua.lastTopicMessage(topic, time.Now()); !found {
+				http.Error(w, "No message has been received on topic "+topic, http.StatusNotFound)
+				return
+			}
+		}
+		if len(msg) == 0 {
 			http.Error(w, "The subscribed topic is not being published", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Message-Age", strconv.Itoa(int(age.Seconds())))
+		if ua.isStale(age) {
+			http.Error(w, "The last message of the subscribed topic is stale", http.StatusServiceUnavailable)
+			return
+		}
+		if len(ua.fields) > 0 {
+			f, err := toForm(ua.fields, msg, time.Now().Add(-age))
+			if err != nil {
+				log.Printf("Unable to map the message of topic %s: %v", ua.Topic, err)
+				http.Error(w, "The last message does not match the configured mapping", http.StatusBadGateway)
+				return
+			}
+			usecases.HTTPProcessGetRequest(w, r, &f)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(msg)
 	case "PUT":
-		// data, err := io.ReadAll(r.Body)
-		// if err != nil {
-		// 	http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		// 	return
-		// }
-		// defer r.Body.Close()
-
-		// if err := ua.publishRaw(data); err != nil {
-		log.Printf("MQTT client is connected: %v", ua.mClient.IsConnected())
-
-		if err := ua.publishRaw([]byte(`{"test":123}`)); err != nil {
+		if isWildcard(ua.Topic) {
+			http.Error(w, "Cannot publish to a wildcard topic", http.StatusBadRequest)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, ua.maxBodySize())
+		data, err := io.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if len(ua.fields) > 0 {
+			var f forms.SignalA_v1a
+			if err := json.Unmarshal(data, &f); err != nil {
+				http.Error(w, "Expected a SignalA_v1a form", http.StatusBadRequest)
+				return
+			}
+			if data, err = fromForm(ua.fields, f); err != nil {
+				http.Error(w, "Failed to map the form", http.StatusInternalServerError)
+				return
+			}
+		}
+		if ua.mClient == nil || !ua.mClient.IsConnected() {
+			http.Error(w, "MQTT client is not connected", http.StatusServiceUnavailable)
+			return
+		}
+		if ua.batch != nil {
+			ua.batch.add(data)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if err := ua.publishRaw(data); err != nil {
 			log.Printf("Failed to publish: %v", err)
 			http.Error(w, "MQTT publish failed", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("MQTT client is connected: %v", ua.mClient.IsConnected())
-
 		w.WriteHeader(http.StatusAccepted)
 	default:
 		http.Error(w, "Method is not supported.", http.StatusNotFound)
 	}
 }
+
+// reportStatus replies with the state of the topic's bridge, such as the number of malformed payloads received
+func (ua *UnitAsset) reportStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ua.status()); err != nil {
+		log.Printf("Unable to write the status of topic %s: %v", ua.Topic, err)
+	}
+}
+
+// bodyTooLarge reports whether reading a request body failed because it exceeds the size limit
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
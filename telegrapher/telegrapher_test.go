@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// ------------------------------------------- //
+// Help functions and structs to test access()
+// ------------------------------------------- //
+
+// mockMQTTClient stands in for the broker connection, keeping what is published
+type mockMQTTClient struct {
+	connected  bool
+	errPublish error
+	topics     []string
+	published  []string
+}
+
+func (m *mockMQTTClient) IsConnected() bool { return m.connected }
+
+func (m *mockMQTTClient) Publish(topic string, qos byte, payload []byte) error {
+	if m.errPublish != nil {
+		return m.errPublish
+	}
+	m.topics = append(m.topics, topic)
+	m.published = append(m.published, string(payload))
+	return nil
+}
+
+func (m *mockMQTTClient) Disconnect(quiesce uint) { m.connected = false }
+
+// errReader fails every read, simulating a broken request body
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) { return 0, errors.New("read error") }
+
+func createSubscribedAsset(staleAfter int) *UnitAsset {
+	access := components.Service{
+		Definition: "temperature",
+		SubPath:    "access",
+	}
+	return &UnitAsset{
+		Name:        "Kitchen",
+		ServicesMap: components.Services{access.SubPath: &access},
+		Traits: Traits{
+			Topic:      "Kitchen/temperature",
+			Period:     -1,
+			StaleAfter: staleAfter,
+		},
+	}
+}
+
+type accessGetTestStruct struct {
+	message        string
+	age            time.Duration
+	staleAfter     int
+	expectedStatus int
+	expectedAge    string
+	testName       string
+}
+
+var accessGetTestParams = []accessGetTestStruct{
+	{`{"value":21}`, 2 * time.Second, 0, http.StatusOK, "2", "Good case, fresh message without threshold"},
+	{`{"value":21}`, time.Hour, 0, http.StatusOK, "3600", "Good case, old message without threshold"},
+	{`{"value":21}`, 5 * time.Second, 60, http.StatusOK, "5", "Good case, message younger than the threshold"},
+	{`{"value":21}`, 2 * time.Minute, 60, http.StatusServiceUnavailable, "120", "Bad case, message older than the threshold"},
+	{"", 0, 60, http.StatusBadRequest, "", "Bad case, no message received"},
+}
+
+func TestAccessGet(t *testing.T) {
+	for _, testCase := range accessGetTestParams {
+		ua := createSubscribedAsset(testCase.staleAfter)
+		if testCase.message != "" {
+			ua.storeMessage([]byte(testCase.message), time.Now().Add(-testCase.age))
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/telegrapher/Kitchen/access", nil)
+
+		ua.Serving(w, r, "access")
+
+		if w.Code != testCase.expectedStatus {
+			t.Errorf("In test case: %s: Expected status %d, got: %d", testCase.testName, testCase.expectedStatus, w.Code)
+		}
+		if got := w.Header().Get("X-Message-Age"); got != testCase.expectedAge {
+			t.Errorf("In test case: %s: Expected message age %q, got: %q", testCase.testName, testCase.expectedAge, got)
+		}
+		if testCase.expectedStatus == http.StatusOK && w.Body.String() != testCase.message {
+			t.Errorf("In test case: %s: Expected body %s, got: %s", testCase.testName, testCase.message, w.Body.String())
+		}
+	}
+}
+
+type accessPutTestStruct struct {
+	body              io.Reader
+	client            *mockMQTTClient
+	batchSize         int
+	expectedStatus    int
+	expectedPublished []string
+	testName          string
+}
+
+func accessPutTestParams() []accessPutTestStruct {
+	return []accessPutTestStruct{
+		{strings.NewReader(`{"value":22}`), &mockMQTTClient{connected: true}, 1,
+			http.StatusAccepted, []string{`{"value":22}`}, "Good case, the body is published"},
+		{strings.NewReader(`{"value":22}`), &mockMQTTClient{connected: true}, 5,
+			http.StatusAccepted, nil, "Good case, the body is buffered in a batch"},
+		{strings.NewReader(`{"value":22}`), &mockMQTTClient{connected: false}, 1,
+			http.StatusServiceUnavailable, nil, "Bad case, the client is disconnected"},
+		{strings.NewReader(`{"value":22}`), &mockMQTTClient{connected: true, errPublish: errors.New("broker gone")}, 1,
+			http.StatusInternalServerError, nil, "Bad case, the publish fails"},
+		{errReader{}, &mockMQTTClient{connected: true}, 1,
+			http.StatusBadRequest, nil, "Bad case, the body cannot be read"},
+		{strings.NewReader(strings.Repeat("x", defaultMaxBodySize+1)), &mockMQTTClient{connected: true}, 1,
+			http.StatusRequestEntityTooLarge, nil, "Bad case, the body exceeds the default limit"},
+	}
+}
+
+func TestAccessPut(t *testing.T) {
+	for _, testCase := range accessPutTestParams() {
+		ua := createSubscribedAsset(0)
+		ua.mClient = testCase.client
+		if testCase.batchSize > 1 {
+			ua.batch = newBatcher(testCase.batchSize, ua.publishRaw)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "http://localhost/telegrapher/Kitchen/access", testCase.body)
+
+		ua.Serving(w, r, "access")
+
+		if w.Code != testCase.expectedStatus {
+			t.Errorf("In test case: %s: Expected status %d, got: %d", testCase.testName, testCase.expectedStatus, w.Code)
+		}
+		if strings.Join(testCase.client.published, ",") != strings.Join(testCase.expectedPublished, ",") {
+			t.Errorf("In test case: %s: Expected published %v, got: %v",
+				testCase.testName, testCase.expectedPublished, testCase.client.published)
+		}
+		for _, topic := range testCase.client.topics {
+			if topic != ua.Topic {
+				t.Errorf("In test case: %s: Expected topic %s, got: %s", testCase.testName, ua.Topic, topic)
+			}
+		}
+	}
+}
+
+func TestAccessUnsupported(t *testing.T) {
+	ua := createSubscribedAsset(0)
+	ua.mClient = &mockMQTTClient{connected: true}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, "http://localhost/telegrapher/Kitchen/access", nil)
+
+	ua.Serving(w, r, "access")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got: %d", http.StatusNotFound, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ua.Serving(w, r, "nosuchservice")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown service, got: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAccessMapped(t *testing.T) {
+	ua := createSubscribedAsset(0)
+	ua.mClient = &mockMQTTClient{connected: true}
+	fields, err := parseMapping(map[string]string{"$.t": "value", "$.u": "unit"})
+	if err != nil {
+		t.Fatalf("Unexpected mapping error: %v", err)
+	}
+	ua.fields = fields
+
+	// GET exposes the broker's payload as a SignalA_v1a form
+	ua.storeMessage([]byte(`{"t": 21.5, "u": "Celsius"}`), time.Now())
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/telegrapher/Kitchen/access", nil)
+	ua.Serving(w, r, "access")
+	var f forms.SignalA_v1a
+	if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a SignalA_v1a form with status 200, got: %d %s", w.Code, w.Body.String())
+	}
+	if f.Value != 21.5 || f.Unit != "Celsius" {
+		t.Errorf("Expected value 21.5 Celsius, got: %+v", f)
+	}
+
+	// GET reports a payload that does not match the mapping
+	ua.storeMessage([]byte(`{"temp": 21.5}`), time.Now())
+	w = httptest.NewRecorder()
+	ua.Serving(w, r, "access")
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected status %d for an unmatched payload, got: %d", http.StatusBadGateway, w.Code)
+	}
+
+	// PUT publishes the form in the broker's shape
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "http://localhost/telegrapher/Kitchen/access",
+		strings.NewReader(`{"value": 19, "unit": "Celsius", "version": "SignalA_v1.0"}`))
+	ua.Serving(w, r, "access")
+	published := ua.mClient.(*mockMQTTClient).published
+	if w.Code != http.StatusAccepted || len(published) != 1 || published[0] != `{"t":19,"u":"Celsius"}` {
+		t.Errorf("Expected status 202 and payload {\"t\":19,\"u\":\"Celsius\"}, got: %d %v", w.Code, published)
+	}
+
+	// PUT rejects a body that is not a form
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "http://localhost/telegrapher/Kitchen/access", strings.NewReader(`21`))
+	ua.Serving(w, r, "access")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a body that is not a form, got: %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ua := createSubscribedAsset(0)
+	ua.receiveMessage(ua.Topic, []byte(`{"value":21}`), time.Now())
+	ua.receiveMessage(ua.Topic, []byte(`{"value":`), time.Now())
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/telegrapher/Kitchen/status", nil)
+	ua.Serving(w, r, "status")
+	var st assetStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a status with code 200, got: %d %s", w.Code, w.Body.String())
+	}
+	if st.Topic != ua.Topic || st.BadPayloads != 1 || st.LastReceived == nil {
+		t.Errorf("Expected the topic, one bad payload and the time of the last message, got: %+v", st)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "http://localhost/telegrapher/Kitchen/status", nil)
+	ua.Serving(w, r, "status")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got: %d", http.StatusNotFound, w.Code)
+	}
+}
+
+type wildcardGetTestStruct struct {
+	query          string
+	expectedStatus int
+	expectedBody   string
+	testName       string
+}
+
+var wildcardGetTestParams = []wildcardGetTestStruct{
+	{"?topic=sensors/kitchen/temp", http.StatusOK, `{"value":21}`, "Good case, first concrete topic"},
+	{"?topic=sensors/garage/temp", http.StatusOK, `{"value":8}`, "Good case, latest message of a concrete topic"},
+	{"?topic=sensors/attic/temp", http.StatusNotFound, "", "Bad case, concrete topic never seen"},
+	{"", http.StatusOK, `{"value":19}`, "Good case, latest message on any matching topic"},
+}
+
+func TestAccessWildcard(t *testing.T) {
+	ua := createSubscribedAsset(0)
+	ua.Topic = "sensors/+/temp"
+	ua.mClient = &mockMQTTClient{connected: true}
+	ua.receiveMessage("sensors/kitchen/temp", []byte(`{"value":21}`), time.Now())
+	ua.receiveMessage("sensors/garage/temp", []byte(`{"value":7}`), time.Now())
+	ua.receiveMessage("sensors/garage/temp", []byte(`{"value":8}`), time.Now())
+	ua.receiveMessage("sensors/cellar/temp", []byte(`{"value":19}`), time.Now())
+
+	for _, testCase := range wildcardGetTestParams {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/telegrapher/sensors_+/access"+testCase.query, nil)
+
+		ua.Serving(w, r, "access")
+
+		if w.Code != testCase.expectedStatus {
+			t.Errorf("In test case: %s: Expected status %d, got: %d", testCase.testName, testCase.expectedStatus, w.Code)
+		}
+		if testCase.expectedStatus == http.StatusOK && w.Body.String() != testCase.expectedBody {
+			t.Errorf("In test case: %s: Expected body %s, got: %s", testCase.testName, testCase.expectedBody, w.Body.String())
+		}
+	}
+
+	// A wildcard filter cannot be published to
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "http://localhost/telegrapher/sensors_+/access", strings.NewReader(`{"value":22}`))
+	ua.Serving(w, r, "access")
+	if w.Code != http.StatusBadRequest || len(ua.mClient.(*mockMQTTClient).published) != 0 {
+		t.Errorf("Expected status %d and nothing published, got: %d", http.StatusBadRequest, w.Code)
+	}
+}
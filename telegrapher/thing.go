@@ -17,10 +17,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -40,14 +45,33 @@ func init() {
 // -------------------------------------Define the unit asset
 // Traits are Asset-specific configurable parameters and variables
 type Traits struct {
-	Broker   string      `json:"broker"`
-	mClient  mqtt.Client `json:"-"`
-	Pattern  []string    `json:"pattern"`
-	Username string      `json:"username"`
-	Password string      `json:"password"`
-	Topic    string      `json:"-"`      // Topic is the MQTT topic to which the unit asset subscribes or publishes
-	Period   int         `json:"period"` // Period is the time interval for periodic service consumption, e.g., 30 seconds
-	Message  []byte      `json:"-"`
+	Broker      string                      `json:"broker"`
+	mClient     mqttClient                  `json:"-"`
+	Pattern     []string                    `json:"pattern"`
+	Username    string                      `json:"username"`
+	Password    string                      `json:"password"`
+	Topic       string                      `json:"-"`           // Topic is the MQTT topic to which the unit asset subscribes or publishes
+	Period      int                         `json:"period"`      // Period is the time interval for periodic service consumption, e.g., 30 seconds
+	StaleAfter  int                         `json:"staleAfter"`  // StaleAfter is the age in seconds after which the last message is no longer served (0 serves it regardless of age)
+	BatchSize   int                         `json:"batchSize"`   // BatchSize is the number of PUT messages buffered before they are published (1 publishes immediately)
+	FlushEvery  int                         `json:"flushEvery"`  // FlushEvery is the interval in milliseconds after which a partial batch is published
+	LogBridge   bool                        `json:"logBridge"`   // LogBridge forwards the messages received on the topic to the messenger as system messages
+	MaxBodySize int                         `json:"maxBodySize"` // MaxBodySize is the largest PUT body accepted in bytes (0 accepts up to 1 MiB)
+	Mapping     map[string]string           `json:"mapping"`     // Mapping maps payload fields (e.g., "$.t") to SignalA_v1a form fields (e.g., "value"); empty bridges the payload as is
+	AlertDelta  float64                     `json:"alertDelta"`  // AlertDelta is the change of value between consecutive messages of a topic above which the messenger is alerted (0 disables the alert)
+	AlertWindow int                         `json:"alertWindow"` // AlertWindow is the time in milliseconds within which consecutive messages are compared (0 compares them regardless of their interval)
+	AlertLevel  string                      `json:"alertLevel"`  // AlertLevel is the level of the alert, "warn" (default) or "error"
+	Message     []byte                      `json:"-"`
+	received    time.Time                   // time at which the last message was received
+	badPayloads uint64                      // number of received payloads rejected as not matching the declared form
+	receivedN   uint64                      // number of valid messages received on the topic since the start
+	publishedN  uint64                      // number of messages published to the topic since the start
+	lastBad     string                      // why the last rejected payload was rejected
+	topics      map[string]topicMessage     // last message of each concrete topic matching the subscription
+	lastValues  map[string]topicValue       // last numeric value of each concrete topic, for the rate of change alert
+	batch       *batcher                    // buffer of the messages to be published when batching is enabled
+	fields      []fieldMapping              // parsed Mapping
+	logs        chan forms.SystemMessage_v1 // messages waiting to be forwarded to the messenger, nil without the log bridge or the alert
 }
 
 // UnitAsset type models the unit asset (interface) of the system
@@ -59,6 +83,7 @@ type UnitAsset struct {
 	CervicesMap components.Cervices `json:"-"`
 	//
 	Traits
+	mu sync.Mutex // protects the last message shared by the MQTT callback and the HTTP handlers
 }
 
 // GetName returns the name of the Resource.
@@ -107,8 +132,17 @@ func initTemplate() components.UnitAsset {
 		Username: "user",
 		Password: "password",
 		// Topic:    "kitchen/temperature", // Default topics
-		Pattern: []string{"Room"}, // Default patterns e.g. "House", "Room" as in "MyHouse/Kitchen"
-		Period:  -1,               // a negative value indicates that the unit asset subscribe to the topic and does not publish periodically
+		Pattern:     []string{"Room"}, // Default patterns e.g. "House", "Room" as in "MyHouse/Kitchen"
+		Period:      -1,               // a negative value indicates that the unit asset subscribe to the topic and does not publish periodically
+		StaleAfter:  0,                // a zero value serves the last message regardless of its age
+		BatchSize:   1,                // a batch of one publishes each PUT immediately
+		FlushEvery:  1000,
+		MaxBodySize: defaultMaxBodySize,
+		LogBridge:   false,               // true forwards the topic's messages (e.g., "devices/log/#") to the messenger
+		Mapping:     map[string]string{}, // e.g., {"$.t": "value", "$.meta.unit": "unit"} exposes {"t": 21.5} as a SignalA_v1a
+		AlertDelta:  0,                   // e.g., 5 alerts the messenger when the value jumps by more than 5 within the window
+		AlertWindow: 60000,
+		AlertLevel:  "warn",
 	}
 
 	uat := &UnitAsset{
@@ -155,6 +189,13 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 	if len(ua.Pattern) <= 0 {
 		log.Fatal("Error: UnitAsset must have at least one pattern defined in Traits")
 	}
+	ua.fields, err = parseMapping(ua.Mapping)
+	if err != nil {
+		log.Fatalf("Error: invalid mapping for topic %s: %v", topic, err)
+	}
+	if level, ok := parseLevel(ua.AlertLevel); ua.AlertLevel != "" && (!ok || level < forms.LevelWarn) {
+		log.Fatalf("Error: invalid alert level %q for topic %s, expected warn or error", ua.AlertLevel, topic)
+	}
 
 	// Fill Details from pattern and topic
 	metaDetails := strings.Split(asset, "/")
@@ -176,6 +217,9 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 			RegPeriod:   30,
 			Description: "Read the current topic message (GET) or publish to it (PUT)",
 		}
+		if len(ua.fields) > 0 {
+			access.Details["forms"] = []string{"SignalA_v1a"}
+		}
 		if ua.ServicesMap == nil {
 			ua.ServicesMap = make(components.Services)
 		}
@@ -213,11 +257,12 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 
 	// Create and start the MQTT connection
 	log.Println("Connecting to broker:", ua.Traits.Broker)
-	ua.mClient = mqtt.NewClient(opts)
-	if token := ua.mClient.Connect(); token.Wait() && token.Error() != nil {
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		log.Fatalf("Error connecting to MQTT broker: %v", token.Error())
 	}
 
+	ua.mClient = pahoClient{client}
 	log.Println("Connected to MQTT broker")
 
 	// Define the message handler callback if subscribing to a topic
@@ -229,15 +274,33 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 			if messageList == nil {
 				messageList = make(map[string][]byte)
 			}
-			ua.Message = msg.Payload() // Assign message to topic in the map
+			received := time.Now()
+			if ua.receiveMessage(msg.Topic(), msg.Payload(), received) { // Assign message to topic in the map, unless malformed
+				if alert, fire := ua.checkChange(msg.Topic(), msg.Payload(), received); fire {
+					ua.queueLog(alert)
+				}
+			}
+			if ua.LogBridge {
+				ua.queueLog(parseLogMessage(msg.Topic(), msg.Payload()))
+			}
+		}
+		if ua.LogBridge || ua.AlertDelta > 0 {
+			ua.logs = make(chan forms.SystemMessage_v1, logQueueSize)
+			go ua.runLogs()
 		}
 
 		// Subscribe to the topic
-		if token := ua.mClient.Subscribe(topic, 0, messageHandler); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topic, 0, messageHandler); token.Wait() && token.Error() != nil {
 			log.Fatalf("Error subscribing to topic: %v", token.Error())
 		}
 		fmt.Printf("Subscribed to topic: %s\n", topic)
 	}
+	// Buffer the PUT messages if batching is enabled
+	if ua.BatchSize > 1 {
+		ua.batch = newBatcher(ua.BatchSize, ua.publishRaw)
+		go ua.batch.run(ua.Owner.Ctx, time.Duration(ua.FlushEvery)*time.Millisecond)
+	}
+
 	// Periodically publish a message to the topic
 	if ua.Period > 0 {
 		go func(ua *UnitAsset) {
@@ -258,6 +321,13 @@ func newResource(configuredAsset usecases.ConfigurableAsset, sys *components.Sys
 						continue // return fmt.Errorf("problem unpacking measurement: %s", name)
 					}
 					message, err := usecases.Pack(payload, "application/json")
+					if len(ua.fields) > 0 {
+						message, err = fromForm(ua.fields, *payload.(*forms.SignalA_v1a))
+					}
+					if err != nil {
+						log.Printf("Unable to encode the %s reading: %v", service, err)
+						continue
+					}
 					if err := ua.publishRaw(message); err != nil {
 						log.Printf("Periodic publish failed for topic %s: %v", ua.Topic, err)
 					} else {
@@ -292,6 +362,134 @@ func UnmarshalTraits(rawTraits []json.RawMessage) ([]Traits, error) {
 
 //-------------------------------------Unit asset's resource functions
 
+// mqttClient is the part of the MQTT client used by the unit asset's services, which tests can mock
+type mqttClient interface {
+	IsConnected() bool
+	Publish(topic string, qos byte, payload []byte) error
+	Disconnect(quiesce uint)
+}
+
+// pahoClient adapts the Paho MQTT client to the mqttClient interface
+type pahoClient struct {
+	mqtt.Client
+}
+
+// Publish sends the payload to the topic and waits for the broker to take it
+func (c pahoClient) Publish(topic string, qos byte, payload []byte) error {
+	token := c.Client.Publish(topic, qos, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// topicMessage is the last message received on a concrete topic
+type topicMessage struct {
+	payload  []byte
+	received time.Time
+}
+
+// storeMessage keeps the last message received on the topic along with its time of reception
+func (ua *UnitAsset) storeMessage(payload []byte, received time.Time) {
+	ua.storeTopicMessage(ua.Topic, payload, received)
+}
+
+// storeTopicMessage keeps the last message received on the subscription, and on the concrete topic it arrived on
+func (ua *UnitAsset) storeTopicMessage(topic string, payload []byte, received time.Time) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	ua.Message = payload
+	ua.received = received
+	ua.receivedN++
+	if ua.topics == nil {
+		ua.topics = make(map[string]topicMessage)
+	}
+	ua.topics[topic] = topicMessage{payload: payload, received: received}
+}
+
+// lastTopicMessage returns the last message received on the concrete topic and its age,
+// or false if no message arrived on it
+func (ua *UnitAsset) lastTopicMessage(topic string, now time.Time) ([]byte, time.Duration, bool) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	tm, found := ua.topics[topic]
+	return tm.payload, now.Sub(tm.received), found
+}
+
+// isWildcard reports whether the MQTT topic is a filter with single (+) or multi-level (#) wildcards
+func isWildcard(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// validatePayload checks that a received payload matches the form declared by the access service:
+// the configured mapping if any, otherwise JSON. Log topics are not checked since they may carry plain text.
+func (ua *UnitAsset) validatePayload(payload []byte) error {
+	if len(ua.fields) > 0 {
+		_, err := toForm(ua.fields, payload, time.Now())
+		return err
+	}
+	if !ua.LogBridge && !json.Valid(payload) {
+		return fmt.Errorf("payload is not valid JSON")
+	}
+	return nil
+}
+
+// receiveMessage stores a payload received on the concrete topic if it is valid.
+// A malformed payload is counted and logged, and the last good message is kept.
+func (ua *UnitAsset) receiveMessage(topic string, payload []byte, received time.Time) bool {
+	if err := ua.validatePayload(payload); err != nil {
+		ua.mu.Lock()
+		ua.badPayloads++
+		ua.lastBad = err.Error()
+		ua.mu.Unlock()
+		log.Printf("Warning: ignoring a malformed payload on topic %s: %v", topic, err)
+		return false
+	}
+	ua.storeTopicMessage(topic, payload, received)
+	return true
+}
+
+// assetStatus reports the state of the topic's bridge
+type assetStatus struct {
+	Topic        string     `json:"topic"`
+	LastReceived *time.Time `json:"lastReceived,omitempty"`
+	BadPayloads  uint64     `json:"badPayloads"`
+	LastBad      string     `json:"lastBadPayload,omitempty"`
+}
+
+// status returns the state of the topic's bridge
+func (ua *UnitAsset) status() assetStatus {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	st := assetStatus{Topic: ua.Topic, BadPayloads: ua.badPayloads, LastBad: ua.lastBad}
+	if !ua.received.IsZero() {
+		received := ua.received
+		st.LastReceived = &received
+	}
+	return st
+}
+
+// lastMessage returns the last message received on the topic and its age
+func (ua *UnitAsset) lastMessage(now time.Time) ([]byte, time.Duration) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return ua.Message, now.Sub(ua.received)
+}
+
+// defaultMaxBodySize is the largest request body accepted when the traits do not set a limit (1 MiB)
+const defaultMaxBodySize = 1 << 20
+
+// maxBodySize returns the largest request body accepted, in bytes
+func (ua *UnitAsset) maxBodySize() int64 {
+	if ua.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return int64(ua.MaxBodySize)
+}
+
+// isStale reports whether a message of the given age exceeds the configured staleness threshold
+func (ua *UnitAsset) isStale(age time.Duration) bool {
+	return ua.StaleAfter > 0 && age > time.Duration(ua.StaleAfter)*time.Second
+}
+
 // publishToTopic publishes a payload to the MQTT topic of the unit asset.
 func (ua *UnitAsset) publishToTopic(payload map[string]interface{}, contentType string) error {
 	if ua.mClient == nil {
@@ -313,25 +511,400 @@ func (ua *UnitAsset) publishToTopic(payload map[string]interface{}, contentType
 	}
 	log.Println(contentType)
 
-	token := ua.mClient.Publish(ua.Topic, 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		return fmt.Errorf("publish error: %w", token.Error())
-	}
-	return nil
+	return ua.publish(data)
 }
 
 // publishRaw publishes raw data to the MQTT topic of the unit asset.
 func (ua *UnitAsset) publishRaw(data []byte) error {
-	// Just publish and return immediately
-	token := ua.mClient.Publish(ua.Topic, 0, false, data)
+	if ua.mClient == nil {
+		return fmt.Errorf("MQTT client not initialized")
+	}
+	return ua.publish(data)
+}
+
+// publish sends the encoded data to the MQTT topic, counting the messages the broker accepted
+func (ua *UnitAsset) publish(data []byte) error {
+	if err := ua.mClient.Publish(ua.Topic, 0, data); err != nil {
+		return fmt.Errorf("publish error: %w", err)
+	}
+	ua.mu.Lock()
+	ua.publishedN++
+	ua.mu.Unlock()
+	return nil
+}
+
+// shutdownSummary is the final statistics line of the topic's bridge, as key=value pairs that log aggregators can parse
+func (ua *UnitAsset) shutdownSummary() string {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return fmt.Sprintf("shutdown summary: topic=%s published=%d received=%d badPayloads=%d",
+		ua.Topic, ua.publishedN, ua.receivedN, ua.badPayloads)
+}
+
+// defaultFlushEvery is the flush interval of a batch when the traits do not set one
+const defaultFlushEvery = time.Second
+
+// batcher accumulates messages and publishes them in a rapid sequence once the batch is full or the flush interval elapses
+type batcher struct {
+	mu      sync.Mutex // protects the pending messages
+	flushMu sync.Mutex // serializes the flushes so that the messages keep their order
+	size    int
+	pending [][]byte
+	publish func([]byte) error
+}
+
+// newBatcher returns a batcher publishing with the given function once size messages are pending
+func newBatcher(size int, publish func([]byte) error) *batcher {
+	return &batcher{size: size, publish: publish}
+}
+
+// add buffers the message and publishes the batch if it is full
+func (b *batcher) add(msg []byte) {
+	b.mu.Lock()
+	b.pending = append(b.pending, msg)
+	full := len(b.pending) >= b.size
+	b.mu.Unlock()
+	if full {
+		b.flush()
+	}
+}
+
+// flush publishes the pending messages in the order they were received
+func (b *batcher) flush() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	for _, msg := range pending {
+		if err := b.publish(msg); err != nil {
+			log.Printf("Batched publish failed: %v", err)
+		}
+	}
+}
+
+// run flushes the partial batch at every interval until the context is cancelled, flushing what is left before returning
+func (b *batcher) run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultFlushEvery
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush()
+		case <-ctx.Done():
+			b.flush()
+			return
+		}
+	}
+}
+
+// messengerName is the name of the core system that collects the system messages
+const messengerName = "messenger"
+
+// logPayload is the JSON a device may publish on a log topic, all fields being optional
+type logPayload struct {
+	Level  string `json:"level"`
+	Body   string `json:"body"`
+	System string `json:"system"`
+}
+
+// parseLogMessage turns an MQTT message into a system message.
+// The level is taken from the payload's "level" field or else from the last topic segment (e.g., "devices/pump/warn"), defaulting to info.
+// A payload that is not JSON becomes the body of the message, and the topic names the system unless the payload does.
+func parseLogMessage(topic string, payload []byte) forms.SystemMessage_v1 {
+	var msg forms.SystemMessage_v1
+	msg.NewForm()
+	msg.Level = forms.LevelInfo
+	msg.System = topic
+	segments := strings.Split(topic, "/")
+	if level, ok := parseLevel(segments[len(segments)-1]); ok {
+		msg.Level = level
+		msg.System = strings.Join(segments[:len(segments)-1], "/")
+	}
 
-	go func() {
-		token.Wait()
-		if err := token.Error(); err != nil {
-			log.Printf("Async publish error: %v", err)
+	var lp logPayload
+	if err := json.Unmarshal(payload, &lp); err != nil {
+		msg.Body = string(payload)
+		return msg
+	}
+	if level, ok := parseLevel(lp.Level); ok {
+		msg.Level = level
+	}
+	if lp.System != "" {
+		msg.System = lp.System
+	}
+	msg.Body = lp.Body
+	return msg
+}
+
+// parseLevel maps a level name to the message level
+func parseLevel(name string) (forms.MessageLevel, bool) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return forms.LevelDebug, true
+	case "info":
+		return forms.LevelInfo, true
+	case "warn", "warning":
+		return forms.LevelWarn, true
+	case "error":
+		return forms.LevelError, true
+	default:
+		return forms.LevelInfo, false
+	}
+}
+
+// logQueueSize is how many messages can wait for the messenger before new ones get dropped
+const logQueueSize int = 100
+
+// logClient sends the messages to the messenger, the timeout keeping an unresponsive messenger from stalling the queue
+var logClient = &http.Client{Timeout: 10 * time.Second}
+
+// queueLog hands a message over to the forwarder. It never blocks the MQTT callback: the message is dropped if the queue is full.
+func (ua *UnitAsset) queueLog(msg forms.SystemMessage_v1) {
+	select {
+	case ua.logs <- msg:
+	default:
+		log.Printf("Dropped the message from %s for the messenger, the queue is full", msg.System)
+	}
+}
+
+// runLogs forwards the queued messages to the messenger one at a time until the system shuts down
+func (ua *UnitAsset) runLogs() {
+	for {
+		select {
+		case msg := <-ua.logs:
+			if err := ua.forwardLog(msg); err != nil {
+				log.Printf("Unable to forward the message from %s to the messenger: %v", msg.System, err)
+			}
+		case <-ua.Owner.Ctx.Done():
+			return
 		}
-	}()
+	}
+}
 
+// forwardLog sends the system message to the messenger's message service
+func (ua *UnitAsset) forwardLog(msg forms.SystemMessage_v1) error {
+	messengerURL, err := components.GetRunningCoreSystemURL(ua.Owner, messengerName)
+	if err != nil {
+		return err
+	}
+	body, err := usecases.Pack(&msg, "application/json")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ua.Owner.Ctx, http.MethodPost, messengerURL+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := logClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad response from the messenger: %s", resp.Status)
+	}
 	return nil
 }
+
+// --------------------------------------------- rate of change alert
+
+// topicValue is the last numeric value received on a concrete topic
+type topicValue struct {
+	value    float64
+	received time.Time
+}
+
+// numericValue returns the number carried by a payload: the mapped value if a mapping is configured,
+// otherwise a bare JSON number or the "value" field of a JSON object (e.g., a SignalA_v1a form)
+func (ua *UnitAsset) numericValue(payload []byte, received time.Time) (float64, bool) {
+	if len(ua.fields) > 0 {
+		f, err := toForm(ua.fields, payload, received)
+		return f.Value, err == nil
+	}
+	var doc any
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return 0, false
+	}
+	if obj, ok := doc.(map[string]any); ok {
+		doc = obj["value"]
+	}
+	value, ok := doc.(float64)
+	return value, ok
+}
+
+// alertLevel returns the level of the rate of change alerts
+func (ua *UnitAsset) alertLevel() forms.MessageLevel {
+	if level, ok := parseLevel(ua.AlertLevel); ok && level == forms.LevelError {
+		return forms.LevelError
+	}
+	return forms.LevelWarn
+}
+
+// checkChange keeps the numeric value of the payload received on the concrete topic and returns an alert for the messenger
+// if it differs from the previous value by more than AlertDelta within AlertWindow. Payloads without a number are ignored.
+func (ua *UnitAsset) checkChange(topic string, payload []byte, received time.Time) (forms.SystemMessage_v1, bool) {
+	var alert forms.SystemMessage_v1
+	if ua.AlertDelta <= 0 {
+		return alert, false
+	}
+	value, ok := ua.numericValue(payload, received)
+	if !ok {
+		return alert, false
+	}
+	ua.mu.Lock()
+	if ua.lastValues == nil {
+		ua.lastValues = make(map[string]topicValue)
+	}
+	last, seen := ua.lastValues[topic]
+	ua.lastValues[topic] = topicValue{value: value, received: received}
+	ua.mu.Unlock()
+
+	if !seen {
+		return alert, false
+	}
+	interval := received.Sub(last.received)
+	if ua.AlertWindow > 0 && interval > time.Duration(ua.AlertWindow)*time.Millisecond {
+		return alert, false
+	}
+	change := value - last.value
+	if change <= ua.AlertDelta && -change <= ua.AlertDelta {
+		return alert, false
+	}
+	alert.NewForm()
+	alert.Level = ua.alertLevel()
+	alert.System = topic
+	alert.Body = fmt.Sprintf("value changed from %g to %g in %v, exceeding the alert threshold of %g", last.value, value, interval, ua.AlertDelta)
+	return alert, true
+}
+
+// --------------------------------------------- payload mapping
+
+// fieldMapping ties a field of the MQTT payload, given as a path of keys, to a field of the SignalA_v1a form
+type fieldMapping struct {
+	path  []string
+	field string
+}
+
+// parseMapping validates the configured mapping and returns it sorted by form field
+func parseMapping(mapping map[string]string) ([]fieldMapping, error) {
+	if len(mapping) == 0 {
+		return nil, nil
+	}
+	var fields []fieldMapping
+	mapped := make(map[string]string)
+	for source, field := range mapping {
+		switch field {
+		case "value", "unit", "timestamp":
+		default:
+			return nil, fmt.Errorf("source %q maps to %q, which is not a SignalA_v1a field (value, unit or timestamp)", source, field)
+		}
+		if other, ok := mapped[field]; ok {
+			return nil, fmt.Errorf("form field %q is mapped from both %q and %q", field, other, source)
+		}
+		path := strings.Split(strings.TrimPrefix(source, "$."), ".")
+		for _, key := range path {
+			if key == "" || key == "$" {
+				return nil, fmt.Errorf("source %q is not a valid path (e.g., \"$.t\" or \"$.meta.unit\")", source)
+			}
+		}
+		mapped[field] = source
+		fields = append(fields, fieldMapping{path: path, field: field})
+	}
+	if _, ok := mapped["value"]; !ok {
+		return nil, fmt.Errorf("no source is mapped to the form field \"value\"")
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].field < fields[j].field })
+	return fields, nil
+}
+
+// toForm builds a SignalA_v1a form from an MQTT payload, using the reception time when the timestamp is not mapped
+func toForm(fields []fieldMapping, payload []byte, received time.Time) (forms.SignalA_v1a, error) {
+	var f forms.SignalA_v1a
+	f.NewForm()
+	f.Timestamp = received
+	var doc any
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return f, fmt.Errorf("payload is not JSON: %w", err)
+	}
+	for _, m := range fields {
+		raw, err := lookup(doc, m.path)
+		if err != nil {
+			return f, err
+		}
+		switch m.field {
+		case "value":
+			value, ok := raw.(float64)
+			if !ok {
+				return f, fmt.Errorf("%s is not a number", strings.Join(m.path, "."))
+			}
+			f.Value = value
+		case "unit":
+			unit, ok := raw.(string)
+			if !ok {
+				return f, fmt.Errorf("%s is not a string", strings.Join(m.path, "."))
+			}
+			f.Unit = unit
+		case "timestamp":
+			stamp, ok := raw.(string)
+			if !ok {
+				return f, fmt.Errorf("%s is not a string", strings.Join(m.path, "."))
+			}
+			t, err := time.Parse(time.RFC3339, stamp)
+			if err != nil {
+				return f, fmt.Errorf("%s is not an RFC 3339 timestamp: %w", strings.Join(m.path, "."), err)
+			}
+			f.Timestamp = t
+		}
+	}
+	return f, nil
+}
+
+// fromForm builds the MQTT payload of a SignalA_v1a form, the reverse of toForm
+func fromForm(fields []fieldMapping, f forms.SignalA_v1a) ([]byte, error) {
+	doc := make(map[string]any)
+	for _, m := range fields {
+		var value any
+		switch m.field {
+		case "value":
+			value = f.Value
+		case "unit":
+			value = f.Unit
+		case "timestamp":
+			value = f.Timestamp.Format(time.RFC3339Nano)
+		}
+		node := doc
+		for _, key := range m.path[:len(m.path)-1] {
+			child, ok := node[key].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+				node[key] = child
+			}
+			node = child
+		}
+		node[m.path[len(m.path)-1]] = value
+	}
+	return json.Marshal(doc)
+}
+
+// lookup follows the path of keys through the decoded JSON document
+func lookup(doc any, path []string) (any, error) {
+	for i, key := range path {
+		node, ok := doc.(map[string]any)
+		if !ok && i == 0 {
+			return nil, fmt.Errorf("payload is not a JSON object")
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s is not an object", strings.Join(path[:i], "."))
+		}
+		if doc, ok = node[key]; !ok {
+			return nil, fmt.Errorf("payload has no field %s", strings.Join(path[:i+1], "."))
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdoque/mbaigo/components"
+	"github.com/sdoque/mbaigo/forms"
+)
+
+// ---------------------------------------------- //
+// Help functions and structs to test the batcher
+// ---------------------------------------------- //
+
+// publishRecorder keeps the messages published by a batcher
+type publishRecorder struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (p *publishRecorder) publish(msg []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, string(msg))
+	return nil
+}
+
+func (p *publishRecorder) published() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.messages...)
+}
+
+type batcherTestStruct struct {
+	size          int
+	interval      time.Duration
+	messages      int
+	gap           time.Duration
+	wait          time.Duration
+	expectedFirst int
+	testName      string
+}
+
+var batcherTestParams = []batcherTestStruct{
+	{3, time.Hour, 7, 0, 0, 6, "Good case, a fast burst publishes the full batches only"},
+	{10, 20 * time.Millisecond, 2, 0, 100 * time.Millisecond, 2, "Good case, a slow trickle is flushed by the interval"},
+	{1, time.Hour, 4, time.Millisecond, 0, 4, "Good case, a batch of one publishes immediately"},
+}
+
+func TestBatcher(t *testing.T) {
+	for _, testCase := range batcherTestParams {
+		ctx, cancel := context.WithCancel(context.Background())
+		rec := &publishRecorder{}
+		b := newBatcher(testCase.size, rec.publish)
+		done := make(chan struct{})
+		go func() {
+			b.run(ctx, testCase.interval)
+			close(done)
+		}()
+
+		for i := 0; i < testCase.messages; i++ {
+			b.add([]byte(fmt.Sprintf("msg%d", i)))
+			time.Sleep(testCase.gap)
+		}
+		time.Sleep(testCase.wait)
+
+		if got := len(rec.published()); got != testCase.expectedFirst {
+			t.Errorf("In test case: %s: Expected %d published messages before shutdown, got: %d",
+				testCase.testName, testCase.expectedFirst, got)
+		}
+
+		// the remaining messages are flushed when the context is cancelled
+		cancel()
+		<-done
+		published := rec.published()
+		if len(published) != testCase.messages {
+			t.Errorf("In test case: %s: Expected %d published messages after shutdown, got: %d",
+				testCase.testName, testCase.messages, len(published))
+		}
+		for i, msg := range published {
+			if msg != fmt.Sprintf("msg%d", i) {
+				t.Errorf("In test case: %s: Expected msg%d at position %d, got: %s", testCase.testName, i, i, msg)
+			}
+		}
+	}
+}
+
+// --------------------------------------------------------------- //
+// Help functions and structs to test the bridge to the messenger
+// --------------------------------------------------------------- //
+
+type parseLogMessageTestStruct struct {
+	topic          string
+	payload        string
+	expectedLevel  forms.MessageLevel
+	expectedSystem string
+	expectedBody   string
+	testName       string
+}
+
+var parseLogMessageTestParams = []parseLogMessageTestStruct{
+	{"devices/pump/warn", "pressure low", forms.LevelWarn, "devices/pump", "pressure low",
+		"Good case, level from the topic and plain text body"},
+	{"devices/pump", `{"level":"error","body":"motor stalled"}`, forms.LevelError, "devices/pump", "motor stalled",
+		"Good case, level from the JSON payload"},
+	{"devices/pump/debug", `{"level":"ERROR","body":"overheat","system":"pump7"}`, forms.LevelError, "pump7", "overheat",
+		"Good case, JSON payload overrides the topic"},
+	{"devices/pump", "started", forms.LevelInfo, "devices/pump", "started",
+		"Good case, info level by default"},
+	{"devices/pump", `{"level":"loud","body":"hum"}`, forms.LevelInfo, "devices/pump", "hum",
+		"Bad case, unknown level falls back to info"},
+}
+
+func TestParseLogMessage(t *testing.T) {
+	for _, testCase := range parseLogMessageTestParams {
+		msg := parseLogMessage(testCase.topic, []byte(testCase.payload))
+		if msg.Level != testCase.expectedLevel || msg.System != testCase.expectedSystem ||
+			msg.Body != testCase.expectedBody || msg.Version != "SystemMessage_v1" {
+			t.Errorf("In test case: %s: Expected level %d, system %s and body %s, got: %+v",
+				testCase.testName, testCase.expectedLevel, testCase.expectedSystem, testCase.expectedBody, msg)
+		}
+	}
+}
+
+// transMessenger mocks the messenger, keeping the forwarded system messages
+type transMessenger struct {
+	t          *testing.T
+	coreStatus int
+	msgStatus  int
+	received   []forms.SystemMessage_v1
+	mu         sync.Mutex // protects received from the forwarder of the queue
+}
+
+func newTransMessenger(t *testing.T) *transMessenger {
+	mock := &transMessenger{t: t}
+	http.DefaultClient.Transport = mock
+	logClient.Transport = mock
+	return mock
+}
+
+// forwarded returns the number of system messages received so far
+func (mock *transMessenger) forwarded() int {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	return len(mock.received)
+}
+
+func (mock *transMessenger) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	switch req.URL.Path {
+	case "/status":
+		rec.WriteHeader(mock.coreStatus)
+		if mock.coreStatus == http.StatusOK {
+			fmt.Fprint(rec.Body, components.ServiceRegistrarLeader)
+		}
+	case "/message":
+		body, _ := io.ReadAll(req.Body)
+		var msg forms.SystemMessage_v1
+		if err := json.Unmarshal(body, &msg); err != nil {
+			mock.t.Errorf("invalid system message form: %s", string(body))
+		}
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			mock.t.Errorf("expected content type application/json, got: %s", ct)
+		}
+		mock.mu.Lock()
+		mock.received = append(mock.received, msg)
+		mock.mu.Unlock()
+		rec.WriteHeader(mock.msgStatus)
+	default:
+		mock.t.Errorf("unexpected path: %s", req.URL.Path)
+		rec.WriteHeader(http.StatusInternalServerError)
+	}
+	return rec.Result(), nil
+}
+
+func TestForwardLog(t *testing.T) {
+	table := []struct {
+		coreStatus int
+		msgStatus  int
+		expectErr  bool
+		expectSent bool
+	}{
+		// Error from GetRunningCoreSystemURL
+		{http.StatusInternalServerError, 0, true, false},
+		// Error from the messenger
+		{http.StatusOK, http.StatusBadRequest, true, true},
+		// All ok
+		{http.StatusOK, http.StatusOK, false, true},
+	}
+
+	sys := components.NewSystem("test sys", context.Background())
+	sys.CoreS = []*components.CoreSystem{
+		{Name: "messenger", Url: "http://fake"},
+	}
+	ua := &UnitAsset{Owner: &sys}
+	mock := newTransMessenger(t)
+	defer func() { http.DefaultClient.Transport, logClient.Transport = nil, nil }()
+
+	for _, test := range table {
+		mock.coreStatus = test.coreStatus
+		mock.msgStatus = test.msgStatus
+		mock.received = nil
+		err := ua.forwardLog(parseLogMessage("devices/pump/warn", []byte("pressure low")))
+
+		if got, want := err != nil, test.expectErr; got != want {
+			t.Errorf("expected error %v, got: %v", want, err)
+		}
+		if got, want := len(mock.received) == 1, test.expectSent; got != want {
+			t.Errorf("expected forwarded form %v, got %d forms", want, len(mock.received))
+			continue
+		}
+		if test.expectSent {
+			msg := mock.received[0]
+			if msg.Level != forms.LevelWarn || msg.System != "devices/pump" || msg.Body != "pressure low" {
+				t.Errorf("unexpected forwarded form: %+v", msg)
+			}
+		}
+	}
+}
+
+func TestQueueLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys := components.NewSystem("test sys", ctx)
+	sys.CoreS = []*components.CoreSystem{
+		{Name: "messenger", Url: "http://fake"},
+	}
+	ua := &UnitAsset{Owner: &sys, Traits: Traits{logs: make(chan forms.SystemMessage_v1, 2)}}
+	mock := newTransMessenger(t)
+	mock.coreStatus, mock.msgStatus = http.StatusOK, http.StatusOK
+	defer func() { http.DefaultClient.Transport, logClient.Transport = nil, nil }()
+
+	// A full queue drops the new messages instead of blocking the MQTT callback
+	for range 3 {
+		ua.queueLog(parseLogMessage("devices/pump/warn", []byte("pressure low")))
+	}
+	if len(ua.logs) != 2 {
+		t.Fatalf("Expected 2 queued messages, got: %d", len(ua.logs))
+	}
+
+	// The single forwarder empties the queue
+	go ua.runLogs()
+	deadline := time.Now().Add(time.Second)
+	for mock.forwarded() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := mock.forwarded(); got != 2 {
+		t.Errorf("Expected 2 forwarded messages, got: %d", got)
+	}
+}
+
+// ------------------------------------------------ //
+// Help functions and structs to test the mapping
+// ------------------------------------------------ //
+
+type parseMappingTestStruct struct {
+	mapping     map[string]string
+	expectedErr bool
+	testName    string
+}
+
+var parseMappingTestParams = []parseMappingTestStruct{
+	{nil, false, "Good case, no mapping"},
+	{map[string]string{"$.t": "value"}, false, "Good case, value only"},
+	{map[string]string{"reading.v": "value", "reading.u": "unit", "at": "timestamp"}, false, "Good case, nested paths without prefix"},
+	{map[string]string{"$.u": "unit"}, true, "Bad case, value is not mapped"},
+	{map[string]string{"$.t": "value", "$.q": "quality"}, true, "Bad case, unknown form field"},
+	{map[string]string{"$.t": "value", "$.v": "value"}, true, "Bad case, form field mapped twice"},
+	{map[string]string{"$.meta..t": "value"}, true, "Bad case, empty key in the path"},
+	{map[string]string{"$": "value"}, true, "Bad case, path without key"},
+}
+
+func TestParseMapping(t *testing.T) {
+	for _, testCase := range parseMappingTestParams {
+		_, err := parseMapping(testCase.mapping)
+		if (err != nil) != testCase.expectedErr {
+			t.Errorf("In test case: %s: Expected error %v, got: %v", testCase.testName, testCase.expectedErr, err)
+		}
+	}
+}
+
+type toFormTestStruct struct {
+	mapping       map[string]string
+	payload       string
+	expectedValue float64
+	expectedUnit  string
+	expectedTime  time.Time
+	expectedErr   bool
+	testName      string
+}
+
+var mappingReceived = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+var toFormTestParams = []toFormTestStruct{
+	{map[string]string{"$.t": "value"}, `{"t": 21.5}`, 21.5, "", mappingReceived, false,
+		"Good case, flat payload stamped with the reception time"},
+	{map[string]string{"$.data.temp": "value", "$.data.unit": "unit", "$.at": "timestamp"},
+		`{"data": {"temp": -3, "unit": "Celsius"}, "at": "2025-02-28T08:30:00Z"}`,
+		-3, "Celsius", time.Date(2025, 2, 28, 8, 30, 0, 0, time.UTC), false,
+		"Good case, nested payload with its own timestamp"},
+	{map[string]string{"$.t": "value"}, `{"temp": 21.5}`, 0, "", mappingReceived, true, "Bad case, missing field"},
+	{map[string]string{"$.t": "value"}, `{"t": "warm"}`, 0, "", mappingReceived, true, "Bad case, value is not a number"},
+	{map[string]string{"$.data.t": "value"}, `{"data": 4}`, 0, "", mappingReceived, true, "Bad case, path through a number"},
+	{map[string]string{"$.t": "value"}, `21.5`, 0, "", mappingReceived, true, "Bad case, payload is not an object"},
+	{map[string]string{"$.t": "value"}, `t=21.5`, 0, "", mappingReceived, true, "Bad case, payload is not JSON"},
+}
+
+func TestToForm(t *testing.T) {
+	for _, testCase := range toFormTestParams {
+		fields, err := parseMapping(testCase.mapping)
+		if err != nil {
+			t.Fatalf("In test case: %s: Unexpected mapping error: %v", testCase.testName, err)
+		}
+		f, err := toForm(fields, []byte(testCase.payload), mappingReceived)
+		if (err != nil) != testCase.expectedErr {
+			t.Errorf("In test case: %s: Expected error %v, got: %v", testCase.testName, testCase.expectedErr, err)
+			continue
+		}
+		if testCase.expectedErr {
+			continue
+		}
+		if f.Value != testCase.expectedValue || f.Unit != testCase.expectedUnit ||
+			!f.Timestamp.Equal(testCase.expectedTime) || f.Version != "SignalA_v1.0" {
+			t.Errorf("In test case: %s: Expected value %v, unit %q and time %v, got: %+v",
+				testCase.testName, testCase.expectedValue, testCase.expectedUnit, testCase.expectedTime, f)
+		}
+	}
+}
+
+type fromFormTestStruct struct {
+	mapping         map[string]string
+	expectedPayload string
+	testName        string
+}
+
+var fromFormTestParams = []fromFormTestStruct{
+	{map[string]string{"$.t": "value"}, `{"t":21.5}`, "Good case, flat payload"},
+	{map[string]string{"$.data.temp": "value", "$.data.unit": "unit", "$.at": "timestamp"},
+		`{"at":"2025-03-01T12:00:00Z","data":{"temp":21.5,"unit":"Celsius"}}`, "Good case, nested payload"},
+}
+
+func TestFromForm(t *testing.T) {
+	f := forms.SignalA_v1a{Value: 21.5, Unit: "Celsius", Timestamp: mappingReceived}
+	for _, testCase := range fromFormTestParams {
+		fields, err := parseMapping(testCase.mapping)
+		if err != nil {
+			t.Fatalf("In test case: %s: Unexpected mapping error: %v", testCase.testName, err)
+		}
+		payload, err := fromForm(fields, f)
+		if err != nil {
+			t.Errorf("In test case: %s: Unexpected error: %v", testCase.testName, err)
+		}
+		if string(payload) != testCase.expectedPayload {
+			t.Errorf("In test case: %s: Expected payload %s, got: %s", testCase.testName, testCase.expectedPayload, payload)
+		}
+		// the payload maps back to the same form
+		back, err := toForm(fields, payload, time.Time{})
+		if err != nil || back.Value != f.Value {
+			t.Errorf("In test case: %s: Expected the payload to map back to value %v, got: %+v (%v)",
+				testCase.testName, f.Value, back, err)
+		}
+	}
+}
+
+type receiveMessageTestStruct struct {
+	mapping          map[string]string
+	payloads         []string
+	expectedMessage  string
+	expectedBadCount uint64
+	testName         string
+}
+
+var receiveMessageTestParams = []receiveMessageTestStruct{
+	{nil, []string{`{"value":21}`, `{"value":`, `garbage`}, `{"value":21}`, 2,
+		"Good case, malformed JSON keeps the last good message"},
+	{nil, []string{`{"value":21}`, `{"value":22}`}, `{"value":22}`, 0,
+		"Good case, valid payloads replace each other"},
+	{map[string]string{"$.t": "value"}, []string{`{"t":21.5}`, `{"temp":21.5}`, `{"t":"warm"}`}, `{"t":21.5}`, 2,
+		"Good case, payloads not matching the mapping keep the last good message"},
+	{nil, []string{`not json`}, "", 1, "Bad case, no good message received yet"},
+}
+
+func TestReceiveMessage(t *testing.T) {
+	for _, testCase := range receiveMessageTestParams {
+		ua := createSubscribedAsset(0)
+		fields, err := parseMapping(testCase.mapping)
+		if err != nil {
+			t.Fatalf("In test case: %s: Unexpected mapping error: %v", testCase.testName, err)
+		}
+		ua.fields = fields
+		for _, payload := range testCase.payloads {
+			ua.receiveMessage(ua.Topic, []byte(payload), time.Now())
+		}
+
+		msg, _ := ua.lastMessage(time.Now())
+		if string(msg) != testCase.expectedMessage {
+			t.Errorf("In test case: %s: Expected message %s, got: %s", testCase.testName, testCase.expectedMessage, msg)
+		}
+		st := ua.status()
+		if st.BadPayloads != testCase.expectedBadCount {
+			t.Errorf("In test case: %s: Expected %d bad payloads, got: %d", testCase.testName, testCase.expectedBadCount, st.BadPayloads)
+		}
+		if (st.LastBad != "") != (testCase.expectedBadCount > 0) {
+			t.Errorf("In test case: %s: Expected the reason only after a bad payload, got: %q", testCase.testName, st.LastBad)
+		}
+	}
+}
+
+func TestReceiveMessageLogBridge(t *testing.T) {
+	ua := createSubscribedAsset(0)
+	ua.LogBridge = true
+	if !ua.receiveMessage("devices/pump/warn", []byte("pump stalled"), time.Now()) {
+		t.Errorf("Expected a plain text log message to be kept")
+	}
+}
+
+// ------------------------------------------------------ //
+// Help functions and structs to test the rate of change alert
+// ------------------------------------------------------ //
+
+type checkChangeTestStruct struct {
+	delta          float64
+	window         int
+	level          string
+	mapping        map[string]string
+	payloads       []string
+	gap            time.Duration
+	expectedAlerts int
+	expectedLevel  forms.MessageLevel
+	testName       string
+}
+
+var checkChangeTestParams = []checkChangeTestStruct{
+	{5, 1000, "", nil, []string{`{"value":20}`, `{"value":21}`, `{"value":30}`, `{"value":22}`}, 100 * time.Millisecond, 2, forms.LevelWarn,
+		"Good case, a spike and its fall are alerted"},
+	{5, 1000, "error", nil, []string{`20`, `27`}, 100 * time.Millisecond, 1, forms.LevelError,
+		"Good case, bare numbers are alerted at the configured level"},
+	{5, 0, "", map[string]string{"$.t": "value"}, []string{`{"t":20}`, `{"t":40}`}, time.Hour, 1, forms.LevelWarn,
+		"Good case, mapped values are compared regardless of their interval without a window"},
+	{5, 1000, "", nil, []string{`{"value":20}`, `{"value":30}`}, 2 * time.Second, 0, 0,
+		"Good case, a change slower than the window is not alerted"},
+	{5, 1000, "", nil, []string{`{"value":20}`, `{"value":24}`, `{"value":28}`}, 100 * time.Millisecond, 0, 0,
+		"Good case, gradual changes are not alerted"},
+	{5, 1000, "", nil, []string{`{"value":20}`, `"warm"`, `{"value":30}`}, 100 * time.Millisecond, 1, forms.LevelWarn,
+		"Good case, payloads without a number are skipped"},
+	{0, 1000, "", nil, []string{`{"value":20}`, `{"value":90}`}, 100 * time.Millisecond, 0, 0,
+		"Good case, no threshold disables the alert"},
+}
+
+func TestCheckChange(t *testing.T) {
+	for _, testCase := range checkChangeTestParams {
+		ua := createSubscribedAsset(0)
+		ua.AlertDelta = testCase.delta
+		ua.AlertWindow = testCase.window
+		ua.AlertLevel = testCase.level
+		fields, err := parseMapping(testCase.mapping)
+		if err != nil {
+			t.Fatalf("In test case: %s: Unexpected mapping error: %v", testCase.testName, err)
+		}
+		ua.fields = fields
+
+		var alerts []forms.SystemMessage_v1
+		received := time.Now()
+		for _, payload := range testCase.payloads {
+			if alert, fire := ua.checkChange(ua.Topic, []byte(payload), received); fire {
+				alerts = append(alerts, alert)
+			}
+			received = received.Add(testCase.gap)
+		}
+
+		if len(alerts) != testCase.expectedAlerts {
+			t.Errorf("In test case: %s: Expected %d alerts, got: %d", testCase.testName, testCase.expectedAlerts, len(alerts))
+		}
+		for _, alert := range alerts {
+			if alert.Level != testCase.expectedLevel || alert.System != ua.Topic || alert.Body == "" {
+				t.Errorf("In test case: %s: Unexpected alert: %+v", testCase.testName, alert)
+			}
+		}
+	}
+}
+
+func TestCheckChangePerTopic(t *testing.T) {
+	ua := createSubscribedAsset(0)
+	ua.AlertDelta = 5
+	now := time.Now()
+	ua.checkChange("sensors/kitchen/temp", []byte(`{"value":21}`), now)
+	// A different topic is not compared with the kitchen's value
+	if _, fire := ua.checkChange("sensors/oven/temp", []byte(`{"value":180}`), now); fire {
+		t.Errorf("Expected the first value of a topic not to be alerted")
+	}
+	if _, fire := ua.checkChange("sensors/kitchen/temp", []byte(`{"value":35}`), now.Add(time.Second)); !fire {
+		t.Errorf("Expected the kitchen's spike to be alerted")
+	}
+}
+
+func TestShutdownSummary(t *testing.T) {
+	ua := createSubscribedAsset(0)
+	client := &mockMQTTClient{connected: true}
+	ua.mClient = client
+	ua.receiveMessage(ua.Topic, []byte(`{"value":21}`), time.Now())
+	ua.receiveMessage(ua.Topic, []byte(`not json`), time.Now())
+	ua.publishRaw([]byte(`{"value":22}`))
+	ua.publishToTopic(map[string]interface{}{"value": 23}, "application/json")
+	// A message the broker refuses is not counted as published
+	client.errPublish = errors.New("broker unreachable")
+	ua.publishRaw([]byte(`{"value":24}`))
+
+	expected := "shutdown summary: topic=Kitchen/temperature published=2 received=1 badPayloads=1"
+	if got := ua.shutdownSummary(); got != expected {
+		t.Errorf("Expected summary %q, got: %q", expected, got)
+	}
+}